@@ -35,6 +35,7 @@ const (
 	Close                   // last message for the topic, topic is closed after this
 	BurstStart              // indicate that there will be burst of messages for the topic ...
 	BurstEnd                // so we can stop updating UI until we get BurstEnd message
+	Closing                 // topic is closed by the server, resubscribe (ref: ClosingInfo)
 )
 
 // Error sources
@@ -49,6 +50,23 @@ const (
 	Replay                // replay of the previously sent message
 )
 
+// ReplayPolicy defines how Replay flag is serialized for the transport
+type ReplayPolicy uint8
+
+// Replay flag serialization policies
+const (
+	ReplayPreserve ReplayPolicy = iota // replay flag is sent in the l header field
+	ReplayStrip                        // replay flag is not sent
+	ReplayMeta                         // replay flag is sent as ReplayMetaKey in the m header field
+)
+
+// ReplayMetaKey is meta key set to "1" for replayed messages, ref: ReplayMeta
+const ReplayMetaKey = "replay"
+
+// GapMetaKey is meta key set to "1" for the full sent instead of the
+// messages skipped by the server, client state jumps over them, ref: AsGap
+const GapMetaKey = "gap"
+
 // supported compression types
 const (
 	CompressionNone uint8 = iota
@@ -75,6 +93,19 @@ type Sender interface {
 	SendMsgs(ms []*Msg)
 }
 
+// Slow consumer levels, ref: SlowConsumer
+const (
+	SlowRecovered uint8 = iota // send queue is back under the warning threshold
+	SlowWarning                // send queue crossed the warning threshold
+)
+
+// SlowConsumer is optionally implemented by subscriber which wants to know
+// that it is falling behind before it is evicted, e.g. to relay it to the client.
+// SlowConsumer is called on each level change, it must not block.
+type SlowConsumer interface {
+	SlowConsumer(level uint8)
+}
+
 // BodyMarshaler nesto sto se zna zapakovati
 type BodyMarshaler interface {
 	MarshalJSON() ([]byte, error)
@@ -93,11 +124,15 @@ type Msg struct {
 	Subscriptions map[string]int64  `json:"b,omitempty"` // topics to subscribe to
 	CacheDepth    int               `json:"d,omitempty"` // cache depth for append update type messages
 	Meta          map[string]string `json:"m,omitempty"` // client session metadata
+	Key           string            `json:"k,omitempty"` // idempotency key, publish with already seen key is dropped
+	Hash          string            `json:"h,omitempty"` // hash of the topic state after applying this message
+	ID            string            `json:"n,omitempty"` // unique message id assigned by broker, for tracing
 
 	body          []byte
 	noCompression bool
 	payloads      map[uint8][]byte
 	src           BodyMarshaler
+	replay        *Msg // memoized AsReplay copy
 	topic         string
 	path          string
 
@@ -158,17 +193,30 @@ func Undeflate(data []byte) []byte {
 
 // Marshal packs message for sending on the wire
 func (m *Msg) Marshal() []byte {
-	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault)
+	buf, _ := m.marshal(CompressionNone, CompatibilityVersionDefault, ReplayPreserve)
 	return buf
 }
 
+// Size returns length of the message packed for sending on the wire
+// without compression. Packed message is cached, later Marshal is free.
+func (m *Msg) Size() int {
+	return len(m.Marshal())
+}
+
 // MarshalDeflate packs and compress message
 func (m *Msg) MarshalDeflate() ([]byte, bool) {
-	return m.marshal(CompressionDeflate, CompatibilityVersionDefault)
+	return m.marshal(CompressionDeflate, CompatibilityVersionDefault, ReplayPreserve)
+}
+
+// MarshalWith packs message for the transport with compression (if supported),
+// compatibility version and Replay flag policy.
+// Version 1 header has no replay flag, policy is ignored.
+func (m *Msg) MarshalWith(supportedCompression, version uint8, rp ReplayPolicy) ([]byte, bool) {
+	return m.marshal(supportedCompression, version, rp)
 }
 
 // marshal encodes message into []byte
-func (m *Msg) marshal(supportedCompression, version uint8) ([]byte, bool) {
+func (m *Msg) marshal(supportedCompression, version uint8, rp ReplayPolicy) ([]byte, bool) {
 	if version == CompatibilityVersion1 {
 		if m.UpdateType == BurstStart || m.UpdateType == BurstEnd {
 			// unsuported mesage types in this version
@@ -182,12 +230,16 @@ func (m *Msg) marshal(supportedCompression, version uint8) ([]byte, bool) {
 		compression = CompressionNone
 	}
 	// check if we already have payload
-	key := payloadKey(compression, version)
+	if !m.IsReplay() || version == CompatibilityVersion1 {
+		// header is the same for all policies
+		rp = ReplayPreserve
+	}
+	key := payloadKey(compression, version, rp)
 	if payload, ok := m.payloads[key]; ok {
 		return payload, compression != CompressionNone
 	}
 
-	payload := m.payload(version)
+	payload := m.payload(version, rp)
 	// decide wather we need compression
 	if len(payload) < compressionLenLimit {
 		m.noCompression = true
@@ -206,12 +258,12 @@ func (m *Msg) marshal(supportedCompression, version uint8) ([]byte, bool) {
 	return payload, compression != CompressionNone
 }
 
-func (m *Msg) payload(version uint8) []byte {
+func (m *Msg) payload(version uint8, rp ReplayPolicy) []byte {
 	var header []byte
 	if version == CompatibilityVersion1 {
 		header = m.marshalV1header()
 	} else {
-		header, _ = json.Marshal(m)
+		header = m.header(rp)
 	}
 	buf := bytes.NewBuffer(header)
 	buf.Write(separtor)
@@ -225,8 +277,40 @@ func (m *Msg) payload(version uint8) []byte {
 	return buf.Bytes()
 }
 
-func payloadKey(compression, version uint8) uint8 {
-	return version*4 + compression
+// header encodes message header with Replay flag by policy
+func (m *Msg) header(rp ReplayPolicy) []byte {
+	if rp == ReplayPreserve {
+		header, _ := json.Marshal(m)
+		return header
+	}
+	h := &Msg{
+		Type:          m.Type,
+		ReplyTo:       m.ReplyTo,
+		CorrelationID: m.CorrelationID,
+		Error:         m.Error,
+		URI:           m.URI,
+		Ts:            m.Ts,
+		UpdateType:    m.UpdateType,
+		Subscriptions: m.Subscriptions,
+		CacheDepth:    m.CacheDepth,
+		Meta:          m.Meta,
+		Key:           m.Key,
+		Hash:          m.Hash,
+		ID:            m.ID,
+	}
+	if rp == ReplayMeta {
+		h.Meta = make(map[string]string, len(m.Meta)+1)
+		for k, v := range m.Meta {
+			h.Meta[k] = v
+		}
+		h.Meta[ReplayMetaKey] = "1"
+	}
+	header, _ := json.Marshal(h)
+	return header
+}
+
+func payloadKey(compression, version uint8, rp ReplayPolicy) uint8 {
+	return uint8(rp)*16 + version*4 + compression
 }
 
 func deflate(src []byte) []byte {
@@ -383,6 +467,41 @@ func (m *Msg) IsTopicClose() bool {
 	return m.UpdateType == Close
 }
 
+// ClosingInfo is body of the Closing message
+type ClosingInfo struct {
+	Reason   string `json:"reason,omitempty"`
+	Redirect string `json:"redirect,omitempty"` // where to resubscribe, empty for the same place
+}
+
+// NewClosing creates message which tells subscribers of the uri
+// that topic is closed and they should resync.
+func NewClosing(uri string, info ClosingInfo) *Msg {
+	return &Msg{
+		Type:       Publish,
+		URI:        uri,
+		UpdateType: Closing,
+		src:        toBodyMarshaler(info),
+	}
+}
+
+// AsClosing creates Closing message from the topic Close message,
+// body (ClosingInfo) of the Close message is preserved.
+func (m *Msg) AsClosing() *Msg {
+	return &Msg{
+		Type:       Publish,
+		URI:        m.URI,
+		Ts:         m.Ts,
+		UpdateType: Closing,
+		body:       m.body,
+		src:        m.src,
+	}
+}
+
+// IsClosing ...
+func (m *Msg) IsClosing() bool {
+	return m.UpdateType == Closing
+}
+
 // IsReplay ...
 func (m *Msg) IsReplay() bool {
 	return m.Replay == Replay
@@ -401,7 +520,10 @@ func (m *Msg) IsFull() bool {
 	return m.UpdateType == Full
 }
 
-// Topic returns topic part of the URI
+// Topic returns topic part of the URI, e.g. nsq topic.
+// Broker topic is the whole URI, all messages sent to broker subscribers
+// (live, replay, burst markers, closing) carry it, so connection
+// subscribed to many topics demultiplexes them by URI.
 func (m *Msg) Topic() string {
 	if m.topic == "" {
 		m.topic = m.URI
@@ -423,14 +545,71 @@ func (m *Msg) Path() string {
 	return ""
 }
 
-// AsReplay marks message as replay
+// AsReplay marks message as replay.
+// Replay message is returned as is, copy of the original is memoized
+// so all consumers share it (and its marshaled payload).
 func (m *Msg) AsReplay() *Msg {
+	if m.IsReplay() {
+		return m
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.replay == nil {
+		m.replay = &Msg{
+			Type:       m.Type,
+			URI:        m.URI,
+			UpdateType: m.UpdateType,
+			Replay:     Replay,
+			Ts:         m.Ts,
+			Hash:       m.Hash,
+			ID:         m.ID,
+			body:       m.body,
+			src:        m.src,
+		}
+	}
+	return m.replay
+}
+
+// AsGap returns copy of the message with GapMetaKey set in Meta.
+func (m *Msg) AsGap() *Msg {
+	meta := make(map[string]string, len(m.Meta)+1)
+	for k, v := range m.Meta {
+		meta[k] = v
+	}
+	meta[GapMetaKey] = "1"
+	return &Msg{
+		Type:       m.Type,
+		URI:        m.URI,
+		UpdateType: m.UpdateType,
+		Replay:     m.Replay,
+		Ts:         m.Ts,
+		CacheDepth: m.CacheDepth,
+		Meta:       meta,
+		Key:        m.Key,
+		Hash:       m.Hash,
+		ID:         m.ID,
+		body:       m.body,
+		src:        m.src,
+	}
+}
+
+// IsGap returns true for the message marked with AsGap
+func (m *Msg) IsGap() bool {
+	return m.Meta[GapMetaKey] == "1"
+}
+
+// WithHash creates copy of the publish message with state hash set
+func (m *Msg) WithHash(hash string) *Msg {
 	return &Msg{
 		Type:       m.Type,
 		URI:        m.URI,
 		UpdateType: m.UpdateType,
-		Replay:     Replay,
+		Replay:     m.Replay,
 		Ts:         m.Ts,
+		CacheDepth: m.CacheDepth,
+		Key:        m.Key,
+		Hash:       hash,
+		ID:         m.ID,
 		body:       m.body,
 		src:        m.src,
 	}
@@ -99,3 +99,62 @@ func TestParseV1Subscriptions(t *testing.T) {
 	assert.Equal(t, m.Subscriptions["sportsbook/s_4"], int64(1))
 	assert.Equal(t, m.Subscriptions["sportsbook/s_5"], int64(2))
 }
+
+func TestSize(t *testing.T) {
+	m := NewPublish("topic", "path", 1, Full, map[string]int{"a": 1})
+	assert.Equal(t, len(m.Marshal()), m.Size())
+	assert.True(t, m.Size() > len(`{"a":1}`))
+}
+
+func TestClosing(t *testing.T) {
+	m := NewClosing("topic", ClosingInfo{Reason: "deploy", Redirect: "ws://other"})
+	assert.True(t, m.IsClosing())
+	m = Parse(m.Marshal())
+	assert.True(t, m.IsClosing())
+	var info ClosingInfo
+	assert.Nil(t, m.Unmarshal(&info))
+	assert.Equal(t, "deploy", info.Reason)
+	assert.Equal(t, "ws://other", info.Redirect)
+
+	c := NewPublish("topic", "", 5, Close, ClosingInfo{Reason: "migrate"}).AsClosing()
+	assert.True(t, c.IsClosing())
+	assert.Equal(t, int64(5), c.Ts)
+	info = ClosingInfo{}
+	assert.Nil(t, Parse(c.Marshal()).Unmarshal(&info))
+	assert.Equal(t, "migrate", info.Reason)
+}
+
+func TestReplayPolicy(t *testing.T) {
+	m := NewPublish("topic", "", 5, Diff, 1)
+	r := m.AsReplay()
+	assert.True(t, r.IsReplay())
+	assert.True(t, r == m.AsReplay())
+	assert.True(t, r == r.AsReplay())
+
+	buf, _ := r.MarshalWith(CompressionNone, CompatibilityVersionDefault, ReplayPreserve)
+	assert.True(t, Parse(buf).IsReplay())
+
+	buf, _ = r.MarshalWith(CompressionNone, CompatibilityVersionDefault, ReplayStrip)
+	p := Parse(buf)
+	assert.False(t, p.IsReplay())
+	assert.Nil(t, p.Meta)
+	assert.Equal(t, int64(5), p.Ts)
+
+	buf, _ = r.MarshalWith(CompressionNone, CompatibilityVersionDefault, ReplayMeta)
+	p = Parse(buf)
+	assert.False(t, p.IsReplay())
+	assert.Equal(t, "1", p.Meta[ReplayMetaKey])
+
+	// original is the same for all policies
+	buf, _ = m.MarshalWith(CompressionNone, CompatibilityVersionDefault, ReplayMeta)
+	assert.Equal(t, m.Marshal(), buf)
+}
+
+func TestMsgAsGap(t *testing.T) {
+	m := &Msg{URI: "1", Ts: 1, UpdateType: Full, Meta: map[string]string{"a": "b"}}
+	g := m.AsGap()
+	assert.True(t, g.IsGap())
+	assert.False(t, m.IsGap())
+	assert.Equal(t, "b", g.Meta["a"])
+	assert.Equal(t, m.Ts, g.Ts)
+}
@@ -0,0 +1,138 @@
+package amp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrNotMergeable is returned from Apply when diff can't be merged into base
+// without changing the meaning of the message sequence.
+var ErrNotMergeable = errors.New("messages are not mergeable")
+
+// Apply merges diff message into the base message.
+// Base can be full or diff message.
+// When base is full result is full, keys set to null in diff are removed.
+// When base is diff result is diff which contains changes of the both messages,
+// null values are preserved so they still remove keys when applied to the full.
+// Result has Ts of the diff.
+func Apply(base, diff *Msg) (*Msg, error) {
+	if diff.UpdateType != Diff {
+		return nil, ErrNotMergeable
+	}
+	b, err := base.bodyMap()
+	if err != nil {
+		return nil, err
+	}
+	d, err := diff.bodyMap()
+	if err != nil {
+		return nil, err
+	}
+	if err := mergeMaps(b, d, base.IsFull()); err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Msg{
+		Type:       base.Type,
+		URI:        diff.URI,
+		Ts:         diff.Ts,
+		UpdateType: base.UpdateType,
+		body:       body,
+	}, nil
+}
+
+// mergeMaps merges src into dst.
+// removeNulls controls whether null in src deletes key from dst or is kept.
+func mergeMaps(dst, src map[string]interface{}, removeNulls bool) error {
+	for k, v := range src {
+		if v == nil {
+			if removeNulls {
+				delete(dst, k)
+			} else {
+				dst[k] = nil
+			}
+			continue
+		}
+		sm, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dv, found := dst[k]
+		if dm, ok := dv.(map[string]interface{}); ok {
+			if err := mergeMaps(dm, sm, removeNulls); err != nil {
+				return err
+			}
+			continue
+		}
+		if found && dv == nil && !removeNulls {
+			// diff removes the key and the next one sets object in its place,
+			// merged diff applied to the full would merge instead of replace
+			return ErrNotMergeable
+		}
+		dst[k] = v
+	}
+	return nil
+}
+
+// bodyMap unmarshals message body into the map.
+// Numbers are kept as json.Number, so they are written back unchanged
+// (int64 above 2^53 would lose precision as float64).
+func (m *Msg) bodyMap() (map[string]interface{}, error) {
+	var buf []byte
+	if m.body != nil {
+		buf = m.body
+	} else if m.src != nil {
+		b, err := m.src.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		buf = b
+	}
+	o := make(map[string]interface{})
+	if len(buf) == 0 {
+		return o, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&o); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	if o == nil {
+		return nil, ErrNotMergeable
+	}
+	return o, nil
+}
+
+// BodyHash returns hex encoded sha1 of the canonical encoding of the
+// message body, client computes the same hash from its state to verify it.
+// Canonical encoding is JSON:
+//   - object keys sorted by bytes, at all levels
+//   - no white space
+//   - numbers as written in the body (not converted to float)
+//   - strings UTF-8, only '"', '\\' and control characters are escaped
+//     (as \n, \r, \t or \u00XX) and U+2028, U+2029 (as \u2028, \u2029),
+//     '<', '>' and '&' are not escaped
+func (m *Msg) BodyHash() (string, error) {
+	o, err := m.bodyMap()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(o); err != nil {
+		return "", err
+	}
+	h := sha1.Sum(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return hex.EncodeToString(h[:]), nil
+}
@@ -0,0 +1,76 @@
+package amp
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyDiffToFull(t *testing.T) {
+	full := &Msg{Type: Publish, Ts: 1, UpdateType: Full, body: []byte(`{"a":1,"b":{"c":2,"d":3},"e":4}`)}
+	diff := &Msg{Type: Publish, Ts: 2, UpdateType: Diff, body: []byte(`{"a":5,"b":{"d":null},"e":null}`)}
+	m, err := Apply(full, diff)
+	assert.Nil(t, err)
+	assert.Equal(t, Full, m.UpdateType)
+	assert.Equal(t, int64(2), m.Ts)
+	assert.Equal(t, `{"a":5,"b":{"c":2}}`, string(m.body))
+}
+
+func TestApplyDiffToDiff(t *testing.T) {
+	d1 := &Msg{Type: Publish, Ts: 1, UpdateType: Diff, body: []byte(`{"a":1,"b":{"c":2}}`)}
+	d2 := &Msg{Type: Publish, Ts: 2, UpdateType: Diff, body: []byte(`{"b":{"c":null,"d":3},"e":null}`)}
+	m, err := Apply(d1, d2)
+	assert.Nil(t, err)
+	assert.Equal(t, Diff, m.UpdateType)
+	assert.Equal(t, int64(2), m.Ts)
+	assert.Equal(t, `{"a":1,"b":{"c":null,"d":3},"e":null}`, string(m.body))
+
+	// src body
+	d3 := NewPublish("t", "", 3, Diff, map[string]int{"f": 6})
+	m, err = Apply(m, d3)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a":1,"b":{"c":null,"d":3},"e":null,"f":6}`, string(m.body))
+}
+
+func TestApplyLargeInt(t *testing.T) {
+	full := &Msg{Type: Publish, Ts: 1, UpdateType: Full, body: []byte(`{"id":9007199254740993,"f":1.5}`)}
+	diff := &Msg{Type: Publish, Ts: 2, UpdateType: Diff, body: []byte(`{"n":9223372036854775807}`)}
+	m, err := Apply(full, diff)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"f":1.5,"id":9007199254740993,"n":9223372036854775807}`, string(m.body))
+}
+
+func TestApplyNotMergeable(t *testing.T) {
+	d1 := &Msg{Type: Publish, Ts: 1, UpdateType: Diff, body: []byte(`{"a":null}`)}
+	d2 := &Msg{Type: Publish, Ts: 2, UpdateType: Diff, body: []byte(`{"a":{"b":1}}`)}
+	_, err := Apply(d1, d2)
+	assert.Equal(t, ErrNotMergeable, err)
+
+	f := &Msg{Type: Publish, Ts: 3, UpdateType: Full, body: []byte(`{}`)}
+	_, err = Apply(d1, f)
+	assert.Equal(t, ErrNotMergeable, err)
+
+	d3 := &Msg{Type: Publish, Ts: 4, UpdateType: Diff, body: []byte(`[1,2]`)}
+	_, err = Apply(d1, d3)
+	assert.NotNil(t, err)
+}
+
+func TestBodyHash(t *testing.T) {
+	m1 := &Msg{body: []byte(`{"b":2, "a":{"d":1,"c":null}}`)}
+	m2 := NewPublish("t", "", 1, Full, map[string]interface{}{"a": map[string]interface{}{"c": nil, "d": 1}, "b": 2})
+	h1, err := m1.BodyHash()
+	assert.Nil(t, err)
+	h2, err := m2.BodyHash()
+	assert.Nil(t, err)
+	assert.Equal(t, h1, h2)
+	assert.Len(t, h1, 40)
+
+	// canonical encoding
+	m3 := &Msg{body: []byte(`{"b": "<&>", "a": 9007199254740993}`)}
+	h3, err := m3.BodyHash()
+	assert.Nil(t, err)
+	sum := sha1.Sum([]byte(`{"a":9007199254740993,"b":"<&>"}`))
+	assert.Equal(t, hex.EncodeToString(sum[:]), h3)
+}
@@ -5,6 +5,7 @@ import "github.com/minus5/svckit/amp"
 type appendCache struct {
 	msgs  []*amp.Msg
 	depth int
+	bytes int64 // size of the cached messages, ref: info
 }
 
 func newAppendCache() *appendCache {
@@ -20,15 +21,21 @@ nakon sto je dosao jedan msg, prije nego smo dobili current iz backenda
 i onda taj subsriber dobije samo jednu poruku, a ne dobije svih (depth)
 */
 
-func (c *appendCache) Add(m *amp.Msg) {
+func (c *appendCache) Add(m *amp.Msg) *amp.Msg {
 	if m.IsReplay() && len(c.msgs) > 0 && c.msgs[len(c.msgs)-1].Ts == m.Ts {
-		return
+		return m
 	}
 	c.msgs = append(c.msgs, m)
+	c.bytes += int64(m.Size())
 	ln := len(c.msgs)
 	if ln > 1 {
 		if c.msgs[ln-2].Ts >= m.Ts {
 			c.msgs = sortMsgs(c.msgs)
+			// sort removes duplicates
+			c.bytes = 0
+			for _, m := range c.msgs {
+				c.bytes += int64(m.Size())
+			}
 		}
 	}
 	if m.CacheDepth > 0 {
@@ -36,8 +43,12 @@ func (c *appendCache) Add(m *amp.Msg) {
 	}
 	if ln > c.depth {
 		// shrink to depth
+		for _, m := range c.msgs[:ln-c.depth] {
+			c.bytes -= int64(m.Size())
+		}
 		c.msgs = c.msgs[ln-c.depth:]
 	}
+	return m
 }
 
 func (c *appendCache) Find(ts int64) []*amp.Msg {
@@ -61,6 +72,11 @@ func (c *appendCache) Current() []*amp.Msg {
 	return c.msgs
 }
 
+// Snapshot returns cached messages
+func (c *appendCache) Snapshot() []*amp.Msg {
+	return append([]*amp.Msg(nil), c.msgs...)
+}
+
 func (c *appendCache) FindFor(consumerTs int64, m *amp.Msg) uint8 {
 	if consumerTs == tsNone {
 		return sendCurrent
@@ -28,3 +28,26 @@ func TestShrink(t *testing.T) {
 	assert.Equal(t, c.depth, 3)
 	assert.Len(t, c.msgs, 3)
 }
+
+func TestAppendCacheBytes(t *testing.T) {
+	c := newAppendCache()
+	c.depth = 2
+	size := func() int64 {
+		var n int64
+		for _, m := range c.msgs {
+			n += int64(m.Size())
+		}
+		return n
+	}
+	c.Add(amp.NewPublish("t", "", 10, amp.Append, map[string]int{"a": 1}))
+	c.Add(amp.NewPublish("t", "", 12, amp.Append, map[string]int{"b": 22}))
+	assert.Equal(t, size(), c.bytes)
+	// out of order and duplicate
+	c.Add(amp.NewPublish("t", "", 11, amp.Append, map[string]int{"c": 333}))
+	c.Add(amp.NewPublish("t", "", 12, amp.Append, map[string]int{"b": 22}))
+	assert.Equal(t, size(), c.bytes)
+	// shrink
+	c.Add(amp.NewPublish("t", "", 13, amp.Append, map[string]int{"d": 4444}))
+	assert.Len(t, c.msgs, 2)
+	assert.Equal(t, size(), c.bytes)
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+// Archive provides messages which are no longer in the topic cache
+type Archive interface {
+	// Diffs calls h in ts order for archived messages of the topic
+	// with fromTs < Ts < toTs.
+	Diffs(topic string, fromTs, toTs int64, h func(*amp.Msg) error) error
+}
+
+// archiveBoundary returns ts of the oldest diff in cache when subscriber
+// positioned at ts is older than cache and should be replayed from archive.
+func (t *topic) archiveBoundary(ts int64) (int64, bool) {
+	if t.opts.archive == nil || ts == tsNone {
+		return 0, false
+	}
+	fdc, ok := t.cache.(*fullDiffCache)
+	if !ok {
+		return 0, false
+	}
+	first, ok := fdc.FirstDiffTs()
+	if !ok || ts >= first {
+		return 0, false
+	}
+	return first, true
+}
+
+// archiveReplay reads messages between ts and boundary from archive,
+// outside of the topic loop, and then subscribes consumer.
+// Consumer gets archived messages (as replay), cached diffs after them,
+// and live messages after that. If archive doesn't reach the cache (ref:
+// archiveReaches) consumer gets current state as without archive.
+func (t *topic) archiveReplay(c amp.Sender, ts, boundary int64, priority int) {
+	var archived []*amp.Msg
+	err := t.opts.archive.Diffs(t.name, ts, boundary, func(m *amp.Msg) error {
+		if m.Ts > ts && m.Ts < boundary {
+			archived = append(archived, m.AsReplay())
+		}
+		return nil
+	})
+	if err != nil {
+		log.S("topic", t.name).I("ts", int(ts)).Error(err)
+		archived = nil
+	}
+	archived = sortMsgs(archived)
+	f := func() {
+		if _, ok := t.pending[c]; !ok {
+			return // unsubscribed in the meantime
+		}
+		delete(t.pending, c)
+		t.register(c, ts, priority)
+		var ms []*amp.Msg
+		fdc := t.cache.(*fullDiffCache)
+		if t.archiveReaches(fdc, archived, ts, boundary) {
+			ms = append(archived, fdc.DiffsAfter(archived[len(archived)-1].Ts)...)
+			metric.Counter("topic.sub.archive")
+		} else {
+			ms = t.cache.Find(ts)
+		}
+		ms = t.filtered(c, ms)
+		if len(ms) > 0 {
+			t.send(c, burst(asReplay(ms)))
+		}
+	}
+	select {
+	case t.loopWork <- f:
+	case <-t.closed:
+	}
+}
+
+// archiveReaches returns true if archived messages connect consumer
+// position ts to the diffs in the cache: cache hasn't moved past boundary,
+// and the archive has diffs removed from the cache (for contiguous topics
+// each one of them).
+// Otherwise there is a gap between the archive and the cache.
+func (t *topic) archiveReaches(fdc *fullDiffCache, archived []*amp.Msg, ts, boundary int64) bool {
+	if len(archived) == 0 {
+		return false
+	}
+	first, ok := fdc.FirstDiffTs()
+	if !ok || first > boundary {
+		return false
+	}
+	last := archived[len(archived)-1].Ts
+	if last < fdc.EvictedTs() {
+		metric.Counter("topic.sub.archive_gap")
+		return false
+	}
+	if t.opts.contiguous {
+		if archived[0].Ts != ts+1 {
+			metric.Counter("topic.sub.archive_gap")
+			return false
+		}
+		for i, m := range archived[1:] {
+			if m.Ts != archived[i].Ts+1 {
+				metric.Counter("topic.sub.archive_gap")
+				return false
+			}
+		}
+		if last+1 < first {
+			metric.Counter("topic.sub.archive_gap")
+			return false
+		}
+	}
+	return true
+}
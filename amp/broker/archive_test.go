@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type testArchive struct {
+	msgs []*amp.Msg
+}
+
+func (a *testArchive) Diffs(topic string, fromTs, toTs int64, h func(*amp.Msg) error) error {
+	for _, m := range a.msgs {
+		if m.Ts > fromTs && m.Ts < toTs {
+			if err := h(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitMessages waits for archive replay which is async
+func waitMessages(c *testConsumer) []int64 {
+	for i := 0; i < 100; i++ {
+		c.Lock()
+		n := len(c.messages)
+		c.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Lock()
+	defer c.Unlock()
+	var ts []int64
+	for _, m := range c.messages {
+		if m.UpdateType == amp.Full || m.UpdateType == amp.Diff {
+			ts = append(ts, m.Ts)
+		}
+	}
+	return ts
+}
+
+func TestTopicArchiveReplay(t *testing.T) {
+	a := &testArchive{}
+	for ts := int64(1); ts <= 11; ts++ {
+		a.msgs = append(a.msgs, &amp.Msg{Ts: ts, UpdateType: amp.Diff})
+	}
+	tp := newTopic("m", ReplayArchive(a))
+	defer tp.close()
+	tp.publish(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+	tp.publish(&amp.Msg{Ts: 11, UpdateType: amp.Diff})
+	tp.publish(&amp.Msg{Ts: 12, UpdateType: amp.Diff})
+	tp.wait()
+
+	// older than cache, replayed from archive
+	c := &testConsumer{}
+	tp.subscribe(c, 5)
+	assert.Equal(t, []int64{6, 7, 8, 9, 10, 11, 12}, waitMessages(c))
+	c.Lock()
+	assert.True(t, c.messages[1].IsReplay())
+	c.Unlock()
+
+	// in cache range, archive is not used
+	c = &testConsumer{}
+	tp.subscribe(c, 11)
+	assert.Equal(t, []int64{12}, waitMessages(c))
+
+	// empty archive, current state
+	a.msgs = nil
+	c = &testConsumer{}
+	tp.subscribe(c, 5)
+	assert.Equal(t, []int64{10, 11, 12}, waitMessages(c))
+
+	// new messages after replay
+	tp.publish(&amp.Msg{Ts: 13, UpdateType: amp.Diff})
+	tp.wait()
+	assert.Equal(t, []int64{10, 11, 12, 13}, waitMessages(c))
+}
+
+func TestTopicArchiveGap(t *testing.T) {
+	a := &testArchive{}
+	for ts := int64(1); ts <= 9; ts++ {
+		a.msgs = append(a.msgs, &amp.Msg{Ts: ts, UpdateType: amp.Diff})
+	}
+	tp := newTopic("m", ReplayArchive(a))
+	defer tp.close()
+	tp.publish(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+	tp.publish(&amp.Msg{Ts: 11, UpdateType: amp.Diff})
+	tp.publish(&amp.Msg{Ts: 12, UpdateType: amp.Diff})
+	tp.publish(&amp.Msg{Ts: 14, UpdateType: amp.Full}) // 11 and 12 are removed
+	tp.publish(&amp.Msg{Ts: 15, UpdateType: amp.Diff})
+	tp.publish(&amp.Msg{Ts: 16, UpdateType: amp.Full})
+	tp.wait()
+
+	// archive ends at 9, cache has lost 12, current state instead of the gap
+	c := &testConsumer{}
+	tp.subscribe(c, 5)
+	assert.Equal(t, []int64{16}, waitMessages(c))
+
+	// archive reaches the removed diffs
+	for ts := int64(10); ts <= 14; ts++ {
+		a.msgs = append(a.msgs, &amp.Msg{Ts: ts, UpdateType: amp.Diff})
+	}
+	c = &testConsumer{}
+	tp.subscribe(c, 5)
+	assert.Equal(t, []int64{6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, waitMessages(c))
+}
@@ -5,19 +5,36 @@
 package broker
 
 import (
+	"context"
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
+	"io"
 	"time"
 )
 
 // Broker type
 type Broker struct {
-	messages      chan *amp.Msg
+	messages      chan publication
 	loopWork      chan func()
 	closed        chan struct{}
 	spreaders     map[string]*spreader
 	consumerNames map[amp.Sender]map[string]int64
+	clients       map[string]amp.Sender // client id -> current consumer
+	clientIDs     map[amp.Sender]string
+	evicted       map[amp.Sender]struct{}      // consumers replaced in SubscribeClient
+	priorities    map[amp.Sender]int           // consumers subscribed with SubscribePriority
+	fullsOnly     map[amp.Sender]struct{}      // consumers subscribed with SubscribeFullsOnly
+	filters       map[amp.Sender]Filter        // consumers subscribed with SubscribeFilter
+	staleness     map[amp.Sender]time.Duration // consumers subscribed with SubscribeMaxStaleness
+	positions     PositionStore
+	store         Store      // ref: PersistStore
+	acks          ackWaiters // PublishSync calls waiting for Confirm
 	current       func(string)
+	opts          []Option
+	maxTopics     int
+	topicLimit    TopicLimitPolicy
+	clock         Clock
+	memory        *memory // ref: MemoryBudget
 }
 
 // Consume consumes all msgs from in channel.
@@ -36,16 +53,35 @@ func (s *Broker) Wait() {
 }
 
 // New creates new scatter
-func New(current func(string)) *Broker {
+func New(current func(string), opts ...Option) *Broker {
+	o := newOptions(opts...)
 	s := &Broker{
-		messages:      make(chan *amp.Msg, 1024),
+		messages:      make(chan publication, 1024),
 		loopWork:      make(chan func()),
 		closed:        make(chan struct{}),
 		spreaders:     make(map[string]*spreader),
 		consumerNames: make(map[amp.Sender]map[string]int64),
+		clients:       make(map[string]amp.Sender),
+		clientIDs:     make(map[amp.Sender]string),
+		evicted:       make(map[amp.Sender]struct{}),
+		priorities:    make(map[amp.Sender]int),
+		fullsOnly:     make(map[amp.Sender]struct{}),
+		filters:       make(map[amp.Sender]Filter),
+		staleness:     make(map[amp.Sender]time.Duration),
 		current:       current,
+		opts:          opts,
+		positions:     o.positions,
+		store:         o.store,
+		maxTopics:     o.maxTopics,
+		topicLimit:    o.topicLimit,
+		clock:         o.clock,
+		memory:        o.memory,
 	}
+	s.opts = append(opts[:len(opts):len(opts)], withAcks(&s.acks), withOnEvict(s.unsubscribeEvicted), withMemory(s.memory))
 	go s.loop()
+	if s.memory != nil {
+		go s.memoryLoop()
+	}
 	return s
 }
 
@@ -77,63 +113,295 @@ func (s *Broker) Replay(name string) []*amp.Msg {
 	return msgs
 }
 
+// HasFull returns true if full was published to the topic (or imported),
+// so subscriber gets its state. Topic is not created.
+func (s *Broker) HasFull(name string) bool {
+	has, _ := s.state(name)
+	return has
+}
+
+// LatestTs returns ts of the last message published to the topic,
+// 0 if there is no such topic. Topic is not created.
+func (s *Broker) LatestTs(name string) int64 {
+	_, ts := s.state(name)
+	return ts
+}
+
+func (s *Broker) state(name string) (hasFull bool, lastTs int64) {
+	s.inLoopWait(func() {
+		if spr, ok := s.spreaders[name]; ok {
+			hasFull, lastTs = spr.state()
+		}
+	})
+	return
+}
+
+// Export writes snapshot of the topic state to w.
+// Standby broker loads it with Import and replays the same messages.
+func (s *Broker) Export(name string, w io.Writer) error {
+	var spr *spreader
+	s.inLoopWait(func() {
+		spr = s.spreaders[name]
+	})
+	if spr == nil {
+		return ErrTopicNotFound
+	}
+	ms, err := spr.export()
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, ms)
+}
+
+// Import replaces topic state with the snapshot made by Export
+func (s *Broker) Import(name string, r io.Reader) error {
+	ms, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	s.inLoopWait(func() {
+		var spr *spreader
+		if spr, err = s.find(name, false); err == nil {
+			err = spr.load(ms)
+		}
+	})
+	return err
+}
+
 // Subscribe consumer to topics defined c.Topics()
 // amp.Sender should call this on each change ih his Topics list.
+// Errors are only logged, use SubscribeWait to get them.
 func (s *Broker) Subscribe(c amp.Sender, newNames map[string]int64) {
 	metric.Time("broker.subscribe.len", len(newNames))
 	s.inLoop(func() {
-		oldNames, ok := s.consumerNames[c]
-		s.consumerNames[c] = copyMap(newNames)
+		if err := s.subscribe(c, newNames); err != nil {
+			log.Error(err)
+		}
+	})
+}
 
-		if !ok {
-			for name, ts := range newNames {
-				s.find(name, true).subscribe(c, ts)
-			}
-			return
+// SubscribeWait is Subscribe which waits until consumer is subscribed.
+// Returns ErrTopicClosed or ErrSubscriberEvicted (ref: SubscribeClient).
+func (s *Broker) SubscribeWait(c amp.Sender, newNames map[string]int64) error {
+	return s.subscribeMode(c, newNames, nil)
+}
+
+// subscribeMode sets consumer mode with set, if not nil, and subscribes it,
+// waits until that is done in the loop
+func (s *Broker) subscribeMode(c amp.Sender, newNames map[string]int64, set func()) error {
+	metric.Time("broker.subscribe.len", len(newNames))
+	var err error
+	s.inLoopWait(func() {
+		if set != nil {
+			set()
+		}
+		err = s.subscribe(c, newNames)
+	})
+	return err
+}
+
+// SubscribePriority subscribes consumer which gets each message before
+// consumers with lower priority (default is 0).
+// Consumers are spread over the topic partitions, priority ones evenly,
+// and each partition delivers to its higher priority consumers first.
+// Priority is kept for the next calls of Subscribe until Unsubscribe.
+func (s *Broker) SubscribePriority(c amp.Sender, newNames map[string]int64, priority int) error {
+	return s.subscribeMode(c, newNames, func() {
+		if priority != 0 {
+			s.priorities[c] = priority
+		} else {
+			delete(s.priorities, c)
 		}
+	})
+}
 
-		// proizvedi mapu promjena za one koje treba dodati true,
-		// za one koje treba maknuti false
-		updMap := make(map[string]bool)
-		for t := range oldNames {
-			updMap[t] = false
+// SubscribeFullsOnly subscribes consumer which gets only full messages:
+// current full of the topic immediately and then each published full.
+// Diffs and events are dropped for it. Ts positions in newNames are ignored.
+// Mode is kept for the next calls of Subscribe until Unsubscribe, topics
+// consumer is already subscribed to are not changed.
+func (s *Broker) SubscribeFullsOnly(c amp.Sender, newNames map[string]int64) error {
+	return s.subscribeMode(c, newNames, func() {
+		s.fullsOnly[c] = struct{}{}
+	})
+}
+
+// SubscribeClient subscribes consumer identified by stable client id.
+// Previous consumer with the same client id (lingering after reconnect)
+// is unsubscribed from all topics before c is subscribed.
+// Replaced consumer gets ErrSubscriberEvicted on the next subscribe.
+func (s *Broker) SubscribeClient(clientID string, c amp.Sender, newNames map[string]int64) error {
+	metric.Time("broker.subscribe.len", len(newNames))
+	var err error
+	s.inLoopWait(func() {
+		if _, ok := s.evicted[c]; ok {
+			err = ErrSubscriberEvicted
+			return
 		}
-		for name := range newNames {
-			if _, ok := updMap[name]; ok {
-				delete(updMap, name)
-			} else {
-				updMap[name] = true
+		if old, ok := s.clients[clientID]; ok && old != c {
+			log.S("client", clientID).Info("replace consumer")
+			s.unsubscribe(old)
+			s.evicted[old] = struct{}{}
+		}
+		s.clients[clientID] = c
+		s.clientIDs[c] = clientID
+		err = s.subscribe(c, newNames)
+	})
+	return err
+}
+
+func (s *Broker) subscribe(c amp.Sender, newNames map[string]int64) error {
+	if _, ok := s.evicted[c]; ok {
+		return ErrSubscriberEvicted
+	}
+	oldNames, ok := s.consumerNames[c]
+	s.consumerNames[c] = copyMap(newNames)
+
+	var err error
+	priority := s.priorities[c]
+	if !ok {
+		for name, ts := range newNames {
+			if serr := s.subscribeName(name, c, ts, priority); serr != nil && err == nil {
+				err = serr
 			}
 		}
+		return err
+	}
 
-		// obradi mapu promjena
-		for name, v := range updMap {
-			if v == true {
-				s.find(name, true).subscribe(c, newNames[name])
-				continue
+	// proizvedi mapu promjena za one koje treba dodati true,
+	// za one koje treba maknuti false
+	updMap := make(map[string]bool)
+	for t := range oldNames {
+		updMap[t] = false
+	}
+	for name := range newNames {
+		if _, ok := updMap[name]; ok {
+			delete(updMap, name)
+		} else {
+			updMap[name] = true
+		}
+	}
+
+	// obradi mapu promjena
+	for name, v := range updMap {
+		if v == true {
+			if serr := s.subscribeName(name, c, newNames[name], priority); serr != nil && err == nil {
+				err = serr
 			}
-			spr, ok := s.spreaders[name]
-			if !ok {
-				continue
+			continue
+		}
+		spr, ok := s.spreaders[name]
+		if !ok {
+			continue
+		}
+		if spr.unsubscribe(c) {
+			log.S("topic", name).Info("delete from uns")
+			delete(s.spreaders, name) // there is no one subscribed to this topic
+			spr.close()
+		}
+	}
+	return err
+}
+
+// subscribeName subscribes consumer to the topic, creating it if needed.
+// Topic which can't be created is removed from consumer names.
+func (s *Broker) subscribeName(name string, c amp.Sender, ts int64, priority int) error {
+	spr, err := s.find(name, true)
+	if err != nil {
+		delete(s.consumerNames[c], name)
+		return err
+	}
+	return s.subscribeTopic(spr, c, ts, priority)
+}
+
+// subscribeTopic subscribes consumer in its subscribe mode
+func (s *Broker) subscribeTopic(spr *spreader, c amp.Sender, ts int64, priority int) error {
+	if _, ok := s.fullsOnly[c]; ok {
+		return spr.subscribeFullsOnly(c, priority)
+	}
+	filter, filtered := s.filters[c]
+	maxStaleness, limited := s.staleness[c]
+	if filtered || limited {
+		return spr.subscribeWith(c, ts, subscription{
+			priority:     priority,
+			filter:       filter,
+			maxStaleness: maxStaleness,
+		})
+	}
+	return spr.subscribePriority(c, ts, priority)
+}
+
+// Migrate moves all consumers of the topic from to the topic to.
+// Returns number of moved consumers.
+//
+// Ordering guarantee: consumer gets all messages of the from topic
+// processed by the broker loop before Migrate (Publish is asynchronous),
+// current state of the to topic (full and diffs) followed by all later
+// messages of the to topic.
+// Messages of the two topics can interleave during migration.
+// Consumer already subscribed to the to topic keeps its position there.
+func (s *Broker) Migrate(from, to string) int {
+	moved := 0
+	s.inLoopWait(func() {
+		src, ok := s.spreaders[from]
+		if !ok || from == to {
+			return
+		}
+		var cs []amp.Sender
+		for c, names := range s.consumerNames {
+			if _, ok := names[from]; ok {
+				cs = append(cs, c)
 			}
-			if spr.unsubscribe(c) {
-				log.S("topic", name).Info("delete from uns")
-				delete(s.spreaders, name) // there is no one subscribed to this topic
-				spr.close()
+		}
+		if len(cs) == 0 {
+			return
+		}
+		dst, err := s.find(to, true)
+		if err != nil {
+			log.S("topic", to).Error(err)
+			return
+		}
+		for _, c := range cs {
+			names := s.consumerNames[c]
+			delete(names, from)
+			if _, ok := names[to]; !ok {
+				names[to] = 0
+				if err := s.subscribeTopic(dst, c, 0, s.priorities[c]); err != nil {
+					log.S("topic", to).Error(err)
+				}
 			}
 		}
+		// deliver messages already published to the from topic
+		src.wait()
+		empty := false
+		for _, c := range cs {
+			empty = src.unsubscribe(c)
+		}
+		if empty {
+			log.S("topic", from).S("to", to).Info("delete after migrate")
+			delete(s.spreaders, from)
+			src.close()
+		}
+		moved = len(cs)
 	})
+	return moved
 }
 
-func (s *Broker) find(name string, currentOnNew bool) *spreader {
+// find returns spreader of the topic, new one is created if it doesn't exist.
+// Returns ErrTooManyTopics if the new one would exceed MaxTopics.
+func (s *Broker) find(name string, currentOnNew bool) (*spreader, error) {
 	spr, ok := s.spreaders[name]
 	if !ok {
+		if s.maxTopics > 0 && len(s.spreaders) >= s.maxTopics && !s.evictIdle() {
+			metric.Counter("broker.topics.rejected")
+			return nil, ErrTooManyTopics
+		}
 		start := time.Now()
 		topicCount := 1
 		if name == "sportsbook/m" {
 			topicCount = 16
 		}
-		spr = newSpreader(name, topicCount)
+		spr = newSpreader(name, topicCount, s.opts...)
 		s.spreaders[name] = spr
 		if currentOnNew && s.current != nil {
 			log.S("topic", name).I("count", topicCount).Info("new top current")
@@ -143,20 +411,91 @@ func (s *Broker) find(name string, currentOnNew bool) *spreader {
 		}
 		metric.Time("topic.new", int(time.Now().Sub(start).Nanoseconds()))
 	}
-	return spr
+	spr.usedAt = s.clock.Now()
+	return spr, nil
+}
+
+// evictIdle closes the least recently used topic without subscribers,
+// if TopicLimitEvictIdle policy is set.
+// Returns false if there is no such topic.
+func (s *Broker) evictIdle() bool {
+	if s.topicLimit != TopicLimitEvictIdle {
+		return false
+	}
+	var idle *spreader
+	var idleName string
+	for name, spr := range s.spreaders {
+		if len(spr.consumerTopics) > 0 {
+			continue
+		}
+		if idle == nil || spr.usedAt.Before(idle.usedAt) {
+			idle, idleName = spr, name
+		}
+	}
+	if idle == nil {
+		return false
+	}
+	log.S("topic", idleName).Info("evict idle topic")
+	metric.Counter("broker.topics.evicted")
+	delete(s.spreaders, idleName)
+	idle.close()
+	return true
 }
 
 // Unsubscribe from all topics
 func (s *Broker) Unsubscribe(c amp.Sender) {
 	s.inLoopWait(func() {
-		oldNames := s.consumerNames[c]
-		delete(s.consumerNames, c)
-		for name := range oldNames {
-			spr, ok := s.spreaders[name]
-			if !ok {
-				continue
-			}
-			spr.unsubscribe(c)
+		s.unsubscribe(c)
+	})
+}
+
+func (s *Broker) unsubscribe(c amp.Sender) {
+	delete(s.evicted, c)
+	delete(s.priorities, c)
+	delete(s.fullsOnly, c)
+	delete(s.filters, c)
+	delete(s.staleness, c)
+	oldNames := s.consumerNames[c]
+	delete(s.consumerNames, c)
+	for name := range oldNames {
+		spr, ok := s.spreaders[name]
+		if !ok {
+			continue
+		}
+		spr.unsubscribe(c)
+	}
+	if id, ok := s.clientIDs[c]; ok {
+		delete(s.clientIDs, c)
+		if s.clients[id] == c {
+			delete(s.clients, id)
+		}
+	}
+}
+
+// withOnEvict sets handler of consumers evicted by the topic
+func withOnEvict(f func(name string, c amp.Sender)) Option {
+	return func(o *options) {
+		o.onEvict = f
+	}
+}
+
+// unsubscribeEvicted unsubscribes consumer evicted by the topic name,
+// as Unsubscribe of that topic, so it can subscribe again.
+// Called from the topic loop, broker loop could be waiting for it.
+func (s *Broker) unsubscribeEvicted(name string, c amp.Sender) {
+	go s.inLoop(func() {
+		names := s.consumerNames[c]
+		if _, ok := names[name]; !ok {
+			return
+		}
+		delete(names, name)
+		spr, ok := s.spreaders[name]
+		if !ok {
+			return
+		}
+		if spr.unsubscribe(c) {
+			delete(s.spreaders, name)
+			spr.close()
 		}
 	})
 }
@@ -198,9 +537,27 @@ func (s *Broker) inLoopWait(f func()) {
 	<-done
 }
 
+// publication is published message, err receives the result
+// of the publish if set (ref: PublishWait)
+type publication struct {
+	m   *amp.Msg
+	err chan error
+}
+
 // Publish is interface for publisher.
+// Rejected messages are only logged, use PublishWait to get the reason.
 func (s *Broker) Publish(m *amp.Msg) {
-	s.messages <- m
+	s.messages <- publication{m: m}
+}
+
+// PublishWait publishes message and waits until the broker handles it.
+// Returns error if the message is rejected, e.g. ErrInFlightLimit
+// when the topic queue is full and RejectOverLimit is set.
+// Message is ordered with the ones sent by Publish.
+func (s *Broker) PublishWait(m *amp.Msg) error {
+	p := publication{m: m, err: make(chan error, 1)}
+	s.messages <- p
+	return <-p.err
 }
 
 func (s *Broker) signalClose() {
@@ -208,30 +565,46 @@ func (s *Broker) signalClose() {
 }
 
 func (s *Broker) close() {
-	for _, spr := range s.spreaders {
-		spr.close()
+	for name, spr := range s.spreaders {
+		spr.closeNotify(amp.NewClosing(name, amp.ClosingInfo{Reason: "shutdown"}))
 	}
 	s.spreaders = make(map[string]*spreader)
 	close(s.closed)
 }
 
+// publish publishes message to its topic, called in loop
+func (s *Broker) publish(m *amp.Msg) error {
+	name := m.URI
+	spr, err := s.find(name, !m.IsFull())
+	if err != nil {
+		return err
+	}
+	if m.IsTopicClose() {
+		log.S("topic", name).Info("delete from msg")
+		delete(s.spreaders, name)
+		// subscribers get Closing with the body of the Close message
+		spr.closeNotify(m.AsClosing())
+		return nil
+	}
+	return spr.publish(m)
+}
+
 func (s *Broker) loop() {
 	for {
 		select {
-		case m := <-s.messages:
+		case p := <-s.messages:
 			start := time.Now()
-			if m == nil {
+			if p.m == nil {
 				s.close()
 				return
 			}
-			name := m.URI
-			spr := s.find(name, !m.IsFull())
-			if m.IsTopicClose() {
-				log.S("topic", name).Info("delete from msg")
-				delete(s.spreaders, name)
-				spr.close()
-			} else {
-				spr.publish(m)
+			err := s.publish(p.m)
+			if err != nil {
+				log.S("topic", p.m.URI).I("ts", int(p.m.Ts)).Error(err)
+				metric.Counter("broker.publish.rejected")
+			}
+			if p.err != nil {
+				p.err <- err
 			}
 			metric.Time("broker.loop.msg", int(time.Now().Sub(start).Nanoseconds()))
 		case f := <-s.loopWork:
@@ -242,16 +615,53 @@ func (s *Broker) loop() {
 	}
 }
 
+// Drain waits until all messages published before the call are delivered
+// to consumers. Returns ctx error if that is not done before ctx is done,
+// e.g. because some consumer is blocked in Send. On shutdown caller can then
+// close the connections of its consumers and continue.
+func (s *Broker) Drain(ctx context.Context) error {
+	var sprs []*spreader
+	for {
+		ch := make(chan int)
+		select {
+		case s.loopWork <- func() {
+			sprs = sprs[:0]
+			for _, spr := range s.spreaders {
+				sprs = append(sprs, spr)
+			}
+			ch <- len(s.messages)
+		}:
+		case <-s.closed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if <-ch == 0 {
+			break
+		}
+	}
+	for _, spr := range sprs {
+		if err := spr.waitContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // cekaj da se procesiraju poruke koje smo publish-ali
 // samo za testove
 func (s *Broker) wait(name string) {
 	for {
 		ch := make(chan int)
+		var spr *spreader
 		s.loopWork <- func() {
+			spr = s.spreaders[name]
 			ch <- len(s.messages)
 		}
 		if 0 == <-ch {
-			s.spreaders[name].wait()
+			if spr != nil { // closed when its last consumer is evicted
+				spr.wait()
+			}
 			return
 		}
 	}
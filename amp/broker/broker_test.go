@@ -1,8 +1,10 @@
 package broker
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/minus5/svckit/log"
@@ -25,6 +27,23 @@ func (c *testConsumer) Send(m *amp.Msg) {
 	c.SendMsgs([]*amp.Msg{m})
 }
 
+// data returns messages without closing ones and number of closing messages.
+// Topics close concurrently, closing of one can arrive before messages of the other.
+func (c *testConsumer) data() ([]*amp.Msg, int) {
+	c.Lock()
+	defer c.Unlock()
+	var ms []*amp.Msg
+	closing := 0
+	for _, m := range c.messages {
+		if m.IsClosing() {
+			closing++
+			continue
+		}
+		ms = append(ms, m)
+	}
+	return ms, closing
+}
+
 func TestDvaTopica(t *testing.T) {
 	log.Discard()
 	s := New(nil)
@@ -75,6 +94,97 @@ func TestSubscribe(t *testing.T) {
 	assert.Len(t, s.spreaders, 1)
 }
 
+func TestSubscribeClient(t *testing.T) {
+	s := New(nil)
+	m10 := &amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}
+	s.Publish(m10)
+	s.wait("1")
+
+	c1 := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.SubscribeClient("client", c1, c1.topics)
+	// reconnect, c1 jos nije odjavljen
+	c2 := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.SubscribeClient("client", c2, c2.topics)
+
+	m11 := &amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff}
+	s.Publish(m11)
+	s.wait("1")
+
+	assert.Len(t, c1.messages, 1, "samo full prije zamjene")
+	assert.Len(t, c2.messages, 2)
+	assert.Equal(t, m11, c2.messages[1])
+
+	// odjava starog ne dira novog
+	s.Unsubscribe(c1)
+	s.inLoopWait(func() {
+		assert.Equal(t, c2, s.clients["client"])
+		assert.Len(t, s.consumerNames, 1)
+	})
+	s.Unsubscribe(c2)
+	s.inLoopWait(func() {
+		assert.Len(t, s.clients, 0)
+		assert.Len(t, s.clientIDs, 0)
+	})
+}
+
+func TestSubscribeClientEvicted(t *testing.T) {
+	s := New(nil)
+	c1 := &testConsumer{topics: map[string]int64{"1": 0}}
+	c2 := &testConsumer{topics: map[string]int64{"1": 0}}
+	assert.Nil(t, s.SubscribeClient("client", c1, c1.topics))
+	assert.Nil(t, s.SubscribeClient("client", c2, c2.topics))
+	assert.Equal(t, ErrSubscriberEvicted, s.SubscribeClient("client", c1, c1.topics))
+	assert.Equal(t, ErrSubscriberEvicted, s.SubscribeWait(c1, c1.topics))
+	s.inLoopWait(func() {
+		assert.Equal(t, c2, s.clients["client"])
+	})
+	// after unsubscribe consumer can subscribe again
+	s.Unsubscribe(c1)
+	assert.Nil(t, s.SubscribeClient("client", c1, c1.topics))
+}
+
+func TestPublishWaitStaleFull(t *testing.T) {
+	s := New(nil)
+	assert.Nil(t, s.PublishWait(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Full}))
+	assert.Equal(t, ErrStaleFull, s.PublishWait(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}))
+	assert.Nil(t, s.PublishWait(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff}))
+}
+
+func TestMigrate(t *testing.T) {
+	s := New(nil)
+	c := &testConsumer{topics: map[string]int64{"a": 0}}
+	s.Subscribe(c, c.topics)
+	s.Publish(&amp.Msg{URI: "a", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "b", Ts: 5, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "b", Ts: 6, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "a", Ts: 2, UpdateType: amp.Diff})
+	s.wait("a")
+
+	assert.Equal(t, 1, s.Migrate("a", "b"))
+	assert.Equal(t, 0, s.Migrate("a", "b"))
+	s.Publish(&amp.Msg{URI: "b", Ts: 7, UpdateType: amp.Diff})
+	s.wait("b")
+
+	c.Lock()
+	defer c.Unlock()
+	var a, b []int64
+	for _, m := range c.messages {
+		switch m.URI {
+		case "a":
+			a = append(a, m.Ts)
+		case "b":
+			b = append(b, m.Ts)
+		}
+	}
+	assert.Equal(t, []int64{1, 2}, a)
+	assert.Equal(t, []int64{5, 6, 7}, b)
+	s.inLoopWait(func() {
+		assert.Equal(t, map[string]int64{"b": 0}, s.consumerNames[c])
+		_, ok := s.spreaders["a"]
+		assert.False(t, ok)
+	})
+}
+
 func TestDobijeFullNakonSubscribe(t *testing.T) {
 	s := New(nil)
 	m10 := &amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}
@@ -93,18 +203,44 @@ func TestDobijeFullNakonSubscribe(t *testing.T) {
 	s.Publish(m13)
 	s.waitClose()
 
-	// c2 je dobio full i sve nakon
-	assert.Len(t, c2.messages, 3)
-	assert.Equal(t, m10, c2.messages[0])
-	assert.Equal(t, m11, c2.messages[1])
-	assert.Equal(t, m13, c2.messages[2])
+	// na zatvaranju svaki consumer dobije closing za oba topica
+	// c2 je dobio full i sve nakon, na subscribe kao replay
+	ms, closing := c2.data()
+	assert.Equal(t, 2, closing)
+	assert.Len(t, ms, 3)
+	assert.Equal(t, m10.AsReplay(), ms[0])
+	assert.Equal(t, m11.AsReplay(), ms[1])
+	assert.Equal(t, m13, ms[2])
 
 	// c3 je dobio samo diff jer je vec bio na no 2 u trenutku subscribe
-	assert.Len(t, c3.messages, 1)
-	assert.Equal(t, m13, c3.messages[0])
+	ms, closing = c3.data()
+	assert.Equal(t, 2, closing)
+	assert.Len(t, ms, 1)
+	assert.Equal(t, m13, ms[0])
 
 	// c4 je dobio sve jer je bio van range-a u trenutku subscribe
-	assert.Len(t, c4.messages, 3)
+	ms, closing = c4.data()
+	assert.Equal(t, 2, closing)
+	assert.Len(t, ms, 3)
+}
+
+func TestNoviFullSvimSubscriberima(t *testing.T) {
+	s := New(nil)
+	c := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.Subscribe(c, c.topics)
+	m1 := &amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}
+	m2 := &amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff}
+	m3 := &amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Full}
+	m4 := &amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Diff}
+	s.Publish(m1)
+	s.Publish(m2)
+	s.Publish(m3)
+	s.Publish(m3.AsReplay())
+	s.Publish(m4)
+	s.wait("1")
+
+	// postojeci subscriber dobije novi full, replay full ne dobije
+	assert.Equal(t, []*amp.Msg{m1, m2, m3, m4}, c.messages)
 }
 
 func TestSubscribeNaPrazanTopic(t *testing.T) {
@@ -147,8 +283,8 @@ func TestDobijePropusteneDiffOveNaSubscribe(t *testing.T) {
 	s.Subscribe(c, c.topics)
 	s.wait("1")
 	assert.Len(t, c.messages, 2)
-	assert.Equal(t, m3, c.messages[0])
-	assert.Equal(t, m4, c.messages[1])
+	assert.Equal(t, m3.AsReplay(), c.messages[0])
+	assert.Equal(t, m4.AsReplay(), c.messages[1])
 
 	c = &testConsumer{topics: map[string]int64{"1": 101, "2": 0}}
 	s.Subscribe(c, c.topics)
@@ -162,6 +298,22 @@ func TestDobijePropusteneDiffOveNaSubscribe(t *testing.T) {
 	assert.Len(t, c.messages, 6)
 }
 
+func TestDrain(t *testing.T) {
+	s := New(nil)
+	c := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.Subscribe(c, c.topics)
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	for i := int64(2); i <= 10; i++ {
+		s.Publish(&amp.Msg{URI: "1", Ts: i, UpdateType: amp.Diff})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.Drain(ctx))
+	c.Lock()
+	assert.Len(t, c.messages, 10)
+	c.Unlock()
+}
+
 func TestReplay(t *testing.T) {
 	s := New(nil)
 	m1 := &amp.Msg{URI: "1", Ts: 101, UpdateType: amp.Full}
@@ -190,3 +342,263 @@ func TestReplay(t *testing.T) {
 	msgs = s.Replay("")
 	assert.Len(t, msgs, 6)
 }
+
+func TestClosing(t *testing.T) {
+	s := New(nil)
+	c1 := &testConsumer{}
+	c2 := &testConsumer{}
+	s.Subscribe(c1, map[string]int64{"1": 0})
+	s.Subscribe(c2, map[string]int64{"2": 0})
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(amp.NewPublish("1", "", 2, amp.Close, amp.ClosingInfo{Redirect: "other"}))
+	s.waitClose()
+
+	// topic close message is forwarded as closing with its body
+	assert.Len(t, c1.messages, 2)
+	m := amp.Parse(c1.messages[1].Marshal())
+	assert.True(t, m.IsClosing())
+	var info amp.ClosingInfo
+	assert.Nil(t, m.Unmarshal(&info))
+	assert.Equal(t, "other", info.Redirect)
+
+	// broker shutdown
+	assert.Len(t, c2.messages, 1)
+	assert.True(t, c2.messages[0].IsClosing())
+}
+
+func TestSubscribeFullsOnly(t *testing.T) {
+	s := New(nil)
+	m1 := &amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}
+	m2 := &amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff}
+	s.Publish(m1)
+	s.Publish(m2)
+	s.wait("1")
+
+	c := &testConsumer{topics: map[string]int64{"1": 1}}
+	s.SubscribeFullsOnly(c, c.topics)
+	s.wait("1")
+	// dobije samo trenutni full, bez diffova
+	assert.Equal(t, []*amp.Msg{m1.AsReplay()}, c.messages)
+
+	m3 := &amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff}
+	m4 := &amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Full}
+	m5 := &amp.Msg{URI: "1", Ts: 5, UpdateType: amp.Diff}
+	m6 := &amp.Msg{URI: "1", Ts: 6, UpdateType: amp.Event}
+	s.Publish(m3)
+	s.Publish(m4)
+	s.Publish(m4.AsReplay())
+	s.Publish(m5)
+	s.Publish(m6)
+	s.wait("1")
+	assert.Equal(t, []*amp.Msg{m1.AsReplay(), m4}, c.messages)
+
+	infos := s.Subscribers("1")
+	assert.Len(t, infos, 1)
+	assert.True(t, infos[0].FullsOnly)
+	assert.Equal(t, 2, infos[0].Received)
+}
+
+func TestMaxTopicsReject(t *testing.T) {
+	s := New(nil, MaxTopics(2, TopicLimitReject))
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "2", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "3", Ts: 1, UpdateType: amp.Full})
+	s.wait("2")
+	s.inLoopWait(func() {
+		assert.Len(t, s.spreaders, 2)
+		assert.NotContains(t, s.spreaders, "3")
+	})
+
+	c := &testConsumer{topics: map[string]int64{"1": 0, "4": 0}}
+	err := s.SubscribeClient("client", c, c.topics)
+	assert.Equal(t, ErrTooManyTopics, err)
+	s.wait("1")
+	assert.Len(t, c.messages, 1)
+	s.inLoopWait(func() {
+		assert.Len(t, s.spreaders, 2)
+		assert.Equal(t, map[string]int64{"1": 0}, s.consumerNames[c])
+	})
+}
+
+func TestMaxTopicsEvictIdle(t *testing.T) {
+	clock := newManualClock()
+	s := New(nil, MaxTopics(2, TopicLimitEvictIdle), WithClock(clock))
+	c := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.SubscribeClient("client", c, c.topics)
+	s.Publish(&amp.Msg{URI: "2", Ts: 1, UpdateType: amp.Full})
+	s.wait("2")
+
+	// 2 nema subscribera, zamijeni ga 3
+	clock.Advance(time.Second)
+	s.Publish(&amp.Msg{URI: "3", Ts: 1, UpdateType: amp.Full})
+	s.wait("3")
+	s.inLoopWait(func() {
+		assert.Len(t, s.spreaders, 2)
+		assert.Contains(t, s.spreaders, "1")
+		assert.Contains(t, s.spreaders, "3")
+	})
+
+	// nema idle topica, odbije
+	c2 := &testConsumer{topics: map[string]int64{"3": 0}}
+	assert.Nil(t, s.SubscribeClient("client2", c2, c2.topics))
+	c3 := &testConsumer{topics: map[string]int64{"4": 0}}
+	assert.Equal(t, ErrTooManyTopics, s.SubscribeClient("client3", c3, c3.topics))
+	s.wait("3")
+	assert.Len(t, c2.messages, 1)
+}
+
+func TestMessagesCarryTopic(t *testing.T) {
+	s := New(nil)
+	for _, name := range []string{"sportsbook/m", "sportsbook/s"} {
+		s.Publish(&amp.Msg{URI: name, Ts: 1, UpdateType: amp.Full})
+		s.Publish(&amp.Msg{URI: name, Ts: 2, UpdateType: amp.Diff})
+		s.Publish(&amp.Msg{URI: name, Ts: 3, UpdateType: amp.Diff})
+		s.wait(name)
+	}
+	c := &testConsumer{topics: map[string]int64{"sportsbook/m": 0, "sportsbook/s": 0}}
+	s.Subscribe(c, c.topics)
+	s.Publish(&amp.Msg{URI: "sportsbook/m", Ts: 4, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "sportsbook/s", Ts: 4, UpdateType: amp.Diff})
+	s.wait("sportsbook/m")
+	s.wait("sportsbook/s")
+
+	// replay with burst markers and live message for each topic
+	byTopic := make(map[string][]uint8)
+	for _, m := range c.messages {
+		byTopic[m.URI] = append(byTopic[m.URI], m.UpdateType)
+	}
+	expected := []uint8{amp.BurstStart, amp.Full, amp.Diff, amp.Diff, amp.BurstEnd, amp.Diff}
+	assert.Equal(t, map[string][]uint8{"sportsbook/m": expected, "sportsbook/s": expected}, byTopic)
+}
+
+func TestHasFull(t *testing.T) {
+	s := New(nil)
+	assert.False(t, s.HasFull("1"))
+	assert.Equal(t, int64(0), s.LatestTs("1"))
+
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Diff})
+	assert.False(t, s.HasFull("1"))
+	assert.Equal(t, int64(1), s.LatestTs("1"))
+
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff})
+	assert.True(t, s.HasFull("1"))
+	assert.Equal(t, int64(3), s.LatestTs("1"))
+	s.wait("1")
+
+	// query doesn't create topic
+	s.HasFull("2")
+	s.inLoopWait(func() {
+		_, ok := s.spreaders["2"]
+		assert.False(t, ok)
+	})
+}
+
+func TestPauseResume(t *testing.T) {
+	s := New(nil)
+	assert.Equal(t, ErrTopicNotFound, s.Pause("1"))
+	c1 := &testConsumer{topics: map[string]int64{"1": 0}}
+	c2 := &testConsumer{topics: map[string]int64{"1": 0}}
+	s.Subscribe(c1, c1.topics)
+	s.SubscribeFullsOnly(c2, c2.topics)
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.wait("1")
+	assert.Len(t, c1.messages, 1)
+	assert.Len(t, c2.messages, 1)
+
+	assert.Nil(t, s.Pause("1"))
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Event})
+	s.Publish(&amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Diff})
+	s.wait("1")
+	assert.Len(t, c1.messages, 1)
+	assert.Equal(t, []int64{1, 2, 4}, tsOf(s.Replay("1")))
+
+	// missed diffs, then live
+	assert.Nil(t, s.Resume("1"))
+	s.Publish(&amp.Msg{URI: "1", Ts: 5, UpdateType: amp.Diff})
+	s.wait("1")
+	assert.Equal(t, []int64{1, 2, 4, 5}, tsOf(c1.messages))
+	assert.Len(t, c2.messages, 1)
+}
+
+func tsOf(ms []*amp.Msg) []int64 {
+	var ts []int64
+	for _, m := range ms {
+		ts = append(ts, m.Ts)
+	}
+	return ts
+}
+
+func TestMemoryBudget(t *testing.T) {
+	publish := func(uri string) []*amp.Msg {
+		return []*amp.Msg{
+			amp.NewPublish(uri, "", 1, amp.Full, map[string]int{"a": 1}),
+			amp.NewPublish(uri, "", 2, amp.Diff, map[string]int{"b": 2}),
+			amp.NewPublish(uri, "", 3, amp.Full, map[string]int{"a": 1, "b": 2}),
+			amp.NewPublish(uri, "", 4, amp.Diff, map[string]int{"c": 4}),
+		}
+	}
+	a, b := publish("a"), publish("b")
+	var size int64
+	for _, m := range append(a[1:], b[1:]...) {
+		size += int64(m.Size())
+	}
+	clock := newManualClock()
+	s := New(nil, WithClock(clock), MemoryBudget(size-1))
+	for _, m := range a {
+		s.Publish(m)
+	}
+	s.wait("a")
+	clock.Advance(time.Second)
+	for _, m := range b {
+		s.Publish(m)
+	}
+	s.wait("b")
+
+	// diff before the full of the least recently used topic is trimmed
+	for i := 0; i < 1000 && s.MemoryUsage() > size-1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, size-int64(a[1].Size()), s.MemoryUsage())
+	snapshot := func(name string) []*amp.Msg {
+		var spr *spreader
+		s.inLoopWait(func() { spr = s.spreaders[name] })
+		ms, err := spr.export()
+		assert.Nil(t, err)
+		return ms
+	}
+	assert.Equal(t, []int64{3, 4}, tsOf(snapshot("a")))
+	assert.Equal(t, []int64{3, 2, 4}, tsOf(snapshot("b")))
+
+	// closed topic releases its bytes
+	s.Publish(amp.NewPublish("a", "", 5, amp.Close, nil))
+	s.wait("b")
+	assert.Equal(t, int64(b[1].Size()+b[2].Size()+b[3].Size()), s.MemoryUsage())
+}
+
+func TestMemoryBudgetPartitions(t *testing.T) {
+	spr := newSpreader("t", 4, MemoryBudget(1<<20))
+	full := amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1})
+	diff := amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"b": 2})
+	spr.publish(full)
+	spr.publish(diff)
+	spr.wait()
+	// cache is the same in every partition, it is accounted once
+	assert.Equal(t, int64(full.Size()+diff.Size()), spr.topics[0].opts.memory.usage())
+	spr.close()
+	assert.Equal(t, int64(0), spr.topics[0].opts.memory.usage())
+}
+
+func TestPublishWaitInFlightLimit(t *testing.T) {
+	s := New(nil, MaxInFlight(1), RejectOverLimit())
+	c := &blockingConsumer{release: make(chan struct{})}
+	s.Subscribe(c, map[string]int64{"1": 0})
+	assert.Nil(t, s.PublishWait(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}))
+	var err error
+	for ts := int64(2); ts < 10 && err == nil; ts++ {
+		err = s.PublishWait(&amp.Msg{URI: "1", Ts: ts, UpdateType: amp.Diff})
+	}
+	assert.Equal(t, ErrInFlightLimit, err)
+	close(c.release)
+}
@@ -0,0 +1,45 @@
+package broker
+
+import "time"
+
+// Clock is source of time for time dependent behaviour: idempotency window,
+// coalescing, send timeout and automatic ts. Tests can replace it
+// with a clock they advance. Metrics use the real time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// timerClock is Clock whose timers can be stopped before they fire
+type timerClock interface {
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// newTimer returns channel which fires after d and func which stops it,
+// timer of the Clock which can't stop it is released when it fires
+func newTimer(c Clock, d time.Duration) (<-chan time.Time, func() bool) {
+	if tc, ok := c.(timerClock); ok {
+		return tc.NewTimer(d)
+	}
+	return c.After(d), func() bool { return false }
+}
+
+// WithClock sets clock used by broker, spreaders and topics.
+// Default is the real clock.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		if c != nil {
+			o.clock = c
+		}
+	}
+}
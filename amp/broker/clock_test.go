@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// manualClock is advanced by the test
+type manualClock struct {
+	now     time.Time
+	waiters []clockWaiter
+	sync.Mutex
+}
+
+type clockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Unix(1500000000, 0)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves clock and fires due waiters
+func (c *manualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	var ws []clockWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			ws = append(ws, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = ws
+}
+
+// waitFlushed waits until coalesce window is flushed
+func (spr *spreader) waitFlushed() {
+	for {
+		spr.lock.Lock()
+		flushed := spr.coalesced == nil
+		spr.lock.Unlock()
+		if flushed {
+			return
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// BrokerInfo is snapshot of the broker state for debugging, ref: Dump
+type BrokerInfo struct {
+	At          time.Time   `json:"at"`
+	Queue       int         `json:"queue"`        // published messages waiting in the broker loop
+	Consumers   int         `json:"consumers"`    // subscribed consumers
+	MemoryUsage int64       `json:"memory_usage"` // ref: MemoryBudget
+	Topics      []TopicInfo `json:"topics"`
+}
+
+// TopicInfo describes topic state, ref: Dump
+type TopicInfo struct {
+	Name        string    `json:"name"`
+	Subscribers int       `json:"subscribers"`
+	IDs         []string  `json:"ids,omitempty"` // subscribers with ID() or client id, ref: SubscriberInfo
+	HasFull     bool      `json:"has_full"`
+	FullTs      int64     `json:"full_ts"`
+	LastTs      int64     `json:"last_ts"` // ts of the last message
+	Diffs       int       `json:"diffs"`   // cached diffs, messages of the append cache
+	FirstDiffTs int64     `json:"first_diff_ts"`
+	LastDiffTs  int64     `json:"last_diff_ts"`
+	Bytes       int64     `json:"bytes"` // approximate size of the cache
+	Paused      bool      `json:"paused,omitempty"`
+	UsedAt      time.Time `json:"used_at"` // last publish or subscribe
+}
+
+// Dump collects state of all topics.
+// Topic list is taken in the broker loop, each topic is then described
+// in its own loop, so topics are consistent by themselves but not with
+// each other. Closed topics are skipped.
+func (s *Broker) Dump() BrokerInfo {
+	info := BrokerInfo{At: s.clock.Now(), MemoryUsage: s.MemoryUsage()}
+	var sprs []*spreader
+	var names []string
+	var usedAt []time.Time
+	clientIDs := make(map[amp.Sender]string)
+	s.inLoopWait(func() {
+		info.Queue = len(s.messages)
+		info.Consumers = len(s.consumerNames)
+		for name, spr := range s.spreaders {
+			names = append(names, name)
+			sprs = append(sprs, spr)
+			usedAt = append(usedAt, spr.usedAt)
+		}
+		for c, id := range s.clientIDs {
+			clientIDs[c] = id
+		}
+	})
+	for i, spr := range sprs {
+		ti, ok := spr.info(clientIDs)
+		if !ok {
+			continue
+		}
+		ti.Name, ti.UsedAt = names[i], usedAt[i]
+		info.Topics = append(info.Topics, ti)
+	}
+	sort.Slice(info.Topics, func(i, j int) bool {
+		return info.Topics[i].Name < info.Topics[j].Name
+	})
+	return info
+}
+
+// ServeDump writes Dump as json, for the debug http endpoint
+func (s *Broker) ServeDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Dump()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// info aggregates info of the spreader topics, cache is the same
+// in all of them. Returns false if spreader is closed.
+func (spr *spreader) info(clientIDs map[amp.Sender]string) (TopicInfo, bool) {
+	spr.lock.Lock()
+	ti := TopicInfo{HasFull: spr.hasFull}
+	spr.lock.Unlock()
+	for i, t := range spr.topics {
+		tti, ok := t.info(clientIDs)
+		if !ok {
+			return ti, false
+		}
+		if i == 0 {
+			ti.FullTs, ti.LastTs, ti.Bytes = tti.FullTs, tti.LastTs, tti.Bytes
+			ti.Diffs, ti.FirstDiffTs, ti.LastDiffTs = tti.Diffs, tti.FirstDiffTs, tti.LastDiffTs
+		}
+		ti.Subscribers += tti.Subscribers
+		ti.IDs = append(ti.IDs, tti.IDs...)
+		ti.Paused = ti.Paused || tti.Paused
+	}
+	sort.Strings(ti.IDs)
+	return ti, true
+}
+
+// info collects topic state in the topic loop
+func (t *topic) info(clientIDs map[amp.Sender]string) (TopicInfo, bool) {
+	ret := make(chan TopicInfo, 1)
+	f := func() {
+		ti := TopicInfo{
+			Subscribers: len(t.consumers),
+			LastTs:      t.lastTs,
+			Paused:      t.paused,
+		}
+		for c := range t.consumers {
+			if i, ok := c.(identifier); ok {
+				ti.IDs = append(ti.IDs, i.ID())
+			} else if id, ok := clientIDs[c]; ok {
+				ti.IDs = append(ti.IDs, id)
+			}
+		}
+		switch c := t.cache.(type) {
+		case *fullDiffCache:
+			c.info(&ti)
+		case *appendCache:
+			ti.Diffs, ti.Bytes = len(c.msgs), c.bytes
+		}
+		ret <- ti
+	}
+	select {
+	case t.loopWork <- f:
+	case <-t.closed:
+		return TopicInfo{}, false
+	}
+	return <-ret, true
+}
+
+// info sets cache fields of the topic info
+func (t *fullDiffCache) info(ti *TopicInfo) {
+	t.Lock()
+	defer t.Unlock()
+	if t.full != nil {
+		ti.FullTs = t.full.Ts
+	}
+	ti.Bytes = t.bytes
+	ti.Diffs = len(t.diffs)
+	if len(t.diffs) > 0 {
+		ti.FirstDiffTs = t.diffs[0].Ts
+		ti.LastDiffTs = t.diffs[len(t.diffs)-1].Ts
+	}
+}
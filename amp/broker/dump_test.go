@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDump(t *testing.T) {
+	s := New(nil)
+	assert.Len(t, s.Dump().Topics, 0)
+
+	c1 := &idConsumer{id: "c1"}
+	c2 := &testConsumer{}
+	s.Subscribe(c1, map[string]int64{"1": 0})
+	assert.Nil(t, s.SubscribeClient("c2", c2, map[string]int64{"1": 0, "2": 0}))
+	full := &amp.Msg{URI: "1", Ts: 101, UpdateType: amp.Full}
+	diffs := []*amp.Msg{
+		{URI: "1", Ts: 102, UpdateType: amp.Diff},
+		{URI: "1", Ts: 103, UpdateType: amp.Diff},
+	}
+	s.Publish(full)
+	for _, m := range diffs {
+		s.Publish(m)
+	}
+	s.wait("1")
+	assert.Nil(t, s.Pause("2"))
+
+	d := s.Dump()
+	assert.Equal(t, 2, d.Consumers)
+	assert.Len(t, d.Topics, 2)
+	t1 := d.Topics[0]
+	assert.Equal(t, "1", t1.Name)
+	assert.Equal(t, 2, t1.Subscribers)
+	assert.Equal(t, []string{"c1", "c2"}, t1.IDs)
+	assert.True(t, t1.HasFull)
+	assert.Equal(t, int64(101), t1.FullTs)
+	assert.Equal(t, int64(103), t1.LastTs)
+	assert.Equal(t, 2, t1.Diffs)
+	assert.Equal(t, int64(102), t1.FirstDiffTs)
+	assert.Equal(t, int64(103), t1.LastDiffTs)
+	assert.Equal(t, int64(full.Size()+diffs[0].Size()+diffs[1].Size()), t1.Bytes)
+	assert.False(t, t1.Paused)
+	t2 := d.Topics[1]
+	assert.Equal(t, "2", t2.Name)
+	assert.Equal(t, []string{"c2"}, t2.IDs)
+	assert.False(t, t2.HasFull)
+	assert.True(t, t2.Paused)
+
+	// http endpoint
+	w := httptest.NewRecorder()
+	s.ServeDump(w, httptest.NewRequest("GET", "/debug/broker", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var rsp BrokerInfo
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+	assert.Len(t, rsp.Topics, 2)
+	assert.Equal(t, t1.IDs, rsp.Topics[0].IDs)
+	assert.Equal(t, t1.Bytes, rsp.Topics[0].Bytes)
+	assert.True(t, t1.UsedAt.Equal(rsp.Topics[0].UsedAt))
+}
+
+func TestSpreaderInfoPartitions(t *testing.T) {
+	spr := newSpreader("t", 4)
+	defer spr.close()
+	full := amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1})
+	diff := amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"b": 2})
+	spr.publish(full)
+	spr.publish(diff)
+	spr.wait()
+	ti, ok := spr.info(nil)
+	assert.True(t, ok)
+	// cache is the same in every partition, its size is counted once
+	assert.Equal(t, int64(full.Size()+diff.Size()), ti.Bytes)
+	assert.Equal(t, 1, ti.Diffs)
+}
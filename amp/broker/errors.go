@@ -0,0 +1,25 @@
+package broker
+
+import "errors"
+
+var (
+	// ErrTopicClosed is returned when publishing or subscribing to the topic
+	// which is already closed.
+	ErrTopicClosed = errors.New("topic closed")
+	// ErrStaleFull is returned when publishing full older than the last one
+	// published to the topic.
+	ErrStaleFull = errors.New("stale full")
+	// ErrSubscriberEvicted is returned when subscriber which was replaced by
+	// another one with the same client id tries to subscribe again.
+	ErrSubscriberEvicted = errors.New("subscriber evicted")
+	// ErrMsgTooLarge is returned when publishing message larger than MaxMsgSize.
+	ErrMsgTooLarge = errors.New("message too large")
+	// ErrAckTimeout is returned from PublishSync when some consumers
+	// haven't confirmed the message before timeout.
+	ErrAckTimeout = errors.New("ack timeout")
+	// ErrTooManyTopics is returned when new topic would exceed MaxTopics.
+	ErrTooManyTopics = errors.New("too many topics")
+	// ErrAlreadySubscribed is returned when subscribing consumer, or another
+	// consumer with the same ID, which is already subscribed to the topic.
+	ErrAlreadySubscribed = errors.New("already subscribed")
+)
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"github.com/minus5/svckit/amp"
+)
+
+// Filter selects messages for the consumer, ref: SubscribeFilter.
+// Message is shared by all consumers and must not be changed.
+type Filter func(m *amp.Msg) bool
+
+// SubscribeFilter subscribes consumer which gets only messages for which
+// filter returns true: live diffs and events, and those sent on subscribe
+// or resume (cached diffs, current state). Fulls are always sent, so
+// consumer has the baseline state.
+//
+// Filter is called in the topic loop, for each message and each filtering
+// consumer of the topic. Slow filter delays delivery to all consumers
+// of the topic, keep it cheap: no I/O or blocking. Parsing message body
+// (e.g. amp.Msg.Unmarshal) in each call multiplies the cost by the
+// number of such consumers.
+//
+// Mode is kept for the next calls of Subscribe until Unsubscribe, topics
+// consumer is already subscribed to are not changed.
+func (s *Broker) SubscribeFilter(c amp.Sender, newNames map[string]int64, filter Filter) error {
+	return s.subscribeMode(c, newNames, func() {
+		delete(s.fullsOnly, c)
+		s.filters[c] = filter
+	})
+}
+
+// accepts returns true if m passes consumer filter
+func (t *topic) accepts(c amp.Sender, m *amp.Msg) bool {
+	f, ok := t.filters[c]
+	return !ok || m.IsFull() || f(m)
+}
+
+// filtered returns messages which pass consumer filter
+func (t *topic) filtered(c amp.Sender, ms []*amp.Msg) []*amp.Msg {
+	if _, ok := t.filters[c]; !ok {
+		return ms
+	}
+	var fs []*amp.Msg
+	for _, m := range ms {
+		if t.accepts(c, m) {
+			fs = append(fs, m)
+		}
+	}
+	return fs
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeFilter(t *testing.T) {
+	s := New(nil)
+	calls := 0
+	even := func(m *amp.Msg) bool {
+		calls++
+		return m.Ts%2 == 0
+	}
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff})
+	s.wait("1")
+
+	// current state on subscribe is filtered, full is kept
+	c := &testConsumer{}
+	c2 := &testConsumer{}
+	s.SubscribeFilter(c, map[string]int64{"1": 0}, even)
+	s.Subscribe(c2, map[string]int64{"1": 0})
+	s.wait("1")
+	assert.Equal(t, []int64{1, 2}, tsOf(c.messages))
+	assert.Equal(t, []int64{1, 1, 2, 3, 3}, tsOf(c2.messages))
+
+	// live diffs and events
+	s.Publish(&amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 5, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 6, UpdateType: amp.Event})
+	s.Publish(&amp.Msg{URI: "1", Ts: 7, UpdateType: amp.Event})
+	s.Publish(&amp.Msg{URI: "1", Ts: 9, UpdateType: amp.Full})
+	s.wait("1")
+	assert.Equal(t, []int64{1, 2, 4, 6, 9}, tsOf(c.messages))
+	assert.Equal(t, 6, calls)
+
+	// filter is kept for the next subscribe
+	s.Publish(&amp.Msg{URI: "2", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "2", Ts: 2, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "2", Ts: 3, UpdateType: amp.Diff})
+	s.wait("2")
+	s.Subscribe(c, map[string]int64{"1": 9, "2": 0})
+	s.wait("2")
+	assert.Equal(t, []int64{1, 2, 4, 6, 9, 1, 2}, tsOf(c.messages))
+}
@@ -2,14 +2,30 @@ package broker
 
 import (
 	"sort"
+	"sync"
 
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
 )
 
+// fullDiffCache is safe for concurrent use, exported methods lock it.
+// Topic loop serialises access anyway, lock guards readers outside of it.
 type fullDiffCache struct {
 	full    *amp.Msg   // last full message
 	diffs   []*amp.Msg // previous diff messages
 	current []*amp.Msg // memoization of Current function
+	evicted int64      // greatest ts of the diffs removed from the cache
+	bytes   int64      // size of the full and diffs, ref: Bytes
+
+	hashState  bool     // set state hash on full and diffs
+	state      *amp.Msg // full with diffs applied, nil if unknown
+	sequential bool     // diff with the same ts as full is applied after it, ref: SameTsMode
+
+	contiguous bool                 // diffs ts are contiguous, ref: ContiguousTs
+	broken     bool                 // hole in the diff chain after the full
+	healed     bool                 // the last added diff filled the hole
+	onGap      func(prev, ts int64) // called with lock when hole is detected
+	sync.Mutex
 }
 
 func newFullDiffCache() *fullDiffCache {
@@ -19,29 +35,61 @@ func newFullDiffCache() *fullDiffCache {
 }
 
 // message for subsribers after he subscribes with ts
+// Counts cache hits: diffs only, fallback to full or nothing without full.
 func (t *fullDiffCache) Find(ts int64) []*amp.Msg {
+	t.Lock()
+	defer t.Unlock()
+	if t.broken && t.full != nil {
+		metric.Counter("broker.cache.broken")
+		return []*amp.Msg{t.full}
+	}
 	if len(t.diffs) > 0 && ts >= t.diffs[0].Ts && ts <= t.diffs[len(t.diffs)-1].Ts {
+		metric.Counter("broker.cache.diff_hit")
 		return t.diffsAfter(ts)
 	}
 	if t.full == nil {
+		metric.Counter("broker.cache.no_full")
 		return nil
 	}
-	return t.Current()
+	metric.Counter("broker.cache.full_fallback")
+	return t.currentMsgs()
 }
 
 // updateCache adds new message to the caches t.full or t.diffs
-func (t *fullDiffCache) Add(m *amp.Msg) {
+// Returns message as it is stored in the cache.
+func (t *fullDiffCache) Add(m *amp.Msg) *amp.Msg {
+	t.Lock()
+	defer t.Unlock()
 	t.current = nil
+	full, n, broken := t.full, len(t.diffs), t.broken
+	stored := t.add(m)
+	t.healed = broken && !t.broken && !m.IsFull()
+	switch {
+	case t.full == full && len(t.diffs) == n:
+		// not added, e.g. replay of the full
+	case t.full == full && len(t.diffs) == n+1 && t.diffs[n] == stored:
+		// diff appended at the end, the common case
+		t.bytes += int64(stored.Size())
+	default:
+		t.bytes = t.size()
+	}
+	return stored
+}
 
+func (t *fullDiffCache) add(m *amp.Msg) *amp.Msg {
 	if m.IsFull() {
 		if m.IsReplay() && t.full != nil {
-			return
+			return m
 		}
 		if t.full != nil { // preserve all after previous full
 			t.compactDiffs(t.full.Ts)
 		}
 		t.full = m
-		return
+		t.heal()
+		if t.hashState {
+			return t.rehash(m)
+		}
+		return m
 	}
 
 	t.diffs = append(t.diffs, m)
@@ -49,8 +97,82 @@ func (t *fullDiffCache) Add(m *amp.Msg) {
 		prev := len(t.diffs) - 2
 		if m.Ts <= t.diffs[prev].Ts {
 			t.sortDiffs()
+			t.heal()
+			if t.hashState {
+				return t.rehash(m)
+			}
+			return m
+		}
+	}
+	t.checkGap(m)
+	if t.hashState {
+		return t.applyState(m)
+	}
+	return m
+}
+
+// applyState applies diff at the end of the diffs to the state
+func (t *fullDiffCache) applyState(m *amp.Msg) *amp.Msg {
+	if t.state == nil || !t.afterFull(m) {
+		return m
+	}
+	state, err := amp.Apply(t.state, m)
+	if err != nil {
+		log.S("uri", m.URI).Error(err)
+		t.state = nil
+		return m
+	}
+	hash, err := state.BodyHash()
+	if err != nil {
+		log.S("uri", m.URI).Error(err)
+		t.state = nil
+		return m
+	}
+	t.state = state
+	hm := m.WithHash(hash)
+	t.diffs[len(t.diffs)-1] = hm
+	return hm
+}
+
+// rehash builds state from full and all diffs after it
+// and sets hash on each of them.
+// Returns stored version of the m.
+func (t *fullDiffCache) rehash(m *amp.Msg) *amp.Msg {
+	t.state = nil
+	if t.full == nil {
+		return m
+	}
+	hash, err := t.full.BodyHash()
+	if err != nil {
+		log.S("uri", t.full.URI).Error(err)
+		return m
+	}
+	t.full = t.full.WithHash(hash)
+	t.state = t.full
+	ret := m
+	if m.IsFull() {
+		ret = t.full
+	}
+	for i, d := range t.diffs {
+		if !t.afterFull(d) {
+			continue
+		}
+		state, err := amp.Apply(t.state, d)
+		if err == nil {
+			hash, err = state.BodyHash()
+		}
+		if err != nil {
+			log.S("uri", d.URI).Error(err)
+			t.state = nil
+			return ret
+		}
+		t.state = state
+		t.diffs[i] = d.WithHash(hash)
+		if d == m {
+			ret = t.diffs[i]
 		}
 	}
+	return ret
 }
 
 // compactDiffs preserves only diffs with Ts greater than input ts
@@ -59,11 +181,28 @@ func (t *fullDiffCache) compactDiffs(ts int64) {
 	for _, m := range t.diffs {
 		if m.Ts >= ts {
 			n = append(n, m)
+			continue
 		}
+		t.evict(m)
 	}
 	t.diffs = n
 }
 
+// evict records diff removed from the cache
+func (t *fullDiffCache) evict(m *amp.Msg) {
+	if m.Ts > t.evicted {
+		t.evicted = m.Ts
+	}
+}
+
+// EvictedTs returns ts of the newest diff removed from the cache,
+// 0 if none is removed
+func (t *fullDiffCache) EvictedTs() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.evicted
+}
+
 // sortDiffs sorts and removes duplicates in t.diffs
 func (t *fullDiffCache) sortDiffs() {
 	t.diffs = sortMsgs(t.diffs)
@@ -90,35 +229,108 @@ func sortMsgs(msgs []*amp.Msg) []*amp.Msg {
 	return msgs
 }
 
+// DiffsAfter returns diffs newer than ts
+func (t *fullDiffCache) DiffsAfter(ts int64) []*amp.Msg {
+	t.Lock()
+	defer t.Unlock()
+	return t.diffsAfter(ts)
+}
+
+// FirstDiffTs returns ts of the oldest diff in cache
+func (t *fullDiffCache) FirstDiffTs() (int64, bool) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.diffs) == 0 {
+		return 0, false
+	}
+	return t.diffs[0].Ts, true
+}
+
+// diffsAfter returns diffs newer than ts. Position at the full ts
+// is the full state, diffs after it are chosen by afterFull.
 func (t *fullDiffCache) diffsAfter(ts int64) []*amp.Msg {
+	atFull := t.full != nil && ts == t.full.Ts
 	var d []*amp.Msg
 	for _, m := range t.diffs {
-		if m.Ts > ts {
+		if m.Ts > ts || (atFull && t.afterFull(m)) {
 			d = append(d, m)
 		}
 	}
 	return d
 }
 
+// afterFull returns true if diff should be applied to the full
+func (t *fullDiffCache) afterFull(d *amp.Msg) bool {
+	return d.Ts > t.full.Ts || (t.sequential && d.Ts == t.full.Ts)
+}
+
 func (t *fullDiffCache) Current() []*amp.Msg {
+	t.Lock()
+	defer t.Unlock()
+	return t.currentMsgs()
+}
+
+func (t *fullDiffCache) currentMsgs() []*amp.Msg {
 	if t.full == nil {
 		return nil
 	}
 	if t.current == nil {
-		t.current = append([]*amp.Msg{t.full}, t.diffsAfter(t.full.Ts)...)
+		t.current = []*amp.Msg{t.full}
+		if t.broken {
+			return t.current
+		}
+		for _, d := range t.diffs {
+			if t.afterFull(d) {
+				t.current = append(t.current, d)
+			}
+		}
 	}
 	return t.current
 }
 
+// Snapshot returns full and all diffs, adding them to the empty cache
+// rebuilds the same cache.
+func (t *fullDiffCache) Snapshot() []*amp.Msg {
+	t.Lock()
+	defer t.Unlock()
+	var ms []*amp.Msg
+	if t.full != nil {
+		ms = append(ms, t.full)
+	}
+	return append(ms, t.diffs...)
+}
+
+// FindFor decides what to send to the subscriber positioned at cTs
+// after m is added to the cache.
+// New full is sent to all subscribers positioned before it, with diffs
+// after it, so their state is replaced with the authoritative one.
+// Replayed full is sent only to subscribers which don't have state.
+// Diffs are not sent while the chain is broken, the late diff which
+// heals it sends the current state.
 func (t *fullDiffCache) FindFor(cTs int64, m *amp.Msg) uint8 {
+	t.Lock()
+	defer t.Unlock()
 	if m.IsFull() {
-		if cTs != tsNone {
+		if cTs != tsNone && (m.IsReplay() || cTs >= m.Ts) {
 			return sendNothing
 		}
 		return sendCurrent
 	}
 
-	if cTs == m.Ts || cTs == tsNone {
+	if cTs == tsNone || t.broken {
+		// diffs can't be applied across the hole
+		return sendNothing
+	}
+	if t.healed {
+		// late diff filled the hole, state is sent again
+		return sendCurrent
+	}
+	if cTs == m.Ts {
+		// subscriber positioned at full gets diff with the same ts,
+		// as in Find
+		if t.full != nil && cTs == t.full.Ts && t.afterFull(m) && !m.IsReplay() {
+			return sendMsg
+		}
 		return sendNothing
 	}
 	if m.IsReplay() && cTs >= m.Ts { // nemoj ponavljati replay poruke onima koji ih vec imaju
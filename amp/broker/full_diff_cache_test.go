@@ -1,6 +1,8 @@
 package broker
 
 import (
+	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/minus5/svckit/amp"
@@ -111,3 +113,160 @@ func TestSortPrevRemovesDuplicates(t *testing.T) {
 	assert.Equal(t, int64(12), topic.diffs[1].Ts)
 	assert.Equal(t, int64(15), topic.diffs[2].Ts)
 }
+
+func TestFullDiffCacheStateHash(t *testing.T) {
+	c := newFullDiffCache()
+	c.hashState = true
+	hash := func(body string) string {
+		h, err := amp.Parse([]byte("{}\n" + body)).BodyHash()
+		assert.Nil(t, err)
+		return h
+	}
+
+	// diff before full has no state
+	m := c.Add(amp.NewPublish("t", "", 9, amp.Diff, map[string]int{"a": 0}))
+	assert.Equal(t, "", m.Hash)
+
+	m = c.Add(amp.NewPublish("t", "", 10, amp.Full, map[string]int{"a": 1}))
+	assert.Equal(t, hash(`{"a":1}`), m.Hash)
+	m = c.Add(amp.NewPublish("t", "", 11, amp.Diff, map[string]int{"b": 2}))
+	assert.Equal(t, hash(`{"a":1,"b":2}`), m.Hash)
+	m = c.Add(amp.NewPublish("t", "", 13, amp.Diff, map[string]int{"a": 3}))
+	assert.Equal(t, hash(`{"a":3,"b":2}`), m.Hash)
+
+	// out of order diff, hashes are rebuilt in ts order
+	m = c.Add(amp.NewPublish("t", "", 12, amp.Diff, map[string]interface{}{"b": nil}))
+	assert.Equal(t, hash(`{"a":1}`), m.Hash)
+	msgs := c.Current()
+	assert.Len(t, msgs, 4)
+	assert.Equal(t, hash(`{"a":3}`), msgs[3].Hash)
+
+	// replay keeps hash
+	assert.Equal(t, msgs[3].Hash, msgs[3].AsReplay().Hash)
+}
+
+func TestFullDiffCacheSameTs(t *testing.T) {
+	newCache := func(sequential bool) *fullDiffCache {
+		c := newFullDiffCache()
+		c.sequential = sequential
+		c.Add(&amp.Msg{Ts: 9, UpdateType: amp.Diff})
+		c.Add(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+		c.Add(&amp.Msg{Ts: 10, UpdateType: amp.Diff})
+		c.Add(&amp.Msg{Ts: 11, UpdateType: amp.Diff})
+		return c
+	}
+	d10 := &amp.Msg{Ts: 10, UpdateType: amp.Diff}
+
+	// full subsumes diff with the same ts
+	c := newCache(false)
+	msgs := c.Find(0)
+	assert.Len(t, msgs, 2)
+	assert.True(t, msgs[0].IsFull())
+	assert.Equal(t, int64(11), msgs[1].Ts)
+	msgs = c.Find(10)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, int64(11), msgs[0].Ts)
+	assert.Equal(t, sendNothing, c.FindFor(10, d10))
+
+	// diff with the same ts is applied after full
+	c = newCache(true)
+	msgs = c.Find(0)
+	assert.Len(t, msgs, 3)
+	assert.True(t, msgs[0].IsFull())
+	assert.Equal(t, int64(10), msgs[1].Ts)
+	assert.False(t, msgs[1].IsFull())
+	assert.Equal(t, int64(11), msgs[2].Ts)
+	// subscriber positioned at full gets the diff with the same ts,
+	// on subscribe and live
+	msgs = c.Find(10)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, int64(10), msgs[0].Ts)
+	assert.False(t, msgs[0].IsFull())
+	assert.Equal(t, int64(11), msgs[1].Ts)
+	assert.Equal(t, sendMsg, c.FindFor(10, d10))
+	assert.Equal(t, sendNothing, c.FindFor(10, d10.AsReplay()))
+}
+
+func TestFullDiffCacheFindMetric(t *testing.T) {
+	counters := make(map[string]int)
+	prev := metric.Counter
+	metric.Counter = func(s string, i ...int) { counters[s]++ }
+	defer func() { metric.Counter = prev }()
+
+	c := newFullDiffCache()
+	c.Find(0)
+	c.Add(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+	c.Add(&amp.Msg{Ts: 11, UpdateType: amp.Diff})
+	c.Add(&amp.Msg{Ts: 12, UpdateType: amp.Diff})
+	c.Find(0)
+	c.Find(11)
+	c.Find(12)
+	c.Find(13)
+
+	assert.Equal(t, 1, counters["broker.cache.no_full"])
+	assert.Equal(t, 2, counters["broker.cache.diff_hit"])
+	assert.Equal(t, 2, counters["broker.cache.full_fallback"])
+}
+
+func TestFullDiffCacheConcurrent(t *testing.T) {
+	c := newFullDiffCache()
+	c.Add(&amp.Msg{Ts: 1, UpdateType: amp.Full})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 500; i++ {
+				c.Add(&amp.Msg{Ts: int64(2 + r.Intn(1000)), UpdateType: amp.Diff})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				for _, m := range c.Find(int64(i)) {
+					assert.NotNil(t, m)
+				}
+				c.Current()
+				c.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// diffs are sorted without duplicates
+	ms := c.DiffsAfter(0)
+	assert.NotEmpty(t, ms)
+	for i := 1; i < len(ms); i++ {
+		assert.True(t, ms[i-1].Ts < ms[i].Ts)
+	}
+}
+
+func TestFullDiffCacheTrim(t *testing.T) {
+	c := newFullDiffCache()
+	c.Add(amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1}))
+	c.Add(amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"b": 2}))
+	c.Add(amp.NewPublish("t", "", 3, amp.Full, map[string]int{"a": 1, "b": 2}))
+	c.Add(amp.NewPublish("t", "", 4, amp.Diff, map[string]int{"c": 4}))
+	c.Add(amp.NewPublish("t", "", 5, amp.Diff, map[string]int{"a": 5}))
+	size := c.Bytes()
+
+	// diffs before the full are removed
+	assert.Equal(t, 1, c.trim(false))
+	assert.Equal(t, []int64{3, 4, 5}, tsOf(c.Snapshot()))
+	assert.True(t, c.Bytes() < size)
+	assert.Equal(t, 0, c.trim(false))
+
+	// diffs after the full are applied to it
+	assert.Equal(t, 2, c.trim(true))
+	ms := c.Current()
+	assert.Equal(t, []int64{5}, tsOf(ms))
+	assert.True(t, ms[0].IsFull())
+	var body map[string]int
+	assert.Nil(t, ms[0].Unmarshal(&body))
+	assert.Equal(t, map[string]int{"a": 5, "b": 2, "c": 4}, body)
+	assert.Equal(t, ms[0].Size(), int(c.Bytes()))
+
+	// subscriber positioned in trimmed diffs gets current state
+	assert.Equal(t, ms, c.Find(4))
+}
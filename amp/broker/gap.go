@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+// ContiguousTs declares that producers publish diffs with contiguous ts:
+// each diff has ts one greater than the previous message (full or diff).
+// Diff after the hole in the chain, e.g. when diff is dropped between the
+// producer and the broker, marks the topic chain as broken. Subscribers of
+// the broken topic get only the full, not the diffs which can't be applied
+// to it consistently, until the new full heals the chain (or the late diff
+// fills the hole).
+// requestFull, if set, is called in a new goroutine on each detected hole,
+// to ask the producer for the fresh full.
+// Not all topics are contiguous, so detection is off by default.
+func ContiguousTs(requestFull func(topic string)) Option {
+	return func(o *options) {
+		o.contiguous = true
+		o.requestFull = requestFull
+	}
+}
+
+// checkGap marks chain as broken if diff m, appended at the end of
+// the chain, doesn't follow the previous message. Called with lock.
+func (t *fullDiffCache) checkGap(m *amp.Msg) {
+	if !t.contiguous || t.full == nil || !t.afterFull(m) {
+		return
+	}
+	prev := t.full.Ts
+	if n := len(t.diffs); n > 1 && t.afterFull(t.diffs[n-2]) {
+		prev = t.diffs[n-2].Ts
+	}
+	if t.next(prev, m.Ts) {
+		return
+	}
+	t.broken = true
+	if t.onGap != nil {
+		t.onGap(prev, m.Ts)
+	}
+}
+
+// next returns true if ts directly follows prev
+func (t *fullDiffCache) next(prev, ts int64) bool {
+	return ts == prev+1 || (t.sequential && ts == t.full.Ts && prev == t.full.Ts)
+}
+
+// heal rechecks the whole chain after the full, called with lock
+// when the chain is changed other than by appending diff
+func (t *fullDiffCache) heal() {
+	if !t.contiguous || t.full == nil {
+		return
+	}
+	prev := t.full.Ts
+	for _, d := range t.diffs {
+		if !t.afterFull(d) {
+			continue
+		}
+		if !t.next(prev, d.Ts) {
+			t.broken = true
+			return
+		}
+		prev = d.Ts
+	}
+	t.broken = false
+}
+
+// Broken returns true if the diff chain after the full has a hole
+func (t *fullDiffCache) Broken() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.broken
+}
+
+// gapHandler returns cache gap callback of the topic
+func (t *topic) gapHandler() func(prev, ts int64) {
+	name := t.name
+	requestFull := t.opts.requestFull
+	return func(prev, ts int64) {
+		metric.Counter("broker.cache.gap")
+		log.S("topic", name).I("prev", int(prev)).I("ts", int(ts)).Info("diff chain gap")
+		if requestFull != nil {
+			go requestFull(name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFullDiffCacheGap(t *testing.T) {
+	var gaps [][2]int64
+	newCache := func() *fullDiffCache {
+		c := newFullDiffCache()
+		c.contiguous = true
+		c.onGap = func(prev, ts int64) { gaps = append(gaps, [2]int64{prev, ts}) }
+		// diffs before the full are not checked
+		c.Add(&amp.Msg{Ts: 5, UpdateType: amp.Diff})
+		c.Add(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+		c.Add(&amp.Msg{Ts: 11, UpdateType: amp.Diff})
+		c.Add(&amp.Msg{Ts: 12, UpdateType: amp.Diff})
+		return c
+	}
+
+	// contiguous chain
+	c := newCache()
+	assert.False(t, c.Broken())
+	assert.Len(t, gaps, 0)
+	assert.Equal(t, []int64{11, 12}, tsOf(c.Find(10)))
+
+	// diff 13 is lost
+	c.Add(&amp.Msg{Ts: 14, UpdateType: amp.Diff})
+	assert.True(t, c.Broken())
+	assert.Equal(t, [][2]int64{{12, 14}}, gaps)
+	assert.Equal(t, []int64{10}, tsOf(c.Find(11)))
+	assert.Equal(t, []int64{10}, tsOf(c.Find(0)))
+	assert.Equal(t, []int64{10}, tsOf(c.Current()))
+	// contiguous after the hole, no new gap
+	c.Add(&amp.Msg{Ts: 15, UpdateType: amp.Diff})
+	assert.True(t, c.Broken())
+	assert.Len(t, gaps, 1)
+
+	// late diff fills the hole
+	c.Add(&amp.Msg{Ts: 13, UpdateType: amp.Diff})
+	assert.False(t, c.Broken())
+	assert.Equal(t, []int64{10, 11, 12, 13, 14, 15}, tsOf(c.Current()))
+
+	// new full heals the chain
+	gaps = nil
+	c = newCache()
+	c.Add(&amp.Msg{Ts: 20, UpdateType: amp.Diff})
+	assert.True(t, c.Broken())
+	c.Add(&amp.Msg{Ts: 20, UpdateType: amp.Full})
+	assert.False(t, c.Broken())
+	c.Add(&amp.Msg{Ts: 21, UpdateType: amp.Diff})
+	assert.False(t, c.Broken())
+	assert.Equal(t, []int64{20, 21}, tsOf(c.Find(0)))
+	assert.Len(t, gaps, 1)
+
+	// first diff after the full, but not the next one
+	c = newCache()
+	c.Add(&amp.Msg{Ts: 30, UpdateType: amp.Full})
+	c.Add(&amp.Msg{Ts: 32, UpdateType: amp.Diff})
+	assert.True(t, c.Broken())
+	assert.Equal(t, [2]int64{30, 32}, gaps[len(gaps)-1])
+
+	// diff with the full ts in sequential mode
+	c = newCache()
+	c.sequential = true
+	c.Add(&amp.Msg{Ts: 40, UpdateType: amp.Full})
+	c.Add(&amp.Msg{Ts: 40, UpdateType: amp.Diff})
+	c.Add(&amp.Msg{Ts: 41, UpdateType: amp.Diff})
+	assert.False(t, c.Broken())
+
+	// detection is off by default
+	c = newFullDiffCache()
+	c.Add(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+	c.Add(&amp.Msg{Ts: 12, UpdateType: amp.Diff})
+	assert.False(t, c.Broken())
+	assert.Equal(t, []int64{10, 12}, tsOf(c.Find(0)))
+}
+
+func TestContiguousTsRequestsFull(t *testing.T) {
+	requested := make(chan string, 1)
+	s := New(nil, ContiguousTs(func(topic string) { requested <- topic }))
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Diff})
+	assert.Equal(t, "1", <-requested)
+
+	c := &testConsumer{}
+	s.Subscribe(c, map[string]int64{"1": 2})
+	s.wait("1")
+	assert.Equal(t, []int64{1}, tsOf(c.messages))
+}
+
+func TestContiguousTsPartitions(t *testing.T) {
+	requested := make(chan string, 4)
+	spr := newSpreader("t", 4, ContiguousTs(func(topic string) { requested <- topic }))
+	defer spr.close()
+	c := &testConsumer{}
+	assert.Nil(t, spr.subscribe(c, 0))
+	spr.publish(&amp.Msg{URI: "t", Ts: 1, UpdateType: amp.Full})
+	spr.publish(&amp.Msg{URI: "t", Ts: 2, UpdateType: amp.Diff})
+	// diff 3 is late, diffs after the hole are not sent
+	spr.publish(&amp.Msg{URI: "t", Ts: 4, UpdateType: amp.Diff})
+	spr.publish(&amp.Msg{URI: "t", Ts: 5, UpdateType: amp.Diff})
+	spr.wait()
+	assert.Equal(t, []int64{1, 2}, tsOf(c.messages))
+
+	// late diff heals the chain, current state is sent in burst
+	spr.publish(&amp.Msg{URI: "t", Ts: 3, UpdateType: amp.Diff})
+	spr.wait()
+	assert.Equal(t, []int64{1, 2, 1, 1, 2, 3, 4, 5, 5}, tsOf(c.messages))
+
+	// full is requested once, not by each partition
+	assert.Equal(t, "t", <-requested)
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, requested, 0)
+}
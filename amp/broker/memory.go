@@ -0,0 +1,227 @@
+package broker
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+// MemoryBudget limits approximate bytes held in full/diff caches of all
+// topics (sum of amp.Msg.Size of the cached fulls and diffs).
+// When over budget, oldest diffs are trimmed from the least recently used
+// topics first: diffs before the full (needed only for subscribers positioned
+// in the past), then diffs after the full are applied to it.
+// Subscribers positioned before the trimmed diffs get current state instead.
+// Zero (default) is no limit. Ref: Broker.MemoryUsage
+func MemoryBudget(bytes int64) Option {
+	return func(o *options) {
+		if bytes > 0 {
+			o.memory = &memory{budget: bytes, over: make(chan struct{}, 1)}
+		}
+	}
+}
+
+// withMemory makes topics account their caches to the broker memory,
+// MemoryBudget creates new memory each time options are applied
+func withMemory(m *memory) Option {
+	return func(o *options) {
+		o.memory = m
+	}
+}
+
+// memory accounts bytes of the topic caches, shared by all topics of the broker
+type memory struct {
+	budget int64
+	used   int64
+	over   chan struct{} // signals trim loop that budget is exceeded
+}
+
+// add changes used bytes by delta, signals trim when over budget
+func (m *memory) add(delta int64) {
+	if delta == 0 {
+		return
+	}
+	used := atomic.AddInt64(&m.used, delta)
+	metric.Time("broker.memory.bytes", int(used))
+	if used > m.budget {
+		select {
+		case m.over <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *memory) usage() int64 {
+	return atomic.LoadInt64(&m.used)
+}
+
+func (m *memory) overBudget() bool {
+	return m.usage() > m.budget
+}
+
+// MemoryUsage returns approximate bytes held in topic caches.
+// Returns zero if MemoryBudget is not set.
+func (s *Broker) MemoryUsage() int64 {
+	if s.memory == nil {
+		return 0
+	}
+	return s.memory.usage()
+}
+
+// memoryLoop trims topic caches when memory is over budget
+func (s *Broker) memoryLoop() {
+	for {
+		select {
+		case <-s.memory.over:
+		case <-s.closed:
+			return
+		}
+		s.trim()
+	}
+}
+
+// trim trims caches of the least recently used topics until under budget
+func (s *Broker) trim() {
+	var sprs []*spreader
+	done := make(chan struct{})
+	select {
+	case s.loopWork <- func() {
+		for _, spr := range s.spreaders {
+			sprs = append(sprs, spr)
+		}
+		sort.Slice(sprs, func(i, j int) bool {
+			return sprs[i].usedAt.Before(sprs[j].usedAt)
+		})
+		close(done)
+	}:
+	case <-s.closed:
+		return
+	}
+	<-done
+	for _, fold := range []bool{false, true} {
+		for _, spr := range sprs {
+			if !s.memory.overBudget() {
+				return
+			}
+			for _, t := range spr.topics {
+				t.trim(fold)
+			}
+		}
+	}
+	if s.memory.overBudget() {
+		log.I("used", int(s.memory.usage())).I("budget", int(s.memory.budget)).Info("memory over budget after trim")
+	}
+}
+
+// trim removes diffs before the full from the cache,
+// with fold also applies diffs after the full to it
+func (t *topic) trim(fold bool) {
+	done := make(chan struct{})
+	f := func() {
+		defer close(done)
+		c, ok := t.cache.(*fullDiffCache)
+		if !ok {
+			return
+		}
+		if n := c.trim(fold); n > 0 {
+			metric.Counter("broker.memory.trimmed", n)
+			t.account()
+		}
+	}
+	select {
+	case t.loopWork <- f:
+	case <-t.closed:
+		return
+	}
+	<-done
+}
+
+// account reports change of the cache size to the MemoryBudget.
+// Topics of the spreader have the same cache, only one of them accounts it.
+func (t *topic) account() {
+	if t.opts.memory == nil || !t.primary {
+		return
+	}
+	var n int64
+	if c, ok := t.cache.(*fullDiffCache); ok {
+		n = c.Bytes()
+	}
+	t.opts.memory.add(n - t.bytes)
+	t.bytes = n
+}
+
+// release returns topic cache bytes to the MemoryBudget on close
+func (t *topic) release() {
+	if t.opts.memory == nil {
+		return
+	}
+	t.opts.memory.add(-t.bytes)
+	t.bytes = 0
+}
+
+// Bytes returns size of the cached full and diffs
+func (t *fullDiffCache) Bytes() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.bytes
+}
+
+// size sums size of the cached full and diffs, called with lock
+func (t *fullDiffCache) size() int64 {
+	var n int64
+	if t.full != nil {
+		n += int64(t.full.Size())
+	}
+	for _, d := range t.diffs {
+		n += int64(d.Size())
+	}
+	return n
+}
+
+// trim removes diffs which are not part of the current state.
+// With fold diffs after the full are applied to it, so only the full remains.
+// Returns number of removed diffs.
+func (t *fullDiffCache) trim(fold bool) int {
+	t.Lock()
+	defer t.Unlock()
+	if t.full == nil {
+		return 0
+	}
+	defer func() { t.bytes = t.size() }()
+	var after []*amp.Msg
+	for _, d := range t.diffs {
+		if t.afterFull(d) {
+			after = append(after, d)
+			continue
+		}
+		t.evict(d)
+	}
+	n := len(t.diffs) - len(after)
+	t.diffs = after
+	if fold && len(after) > 0 {
+		full := t.full
+		for _, d := range after {
+			f, err := amp.Apply(full, d)
+			if err != nil {
+				log.S("uri", d.URI).Error(err)
+				return n
+			}
+			full = f
+		}
+		t.full = full
+		for _, d := range after {
+			t.evict(d)
+		}
+		t.diffs = make([]*amp.Msg, 0)
+		n += len(after)
+		if t.hashState {
+			t.rehash(full)
+		}
+	}
+	if n > 0 {
+		t.current = nil
+	}
+	return n
+}
@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// IDGenerator returns unique message id, ref: MsgIDs.
+// It is called concurrently from different topics.
+type IDGenerator func() string
+
+// CounterIDs returns generator of the monotonic counter ids
+// with prefix, e.g. instance name when ids of more brokers are traced.
+func CounterIDs(prefix string) IDGenerator {
+	var n uint64
+	return func() string {
+		return prefix + strconv.FormatUint(atomic.AddUint64(&n, 1), 36)
+	}
+}
+
+// MsgIDs sets amp.Msg.ID of the published message without one.
+// Id is set before the message is cached, so it is the same in the live
+// message, replay, and for all subscribers.
+// Nil gen uses CounterIDs without prefix.
+// Message is modified in place.
+func MsgIDs(gen IDGenerator) Option {
+	if gen == nil {
+		gen = CounterIDs("")
+	}
+	return func(o *options) {
+		o.msgIDs = gen
+	}
+}
+
+// stampID sets id on the message without one, if MsgIDs is set
+func (spr *spreader) stampID(m *amp.Msg) {
+	if spr.opts.msgIDs != nil && m.ID == "" {
+		m.ID = spr.opts.msgIDs()
+	}
+}
@@ -0,0 +1,252 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// ErrInFlightLimit is returned from publish when topic queue is full
+// and RejectOverLimit option is set.
+var ErrInFlightLimit = errors.New("too many messages in flight")
+
+const defaultMaxInFlight = 128
+
+// options are shared by broker, spreaders and topics
+type options struct {
+	coalesceWindow    time.Duration
+	idempotencyWindow time.Duration
+	maxInFlight       int
+	rejectOverLimit   bool
+	stateHash         bool
+	sameTs            SameTsMode
+	contiguous        bool               // ref: ContiguousTs
+	requestFull       func(topic string) // ref: ContiguousTs
+	maxMsgSize        int
+	archive           Archive
+	positions         PositionStore
+	middleware        []Middleware
+	autoTs            bool
+	sendTimeout       time.Duration
+	clock             Clock
+	maxTopics         int
+	topicLimit        TopicLimitPolicy
+	maxBacklog        int
+	backlogAction     BacklogAction
+	msgIDs            IDGenerator
+	slowBacklog       int
+	overflow          OverflowPolicy
+	topicOverflow     map[string]OverflowPolicy
+	traceRate         float64
+	trace             TraceFunc
+	store             Store // ref: PersistFulls, PersistStore
+	persistDiffs      bool
+	persistEvery      time.Duration
+	topicPersistEvery map[string]time.Duration
+	memory            *memory
+	acks              *ackWaiters // PublishSync calls of the broker
+	// onEvict is called when topic evicts consumer, ref: Broker.unsubscribeEvicted
+	onEvict func(name string, c amp.Sender)
+}
+
+// Option is type for option implementation
+type Option func(o *options)
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		maxInFlight: defaultMaxInFlight,
+		clock:       realClock{},
+	}
+	for _, fn := range opts {
+		fn(o)
+	}
+	return o
+}
+
+// CoalesceWindow sets duration in which diffs are accumulated
+// and merged into a single diff before publishing.
+// Full flushes the window immediately.
+// Zero (default) disables coalescing.
+func CoalesceWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.coalesceWindow = d
+	}
+}
+
+// IdempotencyWindow sets duration for which idempotency keys (amp.Msg.Key)
+// are remembered. Publish with the key seen in the window is dropped.
+// Messages without key are not affected.
+// Zero (default) disables deduplication.
+func IdempotencyWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.idempotencyWindow = d
+	}
+}
+
+// MaxInFlight sets number of messages which are waiting in topic queue
+// to be delivered to subscribers. When limit is reached publish blocks,
+// or returns ErrInFlightLimit if RejectOverLimit is set.
+// Default is 128.
+func MaxInFlight(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxInFlight = n
+		}
+	}
+}
+
+// RejectOverLimit makes publish return ErrInFlightLimit instead of blocking
+// when MaxInFlight is reached. Producer gets the error from PublishWait,
+// Publish only logs it.
+func RejectOverLimit() Option {
+	return func(o *options) {
+		o.rejectOverLimit = true
+	}
+}
+
+// StateHash sets amp.Msg.Hash of full and diff messages
+// to the hash of the topic state after applying the message.
+// Client can compare it with the hash of its state and resync on mismatch.
+// Ref: amp.Msg.BodyHash
+func StateHash() Option {
+	return func(o *options) {
+		o.stateHash = true
+	}
+}
+
+// MaxMsgSize sets limit of the message size (amp.Msg.Size).
+// Publish of the larger message returns ErrMsgTooLarge, message
+// doesn't reach topic cache or subscribers.
+// Zero (default) is no limit.
+func MaxMsgSize(n int) Option {
+	return func(o *options) {
+		o.maxMsgSize = n
+	}
+}
+
+// ReplayArchive sets archive for subscribers positioned before the oldest
+// diff in topic cache. Instead of current state they get archived diffs
+// followed by the cached ones.
+func ReplayArchive(a Archive) Option {
+	return func(o *options) {
+		o.archive = a
+	}
+}
+
+// Positions sets store for client positions used by Ack and SubscribeResume
+func Positions(store PositionStore) Option {
+	return func(o *options) {
+		o.positions = store
+	}
+}
+
+// Middleware intercepts published message before it is cached and sent
+// to subscribers. Returned message replaces the published one,
+// error aborts the publish. Nil message without error drops it.
+type Middleware func(*amp.Msg) (*amp.Msg, error)
+
+// PublishMiddleware appends middleware to the chain applied in order
+// on each publish.
+func PublishMiddleware(mw ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+// AutoTs sets Ts of the published message without one (Ts == 0)
+// to the current time in unix milliseconds, or to the last ts of the topic
+// plus one if that is not greater. Timestamps assigned to the topic
+// are strictly increasing.
+// Message is modified in place.
+func AutoTs() Option {
+	return func(o *options) {
+		o.autoTs = true
+	}
+}
+
+// SendTimeout bounds single delivery to the subscriber. Subscriber whose
+// Send lasts longer is evicted from the topic, and doesn't get any more
+// messages, so it can't block delivery to others. Its blocked Send is
+// left to finish in the background.
+// Zero (default) waits for Send without limit.
+func SendTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.sendTimeout = d
+	}
+}
+
+// SameTsMode defines meaning of the diff with the same ts as the full
+type SameTsMode uint8
+
+const (
+	// SameTsSubsume full already contains changes of the diff with the same ts.
+	// Diff is not part of the current state (full and diffs after it)
+	// and it is not sent to the subscriber positioned at full ts.
+	SameTsSubsume SameTsMode = iota
+	// SameTsSequential diff with the same ts is applied after the full.
+	// Current state is full followed by that diff.
+	SameTsSequential
+)
+
+// SameTs sets handling of the diff published with the same ts as the full.
+// Default is SameTsSubsume.
+func SameTs(mode SameTsMode) Option {
+	return func(o *options) {
+		o.sameTs = mode
+	}
+}
+
+// TopicLimitPolicy defines what happens when new topic would exceed MaxTopics
+type TopicLimitPolicy uint8
+
+const (
+	// TopicLimitReject fails publish and subscribe of the new topic
+	// with ErrTooManyTopics.
+	TopicLimitReject TopicLimitPolicy = iota
+	// TopicLimitEvictIdle closes the least recently used topic without
+	// subscribers to make room for the new one. If there is no such topic
+	// new one is rejected with ErrTooManyTopics.
+	TopicLimitEvictIdle
+)
+
+// MaxTopics limits number of topics in the broker.
+// Zero (default) is no limit.
+func MaxTopics(n int, policy TopicLimitPolicy) Option {
+	return func(o *options) {
+		o.maxTopics = n
+		o.topicLimit = policy
+	}
+}
+
+// SlowBacklog sets warning threshold of the subscriber send queue depth,
+// below MaxBacklog. Subscriber which implements amp.SlowConsumer gets
+// SlowWarning when its backlog crosses it, and SlowRecovered when it is
+// back under it, so it can slow down or resync before eviction.
+// Zero (default) disables warnings.
+func SlowBacklog(n int) Option {
+	return func(o *options) {
+		o.slowBacklog = n
+	}
+}
+
+// BacklogAction defines what happens to the subscriber over MaxBacklog
+type BacklogAction uint8
+
+const (
+	// BacklogWarn only logs and counts broker.subscriber.backlog_exceeded.
+	BacklogWarn BacklogAction = iota
+	// BacklogEvict also evicts subscriber from the topic, as on SendTimeout.
+	BacklogEvict
+)
+
+// MaxBacklog caps send queue depth of the subscriber which reports it
+// (Backlog() int method, e.g. session). Depth is checked after each send,
+// and recorded in broker.subscriber.backlog metric.
+// Zero (default) is no cap.
+func MaxBacklog(n int, action BacklogAction) Option {
+	return func(o *options) {
+		o.maxBacklog = n
+		o.backlogAction = action
+	}
+}
@@ -0,0 +1,117 @@
+package broker
+
+import "github.com/minus5/svckit/amp"
+
+// OverflowPolicy defines publish to the topic whose queue (MaxInFlight) is full
+// because consumers are slow.
+//
+// Dropping diff (or full) would break the chain of diffs in the topic cache
+// and with subscribers. So after a dropped diff or full all diffs of the topic
+// are dropped until the next full, which repairs the state of the cache and
+// of the subscribers (they get it as on any other full). Until then they
+// have consistent but stale state. Other messages (events, appends) are
+// dropped alone.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock publish waits until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest published message is dropped.
+	OverflowDropNewest
+	// OverflowDropOldest oldest queued message is dropped to make room
+	// for the published one.
+	OverflowDropOldest
+)
+
+// Overflow sets overflow policy of all topics. Default is OverflowBlock.
+// RejectOverLimit takes precedence over it.
+func Overflow(p OverflowPolicy) Option {
+	return func(o *options) {
+		o.overflow = p
+	}
+}
+
+// TopicOverflow sets overflow policy of the topic, overriding Overflow.
+func TopicOverflow(topic string, p OverflowPolicy) Option {
+	return func(o *options) {
+		if o.topicOverflow == nil {
+			o.topicOverflow = make(map[string]OverflowPolicy)
+		}
+		o.topicOverflow[topic] = p
+	}
+}
+
+// overflowPolicy returns policy of the topic
+func (o *options) overflowPolicy(topic string) OverflowPolicy {
+	if p, ok := o.topicOverflow[topic]; ok {
+		return p
+	}
+	return o.overflow
+}
+
+// publishDrop queues message by the drop policy, it never blocks.
+// Called from the spreader under its lock, so there is a single producer.
+func (t *topic) publishDrop(m *amp.Msg) {
+	for {
+		if t.gapped(m) {
+			t.drop(m)
+			return
+		}
+		select {
+		case t.messages <- m:
+			return
+		default:
+		}
+		if t.overflow == OverflowDropNewest {
+			t.drop(m)
+			return
+		}
+		t.dropOldest()
+	}
+}
+
+// dropOldest drops the oldest queued message and queued diffs broken by it.
+// Topic loop consumes queue concurrently, it gets messages older than
+// the remaining ones, so order is preserved.
+func (t *topic) dropOldest() {
+	var queued []*amp.Msg
+	for len(queued) < cap(t.messages) {
+		select {
+		case m := <-t.messages:
+			queued = append(queued, m)
+			continue
+		default:
+		}
+		break
+	}
+	if len(queued) == 0 {
+		return // topic loop made room
+	}
+	t.drop(queued[0])
+	for _, m := range queued[1:] {
+		if t.gapped(m) {
+			t.drop(m)
+			continue
+		}
+		t.messages <- m
+	}
+}
+
+// gapped returns true for diff after the dropped message, before the next full
+func (t *topic) gapped(m *amp.Msg) bool {
+	if m.IsFull() && !m.IsReplay() {
+		t.gap = false
+		return false
+	}
+	return t.gap && m.UpdateType == amp.Diff
+}
+
+func (t *topic) drop(m *amp.Msg) {
+	metric.Counter("broker.overflow.dropped")
+	if t.opts.sampled() {
+		t.trace(m, nil, TraceDropped, TraceReasonOverflow)
+	}
+	if m.UpdateType == amp.Diff || m.IsFull() {
+		t.gap = true
+	}
+}
@@ -0,0 +1,113 @@
+package broker
+
+import "github.com/minus5/svckit/amp"
+
+// Pause stops delivery of the topic messages to its subscribers.
+// Subscribers stay subscribed, published fulls and diffs still update
+// the topic cache. Events published while paused are dropped.
+// Returns ErrTopicNotFound if there is no such topic.
+func (s *Broker) Pause(name string) error {
+	return s.pauseTopic(name, true)
+}
+
+// Resume continues delivery of the paused topic. Each subscriber first gets
+// messages it missed while paused (or current state, as on subscribe),
+// then live messages.
+// Returns ErrTopicNotFound if there is no such topic.
+func (s *Broker) Resume(name string) error {
+	return s.pauseTopic(name, false)
+}
+
+func (s *Broker) pauseTopic(name string, pause bool) error {
+	var spr *spreader
+	s.inLoopWait(func() {
+		spr = s.spreaders[name]
+	})
+	if spr == nil {
+		return ErrTopicNotFound
+	}
+	return spr.pause(pause)
+}
+
+func (spr *spreader) pause(pause bool) error {
+	for _, t := range spr.topics {
+		if err := t.pause(pause); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pause sets paused state in the topic loop, on resume
+// consumers get messages after their position
+func (t *topic) pause(pause bool) error {
+	done := make(chan struct{})
+	f := func() {
+		defer close(done)
+		if t.paused == pause {
+			return
+		}
+		t.paused = pause
+		if !pause {
+			t.catchUp()
+		}
+	}
+	select {
+	case t.loopWork <- f:
+	case <-t.closed:
+		return ErrTopicClosed
+	}
+	<-done
+	return nil
+}
+
+// catchUp sends messages cached while paused to each consumer
+func (t *topic) catchUp() {
+	if t.cache == nil {
+		return
+	}
+	for _, c := range t.order() {
+		ts := t.consumers[c]
+		if ts >= t.lastTs {
+			continue
+		}
+		if _, ok := t.fullsOnly[c]; ok {
+			if ms := t.cache.Current(); len(ms) > 0 && ms[0].IsFull() && ms[0].Ts > ts {
+				t.send(c, ms[:1])
+			}
+			continue
+		}
+		if ms := t.filtered(c, t.missed(ts)); len(ms) > 0 {
+			t.send(c, burst(ms))
+		}
+	}
+}
+
+// missed returns messages after ts, without current full if consumer has it
+func (t *topic) missed(ts int64) []*amp.Msg {
+	cur := t.cache.Current()
+	if len(cur) == 0 || !cur[0].IsFull() || ts < cur[0].Ts {
+		return t.cache.Find(ts)
+	}
+	var ms []*amp.Msg
+	for _, m := range cur[1:] {
+		if m.Ts > ts {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// pausedMsg caches message while topic is paused, events are dropped
+func (t *topic) pausedMsg(m *amp.Msg) {
+	if m.UpdateType == amp.Event {
+		metric.Counter("broker.paused.dropped")
+		return
+	}
+	if t.cache == nil {
+		t.cache = t.newCache(m)
+	}
+	t.cache.Add(m)
+	t.account()
+	t.updatedAt = t.opts.clock.Now()
+}
@@ -0,0 +1,295 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+// Persister stores topic state, e.g. mdb.AmpArchive.
+// Use separate store from the ReplayArchive, it holds only fulls.
+type Persister interface {
+	Save(m *amp.Msg) error
+}
+
+// LatestPersister is Persister which replaces older saved fulls of
+// the topic, so the store holds only the latest, e.g. mdb.AmpArchive.
+type LatestPersister interface {
+	SaveLatest(m *amp.Msg) error
+}
+
+// LatestLoader is Persister which loads the latest saved full of the
+// topic, nil if there is none, e.g. mdb.AmpArchive.
+// Restore of the PersistFulls state requires it.
+type LatestLoader interface {
+	LoadLatest(topic string) (*amp.Msg, error)
+}
+
+// ErrNotLoadable is returned from Restore when Persister set by
+// PersistFulls doesn't implement LatestLoader
+var ErrNotLoadable = errors.New("persister can't load saved state")
+
+// fullsStore is Store which only saves fulls to the Persister
+type fullsStore struct {
+	Persister
+}
+
+// SaveFull saves full, replacing the older ones if Persister can
+func (s fullsStore) SaveFull(m *amp.Msg) error {
+	if lp, ok := s.Persister.(LatestPersister); ok {
+		return lp.SaveLatest(m)
+	}
+	return s.Save(m)
+}
+
+// LoadFull loads the latest saved full if Persister can
+func (s fullsStore) LoadFull(topic string) (*amp.Msg, error) {
+	if ll, ok := s.Persister.(LatestLoader); ok {
+		return ll.LoadLatest(topic)
+	}
+	return nil, ErrNotLoadable
+}
+
+func (s fullsStore) AppendDiff(*amp.Msg) error                           { return nil }
+func (s fullsStore) LoadDiffs(string, int64, func(*amp.Msg) error) error { return nil }
+
+// PersistFulls saves topic state to p, so it can be restored after restart
+// from the latest saved full without replaying diffs.
+// With zero every each published full is saved. Otherwise current state
+// (the last full with diffs applied) is saved as full at most once in every,
+// if the topic has changed. Saving is done in the background, when saving
+// is slower than publishing only the latest state is saved.
+// Diffs are never saved. Persister which implements LatestPersister
+// keeps only the latest full of each topic, LatestLoader is needed for Restore.
+func PersistFulls(p Persister, every time.Duration) Option {
+	return func(o *options) {
+		o.store = fullsStore{p}
+		o.persistDiffs = false
+		o.persistEvery = every
+	}
+}
+
+// TopicPersistEvery sets PersistFulls cadence of the topic.
+func TopicPersistEvery(topic string, every time.Duration) Option {
+	return func(o *options) {
+		if o.topicPersistEvery == nil {
+			o.topicPersistEvery = make(map[string]time.Duration)
+		}
+		o.topicPersistEvery[topic] = every
+	}
+}
+
+// persistCadence returns PersistFulls cadence of the topic
+func (o *options) persistCadence(topic string) time.Duration {
+	if d, ok := o.topicPersistEvery[topic]; ok {
+		return d
+	}
+	return o.persistEvery
+}
+
+// persist saves state of the spreader topic
+type persist struct {
+	lock      *sync.Mutex // spreader lock, guards fields below current
+	name      string
+	store     Store
+	diffs     bool // diffs are appended to the store, ref: PersistStore
+	every     time.Duration
+	clock     Clock
+	current   func() []*amp.Msg // current state of the topic, full and diffs
+	savedAt   time.Time
+	lastTs    int64      // ts of the last full or diff
+	savedTs   int64      // ts of the last saved state
+	timer     bool       // save of the changed state is scheduled
+	saveState bool       // loop should save the current state
+	pending   *amp.Msg   // published full waiting for SaveFull
+	queued    []*amp.Msg // diffs waiting for AppendDiff
+	signal    chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newPersist(name string, lock *sync.Mutex, current func() []*amp.Msg, o *options) *persist {
+	p := &persist{
+		lock:    lock,
+		name:    name,
+		store:   o.store,
+		diffs:   o.persistDiffs,
+		every:   o.persistCadence(name),
+		clock:   o.clock,
+		current: current,
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+// persistMsg saves published message or state by the topic cadence.
+// State is not folded here but from the topic cache when it is saved.
+func (spr *spreader) persistMsg(m *amp.Msg) {
+	p := spr.persist
+	if p == nil || (m.UpdateType != amp.Full && m.UpdateType != amp.Diff) {
+		return
+	}
+	if p.diffs && m.UpdateType == amp.Diff && !m.IsReplay() {
+		p.append(m)
+	}
+	if p.every <= 0 {
+		if m.IsFull() && !m.IsReplay() {
+			p.queue(m)
+		}
+		return
+	}
+	if !m.IsFull() && !spr.hasFull {
+		return
+	}
+	if m.Ts > p.lastTs {
+		p.lastTs = m.Ts
+	}
+	p.schedule()
+}
+
+// schedule requests save of the current state now or when every passes
+// from the last save, called with lock
+func (p *persist) schedule() {
+	if p.timer {
+		return
+	}
+	wait := p.every - p.clock.Now().Sub(p.savedAt)
+	if wait <= 0 {
+		p.requestSave(p.clock.Now())
+		return
+	}
+	p.timer = true
+	after, stop := newTimer(p.clock, wait)
+	go func() {
+		select {
+		case <-after:
+		case <-p.done:
+			stop()
+			return
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.timer = false
+		p.requestSave(p.clock.Now())
+	}()
+}
+
+// requestSave wakes up the loop to save the current state
+func (p *persist) requestSave(now time.Time) {
+	p.savedAt = now
+	p.saveState = true
+	p.wake()
+}
+
+// queue replaces pending message and wakes up the loop
+func (p *persist) queue(m *amp.Msg) {
+	p.pending = m
+	p.wake()
+}
+
+func (p *persist) wake() {
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// append queues diff for the store and wakes up the loop
+func (p *persist) append(m *amp.Msg) {
+	p.queued = append(p.queued, m)
+	p.wake()
+}
+
+// close saves the last state and stops the loop, called with spreader lock
+// after the topics are closed, so their caches hold all published messages
+func (p *persist) close() {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	if p.every > 0 {
+		p.saveState = true
+	}
+	close(p.done)
+}
+
+// wait waits for the last save after close
+func (p *persist) wait() {
+	<-p.stopped
+}
+
+func (p *persist) loop() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.signal:
+		case <-p.done:
+			p.flush()
+			return
+		}
+		p.flush()
+	}
+}
+
+// flush appends queued diffs and saves pending message or current state
+func (p *persist) flush() {
+	p.lock.Lock()
+	m := p.pending
+	p.pending = nil
+	diffs := p.queued
+	p.queued = nil
+	saveState := p.saveState && p.lastTs > p.savedTs
+	p.saveState = false
+	p.lock.Unlock()
+	for _, d := range diffs {
+		if err := p.store.AppendDiff(d); err != nil {
+			metric.Counter("broker.persist.failed")
+			log.S("topic", p.name).I("ts", int(d.Ts)).Error(err)
+		}
+	}
+	if m != nil {
+		p.saveFull(m)
+	}
+	if saveState {
+		p.saveCurrent()
+	}
+}
+
+// saveCurrent folds the topic cache into full and saves it if it is newer
+// than the last saved. Cache which is still behind the last published
+// message is saved again after every.
+func (p *persist) saveCurrent() {
+	var st amp.State
+	for _, m := range p.current() {
+		if err := st.Fold(m); err != nil {
+			log.S("topic", p.name).I("ts", int(m.Ts)).Error(err)
+			return
+		}
+	}
+	full := st.Current()
+	p.lock.Lock()
+	if full == nil || full.Ts <= p.savedTs {
+		p.lock.Unlock()
+		return
+	}
+	p.savedTs = full.Ts
+	if p.lastTs > p.savedTs {
+		p.schedule()
+	}
+	p.lock.Unlock()
+	p.saveFull(full)
+}
+
+func (p *persist) saveFull(m *amp.Msg) {
+	if err := p.store.SaveFull(m); err != nil {
+		metric.Counter("broker.persist.failed")
+		log.S("topic", p.name).I("ts", int(m.Ts)).Error(err)
+	}
+}
@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type memPersister struct {
+	saved []*amp.Msg
+	sync.Mutex
+}
+
+func (p *memPersister) Save(m *amp.Msg) error {
+	p.Lock()
+	defer p.Unlock()
+	p.saved = append(p.saved, m)
+	return nil
+}
+
+func (p *memPersister) timestamps() []int64 {
+	p.Lock()
+	defer p.Unlock()
+	var ts []int64
+	for _, m := range p.saved {
+		ts = append(ts, m.Ts)
+	}
+	return ts
+}
+
+// waitSaved waits until n messages are saved
+func (p *memPersister) waitSaved(n int) {
+	for i := 0; i < 1000 && len(p.timestamps()) < n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPersistEveryFull(t *testing.T) {
+	p := &memPersister{}
+	spr := newSpreader("t", 1, PersistFulls(p, 0))
+	spr.publish(amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1}))
+	p.waitSaved(1)
+	spr.publish(amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"b": 2}))
+	spr.publish(amp.NewPublish("t", "", 3, amp.Full, map[string]int{"c": 3}))
+	spr.close()
+	assert.Equal(t, []int64{1, 3}, p.timestamps())
+	for _, m := range p.saved {
+		assert.True(t, m.IsFull())
+	}
+}
+
+func TestPersistInterval(t *testing.T) {
+	p := &memPersister{}
+	clock := newManualClock()
+	spr := newSpreader("t", 1, WithClock(clock), PersistFulls(p, 0), TopicPersistEvery("t", 10*time.Second))
+	// diff before the first full is not saved
+	spr.publish(amp.NewPublish("t", "", 1, amp.Diff, map[string]int{"a": 0}))
+	spr.publish(amp.NewPublish("t", "", 2, amp.Full, map[string]int{"a": 1}))
+	p.waitSaved(1)
+	spr.publish(amp.NewPublish("t", "", 3, amp.Diff, map[string]int{"b": 2}))
+	spr.publish(amp.NewPublish("t", "", 4, amp.Diff, map[string]int{"c": 3}))
+	assert.Equal(t, []int64{2}, p.timestamps())
+
+	clock.Advance(10 * time.Second)
+	p.waitSaved(2)
+	assert.Equal(t, []int64{2, 4}, p.timestamps())
+
+	// close saves the changed state
+	spr.publish(amp.NewPublish("t", "", 5, amp.Diff, map[string]interface{}{"a": nil}))
+	spr.close()
+	assert.Equal(t, []int64{2, 4, 5}, p.timestamps())
+	last := p.saved[2]
+	assert.True(t, last.IsFull())
+	var body map[string]int
+	assert.Nil(t, last.Unmarshal(&body))
+	assert.Equal(t, map[string]int{"b": 2, "c": 3}, body)
+}
+
+// latestPersister keeps only the latest saved full of the topic
+type latestPersister struct {
+	memPersister
+	latest map[string]*amp.Msg
+}
+
+func (p *latestPersister) SaveLatest(m *amp.Msg) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.latest == nil {
+		p.latest = make(map[string]*amp.Msg)
+	}
+	p.latest[m.URI] = m
+	return nil
+}
+
+func (p *latestPersister) LoadLatest(topic string) (*amp.Msg, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.latest[topic], nil
+}
+
+func TestPersistLatest(t *testing.T) {
+	p := &latestPersister{}
+	spr := newSpreader("t", 2, PersistFulls(p, 0))
+	spr.publish(amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1}))
+	spr.publish(amp.NewPublish("t", "", 2, amp.Full, map[string]int{"a": 2}))
+	spr.close()
+	assert.Len(t, p.saved, 0, "older fulls are replaced")
+	assert.Equal(t, int64(2), p.latest["t"].Ts)
+}
+
+func TestPersistCloseStopsTimer(t *testing.T) {
+	p := &memPersister{}
+	clock := newManualClock()
+	spr := newSpreader("t", 2, WithClock(clock), PersistFulls(p, 10*time.Second))
+	spr.publish(amp.NewPublish("t", "", 1, amp.Full, map[string]int{"a": 1}))
+	p.waitSaved(1)
+	spr.publish(amp.NewPublish("t", "", 2, amp.Diff, map[string]int{"b": 2}))
+	spr.close()
+	assert.Equal(t, []int64{1, 2}, p.timestamps())
+
+	// timer goroutine is stopped, firing it saves nothing
+	clock.Advance(10 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, []int64{1, 2}, p.timestamps())
+}
+
+func TestPersistFullsRestore(t *testing.T) {
+	p := &latestPersister{}
+	s := New(nil, PersistFulls(p, 0))
+	s.Publish(amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1}))
+	s.Publish(amp.NewPublish("1", "", 2, amp.Full, map[string]int{"a": 2}))
+	s.wait("1")
+	for i := 0; i < 1000; i++ {
+		if m, _ := p.LoadLatest("1"); m != nil && m.Ts == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s2 := New(nil, PersistFulls(p, 0))
+	assert.Nil(t, s2.Restore("1"))
+	c := &testConsumer{}
+	s2.Subscribe(c, map[string]int64{"1": 0})
+	s2.wait("1")
+	assert.Equal(t, []int64{2}, tsOf(c.messages))
+
+	// nothing saved
+	assert.Nil(t, s2.Restore("2"))
+	// persister can't load
+	assert.Equal(t, ErrNotLoadable, New(nil, PersistFulls(&memPersister{}, 0)).Restore("1"))
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// ErrNoPositionStore is returned from Ack and SubscribeResume when broker
+// is created without Positions option.
+var ErrNoPositionStore = errors.New("position store not set")
+
+// PositionStore persists last processed ts of the client per topic.
+// Implementation should keep the greatest saved ts.
+// Ref: mdb.PositionStore for the mongo backed one.
+type PositionStore interface {
+	Save(clientID, topic string, ts int64) error
+	Load(clientID string) (map[string]int64, error)
+}
+
+// Ack saves ts of the last message of the topic which client has processed.
+// Client should ack periodically, not on every message, each ack is a store write.
+func (s *Broker) Ack(clientID, topic string, ts int64) error {
+	if s.positions == nil {
+		return ErrNoPositionStore
+	}
+	return s.positions.Save(clientID, topic, ts)
+}
+
+// SubscribeResume subscribes client from the acked positions.
+// For topics which client acked after the position in names,
+// subscription starts from the acked ts, so messages after it are
+// replayed (at-least-once delivery). Client could get messages it has
+// already processed and is responsible for skipping those with ts not
+// greater than its last processed.
+func (s *Broker) SubscribeResume(clientID string, c amp.Sender, names map[string]int64) error {
+	if s.positions == nil {
+		return ErrNoPositionStore
+	}
+	acked, err := s.positions.Load(clientID)
+	if err != nil {
+		return err
+	}
+	resumed := copyMap(names)
+	for name, ts := range resumed {
+		if a, ok := acked[name]; ok && a > ts {
+			resumed[name] = a
+		}
+	}
+	return s.SubscribeClient(clientID, c, resumed)
+}
+
+// MemPositionStore keeps positions in memory, they don't survive restart
+type MemPositionStore struct {
+	m map[string]map[string]int64
+	sync.Mutex
+}
+
+// NewMemPositionStore creates empty store
+func NewMemPositionStore() *MemPositionStore {
+	return &MemPositionStore{m: make(map[string]map[string]int64)}
+}
+
+// Save implements PositionStore
+func (p *MemPositionStore) Save(clientID, topic string, ts int64) error {
+	p.Lock()
+	defer p.Unlock()
+	cp, ok := p.m[clientID]
+	if !ok {
+		cp = make(map[string]int64)
+		p.m[clientID] = cp
+	}
+	if ts > cp[topic] {
+		cp[topic] = ts
+	}
+	return nil
+}
+
+// Load implements PositionStore
+func (p *MemPositionStore) Load(clientID string) (map[string]int64, error) {
+	p.Lock()
+	defer p.Unlock()
+	return copyMap(p.m[clientID]), nil
+}
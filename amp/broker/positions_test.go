@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemPositionStore(t *testing.T) {
+	p := NewMemPositionStore()
+	p.Save("c1", "1", 105)
+	p.Save("c1", "1", 101)
+	p.Save("c1", "2", 7)
+	ps, err := p.Load("c1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"1": 105, "2": 7}, ps)
+	ps, err = p.Load("c2")
+	assert.Nil(t, err)
+	assert.Len(t, ps, 0)
+}
+
+func TestSubscribeResume(t *testing.T) {
+	s := New(nil)
+	c := &testConsumer{}
+	assert.Equal(t, ErrNoPositionStore, s.Ack("c1", "1", 105))
+	assert.Equal(t, ErrNoPositionStore, s.SubscribeResume("c1", c, map[string]int64{"1": 0}))
+
+	s = New(nil, Positions(NewMemPositionStore()))
+	m1 := &amp.Msg{URI: "1", Ts: 101, UpdateType: amp.Full}
+	m2 := &amp.Msg{URI: "1", Ts: 105, UpdateType: amp.Diff}
+	m3 := &amp.Msg{URI: "1", Ts: 107, UpdateType: amp.Diff}
+	s.Publish(m1)
+	s.Publish(m2)
+	s.Publish(m3)
+	s.wait("1")
+
+	assert.Nil(t, s.Ack("c1", "1", 105))
+	// client reconnects from the start, gets messages after acked position
+	assert.Nil(t, s.SubscribeResume("c1", c, map[string]int64{"1": 0}))
+	s.wait("1")
+	c.Lock()
+	assert.Equal(t, []*amp.Msg{m3.AsReplay()}, c.messages)
+	c.Unlock()
+}
@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// ackWaiter waits for acks of the message published with PublishSync
+type ackWaiter struct {
+	uri      string
+	ts       int64
+	expected map[amp.Sender]struct{} // subscribed at the call, not confirmed
+	pending  map[amp.Sender]struct{} // message is sent to, not confirmed
+	acked    chan struct{}           // signalled when pending gets empty
+}
+
+// ackWaiters are PublishSync calls in progress
+type ackWaiters struct {
+	m map[*ackWaiter]struct{}
+	n int32 // len(m), checked without lock on each send
+	sync.Mutex
+}
+
+func (a *ackWaiters) add(w *ackWaiter) {
+	a.Lock()
+	defer a.Unlock()
+	if a.m == nil {
+		a.m = make(map[*ackWaiter]struct{})
+	}
+	a.m[w] = struct{}{}
+	atomic.StoreInt32(&a.n, int32(len(a.m)))
+}
+
+func (a *ackWaiters) remove(w *ackWaiter) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.m, w)
+	atomic.StoreInt32(&a.n, int32(len(a.m)))
+}
+
+// sent records that messages ms of the topic are sent to consumer c,
+// called by the topic before delivery. Consumer is waited for if ms
+// include the waited message (or a newer one).
+func (a *ackWaiters) sent(topic string, c amp.Sender, ms []*amp.Msg) {
+	if a == nil || atomic.LoadInt32(&a.n) == 0 {
+		return
+	}
+	ts := ms[len(ms)-1].Ts
+	a.Lock()
+	defer a.Unlock()
+	for w := range a.m {
+		if w.uri != topic || ts < w.ts {
+			continue
+		}
+		if _, ok := w.expected[c]; ok {
+			w.pending[c] = struct{}{}
+		}
+	}
+}
+
+// withAcks makes topics report sends to PublishSync calls
+func withAcks(a *ackWaiters) Option {
+	return func(o *options) {
+		o.acks = a
+	}
+}
+
+// PublishSync publishes message and waits until consumers subscribed
+// to the message topic at the time of the call, to which the message is
+// sent, confirm it (ref: Confirm). Consumers which don't get the message,
+// e.g. fulls only or filtered ones, are not waited for; nor anyone if the
+// message is dropped. Rejected message returns publish error immediately.
+// Returns consumers which haven't confirmed before timeout
+// and ErrAckTimeout. If the message isn't sent to all of them before
+// timeout (consumer blocks the topic), all not confirmed are returned.
+// Consumers subscribed during the wait are not waited for,
+// unsubscribed ones are still.
+// Message should have Ts, confirmation is by ts.
+func (s *Broker) PublishSync(m *amp.Msg, timeout time.Duration) ([]amp.Subscriber, error) {
+	w := &ackWaiter{
+		uri:      m.URI,
+		ts:       m.Ts,
+		expected: make(map[amp.Sender]struct{}),
+		pending:  make(map[amp.Sender]struct{}),
+		acked:    make(chan struct{}, 1),
+	}
+	s.inLoopWait(func() {
+		for c, names := range s.consumerNames {
+			if _, ok := names[m.URI]; ok {
+				w.expected[c] = struct{}{}
+			}
+		}
+	})
+	if len(w.expected) == 0 {
+		return nil, s.PublishWait(m)
+	}
+	s.acks.add(w)
+	defer s.acks.remove(w)
+	if err := s.PublishWait(m); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// when topic has handled the message all consumers it is sent to are pending
+	var spr *spreader
+	s.inLoopWait(func() { spr = s.spreaders[m.URI] })
+	if spr != nil {
+		if err := spr.waitContext(ctx); err != nil {
+			return s.laggards(w.expected), ErrAckTimeout
+		}
+	}
+	for {
+		s.acks.Lock()
+		n := len(w.pending)
+		s.acks.Unlock()
+		if n == 0 {
+			return nil, nil
+		}
+		select {
+		case <-w.acked:
+		case <-ctx.Done():
+			return s.laggards(w.pending), ErrAckTimeout
+		}
+	}
+}
+
+// laggards lists consumers of the waiter set cs
+func (s *Broker) laggards(cs map[amp.Sender]struct{}) []amp.Subscriber {
+	s.acks.Lock()
+	defer s.acks.Unlock()
+	var ls []amp.Subscriber
+	for c := range cs {
+		ls = append(ls, c)
+	}
+	return ls
+}
+
+// Confirm is called by consumer when it has processed messages up to ts.
+// It releases PublishSync calls waiting for that consumer.
+func (s *Broker) Confirm(c amp.Sender, ts int64) {
+	s.acks.Lock()
+	defer s.acks.Unlock()
+	for w := range s.acks.m {
+		if ts < w.ts {
+			continue
+		}
+		delete(w.expected, c)
+		if _, ok := w.pending[c]; !ok {
+			continue
+		}
+		delete(w.pending, c)
+		if len(w.pending) == 0 {
+			select {
+			case w.acked <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
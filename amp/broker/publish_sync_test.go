@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+// confirmingConsumer confirms each received message
+type confirmingConsumer struct {
+	testConsumer
+	b *Broker
+}
+
+func (c *confirmingConsumer) SendMsgs(ms []*amp.Msg) {
+	c.testConsumer.SendMsgs(ms)
+	c.b.Confirm(c, ms[len(ms)-1].Ts)
+}
+
+func (c *confirmingConsumer) Send(m *amp.Msg) {
+	c.SendMsgs([]*amp.Msg{m})
+}
+
+func TestPublishSync(t *testing.T) {
+	s := New(nil)
+	// without subscribers
+	laggards, err := s.PublishSync(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, laggards, 0)
+
+	c1 := &confirmingConsumer{b: s}
+	c2 := &confirmingConsumer{b: s}
+	s.Subscribe(c1, map[string]int64{"1": 0})
+	s.Subscribe(c2, map[string]int64{"1": 0})
+	laggards, err = s.PublishSync(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Event}, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, laggards, 0)
+
+	silent := &testConsumer{}
+	s.Subscribe(silent, map[string]int64{"1": 0})
+	laggards, err = s.PublishSync(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Event}, 10*time.Millisecond)
+	assert.Equal(t, ErrAckTimeout, err)
+	assert.Equal(t, []amp.Subscriber{silent}, laggards)
+}
+
+func TestPublishSyncRecipients(t *testing.T) {
+	s := New(nil, IdempotencyWindow(time.Minute))
+	c := &confirmingConsumer{b: s}
+	s.Subscribe(c, map[string]int64{"1": 0})
+	// never confirm, but don't get the diff
+	s.SubscribeFullsOnly(&testConsumer{}, map[string]int64{"1": 0})
+	none := func(m *amp.Msg) bool { return false }
+	s.SubscribeFilter(&testConsumer{}, map[string]int64{"1": 0}, none)
+
+	laggards, err := s.PublishSync(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full}, 10*time.Millisecond)
+	assert.Equal(t, ErrAckTimeout, err)
+	assert.Len(t, laggards, 2)
+
+	start := time.Now()
+	laggards, err = s.PublishSync(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff, Key: "a"}, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, laggards, 0)
+
+	// rejected
+	_, err = s.PublishSync(&amp.Msg{URI: "1", Ts: 0, UpdateType: amp.Full}, time.Second)
+	assert.Equal(t, ErrStaleFull, err)
+	// dropped as duplicate
+	laggards, err = s.PublishSync(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff, Key: "a"}, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, laggards, 0)
+	assert.True(t, time.Since(start) < time.Second)
+}
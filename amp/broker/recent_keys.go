@@ -0,0 +1,40 @@
+package broker
+
+import "time"
+
+// recentKeys remembers keys seen in the last window
+type recentKeys struct {
+	window time.Duration
+	seen   map[string]time.Time
+	order  []string // keys in order of arrival, for expiration
+}
+
+func newRecentKeys(window time.Duration) *recentKeys {
+	return &recentKeys{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// seenBefore returns true if key is already seen in the window,
+// otherwise remembers the key.
+func (r *recentKeys) seenBefore(key string, now time.Time) bool {
+	r.expire(now)
+	if _, ok := r.seen[key]; ok {
+		return true
+	}
+	r.seen[key] = now
+	r.order = append(r.order, key)
+	return false
+}
+
+func (r *recentKeys) expire(now time.Time) {
+	for len(r.order) > 0 {
+		k := r.order[0]
+		if now.Sub(r.seen[k]) < r.window {
+			return
+		}
+		delete(r.seen, k)
+		r.order = r.order[1:]
+	}
+}
@@ -0,0 +1,25 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentKeys(t *testing.T) {
+	r := newRecentKeys(time.Second)
+	now := time.Now()
+	assert.False(t, r.seenBefore("a", now))
+	assert.False(t, r.seenBefore("b", now.Add(500*time.Millisecond)))
+	assert.True(t, r.seenBefore("a", now.Add(900*time.Millisecond)))
+	assert.True(t, r.seenBefore("b", now.Add(time.Second)))
+
+	// a is expired, b is still in the window
+	assert.False(t, r.seenBefore("a", now.Add(1100*time.Millisecond)))
+	assert.True(t, r.seenBefore("b", now.Add(1400*time.Millisecond)))
+	assert.Len(t, r.order, 2)
+
+	assert.False(t, r.seenBefore("c", now.Add(3*time.Second)))
+	assert.Len(t, r.order, 1)
+}
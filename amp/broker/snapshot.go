@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// ErrTopicNotFound is returned from Export for topic which broker doesn't have
+var ErrTopicNotFound = errors.New("topic not found")
+
+// ErrInvalidSnapshot is returned from Import when snapshot can't be decoded
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// maxSnapshotMsgSize guards Import against corrupted length prefix
+const maxSnapshotMsgSize = 64 << 20
+
+// Export writes current state of the topic cache (full and diffs) to w.
+// Subscribers and their positions are not part of the snapshot.
+func (spr *spreader) Export(w io.Writer) error {
+	ms, err := spr.export()
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, ms)
+}
+
+// Import replaces topic cache with the snapshot made by Export.
+// Existing subscribers are not notified, intended for the standby broker
+// before clients connect to it.
+func (spr *spreader) Import(r io.Reader) error {
+	ms, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	return spr.load(ms)
+}
+
+func (spr *spreader) export() ([]*amp.Msg, error) {
+	return spr.topics[0].export()
+}
+
+func (spr *spreader) load(ms []*amp.Msg) error {
+	spr.lock.Lock()
+	for _, m := range ms {
+		if m.IsFull() {
+			spr.hasFull = true
+			if m.Ts > spr.fullTs {
+				spr.fullTs = m.Ts
+			}
+		}
+		if m.Ts > spr.lastTs {
+			spr.lastTs = m.Ts
+		}
+	}
+	spr.lock.Unlock()
+	for _, t := range spr.topics {
+		if err := t.load(ms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshot writes messages with length prefix
+func writeSnapshot(w io.Writer, ms []*amp.Msg) error {
+	bw := bufio.NewWriter(w)
+	var l [4]byte
+	for _, m := range ms {
+		buf := m.Marshal()
+		binary.BigEndian.PutUint32(l[:], uint32(len(buf)))
+		if _, err := bw.Write(l[:]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func readSnapshot(r io.Reader) ([]*amp.Msg, error) {
+	br := bufio.NewReader(r)
+	var ms []*amp.Msg
+	var l [4]byte
+	for {
+		if _, err := io.ReadFull(br, l[:]); err != nil {
+			if err == io.EOF {
+				return ms, nil
+			}
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(l[:])
+		if n > maxSnapshotMsgSize {
+			return nil, ErrInvalidSnapshot
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		m := amp.Parse(buf)
+		if m == nil {
+			return nil, ErrInvalidSnapshot
+		}
+		ms = append(ms, m)
+	}
+}
+
+// export returns messages from which cache can be rebuilt
+func (t *topic) export() ([]*amp.Msg, error) {
+	ret := make(chan []*amp.Msg, 1)
+	f := func() {
+		if t.cache == nil {
+			ret <- nil
+			return
+		}
+		ret <- t.cache.Snapshot()
+	}
+	select {
+	case t.loopWork <- f:
+	case <-t.closed:
+		return nil, ErrTopicClosed
+	}
+	return <-ret, nil
+}
+
+// load replaces topic cache with one built from ms
+func (t *topic) load(ms []*amp.Msg) error {
+	done := make(chan struct{})
+	f := func() {
+		t.cache = nil
+		for _, m := range ms {
+			if t.cache == nil {
+				t.cache = t.newCache(m)
+			}
+			t.cache.Add(m)
+		}
+		t.account()
+		close(done)
+	}
+	select {
+	case t.loopWork <- f:
+	case <-t.closed:
+		return ErrTopicClosed
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	s := New(nil)
+	s.Publish(amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1}))
+	s.Publish(amp.NewPublish("1", "", 2, amp.Diff, map[string]int{"b": 2}))
+	s.Publish(amp.NewPublish("1", "", 3, amp.Diff, map[string]int{"c": 3}))
+	s.wait("1")
+
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, s.Export("1", buf))
+	assert.Equal(t, ErrTopicNotFound, s.Export("2", buf))
+
+	standby := New(nil)
+	assert.Nil(t, standby.Import("1", buf))
+	assert.True(t, standby.HasFull("1"))
+	assert.Equal(t, int64(3), standby.LatestTs("1"))
+
+	expected := s.Replay("1")
+	actual := standby.Replay("1")
+	assert.Len(t, actual, 3)
+	for i := range expected {
+		assert.Equal(t, expected[i].Marshal(), actual[i].Marshal())
+	}
+
+	// subscriber on standby continues from diff
+	c := &testConsumer{topics: map[string]int64{"1": 2}}
+	standby.Subscribe(c, c.topics)
+	standby.wait("1")
+	assert.Len(t, c.messages, 1)
+	assert.Equal(t, int64(3), c.messages[0].Ts)
+}
+
+func TestImportInvalid(t *testing.T) {
+	s := New(nil)
+	err := s.Import("1", bytes.NewBuffer([]byte{0, 0, 0, 5, '{'}))
+	assert.NotNil(t, err)
+}
+
+func TestExportImportClosed(t *testing.T) {
+	spr := newSpreader("1", 2)
+	spr.close()
+	buf := bytes.NewBuffer(nil)
+	assert.Equal(t, ErrTopicClosed, spr.Export(buf))
+	assert.Equal(t, ErrTopicClosed, spr.load([]*amp.Msg{amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1})}))
+}
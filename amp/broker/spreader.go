@@ -1,53 +1,308 @@
 package broker
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
 )
 
 type spreader struct {
 	topicCount     int
 	topics         []*topic
 	consumerTopics map[amp.Sender]*topic
+	ids            map[string]amp.Sender // subscribed consumers with ID()
 	pos            int
+	priorityPos    int // next topic of the priority consumer
+	opts           *options
+	keys           *recentKeys // idempotency keys of the published messages
+	persist        *persist    // ref: PersistFulls
+	usedAt         time.Time   // last publish or subscribe, set by the broker loop
+
+	fullTs  int64 // ts of the last published full
+	lastTs  int64 // greatest ts of the published messages
+	hasFull bool  // full is published or imported
+
+	coalesced   *amp.Msg // diffs merged in the current coalesce window
+	coalesceGen int      // identifies current coalesce window
+	closed      bool
+	lock        sync.Mutex // guards coalesce window and closed
 }
 
-func newSpreader(name string, topicCount int) *spreader {
+func newSpreader(name string, topicCount int, opts ...Option) *spreader {
 	s := &spreader{
 		topicCount:     topicCount,
 		topics:         []*topic{},
 		consumerTopics: make(map[amp.Sender]*topic),
+		ids:            make(map[string]amp.Sender),
+		opts:           newOptions(opts...),
+	}
+	if s.opts.idempotencyWindow > 0 {
+		s.keys = newRecentKeys(s.opts.idempotencyWindow)
 	}
+	if s.opts.store != nil {
+		s.persist = newPersist(name, &s.lock, s.current, s.opts)
+	}
+	opts = append(opts[:len(opts):len(opts)], withMemory(s.opts.memory))
 	for i := 0; i < topicCount; i++ {
-		s.topics = append(s.topics, newTopic(name))
+		s.topics = append(s.topics, newTopic(name, opts...))
+	}
+	if topicCount > 0 {
+		s.topics[0].primary = true
 	}
 	return s
 }
 
-func (spr *spreader) findTopic(c amp.Sender) *topic {
+func (spr *spreader) findTopic(c amp.Sender, priority int) *topic {
 	if t, ok := spr.consumerTopics[c]; ok {
 		return t
 	}
-	t := spr.topics[spr.pos]
-	spr.pos = (spr.pos + 1) % spr.topicCount
+	var t *topic
+	if priority > 0 {
+		// priority consumers are spread separately, so each topic
+		// delivers to its share of them before the others
+		t = spr.topics[spr.priorityPos]
+		spr.priorityPos = (spr.priorityPos + 1) % spr.topicCount
+	} else {
+		t = spr.topics[spr.pos]
+		spr.pos = (spr.pos + 1) % spr.topicCount
+	}
 	spr.consumerTopics[c] = t
+	if i, ok := c.(identifier); ok {
+		spr.ids[i.ID()] = c
+	}
 	return t
 }
 
-func (spr *spreader) subscribe(c amp.Sender, ts int64) {
-	t := spr.findTopic(c)
-	t.subscribe(c, ts)
+// subscribed returns true if c, or consumer with the same ID,
+// is already subscribed
+func (spr *spreader) subscribed(c amp.Sender) bool {
+	if _, ok := spr.consumerTopics[c]; ok {
+		return true
+	}
+	if i, ok := c.(identifier); ok {
+		if _, ok := spr.ids[i.ID()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (spr *spreader) subscribe(c amp.Sender, ts int64) error {
+	return spr.subscribePriority(c, ts, 0)
+}
+
+// subscribePriority subscribes consumer which gets messages before
+// consumers with lower priority.
+// Subscribe is idempotent, already subscribed consumer is not changed
+// and ErrAlreadySubscribed is returned.
+func (spr *spreader) subscribePriority(c amp.Sender, ts int64, priority int) error {
+	spr.lock.Lock()
+	closed := spr.closed
+	spr.lock.Unlock()
+	if closed {
+		return ErrTopicClosed
+	}
+	if spr.subscribed(c) {
+		return ErrAlreadySubscribed
+	}
+	return spr.findTopic(c, priority).subscribePriority(c, ts, priority)
+}
+
+// subscribeWith subscribes consumer in the mode described by sub.
+func (spr *spreader) subscribeWith(c amp.Sender, ts int64, sub subscription) error {
+	spr.lock.Lock()
+	closed := spr.closed
+	spr.lock.Unlock()
+	if closed {
+		return ErrTopicClosed
+	}
+	if spr.subscribed(c) {
+		return ErrAlreadySubscribed
+	}
+	return spr.findTopic(c, sub.priority).subscribeWith(c, ts, sub)
+}
+
+// subscribeFullsOnly subscribes consumer which gets only full messages.
+func (spr *spreader) subscribeFullsOnly(c amp.Sender, priority int) error {
+	spr.lock.Lock()
+	closed := spr.closed
+	spr.lock.Unlock()
+	if closed {
+		return ErrTopicClosed
+	}
+	if spr.subscribed(c) {
+		return ErrAlreadySubscribed
+	}
+	return spr.findTopic(c, priority).subscribeFullsOnly(c, priority)
+}
+
+func (spr *spreader) publish(m *amp.Msg) error {
+	spr.lock.Lock()
+	defer spr.lock.Unlock()
+	if spr.closed {
+		return ErrTopicClosed
+	}
+	m, err := spr.intercept(m)
+	if err != nil || m == nil {
+		return err
+	}
+	if spr.opts.autoTs && m.Ts == 0 {
+		m.Ts = spr.opts.clock.Now().UnixNano() / int64(time.Millisecond)
+		if m.Ts <= spr.lastTs {
+			m.Ts = spr.lastTs + 1
+		}
+	}
+	if spr.keys != nil && m.Key != "" && !m.IsReplay() &&
+		spr.keys.seenBefore(m.Key, spr.opts.clock.Now()) {
+		metric.Counter("broker.publish.duplicate")
+		return nil
+	}
+	if spr.tooLarge(m) {
+		metric.Counter("broker.publish.too_large")
+		return ErrMsgTooLarge
+	}
+	newFull := m.IsFull() && !m.IsReplay()
+	if newFull && m.Ts < spr.fullTs {
+		return ErrStaleFull
+	}
+	if spr.opts.coalesceWindow <= 0 {
+		err = spr.fanOut(m)
+	} else {
+		err = spr.coalesce(m)
+	}
+	if err != nil {
+		return err
+	}
+	if newFull {
+		spr.fullTs = m.Ts
+	}
+	if m.IsFull() {
+		spr.hasFull = true
+	}
+	if m.Ts > spr.lastTs {
+		spr.lastTs = m.Ts
+	}
+	return nil
+}
+
+// intercept applies middleware chain to the published message
+func (spr *spreader) intercept(m *amp.Msg) (*amp.Msg, error) {
+	for _, mw := range spr.opts.middleware {
+		var err error
+		if m, err = mw(m); err != nil || m == nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (spr *spreader) tooLarge(m *amp.Msg) bool {
+	return spr.opts.maxMsgSize > 0 && m.Size() > spr.opts.maxMsgSize
 }
 
-func (spr *spreader) publish(m *amp.Msg) {
+// fanOut sends message to all topics.
+// Message is sent to all or to none of them, so topic caches stay the same.
+func (spr *spreader) fanOut(m *amp.Msg) error {
+	if spr.opts.rejectOverLimit {
+		for _, t := range spr.topics {
+			if t.full() {
+				return ErrInFlightLimit
+			}
+		}
+	}
+	spr.stampID(m)
 	for _, t := range spr.topics {
-		t.messages <- m
+		if err := t.publish(m); err != nil {
+			return err
+		}
+	}
+	spr.persistMsg(m)
+	return nil
+}
+
+// coalesce merges diff into the current window.
+// Messages which can't be merged flush the window and are published immediately.
+func (spr *spreader) coalesce(m *amp.Msg) error {
+	if m.UpdateType != amp.Diff || m.IsReplay() {
+		if err := spr.flush(); err != nil {
+			return err
+		}
+		return spr.fanOut(m)
+	}
+	if spr.coalesced != nil {
+		if m.Ts <= spr.coalesced.Ts {
+			// out of order diff, leave sorting to the cache
+			if err := spr.flush(); err != nil {
+				return err
+			}
+			return spr.fanOut(m)
+		}
+		if merged, err := amp.Apply(spr.coalesced, m); err == nil && !spr.tooLarge(merged) {
+			spr.coalesced = merged
+			return nil
+		}
+		if err := spr.flush(); err != nil {
+			return err
+		}
+	}
+	spr.coalesced = m
+	spr.coalesceGen++
+	gen := spr.coalesceGen
+	after := spr.opts.clock.After(spr.opts.coalesceWindow)
+	go func() {
+		<-after
+		spr.lock.Lock()
+		defer spr.lock.Unlock()
+		// window already flushed if generation has changed
+		if gen == spr.coalesceGen && !spr.closed {
+			if err := spr.flush(); err != nil {
+				log.S("uri", m.URI).Error(err)
+			}
+		}
+	}()
+	return nil
+}
+
+// flush publishes merged diffs from the current window.
+// On error merged diff is dropped.
+func (spr *spreader) flush() error {
+	spr.coalesceGen++
+	if spr.coalesced == nil {
+		return nil
 	}
+	m := spr.coalesced
+	spr.coalesced = nil
+	return spr.fanOut(m)
 }
 
 func (spr *spreader) close() {
+	spr.closeNotify(nil)
+}
+
+// closeNotify closes spreader, if m is not nil it is sent to all
+// subscribers after pending messages and before they are detached.
+func (spr *spreader) closeNotify(m *amp.Msg) {
+	spr.lock.Lock()
+	if err := spr.flush(); err != nil {
+		log.Error(err)
+	}
+	spr.closed = true
+	spr.lock.Unlock()
 	for _, t := range spr.topics {
+		if m != nil {
+			t.notify(m)
+		}
 		t.close()
 	}
+	if spr.persist != nil {
+		spr.lock.Lock()
+		spr.persist.close()
+		spr.lock.Unlock()
+		spr.persist.wait()
+	}
 }
 
 func (spr *spreader) unsubscribe(c amp.Sender) bool {
@@ -55,17 +310,43 @@ func (spr *spreader) unsubscribe(c amp.Sender) bool {
 	if t != nil {
 		t.unsubscribe(c)
 		delete(spr.consumerTopics, c)
+		if i, ok := c.(identifier); ok && spr.ids[i.ID()] == c {
+			delete(spr.ids, i.ID())
+		}
 	}
 	return len(spr.consumerTopics) == 0
 }
 
+// state returns whether topic has full and ts of its last message
+func (spr *spreader) state() (bool, int64) {
+	spr.lock.Lock()
+	defer spr.lock.Unlock()
+	return spr.hasFull, spr.lastTs
+}
+
+// current returns current state of the topic, after all published
+// messages are added to the cache
+func (spr *spreader) current() []*amp.Msg {
+	t := spr.topics[0]
+	t.waitContext(context.Background())
+	return t.current()
+}
+
 func (spr *spreader) replay() []*amp.Msg {
 	return spr.topics[0].replay()
 }
 
 // samo za testove
 func (spr *spreader) wait() {
+	spr.waitContext(context.Background())
+}
+
+// waitContext waits until all topics deliver published messages or ctx is done
+func (spr *spreader) waitContext(ctx context.Context) error {
 	for _, t := range spr.topics {
-		t.wait()
+		if err := t.waitContext(ctx); err != nil {
+			return err
+		}
 	}
+	return nil
 }
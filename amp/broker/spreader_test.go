@@ -1,8 +1,11 @@
 package broker
 
 import (
+	"context"
+	"errors"
 	"github.com/minus5/svckit/amp"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -100,8 +103,8 @@ func TestSpreaderClose(t *testing.T) {
 }
 
 type publisher interface {
-	subscribe(amp.Sender, int64)
-	publish(*amp.Msg)
+	subscribe(amp.Sender, int64) error
+	publish(*amp.Msg) error
 	close()
 }
 
@@ -123,3 +126,302 @@ func BenchmarkTopic(b *testing.B) {
 func BenchmarkSpreader(b *testing.B) {
 	benchPublisher(newSpreader("m", 16))
 }
+
+func TestSpreaderCoalesce(t *testing.T) {
+	clock := newManualClock()
+	s := newSpreader("m", 2, CoalesceWindow(20*time.Millisecond), WithClock(clock))
+	c := &testConsumer{}
+	s.subscribe(c, 0)
+	s.publish(amp.NewPublish("m", "", 10, amp.Full, map[string]int{"a": 1}))
+	s.publish(amp.NewPublish("m", "", 11, amp.Diff, map[string]int{"a": 2}))
+	s.publish(amp.NewPublish("m", "", 12, amp.Diff, map[string]int{"b": 3}))
+	s.publish(amp.NewPublish("m", "", 13, amp.Diff, map[string]int{"c": 4}))
+	s.wait()
+	// full is published immediately, diffs are waiting for the window to close
+	msgs := s.replay()
+	assert.Len(t, msgs, 1)
+
+	clock.Advance(10 * time.Millisecond)
+	s.wait()
+	assert.Len(t, s.replay(), 1)
+
+	clock.Advance(10 * time.Millisecond)
+	s.waitFlushed()
+	s.wait()
+	msgs = s.replay()
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, int64(13), msgs[1].Ts)
+	var body map[string]int
+	assert.Nil(t, msgs[1].Unmarshal(&body))
+	assert.Equal(t, map[string]int{"a": 2, "b": 3, "c": 4}, body)
+
+	// late subscriber gets full and merged diff
+	c2 := &testConsumer{}
+	s.subscribe(c2, 0)
+	s.wait()
+	assert.Len(t, c2.messages, 2)
+
+	// full flushes the window
+	s.publish(amp.NewPublish("m", "", 14, amp.Diff, map[string]int{"a": 5}))
+	s.publish(amp.NewPublish("m", "", 15, amp.Full, map[string]int{"a": 6}))
+	s.wait()
+	msgs = s.replay()
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, int64(15), msgs[0].Ts)
+	// existing subscriber gets diff from the window and the new full
+	assert.Len(t, c.messages, 4)
+	assert.Equal(t, int64(14), c.messages[2].Ts)
+	assert.Equal(t, int64(15), c.messages[3].Ts)
+
+	// close flushes the window
+	s.publish(amp.NewPublish("m", "", 16, amp.Diff, map[string]int{"a": 7}))
+	s.close()
+	assert.Len(t, c.messages, 5)
+}
+
+func TestSpreaderIdempotencyKey(t *testing.T) {
+	s := newSpreader("m", 2, IdempotencyWindow(time.Minute))
+	c := &testConsumer{}
+	s.subscribe(c, 0)
+	s.publish(&amp.Msg{Ts: 10, UpdateType: amp.Full, Key: "f"})
+	s.publish(&amp.Msg{Ts: 11, UpdateType: amp.Diff, Key: "a"})
+	s.publish(&amp.Msg{Ts: 12, UpdateType: amp.Diff, Key: "a"}) // producer retry
+	s.publish(&amp.Msg{Ts: 13, UpdateType: amp.Diff})
+	s.publish(&amp.Msg{Ts: 14, UpdateType: amp.Diff})
+	s.wait()
+	assert.Len(t, c.messages, 4)
+	msgs := s.replay()
+	assert.Len(t, msgs, 4)
+	assert.Equal(t, int64(11), msgs[1].Ts)
+	assert.Equal(t, int64(13), msgs[2].Ts)
+}
+
+func TestSpreaderIdempotencyWindowExpires(t *testing.T) {
+	clock := newManualClock()
+	s := newSpreader("m", 2, IdempotencyWindow(time.Minute), WithClock(clock))
+	c := &testConsumer{}
+	s.subscribe(c, 0)
+	s.publish(&amp.Msg{Ts: 10, UpdateType: amp.Full, Key: "a"})
+	clock.Advance(59 * time.Second)
+	s.publish(&amp.Msg{Ts: 11, UpdateType: amp.Diff, Key: "a"})
+	clock.Advance(time.Second)
+	s.publish(&amp.Msg{Ts: 12, UpdateType: amp.Diff, Key: "a"})
+	s.wait()
+	msgs := s.replay()
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, int64(12), msgs[1].Ts)
+}
+
+type blockingConsumer struct {
+	release chan struct{}
+	counter
+}
+
+func (c *blockingConsumer) SendMsgs(ms []*amp.Msg) {
+	<-c.release
+	c.counter.SendMsgs(ms)
+}
+
+func TestSpreaderMaxInFlight(t *testing.T) {
+	s := newSpreader("m", 2, MaxInFlight(2), RejectOverLimit())
+	c := &blockingConsumer{release: make(chan struct{})}
+	s.subscribe(c, 0)
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full}))
+	// wait for topic loop to block in SendMsgs
+	for len(s.topics[0].messages)+len(s.topics[1].messages) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff}))
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 3, UpdateType: amp.Diff}))
+	assert.Equal(t, ErrInFlightLimit, s.publish(&amp.Msg{Ts: 4, UpdateType: amp.Diff}))
+
+	close(c.release)
+	s.wait()
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 5, UpdateType: amp.Diff}))
+	s.close()
+	assert.Equal(t, 4, c.msgCount)
+}
+
+func TestSpreaderTopicClosed(t *testing.T) {
+	s := newSpreader("m", 2)
+	s.close()
+	assert.Equal(t, ErrTopicClosed, s.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full}))
+	assert.Equal(t, ErrTopicClosed, s.subscribe(&counter{}, 0))
+
+	tp := newTopic("m")
+	tp.close()
+	assert.Equal(t, ErrTopicClosed, tp.subscribe(&counter{}, 0))
+}
+
+func TestSpreaderStaleFull(t *testing.T) {
+	s := newSpreader("m", 2)
+	defer s.close()
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 2, UpdateType: amp.Full}))
+	assert.Equal(t, ErrStaleFull, s.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full}))
+	// replay and diffs are not checked
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full, Replay: amp.Replay}))
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 3, UpdateType: amp.Diff}))
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 4, UpdateType: amp.Full}))
+}
+
+func TestSpreaderPriority(t *testing.T) {
+	s := newSpreader("m", 4)
+	defer s.close()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, s.subscribe(&counter{}, 0))
+		assert.Nil(t, s.subscribePriority(&counter{}, 0, 1))
+	}
+	s.wait()
+	// each topic has one priority and one regular consumer
+	for _, tp := range s.topics {
+		done := make(chan struct{})
+		tp.loopWork <- func() {
+			assert.Len(t, tp.consumers, 2)
+			assert.Len(t, tp.priorities, 1)
+			close(done)
+		}
+		<-done
+	}
+}
+
+func TestSpreaderMaxMsgSize(t *testing.T) {
+	s := newSpreader("m", 1, MaxMsgSize(100))
+	defer s.close()
+	small := amp.NewPublish("m", "", 1, amp.Full, map[string]string{"a": "b"})
+	large := amp.NewPublish("m", "", 2, amp.Diff, map[string]string{"a": strings.Repeat("b", 100)})
+	assert.Nil(t, s.publish(small))
+	assert.Equal(t, ErrMsgTooLarge, s.publish(large))
+	s.wait()
+	assert.Len(t, s.replay(), 1)
+}
+
+func TestSpreaderWaitContext(t *testing.T) {
+	s := newSpreader("m", 2)
+	c := &blockingConsumer{release: make(chan struct{})}
+	s.subscribe(c, 0)
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full}))
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.waitContext(ctx))
+
+	close(c.release)
+	assert.Nil(t, s.waitContext(context.Background()))
+	s.close()
+	assert.Equal(t, 2, c.msgCount)
+}
+
+func TestSpreaderMiddleware(t *testing.T) {
+	errInvalid := errors.New("invalid")
+	validate := func(m *amp.Msg) (*amp.Msg, error) {
+		if m.Ts < 0 {
+			return nil, errInvalid
+		}
+		return m, nil
+	}
+	stamp := func(m *amp.Msg) (*amp.Msg, error) {
+		if m.Ts == 0 {
+			return &amp.Msg{URI: m.URI, Ts: 10, UpdateType: m.UpdateType}, nil
+		}
+		return m, nil
+	}
+	drop := func(m *amp.Msg) (*amp.Msg, error) {
+		if m.UpdateType == amp.Event {
+			return nil, nil
+		}
+		return m, nil
+	}
+	s := newSpreader("m", 1, PublishMiddleware(validate, stamp), PublishMiddleware(drop))
+	defer s.close()
+	assert.Equal(t, errInvalid, s.publish(&amp.Msg{Ts: -1, UpdateType: amp.Full}))
+	assert.Nil(t, s.publish(&amp.Msg{UpdateType: amp.Full}))
+	assert.Nil(t, s.publish(&amp.Msg{Ts: 11, UpdateType: amp.Event}))
+	s.wait()
+	ms := s.replay()
+	assert.Len(t, ms, 1)
+	assert.Equal(t, int64(10), ms[0].Ts)
+}
+
+func TestSpreaderAutoTs(t *testing.T) {
+	s := newSpreader("m", 2, AutoTs())
+	c := &testConsumer{}
+	assert.Nil(t, s.subscribe(c, 0))
+	future := amp.TS() + 1000
+	assert.Nil(t, s.publish(&amp.Msg{Ts: future, UpdateType: amp.Full}))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.Nil(t, s.publish(&amp.Msg{UpdateType: amp.Diff}))
+			}
+		}()
+	}
+	wg.Wait()
+	s.wait()
+	s.close()
+	assert.Len(t, c.messages, 101)
+	for i, m := range c.messages {
+		assert.Equal(t, future+int64(i), m.Ts)
+	}
+
+	// without option Ts is not changed
+	s = newSpreader("m", 1)
+	defer s.close()
+	m := &amp.Msg{UpdateType: amp.Full}
+	assert.Nil(t, s.publish(m))
+	assert.Equal(t, int64(0), m.Ts)
+}
+
+func TestSpreaderMsgIDs(t *testing.T) {
+	s := newSpreader("m", 2, MsgIDs(CounterIDs("b1-")), StateHash())
+	c := &testConsumer{}
+	s.subscribe(c, 0)
+	m1 := amp.NewPublish("m", "", 10, amp.Full, map[string]int{"a": 1})
+	m2 := amp.NewPublish("m", "", 11, amp.Diff, map[string]int{"a": 2})
+	m3 := amp.NewPublish("m", "", 12, amp.Diff, map[string]int{"a": 3})
+	m3.ID = "own"
+	s.publish(m1)
+	s.publish(m2)
+	s.publish(m3)
+	s.wait()
+
+	// stored with hash and sent live with the same id
+	assert.Len(t, c.messages, 3)
+	assert.Equal(t, []string{"b1-1", "b1-2", "own"}, []string{c.messages[0].ID, c.messages[1].ID, c.messages[2].ID})
+	msgs := s.replay()
+	assert.Len(t, msgs, 3)
+	for i, m := range msgs {
+		assert.True(t, m.IsReplay())
+		assert.Equal(t, c.messages[i].ID, m.ID)
+	}
+
+	// id is sent in the header
+	p := msgs[0].Marshal()
+	assert.Equal(t, "b1-1", amp.Parse(p).ID)
+}
+
+func TestSpreaderSubscribeTwice(t *testing.T) {
+	s := newSpreader("m", 4)
+	c := counter{}
+	assert.Nil(t, s.subscribe(&c, 0))
+	assert.Equal(t, ErrAlreadySubscribed, s.subscribe(&c, 0))
+	assert.Equal(t, ErrAlreadySubscribed, s.subscribeFullsOnly(&c, 0))
+	s.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full})
+	s.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff})
+	s.wait()
+	assert.Equal(t, 2, c.msgCount)
+
+	// the same ID is the same subscriber
+	i1 := &idConsumer{id: "c"}
+	i2 := &idConsumer{id: "c"}
+	assert.Nil(t, s.subscribe(i1, 0))
+	assert.Equal(t, ErrAlreadySubscribed, s.subscribe(i2, 0))
+
+	assert.False(t, s.unsubscribe(&c))
+	assert.True(t, s.unsubscribe(i1))
+	assert.Nil(t, s.subscribe(i2, 0))
+	s.wait()
+}
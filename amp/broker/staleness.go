@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// subscription describes subscribe mode of the consumer in the topic
+type subscription struct {
+	priority     int
+	filter       Filter        // ref: SubscribeFilter
+	maxStaleness time.Duration // ref: SubscribeMaxStaleness
+}
+
+// SubscribeMaxStaleness subscribes consumer which accepts replay of at most
+// maxStaleness. If the consumer position (ts in newNames) is older than
+// maxStaleness from the last message of the topic, it gets only the current
+// state: full marked with amp.GapMetaKey and diffs after it, instead of
+// all diffs (or archived messages) since its position.
+// Ts is compared as unix milliseconds, as set by AutoTs.
+// Combines with SubscribeFilter. Zero maxStaleness is no limit.
+//
+// Mode is kept for the next calls of Subscribe until Unsubscribe, topics
+// consumer is already subscribed to are not changed.
+func (s *Broker) SubscribeMaxStaleness(c amp.Sender, newNames map[string]int64, maxStaleness time.Duration) error {
+	return s.subscribeMode(c, newNames, func() {
+		delete(s.fullsOnly, c)
+		if maxStaleness > 0 {
+			s.staleness[c] = maxStaleness
+		} else {
+			delete(s.staleness, c)
+		}
+	})
+}
+
+// stale returns true if consumer position ts is older than maxStaleness
+// from the last message of the topic
+func (t *topic) stale(ts int64, maxStaleness time.Duration) bool {
+	if maxStaleness <= 0 || ts == tsNone {
+		return false
+	}
+	return t.lastTs-ts > int64(maxStaleness/time.Millisecond)
+}
+
+// sendGap sends current state with full marked as gap,
+// returns number of sent messages
+func (t *topic) sendGap(c amp.Sender) int {
+	if t.cache == nil {
+		return 0
+	}
+	ms := asReplay(t.filtered(c, t.cache.Current()))
+	if len(ms) == 0 {
+		return 0
+	}
+	if ms[0].IsFull() {
+		ms[0] = ms[0].AsGap()
+	}
+	metric.Counter("topic.sub.gap")
+	t.send(c, burst(ms))
+	return len(ms)
+}
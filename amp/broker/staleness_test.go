@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeMaxStaleness(t *testing.T) {
+	s := New(nil)
+	s.Publish(&amp.Msg{URI: "1", Ts: 1000, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 2000, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 5000, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 6000, UpdateType: amp.Diff})
+	s.wait("1")
+
+	// within staleness: diffs since consumer position
+	c := &testConsumer{}
+	s.SubscribeMaxStaleness(c, map[string]int64{"1": 3000}, 3*time.Second)
+	s.wait("1")
+	ms := c.messages
+	assert.Equal(t, []int64{6000}, tsOf(ms))
+	for _, m := range ms {
+		assert.False(t, m.IsGap())
+	}
+
+	// staleness exceeded: current state with full marked as gap
+	c2 := &testConsumer{}
+	s.SubscribeMaxStaleness(c2, map[string]int64{"1": 2000}, 3*time.Second)
+	s.wait("1")
+	ms = c2.messages
+	assert.Equal(t, []int64{5000, 6000}, tsOf(ms))
+	assert.True(t, ms[0].IsFull())
+	assert.True(t, ms[0].IsGap())
+	assert.True(t, ms[0].IsReplay())
+	assert.False(t, ms[1].IsGap())
+
+	// without position there is no gap
+	c3 := &testConsumer{}
+	s.SubscribeMaxStaleness(c3, map[string]int64{"1": 0}, time.Second)
+	s.wait("1")
+	assert.Equal(t, []int64{5000, 6000}, tsOf(c3.messages))
+	assert.False(t, c3.messages[0].IsGap())
+
+	// mode is kept for the next subscribe, cached full is not changed
+	s.Publish(&amp.Msg{URI: "2", Ts: 1000, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "2", Ts: 9000, UpdateType: amp.Diff})
+	s.wait("2")
+	s.Subscribe(c2, map[string]int64{"1": 6000, "2": 1000})
+	s.wait("2")
+	ms = c2.messages[2:]
+	assert.Equal(t, []int64{1000, 9000}, tsOf(ms))
+	assert.True(t, ms[0].IsGap())
+	assert.False(t, s.spreaders["2"].topics[0].cache.Current()[0].IsGap())
+}
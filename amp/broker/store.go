@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// ErrNoStore is returned from Restore when store is not set
+var ErrNoStore = errors.New("store not set")
+
+// Store is durable storage of the topic state, ref: PersistStore.
+// Broker depends only on this interface, e.g. mdb.AmpStore keeps
+// messages in mdb.Fs, in memory, file or S3 backed stores can be plugged in.
+type Store interface {
+	// SaveFull stores full message, state of the topic m.URI at m.Ts.
+	// Stored diffs with Ts <= m.Ts are no longer needed and can be removed.
+	SaveFull(m *amp.Msg) error
+	// LoadFull returns the newest stored full of the topic,
+	// nil if there is none.
+	LoadFull(topic string) (*amp.Msg, error)
+	// AppendDiff stores diff of the topic m.URI.
+	AppendDiff(m *amp.Msg) error
+	// LoadDiffs calls h in ts order for stored diffs
+	// of the topic with Ts > fromTs.
+	LoadDiffs(topic string, fromTs int64, h func(*amp.Msg) error) error
+}
+
+// PersistStore saves topic state to st, as PersistFulls, and appends each
+// published diff, so Restore gets the state as it was published, not as of
+// the last saved full.
+// Diffs are appended in the background in publish order, slow store
+// increases the number of diffs waiting in memory.
+func PersistStore(st Store, every time.Duration) Option {
+	return func(o *options) {
+		o.store = st
+		o.persistDiffs = true
+		o.persistEvery = every
+	}
+}
+
+// Restore loads state of the topic from the store set by PersistStore
+// (or PersistFulls): the newest full and diffs after it.
+// Topic cache is replaced, as with Import, intended for the broker start
+// before clients connect. Does nothing if there is no stored full.
+// Returns ErrNotLoadable if PersistFulls Persister is not LatestLoader.
+func (s *Broker) Restore(name string) error {
+	if s.store == nil {
+		return ErrNoStore
+	}
+	ms, err := loadStored(s.store, name)
+	if err != nil || len(ms) == 0 {
+		return err
+	}
+	s.inLoopWait(func() {
+		var spr *spreader
+		if spr, err = s.find(name, false); err == nil {
+			if err = spr.load(ms); err == nil {
+				spr.restorePersist(ms)
+			}
+		}
+	})
+	return err
+}
+
+// loadStored returns the newest stored full of the topic and diffs after it
+func loadStored(st Store, name string) ([]*amp.Msg, error) {
+	full, err := st.LoadFull(name)
+	if err != nil || full == nil {
+		return nil, err
+	}
+	ms := []*amp.Msg{full}
+	err = st.LoadDiffs(name, full.Ts, func(m *amp.Msg) error {
+		if m.Ts > full.Ts {
+			ms = append(ms, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// restorePersist marks restored state as saved by persist,
+// it is saved again when it changes
+func (spr *spreader) restorePersist(ms []*amp.Msg) {
+	p := spr.persist
+	if p == nil || p.every <= 0 {
+		return
+	}
+	spr.lock.Lock()
+	defer spr.lock.Unlock()
+	ts := ms[len(ms)-1].Ts
+	if ts > p.lastTs {
+		p.lastTs = ts
+	}
+	if ts > p.savedTs {
+		p.savedTs = ts
+	}
+	p.savedAt = p.clock.Now()
+}
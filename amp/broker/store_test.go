@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type memStore struct {
+	fulls map[string]*amp.Msg
+	diffs map[string][]*amp.Msg
+	sync.Mutex
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		fulls: make(map[string]*amp.Msg),
+		diffs: make(map[string][]*amp.Msg),
+	}
+}
+
+func (s *memStore) SaveFull(m *amp.Msg) error {
+	s.Lock()
+	defer s.Unlock()
+	s.fulls[m.URI] = m
+	return nil
+}
+
+func (s *memStore) LoadFull(topic string) (*amp.Msg, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.fulls[topic], nil
+}
+
+func (s *memStore) AppendDiff(m *amp.Msg) error {
+	s.Lock()
+	defer s.Unlock()
+	s.diffs[m.URI] = append(s.diffs[m.URI], m)
+	return nil
+}
+
+func (s *memStore) LoadDiffs(topic string, fromTs int64, h func(*amp.Msg) error) error {
+	s.Lock()
+	ds := s.diffs[topic]
+	s.Unlock()
+	for _, m := range ds {
+		if m.Ts <= fromTs {
+			continue
+		}
+		if err := h(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitDiffs waits until n diffs of the topic are appended
+func (s *memStore) waitDiffs(topic string, n int) {
+	for i := 0; i < 1000; i++ {
+		s.Lock()
+		l := len(s.diffs[topic])
+		s.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPersistStore(t *testing.T) {
+	st := newMemStore()
+	s := New(nil, PersistStore(st, 0))
+	s.Publish(amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1}))
+	s.Publish(amp.NewPublish("1", "", 2, amp.Diff, map[string]int{"b": 2}))
+	s.Publish(amp.NewPublish("1", "", 3, amp.Diff, map[string]int{"c": 3}))
+	s.wait("1")
+	st.waitDiffs("1", 2)
+	full, err := st.LoadFull("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), full.Ts)
+
+	// restore in new broker: stored full and diffs after it
+	s2 := New(nil, PersistStore(st, 0))
+	assert.Nil(t, s2.Restore("1"))
+	c := &testConsumer{}
+	s2.Subscribe(c, map[string]int64{"1": 0})
+	s2.wait("1")
+	assert.Equal(t, []int64{1, 1, 2, 3, 3}, tsOf(c.messages))
+
+	// nothing stored
+	assert.Nil(t, s2.Restore("2"))
+	assert.Equal(t, ErrNoStore, New(nil).Restore("1"))
+}
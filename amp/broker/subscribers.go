@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+// identifier is implemented by consumers which want to be listed
+// in Subscribers with their id
+type identifier interface {
+	ID() string
+}
+
+// backlogger is implemented by consumers with their own send queue,
+// Backlog returns number of queued, not yet written, messages
+type backlogger interface {
+	Backlog() int
+}
+
+// SubscriberInfo describes consumer of the topic
+type SubscriberInfo struct {
+	ID           string // from consumer ID() or client id of SubscribeClient
+	SubscribeTs  int64  // position requested on subscribe
+	SubscribedAt time.Time
+	Ts           int64 // ts of the last message sent to consumer, 0 if none
+	Lag          int64 // ts of the last topic message minus Ts
+	Received     int   // number of messages sent to consumer
+	Backlog      int   // consumer send queue depth, if it reports one
+	Priority     int
+	FullsOnly    bool // subscribed with SubscribeFullsOnly
+	Pending      bool // waiting for archive replay
+}
+
+// subscriberStats are tracked by topic for each consumer
+type subscriberStats struct {
+	subscribeTs  int64
+	subscribedAt time.Time
+	received     int
+}
+
+// Subscribers lists consumers of the topic
+func (s *Broker) Subscribers(name string) []SubscriberInfo {
+	var infos []SubscriberInfo
+	s.inLoopWait(func() {
+		spr, ok := s.spreaders[name]
+		if !ok {
+			return
+		}
+		infos = spr.subscribers(s.clientIDs)
+	})
+	return infos
+}
+
+func (spr *spreader) subscribers(clientIDs map[amp.Sender]string) []SubscriberInfo {
+	var infos []SubscriberInfo
+	for _, t := range spr.topics {
+		infos = append(infos, t.subscribers(clientIDs)...)
+	}
+	return infos
+}
+
+// subscribers collects stats in the topic loop.
+// clientIDs is owned by the broker loop which waits for the result.
+func (t *topic) subscribers(clientIDs map[amp.Sender]string) []SubscriberInfo {
+	ret := make(chan []SubscriberInfo, 1)
+	f := func() {
+		var infos []SubscriberInfo
+		for c, st := range t.stats {
+			info := SubscriberInfo{
+				SubscribeTs:  st.subscribeTs,
+				SubscribedAt: st.subscribedAt,
+				Received:     st.received,
+				Priority:     t.priorities[c],
+			}
+			_, info.FullsOnly = t.fullsOnly[c]
+			if b, ok := c.(backlogger); ok {
+				info.Backlog = b.Backlog()
+			}
+			if i, ok := c.(identifier); ok {
+				info.ID = i.ID()
+			} else if id, ok := clientIDs[c]; ok {
+				info.ID = id
+			}
+			if _, ok := t.pending[c]; ok {
+				info.Pending = true
+			} else if ts := t.consumers[c]; ts != tsNone {
+				info.Ts = ts
+			}
+			info.Lag = t.lastTs - info.Ts
+			infos = append(infos, info)
+		}
+		ret <- infos
+	}
+	select {
+	case t.loopWork <- f:
+		return <-ret
+	case <-t.closed:
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/stretchr/testify/assert"
+)
+
+type idConsumer struct {
+	testConsumer
+	id string
+}
+
+func (c *idConsumer) ID() string {
+	return c.id
+}
+
+func TestSubscribers(t *testing.T) {
+	s := New(nil)
+	assert.Len(t, s.Subscribers("1"), 0)
+
+	c1 := &idConsumer{id: "c1"}
+	c2 := &testConsumer{}
+	s.Subscribe(c1, map[string]int64{"1": 0})
+	assert.Nil(t, s.SubscribeClient("c2", c2, map[string]int64{"1": 101}))
+	s.Publish(&amp.Msg{URI: "1", Ts: 101, UpdateType: amp.Full})
+	s.Publish(&amp.Msg{URI: "1", Ts: 102, UpdateType: amp.Diff})
+	s.wait("1")
+
+	infos := s.Subscribers("1")
+	assert.Len(t, infos, 2)
+	byID := make(map[string]SubscriberInfo)
+	for _, i := range infos {
+		byID[i.ID] = i
+	}
+	i1 := byID["c1"]
+	assert.Equal(t, int64(0), i1.SubscribeTs)
+	assert.Equal(t, int64(102), i1.Ts)
+	assert.Equal(t, int64(0), i1.Lag)
+	assert.Equal(t, 2, i1.Received)
+	assert.False(t, i1.SubscribedAt.IsZero())
+	i2 := byID["c2"]
+	assert.Equal(t, int64(101), i2.SubscribeTs)
+	// positioned at full, gets only diff
+	assert.Equal(t, 1, i2.Received)
+
+	s.Unsubscribe(c1)
+	assert.Len(t, s.Subscribers("1"), 1)
+}
+
+// backlogConsumer never writes, all received messages are its backlog
+type backlogConsumer struct {
+	idConsumer
+}
+
+func (c *backlogConsumer) Backlog() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.messages)
+}
+
+func TestSubscribersBacklog(t *testing.T) {
+	for _, action := range []BacklogAction{BacklogWarn, BacklogEvict} {
+		s := New(nil, MaxBacklog(2, action))
+		c := &backlogConsumer{idConsumer{id: "c"}}
+		s.Subscribe(c, map[string]int64{"1": 0})
+		s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+		s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+		s.wait("1")
+		infos := s.Subscribers("1")
+		assert.Len(t, infos, 1)
+		assert.Equal(t, 2, infos[0].Backlog)
+
+		s.Publish(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff})
+		s.Publish(&amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Diff})
+		s.wait("1")
+		infos = s.Subscribers("1")
+		if action == BacklogEvict {
+			assert.Len(t, infos, 0)
+			ms, closing := c.data()
+			assert.Len(t, ms, 3, "evicted after exceeding")
+			assert.Equal(t, 1, closing, "notified about eviction")
+			// unsubscribed in the broker, could subscribe again
+			assert.True(t, waitFor(func() bool {
+				var subscribed bool
+				s.inLoopWait(func() {
+					_, subscribed = s.consumerNames[c]["1"]
+				})
+				return !subscribed
+			}))
+			continue
+		}
+		assert.Len(t, infos, 1)
+		assert.Equal(t, 4, infos[0].Backlog)
+	}
+}
+
+// waitFor polls cond until it is true or a second passes
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+type slowConsumer struct {
+	backlogConsumer
+	levels []uint8
+}
+
+func (c *slowConsumer) SlowConsumer(level uint8) {
+	c.levels = append(c.levels, level)
+}
+
+// drain simulates consumer writing out its queue
+func (c *slowConsumer) drain() {
+	c.Lock()
+	defer c.Unlock()
+	c.messages = nil
+}
+
+func TestSlowConsumer(t *testing.T) {
+	s := New(nil, SlowBacklog(1), MaxBacklog(3, BacklogEvict))
+	c := &slowConsumer{}
+	s.Subscribe(c, map[string]int64{"1": 0})
+	s.Publish(&amp.Msg{URI: "1", Ts: 1, UpdateType: amp.Full})
+	s.wait("1")
+	assert.Len(t, c.levels, 0)
+
+	s.Publish(&amp.Msg{URI: "1", Ts: 2, UpdateType: amp.Diff})
+	s.Publish(&amp.Msg{URI: "1", Ts: 3, UpdateType: amp.Diff})
+	s.wait("1")
+	// warned once, not evicted
+	assert.Equal(t, []uint8{amp.SlowWarning}, c.levels)
+	assert.Len(t, s.Subscribers("1"), 1)
+
+	c.drain()
+	s.Publish(&amp.Msg{URI: "1", Ts: 4, UpdateType: amp.Diff})
+	s.wait("1")
+	assert.Equal(t, []uint8{amp.SlowWarning, amp.SlowRecovered}, c.levels)
+}
@@ -1,12 +1,15 @@
 package broker
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
 )
 
 const (
@@ -20,19 +23,35 @@ var (
 )
 
 type cache interface {
-	Add(m *amp.Msg)
+	Add(m *amp.Msg) *amp.Msg
 	Find(ts int64) []*amp.Msg
 	FindFor(consumerTs int64, m *amp.Msg) uint8
 	Current() []*amp.Msg
+	Snapshot() []*amp.Msg
 }
 
 type topic struct {
+	name            string
 	messages        chan *amp.Msg
 	loopWork        chan func()
 	consumers       map[amp.Sender]int64
+	priorities      map[amp.Sender]int      // consumers with priority other than 0
+	pending         map[amp.Sender]struct{} // consumers waiting for archive replay
+	fullsOnly       map[amp.Sender]struct{} // consumers subscribed with subscribeFullsOnly
+	filters         map[amp.Sender]Filter   // consumers subscribed with subscribeFilter
+	slow            map[amp.Sender]struct{} // consumers over SlowBacklog
+	ordered         []amp.Sender            // consumers sorted by priority, nil when changed
+	stats           map[amp.Sender]*subscriberStats
+	lastTs          int64 // ts of the last message
 	closed          chan struct{}
 	cache           cache
 	updatedAt       time.Time
+	overflow        OverflowPolicy
+	gap             bool  // diffs are dropped until the next full, ref: OverflowPolicy
+	tracing         bool  // current message is sampled for Trace
+	paused          bool  // messages are cached but not sent, ref: Broker.Pause
+	bytes           int64 // cache size reported to MemoryBudget
+	primary         bool  // reports cache size and gaps, set on one topic of the spreader
 	metricName      string
 	mOnMsgDuration  string
 	mOnMsgConsumers string
@@ -42,15 +61,26 @@ type topic struct {
 	mSubDuration    string
 	mSubMsgCount    string
 	mSubPerMsg      string
+	opts            *options
 }
 
-func newTopic(name string) *topic {
+func newTopic(name string, opts ...Option) *topic {
+	o := newOptions(opts...)
 	t := &topic{
-		messages:   make(chan *amp.Msg, 128),
+		messages:   make(chan *amp.Msg, o.maxInFlight),
 		consumers:  make(map[amp.Sender]int64),
+		priorities: make(map[amp.Sender]int),
+		pending:    make(map[amp.Sender]struct{}),
+		fullsOnly:  make(map[amp.Sender]struct{}),
+		filters:    make(map[amp.Sender]Filter),
+		slow:       make(map[amp.Sender]struct{}),
+		stats:      make(map[amp.Sender]*subscriberStats),
+		name:       name,
 		closed:     make(chan struct{}),
 		loopWork:   make(chan func()),
 		metricName: "other",
+		overflow:   o.overflowPolicy(name),
+		opts:       o,
 	}
 	if strings.HasPrefix(name, "sportsbook/") {
 		t.metricName = name[11:12]
@@ -67,8 +97,21 @@ func newTopic(name string) *topic {
 	return t
 }
 
-func (t *topic) publish(m *amp.Msg) {
+func (t *topic) publish(m *amp.Msg) error {
+	if t.opts.rejectOverLimit && t.full() {
+		return ErrInFlightLimit
+	}
+	if t.overflow != OverflowBlock {
+		t.publishDrop(m)
+		return nil
+	}
 	t.messages <- m
+	return nil
+}
+
+// full returns true if topic queue is full and publish would block
+func (t *topic) full() bool {
+	return len(t.messages) >= cap(t.messages)
 }
 
 func (t *topic) loop() {
@@ -76,9 +119,14 @@ func (t *topic) loop() {
 		select {
 		case m, ok := <-t.messages:
 			if !ok {
+				t.release()
 				close(t.closed)
 				return
 			}
+			if m.IsClosing() {
+				t.notifyAll(m)
+				continue
+			}
 			t.onMessage(m)
 		case f := <-t.loopWork:
 			f()
@@ -95,9 +143,34 @@ func (t *topic) close() {
 	<-t.closed
 }
 
-func (t *topic) subscribe(c amp.Sender, ts int64) {
+// notify sends closing message m to all consumers, bypassing cache.
+// It is queued with published messages so consumers get it after them.
+func (t *topic) notify(m *amp.Msg) {
+	t.messages <- m
+}
+
+// notifyAll delivers m to all consumers, called in loop
+func (t *topic) notifyAll(m *amp.Msg) {
+	ms := []*amp.Msg{m}
+	for _, c := range t.order() {
+		t.deliver(c, ms)
+	}
+}
+
+func (t *topic) subscribe(c amp.Sender, ts int64) error {
+	return t.subscribePriority(c, ts, 0)
+}
+
+// subscribePriority subscribes consumer which gets messages
+// before consumers with lower priority.
+func (t *topic) subscribePriority(c amp.Sender, ts int64, priority int) error {
+	return t.subscribeWith(c, ts, subscription{priority: priority})
+}
+
+// subscribeWith subscribes consumer in the mode described by sub.
+func (t *topic) subscribeWith(c amp.Sender, ts int64, sub subscription) error {
 	call := time.Now()
-	t.loopWork <- func() {
+	f := func() {
 		enter := time.Now()
 		msgCount := 0
 		defer func() {
@@ -110,18 +183,78 @@ func (t *topic) subscribe(c amp.Sender, ts int64) {
 			metric.Time(t.mSubMsgCount, msgCount)
 			metric.Time(t.mSubPerMsg, duration/msgCount)
 		}()
+		t.stats[c] = &subscriberStats{subscribeTs: ts, subscribedAt: call}
+		delete(t.fullsOnly, c)
+		if sub.filter != nil {
+			t.filters[c] = sub.filter
+		} else {
+			delete(t.filters, c)
+		}
 		if ts <= 0 {
 			ts = tsNone
 		}
-		t.consumers[c] = ts
+		if t.stale(ts, sub.maxStaleness) {
+			t.register(c, ts, sub.priority)
+			msgCount = t.sendGap(c)
+			return
+		}
+		if boundary, ok := t.archiveBoundary(ts); ok {
+			t.pending[c] = struct{}{}
+			go t.archiveReplay(c, ts, boundary, sub.priority)
+			return
+		}
+		t.register(c, ts, sub.priority)
 		if t.cache != nil {
-			ms := t.cache.Find(ts)
+			ms := t.filtered(c, t.cache.Find(ts))
 			msgCount = len(ms)
 			if msgCount > 0 {
-				t.send(c, burst(ms))
+				t.send(c, burst(asReplay(ms)))
 			}
 		}
 	}
+	select {
+	case t.loopWork <- f:
+		return nil
+	case <-t.closed:
+		return ErrTopicClosed
+	}
+}
+
+// subscribeFullsOnly subscribes consumer which gets only full messages:
+// the current full immediately and each published full after it.
+// Diffs and events are not sent to it.
+func (t *topic) subscribeFullsOnly(c amp.Sender, priority int) error {
+	call := time.Now()
+	f := func() {
+		t.stats[c] = &subscriberStats{subscribedAt: call}
+		delete(t.pending, c)
+		delete(t.filters, c)
+		t.register(c, tsNone, priority)
+		t.fullsOnly[c] = struct{}{}
+		if t.cache == nil {
+			return
+		}
+		if ms := t.cache.Current(); len(ms) > 0 && ms[0].IsFull() {
+			t.send(c, asReplay(ms[:1]))
+		}
+	}
+	select {
+	case t.loopWork <- f:
+		return nil
+	case <-t.closed:
+		return ErrTopicClosed
+	}
+}
+
+// register adds consumer positioned at ts
+func (t *topic) register(c amp.Sender, ts int64, priority int) {
+	t.consumers[c] = ts
+	if priority != 0 {
+		t.priorities[c] = priority
+	} else {
+		delete(t.priorities, c)
+	}
+	t.ordered = nil
 }
 
 // unsubscribe vraca true ako vise nema niti jednog consumera.
@@ -132,11 +265,28 @@ func (t *topic) unsubscribe(c amp.Sender) bool {
 		enter := time.Now()
 		metric.Time("topic.unsubscribe.wait", int(enter.Sub(call).Nanoseconds()))
 		delete(t.consumers, c)
-		empty <- len(t.consumers) == 0
+		delete(t.priorities, c)
+		delete(t.pending, c)
+		delete(t.fullsOnly, c)
+		delete(t.filters, c)
+		delete(t.slow, c)
+		delete(t.stats, c)
+		t.ordered = nil
+		empty <- len(t.consumers) == 0 && len(t.pending) == 0
 	}
 	return <-empty
 }
 
+// asReplay marks catch-up messages, sent to the consumer on subscribe, as replay.
+// Live messages are sent as published.
+func asReplay(ms []*amp.Msg) []*amp.Msg {
+	rs := make([]*amp.Msg, len(ms))
+	for i, m := range ms {
+		rs[i] = m.AsReplay()
+	}
+	return rs
+}
+
 func burst(ms []*amp.Msg) []*amp.Msg {
 	l := len(ms)
 	if l <= 2 {
@@ -150,9 +300,121 @@ func burst(ms []*amp.Msg) []*amp.Msg {
 	return res
 }
 
-func (t *topic) send(c amp.Sender, ms []*amp.Msg) {
+// send sends messages to the consumer, returns false if it was evicted
+func (t *topic) send(c amp.Sender, ms []*amp.Msg) bool {
 	t.consumers[c] = ms[len(ms)-1].Ts
-	c.SendMsgs(ms)
+	if st, ok := t.stats[c]; ok {
+		st.received += len(ms)
+	}
+	t.opts.acks.sent(t.name, c, ms)
+	return t.deliver(c, ms)
+}
+
+// deliver sends messages to the consumer, within SendTimeout if set.
+// Consumer which doesn't receive them in time is evicted.
+// Returns false if consumer was evicted.
+func (t *topic) deliver(c amp.Sender, ms []*amp.Msg) bool {
+	if t.opts.sendTimeout <= 0 {
+		c.SendMsgs(ms)
+		return t.checkBacklog(c, ms)
+	}
+	done := make(chan struct{})
+	go func() {
+		c.SendMsgs(ms)
+		close(done)
+	}()
+	timeout, stop := newTimer(t.opts.clock, t.opts.sendTimeout)
+	defer stop()
+	select {
+	case <-done:
+		return t.checkBacklog(c, ms)
+	case <-timeout:
+		t.evict(c, done)
+		metric.Counter("broker.send.timeout")
+		log.S("topic", t.name).Info("subscriber evicted after send timeout")
+		if t.tracing {
+			t.trace(ms[len(ms)-1], c, TraceDropped, TraceReasonSendTimeout)
+		}
+		return false
+	}
+}
+
+// checkBacklog records backlog of the consumer which reports it,
+// and applies MaxBacklog action when it is exceeded.
+// Returns false if consumer was evicted.
+func (t *topic) checkBacklog(c amp.Sender, ms []*amp.Msg) bool {
+	b, ok := c.(backlogger)
+	if !ok {
+		return true
+	}
+	depth := b.Backlog()
+	metric.Time("broker.subscriber.backlog", depth)
+	t.checkSlow(c, depth)
+	if t.opts.maxBacklog <= 0 || depth <= t.opts.maxBacklog {
+		return true
+	}
+	metric.Counter("broker.subscriber.backlog_exceeded")
+	if t.opts.backlogAction == BacklogEvict {
+		t.evict(c, nil)
+		log.S("topic", t.name).I("backlog", depth).Info("subscriber evicted after backlog exceeded")
+		if t.tracing {
+			t.trace(ms[len(ms)-1], c, TraceDropped, TraceReasonBacklog)
+		}
+		return false
+	}
+	log.S("topic", t.name).I("backlog", depth).Info("subscriber backlog exceeded")
+	return true
+}
+
+// checkSlow notifies consumer when its backlog crosses SlowBacklog threshold
+func (t *topic) checkSlow(c amp.Sender, depth int) {
+	if t.opts.slowBacklog <= 0 {
+		return
+	}
+	_, wasSlow := t.slow[c]
+	slow := depth > t.opts.slowBacklog
+	if slow == wasSlow {
+		return
+	}
+	level := amp.SlowRecovered
+	if slow {
+		t.slow[c] = struct{}{}
+		level = amp.SlowWarning
+		metric.Counter("broker.subscriber.slow")
+	} else {
+		delete(t.slow, c)
+	}
+	if sc, ok := c.(amp.SlowConsumer); ok {
+		sc.SlowConsumer(level)
+	}
+}
+
+// evict removes consumer which failed to receive messages, sends it
+// Closing message so it can resubscribe, and unsubscribes it in the broker.
+// If sent is not nil Closing is sent after it is closed, when the consumer
+// receives messages it is stuck on.
+func (t *topic) evict(c amp.Sender, sent <-chan struct{}) {
+	delete(t.consumers, c)
+	delete(t.priorities, c)
+	delete(t.pending, c)
+	delete(t.fullsOnly, c)
+	delete(t.filters, c)
+	delete(t.slow, c)
+	delete(t.stats, c)
+	t.ordered = nil
+
+	ms := []*amp.Msg{amp.NewClosing(t.name, amp.ClosingInfo{Reason: "evicted"})}
+	if sent == nil {
+		c.SendMsgs(ms)
+	} else {
+		go func() {
+			<-sent
+			c.SendMsgs(ms)
+		}()
+	}
+	if t.opts.onEvict != nil {
+		t.opts.onEvict(t.name, c)
+	}
 }
 
 func (t *topic) onMessage(m *amp.Msg) {
@@ -168,44 +430,140 @@ func (t *topic) onMessage(m *amp.Msg) {
 		metric.Time(t.mOnMsgMsgCount, msgCount)
 		metric.Time(t.mOnMsgPerMsg, duration/msgCount)
 	}()
-	ms := []*amp.Msg{m}
+	if m.Ts > t.lastTs {
+		t.lastTs = m.Ts
+	}
+	if t.paused {
+		t.pausedMsg(m)
+		return
+	}
+	t.tracing = t.opts.sampled()
+	defer func() { t.tracing = false }()
 	if m.UpdateType == amp.Event {
-		for c := range t.consumers {
-			t.send(c, ms)
+		ms := []*amp.Msg{m}
+		for _, c := range t.order() {
+			if _, ok := t.fullsOnly[c]; ok {
+				t.traceSkip(m, c, TraceReasonFullsOnly)
+				continue
+			}
+			if !t.accepts(c, m) {
+				t.traceSkip(m, c, TraceReasonFiltered)
+				continue
+			}
+			t.traceSend(m, c, ms, TraceReasonMsg)
 		}
 		return
 	}
 	if t.cache == nil {
-		if m.UpdateType == amp.Append || m.UpdateType == amp.Update {
-			t.cache = newAppendCache()
-		} else {
-			t.cache = newFullDiffCache()
-		}
+		t.cache = t.newCache(m)
 	}
-	t.cache.Add(m)
+	m = t.cache.Add(m)
+	t.account()
+	ms := []*amp.Msg{m}
 	var current []*amp.Msg
-	for c, cTs := range t.consumers {
-		switch t.cache.FindFor(cTs, m) {
+	for _, c := range t.order() {
+		if _, ok := t.fullsOnly[c]; ok {
+			if !m.IsFull() {
+				t.traceSkip(m, c, TraceReasonFullsOnly)
+				continue
+			}
+			if t.cache.FindFor(t.consumers[c], m) == sendNothing {
+				t.traceSkip(m, c, TraceReasonUpToDate)
+				continue
+			}
+			t.traceSend(m, c, ms, TraceReasonMsg)
+			msgCount++
+			continue
+		}
+		switch t.cache.FindFor(t.consumers[c], m) {
 		case sendMsg:
-			t.send(c, ms)
+			if !t.accepts(c, m) {
+				t.consumers[c] = m.Ts
+				t.traceSkip(m, c, TraceReasonFiltered)
+				continue
+			}
+			t.traceSend(m, c, ms, TraceReasonMsg)
 			msgCount++
 		case sendCurrent:
+			if _, ok := t.filters[c]; ok {
+				fc := burst(t.filtered(c, t.cache.Current()))
+				t.traceSend(m, c, fc, TraceReasonCurrent)
+				msgCount += len(fc)
+				continue
+			}
 			if current == nil {
 				current = burst(t.cache.Current())
 			}
-			t.send(c, current)
+			t.traceSend(m, c, current, TraceReasonCurrent)
 			msgCount += len(current)
+		default:
+			t.traceSkip(m, c, TraceReasonUpToDate)
 		}
 	}
-	t.updatedAt = time.Now()
+	t.updatedAt = t.opts.clock.Now()
 }
 
-func (t *topic) replay() []*amp.Msg {
-	if t.cache == nil {
-		return nil
+// newCache creates cache for the type of the first message
+func (t *topic) newCache(m *amp.Msg) cache {
+	if m.UpdateType == amp.Append || m.UpdateType == amp.Update {
+		return newAppendCache()
+	}
+	fdc := newFullDiffCache()
+	fdc.hashState = t.opts.stateHash
+	fdc.sequential = t.opts.sameTs == SameTsSequential
+	fdc.contiguous = t.opts.contiguous
+	if t.primary {
+		// caches of the spreader topics are the same, gap is reported once
+		fdc.onGap = t.gapHandler()
+	}
+	return fdc
+}
+
+// order returns consumers sorted by priority, higher first.
+// Each message is sent to all of them so low priority consumers are
+// only delayed, never skipped.
+func (t *topic) order() []amp.Sender {
+	if t.ordered != nil {
+		return t.ordered
+	}
+	t.ordered = make([]amp.Sender, 0, len(t.consumers))
+	for c := range t.consumers {
+		t.ordered = append(t.ordered, c)
 	}
+	if len(t.priorities) > 0 {
+		sort.SliceStable(t.ordered, func(i, j int) bool {
+			return t.priorities[t.ordered[i]] > t.priorities[t.ordered[j]]
+		})
+	}
+	return t.ordered
+}
+
+// current returns current state from the cache,
+// also after the topic is closed
+func (t *topic) current() []*amp.Msg {
+	ret := make(chan []*amp.Msg, 1)
+	get := func() {
+		if t.cache == nil {
+			ret <- nil
+			return
+		}
+		ret <- t.cache.Current()
+	}
+	select {
+	case t.loopWork <- get:
+	case <-t.closed:
+		get()
+	}
+	return <-ret
+}
+
+func (t *topic) replay() []*amp.Msg {
 	ret := make(chan []*amp.Msg, 1)
 	t.loopWork <- func() {
+		if t.cache == nil {
+			ret <- nil
+			return
+		}
 		ret <- t.cache.Current()
 	}
 	msgs := <-ret
@@ -235,13 +593,26 @@ func (t *topic) replay() []*amp.Msg {
 
 // samo za testove
 func (t *topic) wait() {
+	t.waitContext(context.Background())
+}
+
+// waitContext waits until all published messages are delivered.
+// Returns ctx error if the queue is not drained before ctx is done,
+// e.g. when topic loop is blocked in the consumer Send.
+func (t *topic) waitContext(ctx context.Context) error {
 	for {
 		ch := make(chan int)
-		t.loopWork <- func() {
+		select {
+		case t.loopWork <- func() {
 			ch <- len(t.messages)
+		}:
+		case <-t.closed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 		if 0 == <-ch {
-			return
+			return nil
 		}
 	}
 }
@@ -1,7 +1,10 @@
 package broker
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/minus5/svckit/amp"
 	"github.com/stretchr/testify/assert"
@@ -25,3 +28,226 @@ func TestTopicReplay(t *testing.T) {
 	assert.Equal(t, m3.Ts, msgs[2].Ts)
 	assert.Equal(t, m4.Ts, msgs[3].Ts)
 }
+
+type orderConsumer struct {
+	name  string
+	order *[]string
+}
+
+func (c *orderConsumer) SendMsgs(ms []*amp.Msg) {
+	*c.order = append(*c.order, c.name)
+}
+
+func (c *orderConsumer) Send(m *amp.Msg) {
+	c.SendMsgs([]*amp.Msg{m})
+}
+
+func TestTopicPriority(t *testing.T) {
+	topic := newTopic("m")
+	var order []string
+	for i := 0; i < 10; i++ {
+		topic.subscribe(&orderConsumer{name: "low", order: &order}, 0)
+	}
+	topic.subscribePriority(&orderConsumer{name: "mid", order: &order}, 0, 1)
+	topic.subscribePriority(&orderConsumer{name: "high", order: &order}, 0, 2)
+	topic.subscribePriority(&orderConsumer{name: "high", order: &order}, 0, 2)
+
+	topic.publish(&amp.Msg{Ts: 1, UpdateType: amp.Event})
+	topic.wait()
+	assert.Len(t, order, 13)
+	assert.Equal(t, []string{"high", "high", "mid"}, order[:3])
+	for _, n := range order[3:] {
+		assert.Equal(t, "low", n)
+	}
+}
+
+func TestTopicSendTimeout(t *testing.T) {
+	topic := newTopic("m", SendTimeout(10*time.Millisecond))
+	b := &blockingConsumer{release: make(chan struct{})}
+	defer close(b.release)
+	c := &testConsumer{}
+	topic.subscribePriority(b, 0, 1) // blocking one gets messages first
+	topic.subscribe(c, 0)
+
+	start := time.Now()
+	topic.publish(&amp.Msg{Ts: 10, UpdateType: amp.Full})
+	topic.publish(&amp.Msg{Ts: 11, UpdateType: amp.Diff})
+	topic.wait()
+	// only the first send waits for timeout
+	assert.True(t, time.Since(start) < time.Second)
+
+	c.Lock()
+	assert.Len(t, c.messages, 2)
+	c.Unlock()
+	done := make(chan struct{})
+	topic.loopWork <- func() {
+		_, ok := topic.consumers[b]
+		assert.False(t, ok)
+		_, ok = topic.consumers[c]
+		assert.True(t, ok)
+		close(done)
+	}
+	<-done
+}
+
+// stalledConsumer blocks in the first SendMsgs until released
+type stalledConsumer struct {
+	release chan struct{}
+	testConsumer
+}
+
+func (c *stalledConsumer) SendMsgs(ms []*amp.Msg) {
+	<-c.release
+	c.testConsumer.SendMsgs(ms)
+}
+
+func (c *stalledConsumer) timestamps() []int64 {
+	c.Lock()
+	defer c.Unlock()
+	var ts []int64
+	for _, m := range c.messages {
+		ts = append(ts, m.Ts)
+	}
+	return ts
+}
+
+// stall subscribes consumer and publishes full which blocks topic loop
+func stall(topic *topic) *stalledConsumer {
+	c := &stalledConsumer{release: make(chan struct{})}
+	topic.subscribe(c, 0)
+	topic.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full})
+	for len(topic.messages) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return c
+}
+
+func TestTopicOverflowBlock(t *testing.T) {
+	topic := newTopic("m", MaxInFlight(2), Overflow(OverflowDropNewest), TopicOverflow("m", OverflowBlock))
+	c := stall(topic)
+	topic.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff})
+	topic.publish(&amp.Msg{Ts: 3, UpdateType: amp.Diff})
+	published := make(chan struct{})
+	go func() {
+		topic.publish(&amp.Msg{Ts: 4, UpdateType: amp.Diff})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish should block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(c.release)
+	<-published
+	topic.wait()
+	assert.Equal(t, []int64{1, 2, 3, 4}, c.timestamps())
+}
+
+func TestTopicOverflowDropNewest(t *testing.T) {
+	topic := newTopic("m", MaxInFlight(2), Overflow(OverflowDropNewest))
+	c := stall(topic)
+	assert.Nil(t, topic.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff}))
+	assert.Nil(t, topic.publish(&amp.Msg{Ts: 3, UpdateType: amp.Diff}))
+	assert.Nil(t, topic.publish(&amp.Msg{Ts: 4, UpdateType: amp.Diff})) // dropped
+	close(c.release)
+	topic.wait()
+	// diffs after the dropped one are dropped until full
+	topic.publish(&amp.Msg{Ts: 5, UpdateType: amp.Diff})
+	topic.publish(&amp.Msg{Ts: 6, UpdateType: amp.Full})
+	topic.publish(&amp.Msg{Ts: 7, UpdateType: amp.Diff})
+	topic.wait()
+	assert.Equal(t, []int64{1, 2, 3, 6, 7}, c.timestamps())
+	ms := topic.replay()
+	assert.Len(t, ms, 2)
+	assert.Equal(t, int64(6), ms[0].Ts)
+}
+
+func TestTopicOverflowDropOldest(t *testing.T) {
+	topic := newTopic("m", MaxInFlight(2), TopicOverflow("m", OverflowDropOldest))
+	c := stall(topic)
+	topic.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff})
+	topic.publish(&amp.Msg{Ts: 3, UpdateType: amp.Diff})
+	// drops 2, and 3 and 4 which depend on it
+	topic.publish(&amp.Msg{Ts: 4, UpdateType: amp.Diff})
+	topic.publish(&amp.Msg{Ts: 5, UpdateType: amp.Full})
+	topic.publish(&amp.Msg{Ts: 6, UpdateType: amp.Diff})
+	// drops 5 and 6
+	topic.publish(&amp.Msg{Ts: 7, UpdateType: amp.Full})
+	topic.publish(&amp.Msg{Ts: 8, UpdateType: amp.Diff})
+	close(c.release)
+	topic.wait()
+	assert.Equal(t, []int64{1, 7, 8}, c.timestamps())
+	ms := topic.replay()
+	assert.Len(t, ms, 2)
+	assert.Equal(t, int64(7), ms[0].Ts)
+	assert.Equal(t, int64(8), ms[1].Ts)
+}
+
+func TestTopicTrace(t *testing.T) {
+	var l sync.Mutex
+	events := make(map[string]TraceEvent)
+	topic := newTopic("m", Trace(1, func(e TraceEvent) {
+		l.Lock()
+		defer l.Unlock()
+		events[fmt.Sprintf("%s/%d", e.Subscriber, e.Ts)] = e
+	}))
+	c1 := &idConsumer{id: "c1"}
+	c2 := &idConsumer{id: "c2"}
+	topic.subscribe(c1, 0)
+	topic.subscribeFullsOnly(c2, 0)
+	topic.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full})
+	topic.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff})
+	topic.wait()
+
+	l.Lock()
+	defer l.Unlock()
+	assert.Len(t, events, 4)
+	assert.Equal(t, TraceDelivered, events["c1/1"].Action)
+	assert.Equal(t, TraceDelivered, events["c2/1"].Action)
+	assert.Equal(t, TraceDelivered, events["c1/2"].Action)
+	assert.Equal(t, TraceReasonMsg, events["c1/2"].Reason)
+	assert.Equal(t, TraceSkipped, events["c2/2"].Action)
+	assert.Equal(t, TraceReasonFullsOnly, events["c2/2"].Reason)
+	assert.Equal(t, "m", events["c2/2"].Topic)
+}
+
+// gatedConsumer records messages after release is closed
+type gatedConsumer struct {
+	testConsumer
+	release chan struct{}
+}
+
+func (c *gatedConsumer) SendMsgs(ms []*amp.Msg) {
+	<-c.release
+	c.testConsumer.SendMsgs(ms)
+}
+
+func (c *gatedConsumer) Send(m *amp.Msg) {
+	c.SendMsgs([]*amp.Msg{m})
+}
+
+func TestTopicNotifyAfterQueued(t *testing.T) {
+	topic := newTopic("m")
+	c := &gatedConsumer{release: make(chan struct{})}
+	topic.subscribe(c, 0)
+	topic.publish(&amp.Msg{Ts: 1, UpdateType: amp.Full})
+	topic.publish(&amp.Msg{Ts: 2, UpdateType: amp.Diff})
+	topic.publish(&amp.Msg{Ts: 3, UpdateType: amp.Diff})
+	done := make(chan struct{})
+	go func() {
+		topic.notify(amp.NewClosing("m", amp.ClosingInfo{Reason: "test"}))
+		topic.close()
+		close(done)
+	}()
+	close(c.release)
+	<-done
+	c.Lock()
+	defer c.Unlock()
+	var ts []int64
+	for _, m := range c.messages {
+		ts = append(ts, m.Ts)
+	}
+	assert.Len(t, c.messages, 4)
+	assert.Equal(t, []int64{1, 2, 3}, ts[:3])
+	assert.True(t, c.messages[3].IsClosing())
+}
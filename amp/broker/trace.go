@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/log"
+)
+
+// TraceAction is outcome of the message delivery to the subscriber
+type TraceAction uint8
+
+// Trace actions
+const (
+	TraceDelivered TraceAction = iota // message (or current state) sent to subscriber
+	TraceSkipped                      // subscriber doesn't need the message
+	TraceDropped                      // message lost for the subscriber
+)
+
+func (a TraceAction) String() string {
+	switch a {
+	case TraceDelivered:
+		return "delivered"
+	case TraceSkipped:
+		return "skipped"
+	case TraceDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// Trace reasons
+const (
+	TraceReasonMsg         = "msg"          // message sent as is
+	TraceReasonCurrent     = "current"      // current state sent instead of the message
+	TraceReasonUpToDate    = "up_to_date"   // subscriber already has the message
+	TraceReasonFullsOnly   = "fulls_only"   // subscriber gets only fulls
+	TraceReasonFiltered    = "filtered"     // message doesn't pass subscriber Filter
+	TraceReasonOverflow    = "overflow"     // dropped on publish by OverflowPolicy, for all subscribers
+	TraceReasonSendTimeout = "send_timeout" // subscriber evicted after SendTimeout
+	TraceReasonBacklog     = "backlog"      // subscriber evicted after MaxBacklog
+)
+
+// TraceEvent describes delivery decision for one message and subscriber
+type TraceEvent struct {
+	Topic      string
+	Ts         int64  // ts of the message
+	Subscriber string // consumer ID() or its address, empty for overflow drops
+	Action     TraceAction
+	Reason     string
+}
+
+// TraceFunc receives sampled trace events.
+// It is called from topic goroutines, and for overflow drops from
+// the publisher, so it must be safe for concurrent use.
+type TraceFunc func(e TraceEvent)
+
+// Trace enables tracing of the delivery decisions for the sampled messages.
+// Rate is fraction of the messages in (0, 1] which are traced, sampled
+// message is traced for all subscribers of the topic.
+// Nil fn logs events with svckit log.
+// Zero rate (default) disables tracing.
+func Trace(rate float64, fn TraceFunc) Option {
+	return func(o *options) {
+		if fn == nil {
+			fn = logTrace
+		}
+		o.traceRate = rate
+		o.trace = fn
+	}
+}
+
+func logTrace(e TraceEvent) {
+	log.S("topic", e.Topic).
+		I("ts", int(e.Ts)).
+		S("subscriber", e.Subscriber).
+		S("action", e.Action.String()).
+		S("reason", e.Reason).
+		Info("trace")
+}
+
+// sampled returns true if the next message should be traced
+func (o *options) sampled() bool {
+	if o.traceRate <= 0 {
+		return false
+	}
+	return o.traceRate >= 1 || rand.Float64() < o.traceRate
+}
+
+// trace reports delivery decision for the consumer, c is nil for all of them
+func (t *topic) trace(m *amp.Msg, c amp.Sender, a TraceAction, reason string) {
+	e := TraceEvent{
+		Topic:  t.name,
+		Ts:     m.Ts,
+		Action: a,
+		Reason: reason,
+	}
+	if c != nil {
+		e.Subscriber = subscriberID(c)
+	}
+	t.opts.trace(e)
+}
+
+// traceSend sends ms to the consumer and traces delivery of m
+func (t *topic) traceSend(m *amp.Msg, c amp.Sender, ms []*amp.Msg, reason string) {
+	if t.send(c, ms) && t.tracing {
+		t.trace(m, c, TraceDelivered, reason)
+	}
+}
+
+func (t *topic) traceSkip(m *amp.Msg, c amp.Sender, reason string) {
+	if t.tracing {
+		t.trace(m, c, TraceSkipped, reason)
+	}
+}
+
+// subscriberID identifies consumer in traces
+func subscriberID(c amp.Sender) string {
+	if i, ok := c.(identifier); ok {
+		return i.ID()
+	}
+	return fmt.Sprintf("%p", c)
+}
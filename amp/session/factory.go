@@ -71,6 +71,7 @@ type Sessions struct {
 	wg                 sync.WaitGroup
 	wsConnections      counter
 	poolingConnections counter
+	replayPolicy       amp.ReplayPolicy
 }
 
 // Factory creates new seessions factory.
@@ -87,12 +88,18 @@ func Factory(ctx context.Context, broker broker, requester requester) *Sessions
 	return s
 }
 
+// SetReplayPolicy sets how Replay flag of the messages is sent to websocket
+// clients, default is amp.ReplayPreserve. Must be set before Serve.
+func (s *Sessions) SetReplayPolicy(rp amp.ReplayPolicy) {
+	s.replayPolicy = rp
+}
+
 // Serve creates new session for connection.
 // Blocks until connection is closed
 func (s *Sessions) Serve(conn connection) {
 	s.wg.Add(1)
 	s.wsConnections.Up()
-	serve(s.cancelSig, conn, s.requester, s.broker, amp.CompatibilityVersionDefault)
+	serve(s.cancelSig, conn, s.requester, s.broker, amp.CompatibilityVersionDefault, s.replayPolicy)
 	s.wg.Done()
 	s.wsConnections.Down()
 }
@@ -102,7 +109,7 @@ func (s *Sessions) Serve(conn connection) {
 func (s *Sessions) ServeV1(conn connection) {
 	s.wg.Add(1)
 	s.wsConnections.Up()
-	serve(s.cancelSig, conn, s.requester, s.broker, amp.CompatibilityVersion1)
+	serve(s.cancelSig, conn, s.requester, s.broker, amp.CompatibilityVersion1, s.replayPolicy)
 	s.wg.Done()
 	s.wsConnections.Down()
 }
@@ -28,6 +28,7 @@ type session struct {
 		maxQueueLen   int
 	}
 	compatibilityVersion uint8
+	replayPolicy         amp.ReplayPolicy
 	overflow             chan struct{}
 	overflowRead         chan struct{}
 }
@@ -35,7 +36,7 @@ type session struct {
 // serve starts new session
 // Blocks until session is finished.
 func serve(cancelSig context.Context, conn connection, req requester, brk broker,
-	compatibilityVersion uint8) {
+	compatibilityVersion uint8, replayPolicy amp.ReplayPolicy) {
 	overflow := make(chan struct{}, 1)
 	s := &session{
 		conn:                 conn,
@@ -43,6 +44,7 @@ func serve(cancelSig context.Context, conn connection, req requester, brk broker
 		broker:               brk,
 		outMessages:          make(chan []*amp.Msg, 256),
 		compatibilityVersion: compatibilityVersion,
+		replayPolicy:         replayPolicy,
 		overflow:             overflow,
 		overflowRead:         overflow, // read once and set to nil
 	}
@@ -158,6 +160,22 @@ func (s *session) SendMsgs(msgs []*amp.Msg) {
 	}
 }
 
+// Backlog returns number of queued message batches not yet written to the connection.
+// Used by broker to track subscriber queue depth.
+func (s *session) Backlog() int {
+	return len(s.outMessages)
+}
+
+// SlowConsumer is called by broker when session out queue is falling behind.
+// Implements amp.SlowConsumer interface.
+func (s *session) SlowConsumer(level uint8) {
+	if level == amp.SlowWarning {
+		s.log().I("queueLen", len(s.outMessages)).Info("slow consumer")
+		return
+	}
+	s.log().Info("slow consumer recovered")
+}
+
 // should be called during s.Lock
 func (s *session) logOutQueueOverflow() {
 	s.log().
@@ -170,13 +188,11 @@ func (s *session) logOutQueueOverflow() {
 }
 
 func (s *session) connWrite(m *amp.Msg) {
-	var payload []byte
-	deflated := false
+	compression := amp.CompressionNone
 	if s.conn.DeflateSupported() {
-		payload, deflated = m.MarshalDeflateCompatiblity(s.compatibilityVersion)
-	} else {
-		payload = m.MarshalCompatiblity(s.compatibilityVersion)
+		compression = amp.CompressionDeflate
 	}
+	payload, deflated := m.MarshalWith(compression, s.compatibilityVersion, s.replayPolicy)
 	if payload == nil {
 		return
 	}
@@ -0,0 +1,109 @@
+package amp
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrOutOfOrder is returned from State.Fold for diff older than the state
+// which was not applied to it. State can't be fixed by the diff, caller
+// should resubscribe for a new full.
+var ErrOutOfOrder = errors.New("diff is older than the state")
+
+// State folds full and diff messages of a topic into its current state.
+// Diffs received before the first full are kept and applied after it.
+// Messages already in the state, e.g. replays after resubscribe, are ignored.
+// Newer full (original or replay) replaces the state.
+// State is not safe for concurrent use.
+type State struct {
+	current *Msg
+	fullTs  int64   // Ts of the full the state is based on
+	applied []int64 // Ts of the diffs applied after the full, sorted
+	pending []*Msg  // diffs waiting for the full, sorted by Ts
+}
+
+// Fold applies message to the state.
+// Returns ErrNotMergeable for messages other than full and diff,
+// ErrOutOfOrder for diff older than the state which is not in it, and
+// Apply errors for diffs which can't be merged. State is not changed on error.
+func (s *State) Fold(m *Msg) error {
+	switch m.UpdateType {
+	case Full:
+		if s.current != nil && m.Ts <= s.current.Ts {
+			return nil
+		}
+		return s.applyPending(m)
+	case Diff:
+		if s.current == nil {
+			s.addPending(m)
+			return nil
+		}
+		if m.Ts <= s.current.Ts {
+			if s.contains(m.Ts) {
+				return nil
+			}
+			return ErrOutOfOrder
+		}
+		c, err := Apply(s.current, m)
+		if err != nil {
+			return err
+		}
+		s.current = c
+		s.applied = append(s.applied, m.Ts)
+		return nil
+	}
+	return ErrNotMergeable
+}
+
+// contains reports whether message with ts is already in the state
+func (s *State) contains(ts int64) bool {
+	if ts <= s.fullTs {
+		return true
+	}
+	i := sort.Search(len(s.applied), func(i int) bool { return s.applied[i] >= ts })
+	return i < len(s.applied) && s.applied[i] == ts
+}
+
+// addPending inserts diff in Ts order, duplicates are skipped
+func (s *State) addPending(m *Msg) {
+	i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i].Ts >= m.Ts })
+	if i < len(s.pending) && s.pending[i].Ts == m.Ts {
+		return
+	}
+	s.pending = append(s.pending, nil)
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = m
+}
+
+// applyPending makes full with pending diffs newer than it the state.
+// On error state and pending diffs are left as they were.
+func (s *State) applyPending(full *Msg) error {
+	c := full
+	var applied []int64
+	for _, d := range s.pending {
+		if d.Ts <= c.Ts {
+			continue
+		}
+		n, err := Apply(c, d)
+		if err != nil {
+			return err
+		}
+		c = n
+		applied = append(applied, d.Ts)
+	}
+	s.current, s.fullTs, s.applied, s.pending = c, full.Ts, applied, nil
+	return nil
+}
+
+// Current returns folded state as full message, nil until the first full.
+func (s *State) Current() *Msg {
+	return s.current
+}
+
+// Ts returns Ts of the last applied message, 0 until the first full.
+func (s *State) Ts() int64 {
+	if s.current == nil {
+		return 0
+	}
+	return s.current.Ts
+}
@@ -0,0 +1,79 @@
+package amp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateFold(t *testing.T) {
+	var s State
+	assert.Nil(t, s.Current())
+	assert.Equal(t, int64(0), s.Ts())
+
+	// diffs before the full wait for it, out of order and duplicates included
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, body: []byte(`{"c":3}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 1, UpdateType: Diff, body: []byte(`{"a":null}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, body: []byte(`{"c":3}`)}))
+	assert.Nil(t, s.Current())
+
+	assert.Nil(t, s.Fold(&Msg{Ts: 2, UpdateType: Full, Replay: Replay, body: []byte(`{"a":1,"b":2}`)}))
+	assert.Equal(t, int64(3), s.Ts())
+	assert.Equal(t, `{"a":1,"b":2,"c":3}`, string(s.Current().body))
+
+	// replayed diff already in the state is ignored
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, Replay: Replay, body: []byte(`{"c":4}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 4, UpdateType: Diff, body: []byte(`{"b":null}`)}))
+	assert.Equal(t, `{"a":1,"c":3}`, string(s.Current().body))
+
+	// older full is ignored, newer replaces state
+	assert.Nil(t, s.Fold(&Msg{Ts: 4, UpdateType: Full, body: []byte(`{}`)}))
+	assert.Equal(t, `{"a":1,"c":3}`, string(s.Current().body))
+	assert.Nil(t, s.Fold(&Msg{Ts: 5, UpdateType: Full, body: []byte(`{"d":5}`)}))
+	assert.Equal(t, `{"d":5}`, string(s.Current().body))
+	assert.Equal(t, int64(5), s.Ts())
+
+	assert.Equal(t, ErrNotMergeable, s.Fold(&Msg{Ts: 6, UpdateType: Append}))
+	assert.NotNil(t, s.Fold(&Msg{Ts: 6, UpdateType: Diff, body: []byte(`[1]`)}))
+	assert.Equal(t, int64(5), s.Ts())
+}
+
+func TestStateFoldOutOfOrder(t *testing.T) {
+	var s State
+	assert.Nil(t, s.Fold(&Msg{Ts: 1, UpdateType: Full, body: []byte(`{"a":1}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, body: []byte(`{"c":3}`)}))
+
+	// diff between the full and the applied diff is missing from the state
+	assert.Equal(t, ErrOutOfOrder, s.Fold(&Msg{Ts: 2, UpdateType: Diff, body: []byte(`{"b":2}`)}))
+	assert.Equal(t, `{"a":1,"c":3}`, string(s.Current().body))
+
+	// duplicates of the full and applied diffs are ignored
+	assert.Nil(t, s.Fold(&Msg{Ts: 1, UpdateType: Full, body: []byte(`{"a":1}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 1, UpdateType: Diff, body: []byte(`{"a":2}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, body: []byte(`{"c":4}`)}))
+	assert.Equal(t, `{"a":1,"c":3}`, string(s.Current().body))
+
+	// new full resets applied diffs
+	assert.Nil(t, s.Fold(&Msg{Ts: 4, UpdateType: Full, body: []byte(`{"d":4}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, body: []byte(`{"c":3}`)}))
+	assert.Equal(t, `{"d":4}`, string(s.Current().body))
+}
+
+func TestStateFoldPendingError(t *testing.T) {
+	var s State
+	assert.Nil(t, s.Fold(&Msg{Ts: 2, UpdateType: Diff, body: []byte(`{"b":2}`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Diff, body: []byte(`[3]`)}))
+	assert.Nil(t, s.Fold(&Msg{Ts: 4, UpdateType: Diff, body: []byte(`{"d":4}`)}))
+
+	// full is not applied half way, pending diffs are kept
+	assert.NotNil(t, s.Fold(&Msg{Ts: 1, UpdateType: Full, body: []byte(`{"a":1}`)}))
+	assert.Nil(t, s.Current())
+	assert.Len(t, s.pending, 3)
+
+	// full newer than the broken diff applies the rest
+	assert.Nil(t, s.Fold(&Msg{Ts: 3, UpdateType: Full, body: []byte(`{"a":1,"b":2,"c":3}`)}))
+	assert.Equal(t, `{"a":1,"b":2,"c":3,"d":4}`, string(s.Current().body))
+	assert.Len(t, s.pending, 0)
+	assert.Nil(t, s.Fold(&Msg{Ts: 4, UpdateType: Diff, body: []byte(`{"d":5}`)}))
+	assert.Equal(t, int64(4), s.Ts())
+}
@@ -3,48 +3,147 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
 
-	"github.com/koding/websocketproxy"
 	"github.com/minus5/svckit/env"
 	"github.com/minus5/svckit/log"
 )
 
 type config struct {
 	Services []string
-	HTTP     struct {
+	// stop services which are already started when one fails to start
+	StopStartedOnError bool `yaml:"stop_started_on_error"`
+	HTTP               struct {
 		Port  int
+		Debug bool // expose pprof and metrics under /cockpit/debug
 		Proxy []struct {
-			URL     string
-			Backend string
+			URL         string
+			Backend     string
+			DialTimeout time.Duration `yaml:"dial_timeout"` // default 5s
+			Retry       time.Duration // retry dial to the backend for that long
 		}
 	}
 	services map[string]*service
 }
 
-func (c *config) start() error {
+// startResult describes which services are running after start
+type startResult struct {
+	Started []string // started services in start order
+	Missing []string // services not found in services files
+	Failed  string   // service which failed to start, empty on success
+	Err     error    // error of the failed service
+}
+
+func (r startResult) String() string {
+	s := fmt.Sprintf("started: %s", strings.Join(r.Started, ", "))
+	if len(r.Missing) > 0 {
+		s += fmt.Sprintf("; missing: %s", strings.Join(r.Missing, ", "))
+	}
+	if r.Failed != "" {
+		s += fmt.Sprintf("; failed: %s (%s)", r.Failed, r.Err)
+	}
+	return s
+}
+
+// start starts services in order, stops at the first one which fails.
+// With StopStartedOnError already started services are stopped then.
+func (c *config) start() startResult {
+	var r startResult
 	for _, key := range c.Services {
 		service := c.services[key]
 		if service == nil {
 			warn("Service %s not found\n", key)
+			r.Missing = append(r.Missing, key)
 			continue
 		}
 		if err := service.Go(); err != nil {
 			log.S("service", service.Name).Error(err)
 			warn("Failed to start %s\n", service)
-			return err
+			r.Failed = key
+			r.Err = err
+			break
 		}
+		r.Started = append(r.Started, key)
+	}
+	if r.Err != nil {
+		if c.StopStartedOnError {
+			c.stopServices(r.Started)
+		}
+		return r
 	}
 	info(">")
-	return nil
+	return r
 }
 
 func (c *config) stop() {
-	for i := len(c.Services) - 1; i >= 0; i-- {
-		service := c.services[c.Services[i]]
-		service.stop()
+	for _, key := range c.stopOrder() {
+		c.services[key].stop()
+	}
+}
+
+// stopServices stops given services in stop order
+func (c *config) stopServices(keys []string) {
+	stop := make(map[string]bool)
+	for _, key := range keys {
+		stop[key] = true
+	}
+	for _, key := range c.stopOrder() {
+		if stop[key] {
+			c.services[key].stop()
+		}
+	}
+}
+
+// stopOrder returns services in reverse dependency order, dependents before
+// their dependencies. Independent services are stopped in reverse start order.
+// Services in dependency cycle are stopped in reverse start order at the end.
+func (c *config) stopOrder() []string {
+	// dependents of each service
+	dependents := make(map[string][]string)
+	for _, key := range c.Services {
+		if s := c.services[key]; s != nil {
+			for _, dep := range s.DependsOn {
+				dependents[dep] = append(dependents[dep], key)
+			}
+		}
+	}
+	stopped := make(map[string]bool)
+	var order []string
+	for {
+		next := ""
+		for i := len(c.Services) - 1; i >= 0; i-- {
+			key := c.Services[i]
+			if stopped[key] {
+				continue
+			}
+			ready := true
+			for _, d := range dependents[key] {
+				if !stopped[d] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = key
+				break
+			}
+		}
+		if next != "" {
+			stopped[next] = true
+			order = append(order, next)
+			continue
+		}
+		// all stopped or the rest is in cycle
+		for i := len(c.Services) - 1; i >= 0; i-- {
+			if key := c.Services[i]; !stopped[key] {
+				warn("Dependency cycle, stopping %s\n", key)
+				stopped[key] = true
+				order = append(order, key)
+			}
+		}
+		return order
 	}
 }
 
@@ -52,6 +151,8 @@ func (c *config) startHTTP() error {
 	if c.HTTP.Port == 0 {
 		return nil
 	}
+	// own mux, so that net/http/pprof is not exposed on the default one
+	mux := http.NewServeMux()
 	for _, p := range c.HTTP.Proxy {
 		u, err := url.Parse(p.Backend)
 		if err != nil {
@@ -59,18 +160,24 @@ func (c *config) startHTTP() error {
 			return err
 		}
 		if strings.HasPrefix(p.Backend, "http://") {
-			http.Handle(p.URL, httputil.NewSingleHostReverseProxy(u))
+			mux.Handle(p.URL, countRequests(p.URL, newHTTPProxy(u, p.DialTimeout, p.Retry)))
 			continue
 		}
 		if strings.HasPrefix(p.Backend, "ws://") {
-			http.Handle(p.URL, websocketproxy.NewProxy(u))
+			mux.Handle(p.URL, countRequests(p.URL, newWebsocketProxy(u, p.DialTimeout, p.Retry)))
 			continue
 		}
 		fs := http.FileServer(http.Dir(env.ExpandPath(p.Backend)))
-		http.Handle(p.URL, fs)
+		mux.Handle(p.URL, countRequests(p.URL, fs))
+	}
+	if c.HTTP.Debug {
+		if err := c.handleDebug(mux); err != nil {
+			log.Error(err)
+			return err
+		}
 	}
 	go func() {
-		http.ListenAndServe(fmt.Sprintf(":%d", c.HTTP.Port), nil)
+		http.ListenAndServe(fmt.Sprintf(":%d", c.HTTP.Port), mux)
 	}()
 	return nil
 }
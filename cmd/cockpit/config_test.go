@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopOrder(t *testing.T) {
+	cases := []struct {
+		name      string
+		services  []string
+		dependsOn map[string][]string
+		order     []string
+	}{
+		{
+			name:     "independent in reverse start order",
+			services: []string{"a", "b", "c"},
+			order:    []string{"c", "b", "a"},
+		},
+		{
+			name:      "dependent before dependency started after it",
+			services:  []string{"a", "b", "c"},
+			dependsOn: map[string][]string{"a": {"c"}},
+			order:     []string{"b", "a", "c"},
+		},
+		{
+			name:      "diamond",
+			services:  []string{"d", "a", "b", "c"},
+			dependsOn: map[string][]string{"d": {"b", "c"}, "b": {"a"}, "c": {"a"}},
+			order:     []string{"d", "c", "b", "a"},
+		},
+		{
+			name:      "cycle at the end",
+			services:  []string{"a", "b", "c"},
+			dependsOn: map[string][]string{"a": {"b"}, "b": {"a"}},
+			order:     []string{"c", "b", "a"},
+		},
+		{
+			name:      "service not found",
+			services:  []string{"a", "x", "b"},
+			dependsOn: map[string][]string{"b": {"a"}},
+			order:     []string{"b", "x", "a"},
+		},
+	}
+	for _, c := range cases {
+		cfg := &config{Services: c.services, services: make(map[string]*service)}
+		for _, key := range c.services {
+			if key != "x" {
+				cfg.services[key] = &service{Name: key, DependsOn: c.dependsOn[key]}
+			}
+		}
+		assert.Equal(t, c.order, cfg.stopOrder(), c.name)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/http/pprof"
+	"net/url"
+	"runtime"
+	"sync"
+)
+
+const debugPrefix = "/cockpit/debug"
+
+// proxyRequests counts requests per proxy url
+var proxyRequests = struct {
+	m map[string]int64
+	sync.Mutex
+}{m: make(map[string]int64)}
+
+func countRequests(url string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyRequests.Lock()
+		proxyRequests.m[url]++
+		proxyRequests.Unlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleDebug registers cockpit pprof, metrics and backends pprof passthrough
+// under the debugPrefix.
+func (c *config) handleDebug(mux *http.ServeMux) error {
+	// pprof handlers expect /debug/pprof/ path
+	pm := http.NewServeMux()
+	pm.HandleFunc("/debug/pprof/", pprof.Index)
+	pm.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	pm.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	pm.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	pm.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle(debugPrefix+"/pprof/", http.StripPrefix("/cockpit", pm))
+
+	mux.HandleFunc(debugPrefix+"/metrics", debugMetrics)
+
+	// backend is expected to serve pprof on /debug/pprof/
+	// ref: httpi.Pprof
+	for _, key := range c.Services {
+		s := c.services[key]
+		if s == nil || s.Port == 0 {
+			continue
+		}
+		u, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", s.Port))
+		if err != nil {
+			return err
+		}
+		// only pprof of the backend is passed through, not its other routes
+		prefix := fmt.Sprintf("%s/%s", debugPrefix, s.Name)
+		mux.Handle(prefix+"/debug/pprof/", http.StripPrefix(prefix, httputil.NewSingleHostReverseProxy(u)))
+	}
+	return nil
+}
+
+func debugMetrics(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	proxyRequests.Lock()
+	requests := make(map[string]int64)
+	for k, v := range proxyRequests.m {
+		requests[k] = v
+	}
+	proxyRequests.Unlock()
+
+	rsp := struct {
+		Goroutines    int              `json:"goroutines"`
+		Alloc         uint64           `json:"alloc"`
+		Sys           uint64           `json:"sys"`
+		HeapInuse     uint64           `json:"heap_inuse"`
+		NumGC         uint32           `json:"num_gc"`
+		ProxyRequests map[string]int64 `json:"proxy_requests"`
+	}{
+		Goroutines:    runtime.NumGoroutine(),
+		Alloc:         ms.Alloc,
+		Sys:           ms.Sys,
+		HeapInuse:     ms.HeapInuse,
+		NumGC:         ms.NumGC,
+		ProxyRequests: requests,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
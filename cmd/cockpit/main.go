@@ -27,7 +27,6 @@ func init() {
 	flag.StringVar(&configFile, "config", "./cockpit.yml", "config file name")
 	flag.StringVar(&bindInterface, "if", "lo0", "bind to this interface")
 	flag.BoolVar(&noClear, "no-clear", false, "do not remove tmp directory")
-	flag.Parse()
 }
 
 func logFilePath(name string) string {
@@ -59,6 +58,8 @@ func interfaceIP(ifc string) string {
 }
 
 func main() {
+	// parsed here, not in init, so test flags are not rejected
+	flag.Parse()
 	bindIP = interfaceIP(bindInterface)
 
 	if fileNotExists(configFile) {
@@ -95,8 +96,9 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 
-	err = config.start()
-	if err == nil {
+	r := config.start()
+	log.S("result", r.String()).Info("start")
+	if r.Err == nil {
 		config.startHTTP()
 
 		f, err := os.Create(logFilePath("metrics"))
@@ -150,6 +152,9 @@ func loadServicesFile(file string) map[string]*service {
 	}
 	for name, s := range services {
 		s.init(name)
+		if err := s.compileReadyLog(); err != nil {
+			log.S("path", file).Fatal(err)
+		}
 	}
 	return services
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/koding/websocketproxy"
+	"github.com/minus5/svckit/log"
+)
+
+const (
+	defaultDialTimeout = 5 * time.Second
+	minDialBackoff     = 50 * time.Millisecond
+	maxDialBackoff     = time.Second
+)
+
+// retryDial returns dial func which retries failed dial with backoff
+// until retry duration passes, so requests which arrive while the backend
+// is still starting succeed once it is listening.
+// Only connecting is retried, request is not sent before that.
+func retryDial(timeout, retry time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		deadline := time.Now().Add(retry)
+		backoff := minDialBackoff
+		for {
+			conn, err := d.DialContext(ctx, network, addr)
+			if err == nil {
+				return conn, nil
+			}
+			if time.Now().Add(backoff).After(deadline) {
+				return nil, err
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, err
+			}
+			if backoff *= 2; backoff > maxDialBackoff {
+				backoff = maxDialBackoff
+			}
+		}
+	}
+}
+
+// newHTTPProxy proxies requests to u.
+// Outgoing request carries context of the incoming one (ReverseProxy does
+// that), so when the client goes away dial, retry and backend call are cancelled.
+func newHTTPProxy(u *url.URL, timeout, retry time.Duration) http.Handler {
+	p := httputil.NewSingleHostReverseProxy(u)
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = retryDial(timeout, retry)
+	p.Transport = t
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() != nil {
+			// client is gone, nobody reads the response
+			return
+		}
+		log.S("url", r.URL.Path).Error(err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return p
+}
+
+// wsProxy proxies websocket connections to u.
+// Backend is dialed with the context of the incoming request, so dial and
+// retry stop when the client disconnects during handshake.
+// When either side closes websocketproxy closes the other one.
+type wsProxy struct {
+	u    *url.URL
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newWebsocketProxy(u *url.URL, timeout, retry time.Duration) http.Handler {
+	return &wsProxy{u: u, dial: retryDial(timeout, retry)}
+}
+
+func (p *wsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	wp := websocketproxy.NewProxy(p.u)
+	wp.Dialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		NetDialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return p.dial(ctx, network, addr)
+		},
+	}
+	wp.ServeHTTP(w, r)
+}
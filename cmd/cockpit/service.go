@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
@@ -40,6 +43,16 @@ type service struct {
 	Kill       string
 	Env        []string
 	KV         map[string]string
+	// wait after start before starting next service
+	StartupDelay time.Duration `yaml:"startup_delay"`
+	// regexp matched against service output, service is ready when it matches
+	ReadyLog     string        `yaml:"ready_log"`
+	ReadyTimeout time.Duration `yaml:"ready_timeout"`
+	readyLog     *regexp.Regexp
+	// services which must be stopped after this one
+	DependsOn []string `yaml:"depends_on"`
+	// wait after interrupt before kill, default 20s
+	StopTimeout time.Duration `yaml:"stop_timeout"`
 }
 
 type serviceConsul struct {
@@ -53,6 +66,11 @@ type serviceConsul struct {
 
 var netPortRange = 9000
 
+const (
+	defaultReadyTimeout = 30 * time.Second
+	defaultStopTimeout  = 20 * time.Second
+)
+
 func netPort() int {
 	netPortRange++
 	return netPortRange
@@ -90,6 +108,20 @@ func (s *service) init(name string) {
 	}
 }
 
+// compileReadyLog compiles ReadyLog so that invalid regexp is reported
+// when the services are loaded
+func (s *service) compileReadyLog() error {
+	if s.ReadyLog == "" {
+		return nil
+	}
+	re, err := regexp.Compile(s.ReadyLog)
+	if err != nil {
+		return fmt.Errorf("%s ready_log: %s", s.Name, err)
+	}
+	s.readyLog = re
+	return nil
+}
+
 func (s service) String() string {
 	return s.Name
 }
@@ -113,10 +145,15 @@ func (s *service) stop() {
 	} else {
 		s.cmd.Process.Signal(os.Interrupt)
 	}
+	timeout := s.StopTimeout
+	if timeout <= 0 {
+		timeout = defaultStopTimeout
+	}
 	select {
 	case <-s.done:
 		return
-	case <-time.After(20 * time.Second):
+	case <-time.After(timeout):
+		warn("Killing %s after %s\n", s, timeout)
 		s.cmd.Process.Signal(os.Kill)
 		select {
 		case <-s.done:
@@ -305,7 +342,55 @@ func (s *service) Go() error {
 	if err := s.start(); err != nil {
 		return err
 	}
-	return nil
+	return s.waitReady()
+}
+
+// waitReady waits for StartupDelay and then for ReadyLog line in service output.
+// If ReadyLog is not found in ReadyTimeout it warns and continues.
+func (s *service) waitReady() error {
+	if s.StartupDelay > 0 {
+		time.Sleep(s.StartupDelay)
+	}
+	if s.readyLog == nil || s.done == nil {
+		return nil
+	}
+	timeout := s.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	deadline := time.After(timeout)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	// unterminated last line of the output read so far
+	var line []byte
+	for {
+		if f == nil {
+			f, _ = os.Open(logFilePath(s.Name))
+		}
+		if f != nil {
+			// only bytes written since the last read
+			if buf, err := ioutil.ReadAll(f); err == nil && len(buf) > 0 {
+				buf = append(line, buf...)
+				if s.readyLog.Match(buf) {
+					info("Ready %s\n", s)
+					return nil
+				}
+				line = buf[bytes.LastIndexByte(buf, '\n')+1:]
+			}
+		}
+		select {
+		case <-s.done:
+			return fmt.Errorf("%s stopped before ready", s)
+		case <-deadline:
+			warn("Ready line not found for %s in %s\n", s, timeout)
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
 }
 
 func consulConnect() (*api.Client, error) {
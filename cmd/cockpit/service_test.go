@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileReadyLog(t *testing.T) {
+	s := &service{Name: "a", ReadyLog: "listening on [0-9]+"}
+	assert.Nil(t, s.compileReadyLog())
+	assert.NotNil(t, s.readyLog)
+	assert.EqualError(t, (&service{Name: "a", ReadyLog: "("}).compileReadyLog(),
+		"a ready_log: error parsing regexp: missing closing ): `(`")
+}
+
+func TestWaitReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cockpit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	assert.Nil(t, os.Mkdir("log", 0755))
+
+	s := &service{Name: "a", ReadyLog: "listening on [0-9]+", ReadyTimeout: -1, done: make(chan struct{})}
+	assert.Nil(t, s.compileReadyLog())
+	f, err := os.Create(logFilePath(s.Name))
+	assert.Nil(t, err)
+	defer f.Close()
+	go func() {
+		// ready line is written in parts
+		for _, p := range []string{"starting\nlisten", "ing on ", "80", "80\n"} {
+			f.WriteString(p)
+			time.Sleep(150 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	assert.Nil(t, s.waitReady())
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+}
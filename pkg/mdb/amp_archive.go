@@ -0,0 +1,137 @@
+package mdb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/minus5/svckit/amp"
+)
+
+var errInvalidMsg = errors.New("invalid archived message")
+
+// AmpArchive stores amp messages in Fs, one file per message.
+// File type is message URI, upload date is message Ts (unix milliseconds).
+// Implements broker.Archive, broker.Persister, broker.LatestPersister
+// and broker.LatestLoader.
+type AmpArchive struct {
+	fs *Fs
+}
+
+// NewAmpArchive creates archive in fs
+func NewAmpArchive(fs *Fs) *AmpArchive {
+	return &AmpArchive{fs: fs}
+}
+
+// Save stores message
+func (a *AmpArchive) Save(m *amp.Msg) error {
+	return a.fs.Insert(m.URI, nil, msTime(m.Ts), bytes.NewReader(m.Marshal()))
+}
+
+// SaveLatest stores message and removes older messages of the topic
+func (a *AmpArchive) SaveLatest(m *amp.Msg) error {
+	return a.fs.ReplaceLatest(m.URI, msTime(m.Ts), bytes.NewReader(m.Marshal()))
+}
+
+// Latest returns the newest stored message of the topic,
+// for restoring topic saved by broker.PersistFulls.
+// Returns ErrNotFound if there are no messages of the topic.
+func (a *AmpArchive) Latest(topic string) (*amp.Msg, error) {
+	var m *amp.Msg
+	err := a.fs.Find(topic, func(rc io.ReadCloser, _ time.Time, _ interface{}) error {
+		buf, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		if m = amp.Parse(buf); m == nil {
+			return errInvalidMsg
+		}
+		return nil
+	})
+	return m, err
+}
+
+// LoadLatest returns the newest stored message of the topic,
+// nil if there is none
+func (a *AmpArchive) LoadLatest(topic string) (*amp.Msg, error) {
+	m, err := a.Latest(topic)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return m, err
+}
+
+// RemoveUntil removes messages of the topic with Ts <= ts
+func (a *AmpArchive) RemoveUntil(topic string, ts int64) error {
+	_, err := a.fs.RemoveUntil(topic, msTime(ts))
+	return err
+}
+
+// Diffs calls h in ts order for messages of the topic with fromTs < Ts < toTs
+func (a *AmpArchive) Diffs(topic string, fromTs, toTs int64, h func(*amp.Msg) error) error {
+	return a.fs.SeekRange(topic, msTime(fromTs), msTime(toTs), parseMsg(h))
+}
+
+// After calls h in ts order for messages of the topic with Ts > fromTs
+func (a *AmpArchive) After(topic string, fromTs int64, h func(*amp.Msg) error) error {
+	return a.fs.Seek(topic, msTime(fromTs), parseMsg(h))
+}
+
+// parseMsg returns Fs handler which calls h with the stored message
+func parseMsg(h func(*amp.Msg) error) func(io.ReadCloser, time.Time, interface{}) error {
+	return func(rc io.ReadCloser, _ time.Time, _ interface{}) error {
+		buf, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		m := amp.Parse(buf)
+		if m == nil {
+			return errInvalidMsg
+		}
+		return h(m)
+	}
+}
+
+// AmpStore is broker.Store backed by Fs, the default store for
+// broker.PersistStore. Fulls and diffs are kept in separate archives,
+// so the newest full is found without scanning diffs.
+type AmpStore struct {
+	fulls *AmpArchive
+	diffs *AmpArchive
+}
+
+// NewAmpStore creates store with fulls and diffs in separate Fs buckets
+func NewAmpStore(fulls, diffs *Fs) *AmpStore {
+	return &AmpStore{fulls: NewAmpArchive(fulls), diffs: NewAmpArchive(diffs)}
+}
+
+// SaveFull stores full message, older fulls of the topic are removed.
+// Diffs up to the full are removed after it is stored, Restore doesn't
+// need them.
+func (s *AmpStore) SaveFull(m *amp.Msg) error {
+	if err := s.fulls.SaveLatest(m); err != nil {
+		return err
+	}
+	return s.diffs.RemoveUntil(m.URI, m.Ts)
+}
+
+// LoadFull returns the newest stored full of the topic, nil if there is none
+func (s *AmpStore) LoadFull(topic string) (*amp.Msg, error) {
+	return s.fulls.LoadLatest(topic)
+}
+
+// AppendDiff stores diff message
+func (s *AmpStore) AppendDiff(m *amp.Msg) error {
+	return s.diffs.Save(m)
+}
+
+// LoadDiffs calls h in ts order for stored diffs of the topic with Ts > fromTs
+func (s *AmpStore) LoadDiffs(topic string, fromTs int64, h func(*amp.Msg) error) error {
+	return s.diffs.After(topic, fromTs, h)
+}
+
+func msTime(ts int64) time.Time {
+	return time.Unix(0, ts*int64(time.Millisecond))
+}
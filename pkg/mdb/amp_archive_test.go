@@ -0,0 +1,66 @@
+package mdb
+
+import (
+	"testing"
+
+	"github.com/minus5/svckit/amp"
+	"github.com/minus5/svckit/amp/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ broker.LatestPersister = (*AmpArchive)(nil)
+	_ broker.LatestLoader    = (*AmpArchive)(nil)
+	_ broker.Store           = (*AmpStore)(nil)
+)
+
+func TestAmpArchiveRestore(t *testing.T) {
+	fs, cleanup := testFs(t)
+	defer cleanup()
+	a := NewAmpArchive(fs)
+	m, err := a.LoadLatest("1")
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	s := broker.New(nil, broker.PersistFulls(a, 0))
+	in := make(chan *amp.Msg, 2)
+	in <- amp.NewPublish("1", "", 1, amp.Full, map[string]int{"a": 1})
+	in <- amp.NewPublish("1", "", 2, amp.Full, map[string]int{"a": 2})
+	close(in)
+	s.Consume(in)
+	s.Wait()
+	m, err = a.LoadLatest("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), m.Ts)
+	assert.Len(t, liveIds(t, fs, "1"), 1)
+
+	s = broker.New(nil, broker.PersistFulls(a, 0))
+	assert.Nil(t, s.Restore("1"))
+	assert.True(t, s.HasFull("1"))
+	assert.Equal(t, int64(2), s.LatestTs("1"))
+}
+
+func TestAmpStorePrunesDiffs(t *testing.T) {
+	fulls, cleanup := testFs(t)
+	defer cleanup()
+	diffs := fulls.db.NewFs("diffs")
+	s := NewAmpStore(fulls, diffs)
+	for ts := int64(1); ts <= 3; ts++ {
+		assert.Nil(t, s.AppendDiff(amp.NewPublish("1", "", ts, amp.Diff, map[string]int64{"a": ts})))
+	}
+	assert.Nil(t, s.AppendDiff(amp.NewPublish("2", "", 1, amp.Diff, map[string]int{"b": 1})))
+
+	// diffs up to the full are removed, other topics are not changed
+	assert.Nil(t, s.SaveFull(amp.NewPublish("1", "", 2, amp.Full, map[string]int{"a": 2})))
+	assert.Len(t, liveIds(t, diffs, "1"), 1)
+	assert.Len(t, liveIds(t, diffs, "2"), 1)
+	var ts []int64
+	assert.Nil(t, s.LoadDiffs("1", 0, func(m *amp.Msg) error {
+		ts = append(ts, m.Ts)
+		return nil
+	}))
+	assert.Equal(t, []int64{3}, ts)
+	full, err := s.LoadFull("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), full.Ts)
+}
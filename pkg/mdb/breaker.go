@@ -0,0 +1,156 @@
+package mdb
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/svckit/health"
+	"github.com/minus5/svckit/log"
+)
+
+// ErrCircuitOpen is returned without calling mongo while circuit breaker is open
+var ErrCircuitOpen = errors.New("mongo circuit open")
+
+// circuit breaker states
+const (
+	CircuitClosed   = "closed"    // operations are passed to mongo
+	CircuitOpen     = "open"      // operations fail fast with ErrCircuitOpen
+	CircuitHalfOpen = "half-open" // single probe operation is passed to mongo
+)
+
+// CircuitBreaker opens circuit after failures consecutive operations fail
+// within window because mongo is unavailable. While open Use, UseFs (and all
+// Fs methods) fail fast with ErrCircuitOpen. After cooldown single probe
+// operation is allowed, its success closes the circuit, failure opens it again.
+// Only connection errors are counted, errors returned by the server
+// (not found, duplicate...) and by the handler mean mongo is available.
+func CircuitBreaker(failures int, window, cooldown time.Duration) func(db *Mdb) {
+	return func(db *Mdb) {
+		db.breaker = &breaker{failures: failures, window: window, cooldown: cooldown, state: CircuitClosed}
+	}
+}
+
+type breaker struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+
+	state    string
+	count    int       // consecutive failures
+	first    time.Time // first of the consecutive failures
+	openedAt time.Time
+	probing  bool
+	sync.Mutex
+}
+
+// allow returns ErrCircuitOpen if the operation should not be tried
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records result of the allowed operation
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if !unavailable(err) {
+		if b.state != CircuitClosed {
+			log.S("state", CircuitClosed).Info("mongo circuit breaker")
+		}
+		b.state = CircuitClosed
+		b.count = 0
+		b.probing = false
+		return
+	}
+	now := time.Now()
+	if b.state == CircuitHalfOpen {
+		b.open(now)
+		return
+	}
+	if b.count == 0 || now.Sub(b.first) > b.window {
+		b.count = 0
+		b.first = now
+	}
+	b.count++
+	if b.state == CircuitClosed && b.count >= b.failures {
+		b.open(now)
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = CircuitOpen
+	b.openedAt = now
+	b.probing = false
+	b.count = 0
+	log.S("state", CircuitOpen).Info("mongo circuit breaker")
+}
+
+func (b *breaker) currentState() string {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// unavailable returns true for errors caused by mongo being unreachable
+func unavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	return msg == "no reachable servers" || strings.Contains(msg, "Closed explicitly")
+}
+
+// CircuitState returns state of the circuit breaker,
+// CircuitClosed if it is not configured.
+func (db *Mdb) CircuitState() string {
+	return db.breaker.currentState()
+}
+
+// Health is health check handler (health.Set) reporting circuit breaker state:
+// passing when closed, warn when half-open and fail when open.
+func (db *Mdb) Health() (health.Status, []byte) {
+	state := db.CircuitState()
+	note, _ := json.Marshal(map[string]string{"db": db.name, "circuit": state})
+	switch state {
+	case CircuitOpen:
+		return health.Fail, note
+	case CircuitHalfOpen:
+		return health.Warn, note
+	}
+	return health.Passing, note
+}
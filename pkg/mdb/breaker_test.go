@@ -0,0 +1,43 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{failures: 2, window: time.Minute, cooldown: 10 * time.Millisecond, state: CircuitClosed}
+
+	// handler and server errors don't count
+	assert.Nil(t, b.allow())
+	b.done(errors.New("handler error"))
+	assert.Nil(t, b.allow())
+	b.done(io.EOF)
+	assert.Equal(t, CircuitClosed, b.currentState())
+	assert.Nil(t, b.allow())
+	b.done(io.EOF)
+	assert.Equal(t, CircuitOpen, b.currentState())
+	assert.Equal(t, ErrCircuitOpen, b.allow())
+
+	// after cooldown single probe
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, b.allow())
+	assert.Equal(t, CircuitHalfOpen, b.currentState())
+	assert.Equal(t, ErrCircuitOpen, b.allow())
+	b.done(io.EOF)
+	assert.Equal(t, CircuitOpen, b.currentState())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, b.allow())
+	b.done(nil)
+	assert.Equal(t, CircuitClosed, b.currentState())
+	assert.Nil(t, b.allow())
+
+	var nb *breaker
+	assert.Nil(t, nb.allow())
+	assert.Equal(t, CircuitClosed, nb.currentState())
+}
@@ -0,0 +1,99 @@
+package mdb
+
+import (
+	"fmt"
+
+	"github.com/globalsign/mgo"
+)
+
+// maxBulkOps is number of operations sent to mongo in one batch
+const maxBulkOps = 1000
+
+// BulkOp is single operation in BulkUpsert
+type BulkOp struct {
+	Selector interface{}
+	Update   interface{}
+	Upsert   bool // insert document if selector doesn't match any
+	Multi    bool // update all matched documents, ignored for upsert
+}
+
+// BulkResult counts documents changed by BulkUpsert.
+// Matched includes upserted documents, driver does not report them separately.
+// Counts of the batch with failed operations are unknown and not included.
+type BulkResult struct {
+	Matched  int
+	Modified int
+}
+
+// BulkErrorCase is error of the single operation
+type BulkErrorCase struct {
+	Index int // position in ops, -1 if unknown
+	Err   error
+}
+
+// BulkError lists failed operations of the BulkUpsert
+type BulkError struct {
+	Cases []BulkErrorCase
+}
+
+func (e *BulkError) Error() string {
+	if len(e.Cases) == 1 {
+		return e.Cases[0].Err.Error()
+	}
+	return fmt.Sprintf("%d bulk operations failed, first: %s", len(e.Cases), e.Cases[0].Err)
+}
+
+// BulkUpsert runs update and upsert operations in unordered batches.
+// All operations are tried, failed ones are reported in *BulkError.
+// Writes are acknowledged even if the session is not in safe mode.
+func (db *Mdb) BulkUpsert(col string, ops []BulkOp) (*BulkResult, error) {
+	res := &BulkResult{}
+	berr := &BulkError{}
+	err := db.Use(col, col+"_bulk", func(c *mgo.Collection) error {
+		// unacknowledged bulk returns no counts and no errors
+		c.Database.Session.EnsureSafe(&mgo.Safe{})
+		for start := 0; start < len(ops); start += maxBulkOps {
+			end := start + maxBulkOps
+			if end > len(ops) {
+				end = len(ops)
+			}
+			b := c.Bulk()
+			b.Unordered()
+			for _, op := range ops[start:end] {
+				switch {
+				case op.Upsert:
+					b.Upsert(op.Selector, op.Update)
+				case op.Multi:
+					b.UpdateAll(op.Selector, op.Update)
+				default:
+					b.Update(op.Selector, op.Update)
+				}
+			}
+			r, err := b.Run()
+			if err != nil {
+				be, ok := err.(*mgo.BulkError)
+				if !ok {
+					return err
+				}
+				for _, bc := range be.Cases() {
+					idx := bc.Index
+					if idx >= 0 {
+						idx += start
+					}
+					berr.Cases = append(berr.Cases, BulkErrorCase{Index: idx, Err: translateError(bc.Err)})
+				}
+				continue
+			}
+			res.Matched += r.Matched
+			res.Modified += r.Modified
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(berr.Cases) > 0 {
+		return res, berr
+	}
+	return res, nil
+}
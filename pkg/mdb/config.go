@@ -0,0 +1,236 @@
+package mdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// Read modes accepted in Config.ReadMode
+var readModes = map[string]mgo.Mode{
+	"primary":             mgo.Primary,
+	"primary_preferred":   mgo.PrimaryPreferred,
+	"secondary":           mgo.Secondary,
+	"secondary_preferred": mgo.SecondaryPreferred,
+	"nearest":             mgo.Nearest,
+}
+
+// Write concerns accepted in Config.WriteConcern
+const (
+	WriteUnacknowledged = "unacknowledged"
+	WriteSafe           = "safe"
+	WriteMajority       = "majority"
+)
+
+// Duration is time.Duration which can be read from JSON
+// as string ("5s", "1m") or as number of nanoseconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case float64:
+		*d = Duration(t)
+	case string:
+		pd, err := time.ParseDuration(t)
+		if err != nil {
+			return err
+		}
+		*d = Duration(pd)
+	default:
+		return fmt.Errorf("invalid duration %s", buf)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config holds all Mdb settings in one place.
+// Start from DefaultConfig, populate from JSON with ParseConfig.
+type Config struct {
+	URI             string   `json:"uri"`
+	Name            string   `json:"name"`       // database name, default is application name
+	PoolLimit       int      `json:"pool_limit"` // 0 is driver default
+	ReadMode        string   `json:"read_mode"`
+	WriteConcern    string   `json:"write_concern"`
+	DialTimeout     Duration `json:"dial_timeout"`
+	SocketTimeout   Duration `json:"socket_timeout"`
+	CacheRoot       string   `json:"cache_root"` // empty disables disk cache
+	CacheCheckpoint Duration `json:"cache_checkpoint"`
+	FsBuckets       []string `json:"fs_buckets"` // ref: Mdb.Fs
+	// insert rate limits of the buckets from FsBuckets, ref: RateLimit
+	FsRateLimits map[string]RateLimits `json:"fs_rate_limits"`
+	// sockets idle longer are closed instead of reused, 0 keeps them
+	MaxIdleTime Duration `json:"max_idle_time"`
+	// TCP keepalive period of the sockets, 0 is the system default
+	KeepAlive Duration `json:"keep_alive"`
+	// interval of the background ping, 0 disables it, ref: PingInterval
+	PingInterval Duration `json:"ping_interval"`
+	// session refresh schedule while mongo is unavailable,
+	// zero base disables it, ref: Reconnect
+	Reconnect ReconnectBackoff `json:"reconnect"`
+}
+
+// DefaultConfig returns config with the same defaults as NewDb
+func DefaultConfig() Config {
+	return Config{
+		ReadMode:        "secondary_preferred",
+		WriteConcern:    WriteUnacknowledged,
+		DialTimeout:     Duration(10 * time.Second),
+		SocketTimeout:   Duration(time.Minute),
+		CacheCheckpoint: Duration(time.Minute),
+	}
+}
+
+// ParseConfig reads JSON config, missing fields get default values
+func ParseConfig(buf []byte) (Config, error) {
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return cfg, fmt.Errorf("mdb config: %s", err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate returns error describing first invalid field
+func (c Config) Validate() error {
+	if c.URI == "" {
+		return fmt.Errorf("mdb config: uri is required")
+	}
+	if c.PoolLimit < 0 {
+		return fmt.Errorf("mdb config: pool_limit must not be negative, got %d", c.PoolLimit)
+	}
+	if _, ok := readModes[c.ReadMode]; !ok {
+		return fmt.Errorf("mdb config: unknown read_mode %q", c.ReadMode)
+	}
+	switch c.WriteConcern {
+	case WriteUnacknowledged, WriteSafe, WriteMajority:
+	default:
+		return fmt.Errorf("mdb config: unknown write_concern %q", c.WriteConcern)
+	}
+	if c.DialTimeout <= 0 {
+		return fmt.Errorf("mdb config: dial_timeout must be positive")
+	}
+	if c.SocketTimeout <= 0 {
+		return fmt.Errorf("mdb config: socket_timeout must be positive")
+	}
+	if c.CacheRoot != "" && c.CacheCheckpoint <= 0 {
+		return fmt.Errorf("mdb config: cache_checkpoint must be positive")
+	}
+	if c.MaxIdleTime < 0 || c.KeepAlive < 0 || c.PingInterval < 0 {
+		return fmt.Errorf("mdb config: max_idle_time, keep_alive and ping_interval must not be negative")
+	}
+	if err := c.Reconnect.validate(); err != nil {
+		return fmt.Errorf("mdb config: %s", err)
+	}
+	seen := make(map[string]bool)
+	for _, b := range c.FsBuckets {
+		if b == "" {
+			return fmt.Errorf("mdb config: empty fs bucket name")
+		}
+		if seen[b] {
+			return fmt.Errorf("mdb config: duplicate fs bucket %q", b)
+		}
+		seen[b] = true
+	}
+	for b, l := range c.FsRateLimits {
+		if !seen[b] {
+			return fmt.Errorf("mdb config: rate limits of unknown fs bucket %q", b)
+		}
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("mdb config: fs bucket %q: %s", b, err)
+		}
+	}
+	return nil
+}
+
+// options converts config into Mdb options
+func (c Config) options() []func(db *Mdb) {
+	var opts []func(db *Mdb)
+	if c.Name != "" {
+		opts = append(opts, Name(c.Name))
+	}
+	if c.PoolLimit > 0 {
+		opts = append(opts, SetPoolLimit(c.PoolLimit))
+	}
+	mode := readModes[c.ReadMode]
+	opts = append(opts, func(db *Mdb) {
+		db.session.SetMode(mode, true)
+	})
+	switch c.WriteConcern {
+	case WriteSafe:
+		opts = append(opts, EnsureSafe())
+	case WriteMajority:
+		opts = append(opts, MajoritySafe())
+	}
+	opts = append(opts,
+		SetSocketTimeout(time.Duration(c.SocketTimeout)),
+		CacheRoot(c.CacheRoot),
+		CacheCheckpoint(time.Duration(c.CacheCheckpoint)),
+		PingInterval(time.Duration(c.PingInterval)),
+		Reconnect(c.Reconnect),
+	)
+	return opts
+}
+
+// dial connects to mongo with config dial settings
+func (c Config) dial() (*mgo.Session, error) {
+	info, err := mgo.ParseURL(c.URI)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = time.Duration(c.DialTimeout)
+	if c.MaxIdleTime > 0 {
+		info.MaxIdleTimeMS = int(time.Duration(c.MaxIdleTime) / time.Millisecond)
+	}
+	// ssl connections have their own dialer
+	if c.KeepAlive > 0 && info.DialServer == nil {
+		d := &net.Dialer{Timeout: info.Timeout, KeepAlive: time.Duration(c.KeepAlive)}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return d.Dial("tcp", addr.String())
+		}
+	}
+	return mgo.DialWithInfo(info)
+}
+
+// NewWithConfig validates config, connects to mongo
+// and creates configured Fs buckets.
+func NewWithConfig(cfg Config) (*Mdb, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s, err := cfg.dial()
+	if err != nil {
+		return nil, err
+	}
+	db := &Mdb{}
+	if err := db.init(s, cfg.options()...); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(cfg.FsBuckets) > 0 {
+		db.fss = make(map[string]*Fs)
+		for _, b := range cfg.FsBuckets {
+			var opts []func(fs *Fs)
+			if l, ok := cfg.FsRateLimits[b]; ok {
+				opts = append(opts, RateLimit(l))
+			}
+			db.fss[b] = db.NewFs(b, opts...)
+		}
+	}
+	return db, nil
+}
+
+// Fs returns bucket listed in Config.FsBuckets, nil if there is no such bucket
+func (db *Mdb) Fs(name string) *Fs {
+	return db.fss[name]
+}
@@ -0,0 +1,68 @@
+package mdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{"uri": "localhost", "pool_limit": 16, "dial_timeout": "2s", "fs_buckets": ["fs"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost", cfg.URI)
+	assert.Equal(t, 16, cfg.PoolLimit)
+	assert.Equal(t, Duration(2*time.Second), cfg.DialTimeout)
+	assert.Equal(t, Duration(time.Minute), cfg.SocketTimeout)
+	assert.Equal(t, "secondary_preferred", cfg.ReadMode)
+	assert.Equal(t, []string{"fs"}, cfg.FsBuckets)
+	assert.Equal(t, Duration(0), cfg.PingInterval)
+
+	cfg, err = ParseConfig([]byte(`{"uri": "localhost", "keep_alive": "30s", "max_idle_time": "5m", "ping_interval": "10s"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(30*time.Second), cfg.KeepAlive)
+	assert.Equal(t, Duration(5*time.Minute), cfg.MaxIdleTime)
+	assert.Equal(t, Duration(10*time.Second), cfg.PingInterval)
+
+	cfg, err = ParseConfig([]byte(`{"uri": "localhost", "reconnect": {"base": "100ms", "max": "30s", "multiplier": 3, "jitter": 0.2}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, ReconnectBackoff{Base: Duration(100 * time.Millisecond), Max: Duration(30 * time.Second), Multiplier: 3, Jitter: 0.2}, cfg.Reconnect)
+
+	_, err = ParseConfig([]byte(`{"uri": "localhost", "dial_timeout": "2 seconds"}`))
+	assert.NotNil(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.URI = "localhost"
+	valid.FsBuckets = []string{"fs"}
+	valid.FsRateLimits = map[string]RateLimits{"fs": {Default: 10, Types: map[string]float64{"a": 1}}}
+	assert.Nil(t, valid.Validate())
+
+	cases := []func(c *Config){
+		func(c *Config) { c.URI = "" },
+		func(c *Config) { c.PoolLimit = -1 },
+		func(c *Config) { c.ReadMode = "any" },
+		func(c *Config) { c.WriteConcern = "all" },
+		func(c *Config) { c.DialTimeout = 0 },
+		func(c *Config) { c.SocketTimeout = -1 },
+		func(c *Config) { c.CacheRoot = "/tmp"; c.CacheCheckpoint = 0 },
+		func(c *Config) { c.FsBuckets = []string{"fs", "fs"} },
+		func(c *Config) { c.MaxIdleTime = -1 },
+		func(c *Config) { c.KeepAlive = -1 },
+		func(c *Config) { c.PingInterval = -1 },
+		func(c *Config) { c.FsRateLimits = map[string]RateLimits{"other": {Default: 1}} },
+		func(c *Config) { c.FsRateLimits = map[string]RateLimits{"fs": {Types: map[string]float64{"a": -1}}} },
+		func(c *Config) { c.Reconnect.Base = -1 },
+		func(c *Config) {
+			c.Reconnect = ReconnectBackoff{Base: Duration(time.Second), Max: Duration(time.Millisecond)}
+		},
+		func(c *Config) { c.Reconnect.Multiplier = 0.5 },
+		func(c *Config) { c.Reconnect.Jitter = 2 },
+	}
+	for i, fn := range cases {
+		c := valid
+		fn(&c)
+		assert.NotNil(t, c.Validate(), "case %d", i)
+	}
+}
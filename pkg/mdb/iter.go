@@ -0,0 +1,161 @@
+package mdb
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// cursor is mgo result stream, *mgo.Iter or *mgo.ChangeStream
+type cursor interface {
+	Next(result interface{}) bool
+	Err() error
+	Close() error
+}
+
+// Iter is result stream of Fs.SeekCursor, Mdb.FindIter, Mdb.Aggregate
+// and Mdb.Watch. Iter holds its own session, it must be closed.
+//
+//	i := db.FindIter("col", query, nil, nil)
+//	defer i.Close()
+//	for i.Next(ctx) {
+//		var d doc
+//		if err := i.Decode(&d); err != nil {
+//			return err
+//		}
+//	}
+//	return i.Err()
+type Iter struct {
+	session *mgo.Session
+	cur     cursor
+	decode  func(raw bson.Raw, v interface{}) error
+	raw     bson.Raw
+	err     error
+	closed  bool
+	done    func(err error) // reports the result to the breaker and reconnect
+}
+
+// newIter creates iterator over cursor opened by open in the session copy,
+// open error is returned from Err
+func (db *Mdb) newIter(open func(s *mgo.Session) (cursor, error)) *Iter {
+	i := &Iter{decode: unmarshalRaw}
+	s, err := db.copySession()
+	if err != nil {
+		i.err, i.closed = err, true
+		return i
+	}
+	if err := db.breaker.allow(); err != nil {
+		s.Close()
+		i.err, i.closed = err, true
+		return i
+	}
+	i.session = s
+	// as timing, but once the stream ends, with the open or cursor error
+	i.done = func(err error) {
+		db.breaker.done(err)
+		db.reconnectAfter(err)
+	}
+	cur, err := open(i.session)
+	if err != nil {
+		i.err = translateError(err)
+		i.Close()
+		return i
+	}
+	i.cur = cur
+	return i
+}
+
+func unmarshalRaw(raw bson.Raw, v interface{}) error {
+	return raw.Unmarshal(v)
+}
+
+// Next advances to the next result, returns false when there are no more
+// results, on error or when ctx is done; Err tells which.
+// Context is checked before each fetch, fetch in progress is not
+// interrupted (it is bounded by the session socket timeout).
+func (i *Iter) Next(ctx context.Context) bool {
+	if i.closed {
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		i.err = err
+		i.Close()
+		return false
+	}
+	i.raw = bson.Raw{}
+	if i.cur.Next(&i.raw) {
+		return true
+	}
+	if t, ok := i.cur.(interface{ Timeout() bool }); ok && t.Timeout() {
+		return false // change stream without changes, stays open
+	}
+	i.err = translateError(i.cur.Err())
+	i.Close()
+	return false
+}
+
+// Decode decodes current result into v
+func (i *Iter) Decode(v interface{}) error {
+	if i.raw.Kind == 0 {
+		return ErrNotFound
+	}
+	return i.decode(i.raw, v)
+}
+
+// Err returns error which stopped the iteration, nil at the end of results
+func (i *Iter) Err() error {
+	return i.err
+}
+
+// Close closes cursor and session, safe to call more than once.
+func (i *Iter) Close() error {
+	if i.closed {
+		return i.err
+	}
+	i.closed = true
+	if i.cur != nil {
+		if err := i.cur.Close(); err != nil && i.err == nil {
+			i.err = translateError(err)
+		}
+	}
+	if i.session != nil {
+		i.session.Close()
+	}
+	if i.done != nil {
+		i.done(i.err)
+	}
+	return i.err
+}
+
+// FindIter is Find which streams documents instead of loading them all.
+// projection could be nil, sort fields as in mgo.Query.Sort.
+func (db *Mdb) FindIter(col string, query, projection interface{}, sort []string) *Iter {
+	return db.newIter(func(s *mgo.Session) (cursor, error) {
+		q := s.DB(db.name).C(col).Find(query)
+		if projection != nil {
+			q = q.Select(projection)
+		}
+		if len(sort) > 0 {
+			q = q.Sort(sort...)
+		}
+		return q.Iter(), nil
+	})
+}
+
+// Aggregate runs aggregation pipeline on the collection.
+func (db *Mdb) Aggregate(col string, pipeline interface{}) *Iter {
+	return db.newIter(func(s *mgo.Session) (cursor, error) {
+		return s.DB(db.name).C(col).Pipe(pipeline).AllowDiskUse().Iter(), nil
+	})
+}
+
+// Watch opens change stream of the collection, pipeline filters changes
+// (could be nil). Next waits for the next change up to opts.MaxAwaitTimeMS
+// and returns false on timeout, with nil Err; iterator stays open
+// and Next can be called again.
+func (db *Mdb) Watch(col string, pipeline interface{}, opts mgo.ChangeStreamOptions) *Iter {
+	return db.newIter(func(s *mgo.Session) (cursor, error) {
+		return s.DB(db.name).C(col).Watch(pipeline, opts)
+	})
+}
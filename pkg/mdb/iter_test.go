@@ -0,0 +1,98 @@
+package mdb
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCursor struct {
+	docs    []interface{}
+	err     error
+	timeout bool
+	closed  int
+}
+
+func (c *fakeCursor) Next(result interface{}) bool {
+	if len(c.docs) == 0 {
+		return false
+	}
+	buf, _ := bson.Marshal(c.docs[0])
+	c.docs = c.docs[1:]
+	return bson.Unmarshal(buf, result) == nil
+}
+
+func (c *fakeCursor) Err() error    { return c.err }
+func (c *fakeCursor) Close() error  { c.closed++; return c.err }
+func (c *fakeCursor) Timeout() bool { return c.timeout }
+
+func TestIter(t *testing.T) {
+	ctx := context.Background()
+	type doc struct {
+		A int `bson:"a"`
+	}
+	cur := &fakeCursor{docs: []interface{}{doc{1}, doc{2}}}
+	i := &Iter{cur: cur, decode: unmarshalRaw}
+	var d doc
+	assert.Equal(t, ErrNotFound, i.Decode(&d))
+	var as []int
+	for i.Next(ctx) {
+		assert.Nil(t, i.Decode(&d))
+		as = append(as, d.A)
+	}
+	assert.Equal(t, []int{1, 2}, as)
+	assert.Nil(t, i.Err())
+	assert.Equal(t, 1, cur.closed)
+	assert.Nil(t, i.Close())
+	assert.Equal(t, 1, cur.closed)
+
+	// cursor error is translated
+	cur = &fakeCursor{err: mgo.ErrNotFound}
+	i = &Iter{cur: cur, decode: unmarshalRaw}
+	assert.False(t, i.Next(ctx))
+	assert.Equal(t, ErrNotFound, i.Err())
+
+	// context is checked before fetch
+	cctx, cancel := context.WithCancel(ctx)
+	cur = &fakeCursor{docs: []interface{}{doc{1}, doc{2}}}
+	i = &Iter{cur: cur, decode: unmarshalRaw}
+	assert.True(t, i.Next(cctx))
+	cancel()
+	assert.False(t, i.Next(cctx))
+	assert.Equal(t, context.Canceled, i.Err())
+	assert.Equal(t, 1, cur.closed)
+	assert.Len(t, cur.docs, 1)
+
+	// change stream timeout keeps iterator open
+	cur = &fakeCursor{timeout: true}
+	i = &Iter{cur: cur, decode: unmarshalRaw}
+	assert.False(t, i.Next(ctx))
+	assert.Nil(t, i.Err())
+	assert.Equal(t, 0, cur.closed)
+	cur.timeout = false
+	cur.docs = []interface{}{doc{3}}
+	assert.True(t, i.Next(ctx))
+
+	// result is reported once, when the stream ends
+	var reported []error
+	cur = &fakeCursor{docs: []interface{}{doc{1}}, err: io.EOF}
+	i = &Iter{cur: cur, decode: unmarshalRaw, done: func(err error) { reported = append(reported, err) }}
+	assert.True(t, i.Next(ctx))
+	assert.Len(t, reported, 0)
+	assert.False(t, i.Next(ctx))
+	assert.Equal(t, io.EOF, i.Close())
+	assert.Equal(t, []error{io.EOF}, reported)
+
+	// closed db
+	db := &Mdb{closed: 1}
+	i = db.newIter(func(s *mgo.Session) (cursor, error) {
+		t.Fatal("opened")
+		return nil, nil
+	})
+	assert.Equal(t, ErrClosed, i.Err())
+	assert.False(t, i.Next(ctx))
+}
@@ -2,6 +2,7 @@ package mdb
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -25,6 +27,18 @@ import (
 var ErrNotFound = errors.New("not found")
 var ErrDuplicate = errors.New("duplicate document")
 
+// ErrDeleted is returned when reading file removed in Fs SoftDelete mode
+var ErrDeleted = errors.New("deleted")
+
+// ErrInvalidOffset is returned from Fs.FindIdFrom for offset outside of the file
+var ErrInvalidOffset = errors.New("offset out of file range")
+
+// ErrInvalidLimit is returned from Fs.FindLatest for n < 1
+var ErrInvalidLimit = errors.New("invalid limit")
+
+// ErrClosed is returned from operations after Mdb.Close
+var ErrClosed = errors.New("mdb closed")
+
 type cache struct {
 	db *Mdb
 	m  map[string]*cacheItem
@@ -204,6 +218,16 @@ type Mdb struct {
 	cacheDir     string
 	checkPointIn time.Duration
 	cache        *cache
+	fss          map[string]*Fs // Fs buckets created from Config
+	logSlow      time.Duration  // ref: LogSlow
+	breaker      *breaker       // ref: CircuitBreaker
+	pingInterval time.Duration  // ref: PingInterval
+	reconnect    *reconnector   // ref: Reconnect
+	closed       int32          // set by Close
+	sessionLock  sync.RWMutex   // orders session copies before Close, ref: copySession
+	closeOnce    sync.Once
+	done         chan struct{}  // closed by Close, stops background loops
+	loops        sync.WaitGroup // background loops, Close waits for them
 }
 
 // DefaultConnStr creates connection string from consul
@@ -289,6 +313,23 @@ func MajoritySafe() func(db *Mdb) {
 	}
 }
 
+// SetSocketTimeout sets timeout of the mongo operations
+func SetSocketTimeout(d time.Duration) func(db *Mdb) {
+	return func(db *Mdb) {
+		db.session.SetSocketTimeout(d)
+	}
+}
+
+// PingInterval starts background ping of mongo in interval, it keeps
+// idle connections (and their NAT/load balancer mappings) alive and detects
+// broken ones before the next operation: on failure sockets are refreshed.
+// Zero (default) disables it.
+func PingInterval(d time.Duration) func(db *Mdb) {
+	return func(db *Mdb) {
+		db.pingInterval = d
+	}
+}
+
 // SetModePrimaryPreferred sets mode to primary preferred
 func SetModePrimaryPreferred() func(db *Mdb) {
 	return func(db *Mdb) {
@@ -309,14 +350,20 @@ func NewDb(connStr string, opts ...func(db *Mdb)) (*Mdb, error) {
 // Init initializes new Mdb
 // Connects to mongo, initializes cache, starts checkpoint loop.
 func (db *Mdb) Init(connStr string, opts ...func(db *Mdb)) error {
-	db.checkpoint()
 	s, err := mgo.Dial(connStr)
 	if err != nil {
 		return err
 	}
+	return db.init(s, opts...)
+}
+
+func (db *Mdb) init(s *mgo.Session, opts ...func(db *Mdb)) error {
+	db.checkpoint()
+	var err error
 	s.SetMode(mgo.SecondaryPreferred, true)
 	s.SetSafe(nil)
 	db.session = s
+	db.done = make(chan struct{})
 	// defaults
 	db.name = strings.Replace(env.AppName(), ".", "_", -1)
 	db.checkPointIn = time.Minute
@@ -329,7 +376,10 @@ func (db *Mdb) Init(connStr string, opts ...func(db *Mdb)) error {
 		if err != nil {
 			return err
 		}
-		go db.loop()
+		db.goLoop(db.loop)
+	}
+	if db.pingInterval > 0 {
+		db.goLoop(db.pingLoop)
 	}
 	db.LogServers()
 	return nil
@@ -337,13 +387,55 @@ func (db *Mdb) Init(connStr string, opts ...func(db *Mdb)) error {
 
 // Ping returns true if mongo is available
 func (db *Mdb) Ping() bool {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return false
+	}
 	defer s.Close()
 	return s.Ping() == nil
 }
 
+// goLoop starts background loop which stops when done is closed
+func (db *Mdb) goLoop(loop func()) {
+	db.loops.Add(1)
+	go func() {
+		defer db.loops.Done()
+		loop()
+	}()
+}
+
+func (db *Mdb) pingLoop() {
+	t := time.NewTicker(db.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-db.done:
+			return
+		}
+		s, err := db.copySession()
+		if err != nil {
+			return
+		}
+		err = s.Ping()
+		s.Close()
+		if err != nil {
+			log.S("db", db.name).Error(err)
+			metric.Counter("db.ping.failed")
+		}
+		if db.reconnect != nil {
+			db.reconnectAfter(err)
+		} else if err != nil {
+			db.session.Refresh()
+		}
+	}
+}
+
 func (db *Mdb) LogServers() {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return
+	}
 	defer s.Close()
 	srvs := strings.Join(s.LiveServers(), ",")
 	log.S("servers", srvs).S("db", db.name).Info("mongo servers")
@@ -351,13 +443,23 @@ func (db *Mdb) LogServers() {
 
 func (db *Mdb) loop() {
 	t := time.NewTicker(db.checkPointIn)
-	for range t.C {
-		db.checkpoint()
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			db.checkpoint()
+		case <-db.done:
+			return
+		}
 	}
-	//t.Stop()
 }
 
 func (db *Mdb) ResetIndexCache() {
+	db.sessionLock.RLock()
+	defer db.sessionLock.RUnlock()
+	if db.isClosed() {
+		return
+	}
 	db.session.ResetIndexCache()
 }
 
@@ -367,9 +469,43 @@ func (db *Mdb) checkpoint() {
 	}
 }
 
-// Close starts clean exit
-func (db *Mdb) Close() {
-	db.checkpoint()
+// Close flushes cache, stops background work and closes mongo session.
+// Fs buckets share the lifecycle of their Mdb, after Close their operations
+// return ErrClosed. Files left in the WriteAhead log are replayed by the
+// next process. It is safe to call Close more than once.
+func (db *Mdb) Close() error {
+	db.closeOnce.Do(func() {
+		// cache is flushed while operations are still allowed
+		db.checkpoint()
+		atomic.StoreInt32(&db.closed, 1)
+		if db.done != nil {
+			close(db.done)
+		}
+		db.loops.Wait()
+		// waits for the copies in progress, later ones see closed
+		db.sessionLock.Lock()
+		if db.session != nil {
+			db.session.Close()
+		}
+		db.sessionLock.Unlock()
+	})
+	return nil
+}
+
+func (db *Mdb) isClosed() bool {
+	return atomic.LoadInt32(&db.closed) == 1
+}
+
+// copySession returns copy of the session, ErrClosed after Close.
+// Check and copy are under the read lock, so Close can't close
+// the session between them (copy of the closed session panics).
+func (db *Mdb) copySession() (*mgo.Session, error) {
+	db.sessionLock.RLock()
+	defer db.sessionLock.RUnlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	return db.session.Copy(), nil
 }
 
 // Checkpoint flush caches
@@ -378,14 +514,7 @@ func (db *Mdb) Checkpoint() {
 }
 
 func (db *Mdb) Use(col string, metricKey string, handler func(*mgo.Collection) error) error {
-	s := db.session.Copy()
-	defer s.Close()
-	c := s.DB(db.name).C(col)
-	var err error
-	metric.Timing("db."+metricKey, func() {
-		err = handler(c)
-	})
-	return err
+	return db.UseContext(context.Background(), col, metricKey, handler)
 }
 
 // Use2 same as Use but withiout metriceKey
@@ -395,11 +524,13 @@ func (db *Mdb) Use2(col string, handler func(*mgo.Collection) error) error {
 }
 
 func (db *Mdb) UseSafe(col string, metricKey string, handler func(*mgo.Collection) error) error {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
 	defer s.Close()
 	s.SetSafe(&mgo.Safe{WMode: "majority"})
 	c := s.DB(db.name).C(col)
-	var err error
 	metric.Timing("db."+metricKey, func() {
 		err = handler(c)
 	})
@@ -409,12 +540,14 @@ func (db *Mdb) UseSafe(col string, metricKey string, handler func(*mgo.Collectio
 // Use2 same as Use but withiout metriceKey
 // metricKey is set to collection name (col)
 func (db *Mdb) UseWithoutTimeout(col string, handler func(*mgo.Collection) error) error {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
 	s.SetSocketTimeout(60 * time.Minute)
 	s.SetCursorTimeout(0)
 	defer s.Close()
 	c := s.DB(db.name).C(col)
-	var err error
 	metric.Timing("db."+col, func() {
 		err = handler(c)
 	})
@@ -423,15 +556,7 @@ func (db *Mdb) UseWithoutTimeout(col string, handler func(*mgo.Collection) error
 
 func (db *Mdb) UseFs(col string, metricKey string,
 	handler func(*mgo.GridFS) error) error {
-	s := db.session.Copy()
-	defer s.Close()
-	d := s.DB(db.name)
-	g := d.GridFS(col)
-	var err error
-	metric.Timing("db."+metricKey, func() {
-		err = handler(g)
-	})
-	return err
+	return db.UseFsContext(context.Background(), col, metricKey, handler)
 }
 
 // SaveId stores document to cache
@@ -480,6 +605,38 @@ func (db *Mdb) Exists(col string, query interface{}) (bool, error) {
 	return exists, err
 }
 
+// FindOne finds first document matching query into result.
+// projection selects fields, could be nil.
+// Returns ErrNotFound if there is no such document.
+func (db *Mdb) FindOne(col string, query, projection, result interface{}) error {
+	return db.Use(col, col+"findOne", func(c *mgo.Collection) error {
+		q := c.Find(query)
+		if projection != nil {
+			q = q.Select(projection)
+		}
+		return translateError(q.One(result))
+	})
+}
+
+// Find finds all documents matching query into result (pointer to slice).
+// projection could be nil, sort fields as in mgo.Query.Sort, limit 0 is no limit.
+// No documents is not an error, result is empty.
+func (db *Mdb) Find(col string, query, projection interface{}, sort []string, limit int, result interface{}) error {
+	return db.Use(col, col+"find", func(c *mgo.Collection) error {
+		q := c.Find(query)
+		if projection != nil {
+			q = q.Select(projection)
+		}
+		if len(sort) > 0 {
+			q = q.Sort(sort...)
+		}
+		if limit > 0 {
+			q = q.Limit(limit)
+		}
+		return translateError(q.All(result))
+	})
+}
+
 func (db *Mdb) RemoveId(col string, id interface{}) error {
 	if db.cache != nil {
 		db.cache.remove(col, id)
@@ -500,15 +657,24 @@ func (db *Mdb) Insert(col string, o interface{}) error {
 }
 
 // NewFs new grid file system interface
-func (db *Mdb) NewFs(name string) *Fs {
-	fs := &Fs{db: db, name: name}
+func (db *Mdb) NewFs(name string, opts ...func(fs *Fs)) *Fs {
+	fs := &Fs{db: db, name: name, sortField: defaultSortField, codec: JSONCodec}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	if fs.walDir != "" {
+		fs.wal = openWal(fs, fs.walDir)
+	}
 	_ = fs.createIndexes()
 	return fs
 }
 
 // EnsureIndex kreira index ako ne postoji
 func (db *Mdb) EnsureIndex(col string, key []string, expireAfter time.Duration) error {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
 	defer s.Close()
 	c := s.DB(db.name).C(col)
 	return c.EnsureIndex(mgo.Index{
@@ -521,7 +687,10 @@ func (db *Mdb) EnsureIndex(col string, key []string, expireAfter time.Duration)
 
 // EnsureIndex kreira index ako ne postoji
 func (db *Mdb) EnsureUniqueIndex(col string, key []string) error {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
 	defer s.Close()
 	c := s.DB(db.name).C(col)
 	return c.EnsureIndex(mgo.Index{
@@ -564,7 +733,10 @@ func (db *Mdb) NextSerialNumber(colName, key string) (int, error) {
 
 // EnsureIndex kreira index ako ne postoji
 func (db *Mdb) CreateCapedCollection(col string, maxGB int) error {
-	s := db.session.Copy()
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
 	defer s.Close()
 	c := s.DB(db.name).C(col)
 	return c.Create(
@@ -1,7 +1,10 @@
 package mdb
 
 import (
+	"context"
 	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -14,61 +17,366 @@ When seeking all files of a type are returned.
 Id could be used if it is needed to get a specific file.
 */
 type Fs struct {
-	name string
-	db   *Mdb
+	name          string
+	db            *Mdb
+	sortField     string
+	codec         Codec
+	readCodecs    []Codec // ref: ReadCodec
+	atomicDup     bool    // ref: AtomicDuplicateCheck
+	dedup         bool    // ref: Dedup
+	softDelete    bool    // ref: SoftDelete
+	purge         bool    // remove chunks on soft delete
+	walDir        string  // ref: WriteAhead
+	wal           *wal
+	groupBy       []string     // ref: GroupBy
+	safe          *mgo.Safe    // ref: WriteConcern
+	limiter       *rateLimiter // ref: RateLimit
+	findRetry     *findRetry   // ref: FindIdRetry
+	recoverPanics bool         // ref: RecoverPanics
+}
+
+const defaultSortField = "uploadDate"
+
+// SortField sets field by which Seek, SeekRange and Find sort files.
+// Default is uploadDate. Use it for metadata field, e.g. "metadata.seq",
+// which is set by InsertMeta. Index on (filename, field) is created.
+func SortField(field string) func(fs *Fs) {
+	return func(fs *Fs) {
+		if field != "" {
+			fs.sortField = field
+		}
+	}
+}
+
+// AtomicDuplicateCheck makes Insert with id detect duplicate with the unique
+// _id index instead of the OpenId probe before insert.
+// Files document is inserted before chunks so duplicate fails atomically
+// and chunks of the existing file are never touched.
+func AtomicDuplicateCheck() func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.atomicDup = true
+	}
+}
+
+// FileOption sets optional file attributes on insert
+type FileOption func(a *fileAttrs)
+
+// fileAttrs are optional attributes of the inserted file, zero is default
+type fileAttrs struct {
+	name        string // file name, default is the type
+	contentType string
+	chunkSize   int
+}
+
+func newFileAttrs(opts []FileOption) fileAttrs {
+	var a fileAttrs
+	for _, opt := range opts {
+		opt(&a)
+	}
+	return a
+}
+
+// apply sets attributes on the file being written
+func (a fileAttrs) apply(f *mgo.GridFile) {
+	if a.name != "" {
+		f.SetName(a.name)
+	}
+	if a.contentType != "" {
+		f.SetContentType(a.contentType)
+	}
+	if a.chunkSize > 0 {
+		f.SetChunkSize(a.chunkSize)
+	}
+}
+
+// SetContentType sets MIME content type of the inserted file
+func SetContentType(ct string) FileOption {
+	return func(a *fileAttrs) {
+		a.contentType = ct
+	}
+}
+
+// SetName sets name of the inserted file instead of its type.
+// Seek and find by type don't return the file then.
+func SetName(name string) FileOption {
+	return func(a *fileAttrs) {
+		a.name = name
+	}
+}
+
+// SetChunkSize sets size of the chunks of the inserted file
+func SetChunkSize(n int) FileOption {
+	return func(a *fileAttrs) {
+		a.chunkSize = n
+	}
+}
+
+// ContentType returns MIME content type of the file passed to seek or find handler.
+// Empty for files inserted without content type.
+func ContentType(rc io.ReadCloser) string {
+	if f, ok := rc.(*mgo.GridFile); ok {
+		return f.ContentType()
+	}
+	return ""
 }
 
 // Insert file
 // typ - type of the file
-// id  - colud be omitted if it not required do get by id later
+// id  - colud be omitted if it not required do get by id later (ref: Id)
 // ts  - timestamp, seek will sort by timestamp
 // rdr - content
-func (fs *Fs) Insert(typ string, id interface{}, ts time.Time, rdr io.Reader) error {
-	return fs.db.UseFs(fs.name, fs.name+"_insert", func(g *mgo.GridFS) error {
-		if id != nil {
-			_, err := g.OpenId(id)
-			if err == nil {
-				return ErrDuplicate
-			}
-		}
+func (fs *Fs) Insert(typ string, id interface{}, ts time.Time, rdr io.Reader, opts ...FileOption) error {
+	return fs.InsertMetaCtx(context.Background(), typ, id, ts, nil, rdr, opts...)
+}
 
-		f, err := g.Create(typ)
-		if err != nil {
-			return translateError(err)
+// InsertCtx is Insert which stops when ctx is done.
+// Upload in progress is aborted on the next read of rdr and ctx.Err() is returned.
+func (fs *Fs) InsertCtx(ctx context.Context, typ string, id interface{}, ts time.Time, rdr io.Reader, opts ...FileOption) error {
+	return fs.InsertMetaCtx(ctx, typ, id, ts, nil, rdr, opts...)
+}
+
+// InsertMeta inserts file with metadata
+// meta - stored in metadata field of the file, could be nil
+func (fs *Fs) InsertMeta(typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	return fs.InsertMetaCtx(context.Background(), typ, id, ts, meta, rdr, opts...)
+}
+
+// InsertMetaCtx is InsertMeta which stops when ctx is done, ref: InsertCtx
+func (fs *Fs) InsertMetaCtx(ctx context.Context, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	id, err := fs.beforeInsert(ctx, typ, id)
+	if err != nil {
+		return err
+	}
+	if fs.wal != nil {
+		return fs.wal.insert(ctx, typ, id, ts, meta, rdr, opts...)
+	}
+	return fs.insert(ctx, typ, id, ts, meta, ctxReader{ctx: ctx, r: rdr}, opts...)
+}
+
+// InsertSafe is InsertMetaCtx with write concern safe instead of the Fs one
+// (ref: WriteConcern), e.g. DurableSafe for the files which must not be lost.
+// File is written directly, not through the WAL.
+func (fs *Fs) InsertSafe(ctx context.Context, safe *mgo.Safe, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	id, err := fs.beforeInsert(ctx, typ, id)
+	if err != nil {
+		return err
+	}
+	return fs.insertSafe(ctx, safe, typ, id, ts, meta, ctxReader{ctx: ctx, r: rdr}, opts...)
+}
+
+// beforeInsert checks ctx and rate limit, returns id of the file
+func (fs *Fs) beforeInsert(ctx context.Context, typ string, id interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	id, err := idValue(id)
+	if err != nil {
+		return nil, err
+	}
+	if fs.limiter != nil {
+		if err := fs.limiter.allow(ctx, typ); err != nil {
+			return nil, err
 		}
-		if id != nil {
-			f.SetId(id)
+	}
+	return id, nil
+}
+
+func (fs *Fs) insert(ctx context.Context, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	return fs.insertSafe(ctx, fs.safe, typ, id, ts, meta, rdr, opts...)
+}
+
+// insertAcked is insert acknowledged by the server also when the session
+// is not in safe mode, for callers which act on its success
+func (fs *Fs) insertAcked(ctx context.Context, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	safe := fs.safe
+	if safe == nil {
+		safe = fs.db.session.Safe()
+	}
+	if safe == nil {
+		safe = &mgo.Safe{}
+	}
+	return fs.insertSafe(ctx, safe, typ, id, ts, meta, rdr, opts...)
+}
+
+// insertSafe inserts file with write concern safe, session one if nil
+func (fs *Fs) insertSafe(ctx context.Context, safe *mgo.Safe, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_insert", func(g *mgo.GridFS) error {
+		if safe != nil {
+			// write is only acknowledged, write concern is confirmed after it
+			// by a write command, file stays in place if that fails
+			g.Files.Database.Session.SetSafe(&mgo.Safe{})
 		}
-		f.SetUploadDate(ts)
-		if _, err := io.Copy(f, rdr); err != nil {
+		fid, err := fs.insertFile(g, typ, id, ts, meta, rdr, opts...)
+		if err != nil {
 			return err
 		}
-		if err := f.Close(); err != nil {
-			return translateError(err)
-		}
-		return nil
+		return confirmSafe(g.Files, fid, safe)
 	})
 }
 
+// insertFile writes file in the session of g, returns its id
+func (fs *Fs) insertFile(g *mgo.GridFS, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) (interface{}, error) {
+	if id != nil && fs.atomicDup {
+		if err := insertReserved(g, typ, id, ts, meta, rdr, opts...); err != nil {
+			return nil, err
+		}
+		return id, fs.dedupFile(g, id)
+	}
+	if id != nil {
+		_, err := g.OpenId(id)
+		if err == nil {
+			return nil, ErrDuplicate
+		}
+	}
+
+	f, err := g.Create(typ)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if id != nil {
+		f.SetId(id)
+	}
+	f.SetUploadDate(ts)
+	if meta != nil {
+		f.SetMeta(meta)
+	}
+	newFileAttrs(opts).apply(f)
+	if _, err := io.Copy(f, rdr); err != nil {
+		f.Abort()
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, translateError(err)
+	}
+	return f.Id(), fs.dedupFile(g, f.Id())
+}
+
+// seekResult is .files document of the found file
 type seekResult struct {
-	Id interface{} `bson:"_id"`
+	Id         interface{} `bson:"_id"`
+	Filename   string      `bson:"filename"`
+	UploadDate time.Time   `bson:"uploadDate"`
+	Ref        interface{} `bson:"ref,omitempty"`     // ref: Dedup
+	Deleted    time.Time   `bson:"deleted,omitempty"` // ref: SoftDelete
 }
 
-// Seek returns all files of a type newer than fromTs
+// Seek returns all files of a type newer than fromTs.
+// If there are no such files handler is not called and nil is returned,
+// unlike Find which returns ErrNotFound. Ref: SeekOrNotFound
+// File passed to the handler is closed when handler returns,
+// as in all seek and find methods.
 func (fs *Fs) Seek(typ string, fromTs time.Time, h func(io.ReadCloser, time.Time, interface{}) error) error {
-	return fs.db.UseFs(fs.name, fs.name+"_seek", func(g *mgo.GridFS) error {
-		q := bson.M{"filename": typ}
+	return fs.SeekCtx(context.Background(), typ, fromTs, withoutCtx(h))
+}
+
+// SeekCtx is Seek which stops when ctx is done: iterator is closed
+// before the next file and ctx.Err() is returned.
+// File passed to the handler is not interrupted, handler gets ctx
+// for its own work.
+func (fs *Fs) SeekCtx(ctx context.Context, typ string, fromTs time.Time, h func(context.Context, io.ReadCloser, time.Time, interface{}) error) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_seek", func(g *mgo.GridFS) error {
+		q := fs.live(bson.M{"filename": typ})
+		if !fromTs.IsZero() {
+			q["uploadDate"] = bson.M{"$gt": fromTs}
+		}
+		i := g.Find(q).Sort(fs.sortField).Iter()
+		r := seekResult{}
+		for i.Next(&r) {
+			if err := ctx.Err(); err != nil {
+				i.Close()
+				return err
+			}
+			f, err := fs.open(g, r)
+			if err != nil {
+				i.Close()
+				return err
+			}
+			if err := fs.handle(f, func(rc io.ReadCloser) error { return h(ctx, rc, r.UploadDate, r.Id) }); err != nil {
+				i.Close()
+				return err
+			}
+		}
+		return i.Close()
+	})
+}
+
+// withoutCtx adapts handler of the methods without ctx to the Ctx ones
+func withoutCtx(h func(io.ReadCloser, time.Time, interface{}) error) func(context.Context, io.ReadCloser, time.Time, interface{}) error {
+	return func(_ context.Context, rc io.ReadCloser, ts time.Time, id interface{}) error {
+		return h(rc, ts, id)
+	}
+}
+
+// IterIds calls handler with id and ts of all files of a type newer than fromTs,
+// in the same order as Seek. Files are not opened, only .files documents
+// are read, use it when content is not needed.
+func (fs *Fs) IterIds(typ string, fromTs time.Time, h func(id interface{}, ts time.Time) error) error {
+	return fs.IterIdsCtx(context.Background(), typ, fromTs, func(_ context.Context, id interface{}, ts time.Time) error {
+		return h(id, ts)
+	})
+}
+
+// IterIdsCtx is IterIds which stops when ctx is done, as SeekCtx.
+func (fs *Fs) IterIdsCtx(ctx context.Context, typ string, fromTs time.Time, h func(ctx context.Context, id interface{}, ts time.Time) error) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_iter_ids", func(g *mgo.GridFS) error {
+		return fs.iterIds(ctx, g, typ, fromTs, fs.sortField, func(id interface{}, ts time.Time) error {
+			return h(ctx, id, ts)
+		})
+	})
+}
+
+func (fs *Fs) iterIds(ctx context.Context, g *mgo.GridFS, typ string, fromTs time.Time, sort string, h func(id interface{}, ts time.Time) error) error {
+	q := fs.live(bson.M{"filename": typ})
+	if !fromTs.IsZero() {
+		q["uploadDate"] = bson.M{"$gt": fromTs}
+	}
+	i := g.Find(q).Sort(sort).Select(bson.M{"uploadDate": 1}).Iter()
+	r := seekResult{}
+	for i.Next(&r) {
+		if err := ctx.Err(); err != nil {
+			i.Close()
+			return err
+		}
+		if err := h(r.Id, r.UploadDate); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// SeekTypes returns files of all typs newer than fromTs in the single
+// stream ordered by the sort field, handler gets type of each file.
+// Merge is done by the server, with index on filename it merges
+// per type sorted index ranges.
+func (fs *Fs) SeekTypes(typs []string, fromTs time.Time, h func(io.ReadCloser, string, time.Time, interface{}) error) error {
+	return fs.SeekTypesCtx(context.Background(), typs, fromTs, func(_ context.Context, rc io.ReadCloser, typ string, ts time.Time, id interface{}) error {
+		return h(rc, typ, ts, id)
+	})
+}
+
+// SeekTypesCtx is SeekTypes which stops when ctx is done, as SeekCtx.
+func (fs *Fs) SeekTypesCtx(ctx context.Context, typs []string, fromTs time.Time, h func(context.Context, io.ReadCloser, string, time.Time, interface{}) error) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_seek_types", func(g *mgo.GridFS) error {
+		q := fs.live(bson.M{"filename": bson.M{"$in": typs}})
 		if !fromTs.IsZero() {
 			q["uploadDate"] = bson.M{"$gt": fromTs}
 		}
-		i := g.Find(q).Sort("uploadDate").Iter()
+		i := g.Find(q).Sort(fs.sortField).Iter()
 		r := seekResult{}
 		for i.Next(&r) {
-			f, err := g.OpenId(r.Id)
+			if err := ctx.Err(); err != nil {
+				i.Close()
+				return err
+			}
+			f, err := fs.open(g, r)
 			if err != nil {
+				i.Close()
 				return err
 			}
-			if err := h(f, f.UploadDate(), f.Id()); err != nil {
+			if err := fs.handle(f, func(rc io.ReadCloser) error { return h(ctx, rc, r.Filename, r.UploadDate, r.Id) }); err != nil {
+				i.Close()
 				return err
 			}
 		}
@@ -76,42 +384,265 @@ func (fs *Fs) Seek(typ string, fromTs time.Time, h func(io.ReadCloser, time.Time
 	})
 }
 
-// Seek returns all files of a type newer than fromTs and older than toTs
+// SeekParallel returns all files of a type newer than fromTs
+// calling handler from concurrency workers.
+// Files are opened in seek order but handlers may complete in any order.
+// First handler error stops the seek and is returned.
+func (fs *Fs) SeekParallel(typ string, fromTs time.Time, concurrency int, h func(io.ReadCloser, time.Time, interface{}) error) error {
+	return fs.SeekParallelCtx(context.Background(), typ, fromTs, concurrency, withoutCtx(h))
+}
+
+// SeekParallelCtx is SeekParallel which stops opening files when ctx is
+// done and returns ctx.Err() after the started handlers complete.
+func (fs *Fs) SeekParallelCtx(ctx context.Context, typ string, fromTs time.Time, concurrency int, h func(context.Context, io.ReadCloser, time.Time, interface{}) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_seek", func(g *mgo.GridFS) error {
+		q := fs.live(bson.M{"filename": typ})
+		if !fromTs.IsZero() {
+			q["uploadDate"] = bson.M{"$gt": fromTs}
+		}
+
+		type file struct {
+			f *mgo.GridFile
+			r seekResult
+		}
+		files := make(chan file)
+		done := make(chan struct{})
+		var herr error
+		var once sync.Once
+		fail := func(err error) {
+			once.Do(func() {
+				herr = err
+				close(done)
+			})
+		}
+		var wg sync.WaitGroup
+		for n := 0; n < concurrency; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for f := range files {
+					select {
+					case <-done:
+						f.f.Close()
+						continue
+					default:
+					}
+					if err := fs.handle(f.f, func(rc io.ReadCloser) error { return h(ctx, rc, f.r.UploadDate, f.r.Id) }); err != nil {
+						fail(err)
+					}
+				}
+			}()
+		}
+
+		i := g.Find(q).Sort(fs.sortField).Iter()
+		r := seekResult{}
+		var err error
+	loop:
+		for i.Next(&r) {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			f, oerr := fs.open(g, r)
+			if oerr != nil {
+				err = oerr
+				break
+			}
+			select {
+			case files <- file{f: f, r: r}:
+			case <-done:
+				f.Close()
+				break loop
+			case <-ctx.Done():
+				f.Close()
+				err = ctx.Err()
+				break loop
+			}
+		}
+		close(files)
+		wg.Wait()
+		cerr := i.Close()
+		if herr != nil {
+			return herr
+		}
+		if err != nil {
+			return err
+		}
+		return cerr
+	})
+}
+
+// SeekRange returns all files of a type newer than fromTs and older than toTs.
+// Returns nil if there are no such files. Ref: SeekRangeOrNotFound
 func (fs *Fs) SeekRange(typ string, fromTs time.Time, toTs time.Time, h func(io.ReadCloser, time.Time, interface{}) error) error {
-	return fs.db.UseFs(fs.name, fs.name+"_seek", func(g *mgo.GridFS) error {
-		i := g.Find(bson.M{"filename": typ,
+	return fs.SeekRangeCtx(context.Background(), typ, fromTs, toTs, withoutCtx(h))
+}
+
+// SeekRangeCtx is SeekRange which stops when ctx is done, as SeekCtx.
+func (fs *Fs) SeekRangeCtx(ctx context.Context, typ string, fromTs time.Time, toTs time.Time, h func(context.Context, io.ReadCloser, time.Time, interface{}) error) error {
+	return fs.seekRange(ctx, typ, fromTs, toTs, fs.sortField, h)
+}
+
+// SeekRangeDesc is SeekRange in reverse order, newest file first by uploadDate
+// the range is on. Use it to page backward through history.
+func (fs *Fs) SeekRangeDesc(typ string, fromTs time.Time, toTs time.Time, h func(io.ReadCloser, time.Time, interface{}) error) error {
+	return fs.SeekRangeDescCtx(context.Background(), typ, fromTs, toTs, withoutCtx(h))
+}
+
+// SeekRangeDescCtx is SeekRangeDesc which stops when ctx is done, as SeekCtx.
+func (fs *Fs) SeekRangeDescCtx(ctx context.Context, typ string, fromTs time.Time, toTs time.Time, h func(context.Context, io.ReadCloser, time.Time, interface{}) error) error {
+	return fs.seekRange(ctx, typ, fromTs, toTs, "-uploadDate", h)
+}
+
+func (fs *Fs) seekRange(ctx context.Context, typ string, fromTs time.Time, toTs time.Time, sort string, h func(context.Context, io.ReadCloser, time.Time, interface{}) error) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_seek", func(g *mgo.GridFS) error {
+		i := g.Find(fs.live(bson.M{"filename": typ,
 			"$and": []interface{}{
 				bson.M{"uploadDate": bson.M{"$gt": fromTs}},
 				bson.M{"uploadDate": bson.M{"$lt": toTs}},
-			}}).Sort("uploadDate").Iter()
+			}})).Sort(sort).Iter()
 		r := seekResult{}
 		for i.Next(&r) {
-			f, err := g.OpenId(r.Id)
+			if err := ctx.Err(); err != nil {
+				i.Close()
+				return err
+			}
+			f, err := fs.open(g, r)
+			if err != nil {
+				i.Close()
+				return err
+			}
+			if err := fs.handle(f, func(rc io.ReadCloser) error { return h(ctx, rc, r.UploadDate, r.Id) }); err != nil {
+				i.Close()
+				return err
+			}
+		}
+		return i.Close()
+	})
+}
+
+// SeekKey returns all files of a type with sort field greater than from.
+// Handler gets value of the sort field so it can be used as checkpoint.
+// Nil from returns all files of a type.
+func (fs *Fs) SeekKey(typ string, from interface{}, h func(io.ReadCloser, interface{}, time.Time, interface{}) error) error {
+	return fs.db.UseFs(fs.name, fs.name+"_seek", func(g *mgo.GridFS) error {
+		q := fs.live(bson.M{"filename": typ})
+		if from != nil {
+			q[fs.sortField] = bson.M{"$gt": from}
+		}
+		i := g.Find(q).Sort(fs.sortField).Iter()
+		var r bson.M
+		for i.Next(&r) {
+			f, err := fs.open(g, seekResult{Id: r["_id"], Ref: r["ref"]})
 			if err != nil {
+				i.Close()
 				return err
 			}
-			if err := h(f, f.UploadDate(), f.Id()); err != nil {
+			ts, _ := r["uploadDate"].(time.Time)
+			if err := fs.handle(f, func(rc io.ReadCloser) error { return h(rc, lookup(r, fs.sortField), ts, r["_id"]) }); err != nil {
+				i.Close()
 				return err
 			}
+			r = nil
 		}
 		return i.Close()
 	})
 }
 
+// lookup finds value in the document by dot separated path
+func lookup(doc bson.M, path string) interface{} {
+	var v interface{} = doc
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
 // FindId returns one file by id
 func (fs *Fs) FindId(id interface{}, h func(io.ReadCloser) error) error {
-	return fs.db.UseFs(fs.name, fs.name+"_find_id", func(g *mgo.GridFS) error {
-		f, err := g.OpenId(id)
+	return fs.findId(context.Background(), id, func(f *mgo.GridFile, _ seekResult) error {
+		return h(f)
+	})
+}
+
+// FindIdCtx is FindId which returns ctx.Err() when ctx is done
+// before the file is opened, also between FindIdRetry attempts.
+// Handler gets ctx for its own work.
+func (fs *Fs) FindIdCtx(ctx context.Context, id interface{}, h func(context.Context, io.ReadCloser) error) error {
+	return fs.findId(ctx, id, func(f *mgo.GridFile, _ seekResult) error {
+		return h(ctx, f)
+	})
+}
+
+// findId is FindId with the .files document of the file,
+// which differs from the opened one for dedup reference.
+func (fs *Fs) findId(ctx context.Context, id interface{}, h func(*mgo.GridFile, seekResult) error) error {
+	id, err := idValue(id)
+	if err != nil {
+		return err
+	}
+	if fs.findRetry != nil {
+		return fs.findRetry.do(ctx, func() (bool, error) {
+			return fs.findIdOnce(ctx, id, h)
+		})
+	}
+	_, err = fs.findIdOnce(ctx, id, h)
+	return err
+}
+
+// findIdOnce returns found true if file is opened and passed to the handler
+func (fs *Fs) findIdOnce(ctx context.Context, id interface{}, h func(*mgo.GridFile, seekResult) error) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	found := false
+	err := fs.db.UseFsContext(ctx, fs.name, fs.name+"_find_id", func(g *mgo.GridFS) error {
+		f, r, err := fs.openId(g, id)
 		if err != nil {
 			return translateError(err)
 		}
-		if err := h(f); err != nil {
-			return translateError(err)
+		found = true
+		return translateError(fs.handle(f, func(io.ReadCloser) error { return h(f, r) }))
+	})
+	return found, err
+}
+
+// FindIdFrom returns file by id positioned at offset, for resuming
+// interrupted downloads. Handler gets file size so it can report the
+// remaining length (e.g. Content-Range). Offset equal to the size is valid,
+// reader is then empty. Offset outside of the file returns ErrInvalidOffset.
+func (fs *Fs) FindIdFrom(id interface{}, offset int64, h func(r io.Reader, size int64) error) error {
+	return fs.FindId(id, func(rc io.ReadCloser) error {
+		f := rc.(*mgo.GridFile)
+		if offset < 0 || offset > f.Size() {
+			return ErrInvalidOffset
 		}
-		return nil
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		return h(f, f.Size())
 	})
 }
 
+// ctxReader fails read with ctx.Err() when ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 func translateError(err error) error {
 	if mgo.IsDup(err) {
 		return ErrDuplicate
@@ -122,69 +653,243 @@ func translateError(err error) error {
 	return err
 }
 
-// Find retuns last file of a type
+// Find retuns last file of a type.
+// Returns ErrNotFound if there are no files of the type.
 func (fs *Fs) Find(typ string, h func(io.ReadCloser, time.Time, interface{}) error) error {
-	return fs.db.UseFs(fs.name, fs.name+"_find", func(g *mgo.GridFS) error {
+	return fs.FindCtx(context.Background(), typ, withoutCtx(h))
+}
+
+// FindCtx is Find which returns ctx.Err() when ctx is done
+// before the file is opened. Handler gets ctx for its own work.
+func (fs *Fs) FindCtx(ctx context.Context, typ string, h func(context.Context, io.ReadCloser, time.Time, interface{}) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_find", func(g *mgo.GridFS) error {
 		r := seekResult{}
-		if err := g.Find(bson.M{"filename": typ}).Sort("-uploadDate").One(&r); err != nil {
+		if err := g.Find(fs.live(bson.M{"filename": typ})).Sort("-" + fs.sortField).One(&r); err != nil {
 			return translateError(err)
 		}
-		f, err := g.OpenId(r.Id)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := fs.open(g, r)
 		if err != nil {
 			return translateError(err)
 		}
-		if err := h(f, f.UploadDate(), f.Id()); err != nil {
+		if err := fs.handle(f, func(rc io.ReadCloser) error { return h(ctx, rc, r.UploadDate, r.Id) }); err != nil {
 			return translateError(err)
 		}
 		return nil
 	})
 }
 
-// Compact deletes all but a last files of a type
-func (fs *Fs) Compact(typ string) error {
-	return fs.db.UseFs(fs.name, fs.name+"_compact", func(g *mgo.GridFS) error {
-		q := g.Find(bson.M{"filename": typ}).Sort("uploadDate")
+// FindLatest returns up to n last files of a type, newest first.
+// Returns ErrNotFound if there are no files of the type,
+// ErrInvalidLimit if n < 1.
+func (fs *Fs) FindLatest(typ string, n int, h func(io.ReadCloser, time.Time, interface{}) error) error {
+	if n < 1 {
+		return ErrInvalidLimit
+	}
+	return fs.db.UseFs(fs.name, fs.name+"_find_latest", func(g *mgo.GridFS) error {
+		i := g.Find(fs.live(bson.M{"filename": typ})).Sort("-" + fs.sortField).Limit(n).Iter()
 		r := seekResult{}
-		cnt, err := q.Count()
-		if err != nil {
-			return err
-		}
-		idx := 0
-		i := q.Iter()
+		found := false
 		for i.Next(&r) {
-			idx++
-			if idx >= cnt {
-				break
+			found = true
+			f, err := fs.open(g, r)
+			if err != nil {
+				i.Close()
+				return translateError(err)
 			}
-			if err := g.RemoveId(r.Id); err != nil {
-				return err
+			if err := fs.handle(f, func(rc io.ReadCloser) error { return h(rc, r.UploadDate, r.Id) }); err != nil {
+				i.Close()
+				return translateError(err)
 			}
 		}
-		return i.Close()
+		if err := i.Close(); err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// LastTs returns timestamp of the newest file of a type.
+// Files are not opened, only uploadDate is read.
+func (fs *Fs) LastTs(typ string) (time.Time, error) {
+	var r struct {
+		UploadDate time.Time `bson:"uploadDate"`
+	}
+	err := fs.db.UseFs(fs.name, fs.name+"_last_ts", func(g *mgo.GridFS) error {
+		return g.Find(fs.live(bson.M{"filename": typ})).
+			Sort("-uploadDate").
+			Select(bson.M{"uploadDate": 1}).
+			One(&r)
 	})
+	if err != nil {
+		return time.Time{}, translateError(err)
+	}
+	return r.UploadDate, nil
+}
+
+// Compact deletes all but a last files of a type, last by the sort field.
+// Files are removed from the newest down, so file inserted concurrently
+// is never removed.
+func (fs *Fs) Compact(typ string) error {
+	return fs.CompactCtx(context.Background(), typ)
 }
 
-// Remove deletes all files of a type
+// CompactCtx is Compact which stops when ctx is done and returns ctx.Err().
+// Files removed before that stay removed, the newest file is never removed.
+func (fs *Fs) CompactCtx(ctx context.Context, typ string) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_compact", func(g *mgo.GridFS) error {
+		_, err := fs.compact(ctx, g, typ, 1, time.Time{})
+		return err
+	})
+}
+
+// Remove deletes all files of a type.
+// In SoftDelete mode files are marked as deleted.
 func (fs *Fs) Remove(typ string) error {
-	return fs.db.UseFs(fs.name, fs.name+"_remove", func(g *mgo.GridFS) error {
-		return g.Remove(typ)
+	return fs.RemoveCtx(context.Background(), typ)
+}
+
+// RemoveCtx is Remove which stops when ctx is done and returns ctx.Err().
+// Files removed before that stay removed. Without Dedup and SoftDelete
+// all files are removed by the single server call which is not interrupted.
+func (fs *Fs) RemoveCtx(ctx context.Context, typ string) error {
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_remove", func(g *mgo.GridFS) error {
+		if fs.softDelete {
+			return fs.tombstoneType(ctx, g, typ)
+		}
+		return fs.removeType(ctx, g, typ)
 	})
 }
 
-// Remove deletes all files of a type
+// RemoveId deletes file by id.
+// In SoftDelete mode file is marked as deleted.
 func (fs *Fs) RemoveId(id interface{}) error {
-	return fs.db.UseFs(fs.name, fs.name+"_remove", func(g *mgo.GridFS) error {
-		return g.RemoveId(id)
+	return fs.RemoveIdCtx(context.Background(), id)
+}
+
+// RemoveIdCtx is RemoveId which returns ctx.Err() when ctx is done
+// before the file is removed.
+func (fs *Fs) RemoveIdCtx(ctx context.Context, id interface{}) error {
+	id, err := idValue(id)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fs.db.UseFsContext(ctx, fs.name, fs.name+"_remove", func(g *mgo.GridFS) error {
+		return translateError(fs.remove(g, id))
 	})
 }
 
+// indexes required on the .files collection
+func (fs *Fs) indexes() []mgo.Index {
+	idx := []mgo.Index{
+		{Key: []string{"filename", "uploadDate"}},
+	}
+	if fs.sortField != defaultSortField {
+		idx = append(idx, mgo.Index{Key: []string{"filename", fs.sortField}})
+	}
+	if fs.dedup {
+		idx = append(idx,
+			mgo.Index{Key: []string{"md5"}},
+			mgo.Index{Key: []string{"ref"}, Sparse: true},
+		)
+	}
+	if fs.softDelete {
+		idx = append(idx, mgo.Index{Key: []string{"deleted"}, Sparse: true})
+	}
+	if len(fs.groupBy) > 0 {
+		idx = append(idx, fs.groupIndex())
+	}
+	return idx
+}
+
 func (fs *Fs) createIndexes() error {
-	return fs.db.Use(fs.name+".files", fs.name+"_indexes", func(c *mgo.Collection) error {
-		if err := c.EnsureIndex(mgo.Index{
-			Key: []string{"filename", "uploadDate"},
-		}); err != nil {
-			return err
+	err := fs.db.Use(fs.name+".files", fs.name+"_indexes", func(c *mgo.Collection) error {
+		for _, idx := range fs.indexes() {
+			if err := c.EnsureIndex(idx); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
+	if err != nil || !fs.atomicDup {
+		return err
+	}
+	// mgo ensures it after first written file, insertReserved writes chunks directly
+	return fs.db.Use(fs.name+".chunks", fs.name+"_indexes", func(c *mgo.Collection) error {
+		return c.EnsureIndex(mgo.Index{Key: []string{"files_id", "n"}, Unique: true})
+	})
+}
+
+// EnsureIndexes creates required indexes on demand.
+// Use it after restore when indexes are lost.
+func (fs *Fs) EnsureIndexes() error {
+	// mgo remembers ensured indexes, force it to go to the server
+	fs.db.ResetIndexCache()
+	return fs.createIndexes()
+}
+
+// IndexInfo describes index on the .files collection
+type IndexInfo struct {
+	Name     string
+	Key      []string
+	Unique   bool
+	Required bool // required by Fs
+	Exists   bool // found in database
+}
+
+// IndexStatus reports existing indexes on the .files collection
+// and required ones which are missing.
+func (fs *Fs) IndexStatus() ([]IndexInfo, error) {
+	var existing []mgo.Index
+	err := fs.db.Use(fs.name+".files", fs.name+"_indexes", func(c *mgo.Collection) error {
+		var err error
+		existing, err = c.Indexes()
+		if qe, ok := err.(*mgo.QueryError); ok && qe.Code == 26 { // NamespaceNotFound
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var infos []IndexInfo
+	found := make(map[string]bool)
+	for _, idx := range existing {
+		key := strings.Join(idx.Key, ",")
+		found[key] = true
+		infos = append(infos, IndexInfo{
+			Name:   idx.Name,
+			Key:    idx.Key,
+			Unique: idx.Unique,
+			Exists: true,
+		})
+	}
+	for _, idx := range fs.indexes() {
+		key := strings.Join(idx.Key, ",")
+		if found[key] {
+			for i := range infos {
+				if strings.Join(infos[i].Key, ",") == key {
+					infos[i].Required = true
+				}
+			}
+			continue
+		}
+		infos = append(infos, IndexInfo{
+			Key:      idx.Key,
+			Unique:   idx.Unique,
+			Required: true,
+		})
+	}
+	return infos, nil
 }
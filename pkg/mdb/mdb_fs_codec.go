@@ -0,0 +1,123 @@
+package mdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Codec encodes objects stored with InsertObject and read with FindObject
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(buf []byte, v interface{}) error
+	ContentType() string // stored as file content type
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)     { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(buf []byte, v interface{}) error { return json.Unmarshal(buf, v) }
+func (jsonCodec) ContentType() string                       { return "application/json" }
+
+type bsonCodec struct{}
+
+func (bsonCodec) Marshal(v interface{}) ([]byte, error)     { return bson.Marshal(v) }
+func (bsonCodec) Unmarshal(buf []byte, v interface{}) error { return bson.Unmarshal(buf, v) }
+func (bsonCodec) ContentType() string                       { return "application/bson" }
+
+var (
+	// JSONCodec encodes objects as JSON, default Fs codec
+	JSONCodec Codec = jsonCodec{}
+	// BSONCodec encodes objects as BSON
+	BSONCodec Codec = bsonCodec{}
+)
+
+// SetCodec sets codec used by InsertObject.
+// Format of the file is recorded in its content type, FindObject decodes
+// each file by its content type so bucket can contain different formats.
+func SetCodec(c Codec) func(fs *Fs) {
+	return func(fs *Fs) {
+		if c != nil {
+			fs.codec = c
+		}
+	}
+}
+
+// ReadCodec adds codec which FindObject can use for decoding files,
+// beside the Fs codec, JSONCodec and BSONCodec.
+func ReadCodec(c Codec) func(fs *Fs) {
+	return func(fs *Fs) {
+		if c != nil {
+			fs.readCodecs = append(fs.readCodecs, c)
+		}
+	}
+}
+
+// decoder returns codec for the file content type.
+// Files without content type are decoded with the Fs codec.
+func (fs *Fs) decoder(contentType string) (Codec, error) {
+	if contentType == "" {
+		return fs.codec, nil
+	}
+	for _, c := range append([]Codec{fs.codec, JSONCodec, BSONCodec}, fs.readCodecs...) {
+		if c.ContentType() == contentType {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no codec for content type %s", contentType)
+}
+
+// InsertObject encodes v with the Fs codec and inserts it as file
+func (fs *Fs) InsertObject(typ string, id interface{}, ts time.Time, v interface{}) error {
+	buf, err := fs.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fs.Insert(typ, id, ts, bytes.NewReader(buf), SetContentType(fs.codec.ContentType()))
+}
+
+// FindObject decodes last file of a type into v.
+// Codec is chosen by the file content type.
+// Returns ErrNotFound if there is no file of the type.
+func (fs *Fs) FindObject(typ string, v interface{}) error {
+	return fs.Find(typ, func(rc io.ReadCloser, _ time.Time, _ interface{}) error {
+		c, err := fs.decoder(ContentType(rc))
+		if err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return c.Unmarshal(buf, v)
+	})
+}
+
+// InsertJSON encodes v as JSON and inserts it as file.
+// validate, if not nil, checks encoded document before insert,
+// its error is returned and nothing is written.
+func (fs *Fs) InsertJSON(typ string, id interface{}, ts time.Time, v interface{}, validate func([]byte) error) error {
+	buf, err := JSONCodec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if validate != nil {
+		if err := validate(buf); err != nil {
+			return err
+		}
+	}
+	return fs.Insert(typ, id, ts, bytes.NewReader(buf), SetContentType(JSONCodec.ContentType()))
+}
+
+// FindJSON decodes last file of a type as JSON into v.
+// Returns ErrNotFound if there is no file of the type.
+func (fs *Fs) FindJSON(typ string, v interface{}) error {
+	return fs.Find(typ, func(rc io.ReadCloser, _ time.Time, _ interface{}) error {
+		return json.NewDecoder(rc).Decode(v)
+	})
+}
@@ -0,0 +1,56 @@
+package mdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	type rec struct {
+		Name string
+		No   int
+	}
+	for _, c := range []Codec{JSONCodec, BSONCodec} {
+		buf, err := c.Marshal(rec{Name: "a", No: 1})
+		assert.Nil(t, err)
+		var r rec
+		assert.Nil(t, c.Unmarshal(buf, &r))
+		assert.Equal(t, rec{Name: "a", No: 1}, r)
+	}
+}
+
+type xmlCodec struct{ jsonCodec }
+
+func (xmlCodec) ContentType() string { return "application/xml" }
+
+func TestFsDecoder(t *testing.T) {
+	fs := &Fs{codec: BSONCodec}
+	c, err := fs.decoder("")
+	assert.Nil(t, err)
+	assert.Equal(t, BSONCodec, c)
+	c, err = fs.decoder("application/json")
+	assert.Nil(t, err)
+	assert.Equal(t, JSONCodec, c)
+	_, err = fs.decoder("application/xml")
+	assert.NotNil(t, err)
+
+	ReadCodec(xmlCodec{})(fs)
+	c, err = fs.decoder("application/xml")
+	assert.Nil(t, err)
+	assert.Equal(t, "application/xml", c.ContentType())
+}
+
+func TestInsertJSONValidate(t *testing.T) {
+	errInvalid := errors.New("invalid")
+	var validated []byte
+	fs := &Fs{} // validation fails before mongo is used
+	err := fs.InsertJSON("typ", nil, time.Now(), map[string]int{"a": 1}, func(buf []byte) error {
+		validated = buf
+		return errInvalid
+	})
+	assert.Equal(t, errInvalid, err)
+	assert.Equal(t, `{"a":1}`, string(validated))
+}
@@ -0,0 +1,187 @@
+package mdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/minus5/svckit/log"
+)
+
+// CompactPolicy defines which files of a type are removed in compaction.
+// Newest Keep files are always kept, older ones are removed
+// if they are older than MaxAge (or regardless of age when MaxAge is zero).
+// The newest file is never removed. With SoftDelete removed files are
+// marked as deleted, as by Remove; this holds for all Compact functions.
+type CompactPolicy struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+// KeepLast keeps n newest files of a type
+func KeepLast(n int) CompactPolicy {
+	return CompactPolicy{Keep: n}
+}
+
+// OlderThan removes files older than d, except the newest one
+func OlderThan(d time.Duration) CompactPolicy {
+	return CompactPolicy{Keep: 1, MaxAge: d}
+}
+
+// CompactWith removes files of a type by policy.
+// Returns number of removed files.
+func (fs *Fs) CompactWith(typ string, policy CompactPolicy) (int, error) {
+	var cutoff time.Time
+	if policy.MaxAge > 0 {
+		cutoff = time.Now().Add(-policy.MaxAge)
+	}
+	removed := 0
+	err := fs.db.UseFs(fs.name, fs.name+"_compact", func(g *mgo.GridFS) error {
+		var err error
+		removed, err = fs.compact(context.Background(), g, typ, policy.Keep, cutoff)
+		return err
+	})
+	return removed, err
+}
+
+// compact removes files of a type except keep newest ones by the sort
+// field, and except files uploaded after cutoff (if not zero).
+// Files are scanned from the newest, so files inserted during compaction
+// are never removed. Files with the same sort value are ordered by id,
+// so the kept files are the same on each run.
+func (fs *Fs) compact(ctx context.Context, g *mgo.GridFS, typ string, keep int, cutoff time.Time) (int, error) {
+	if keep < 1 {
+		keep = 1
+	}
+	var r struct {
+		Id         interface{} `bson:"_id"`
+		UploadDate time.Time   `bson:"uploadDate"`
+	}
+	removed := 0
+	i := g.Find(fs.live(bson.M{"filename": typ})).
+		Sort("-"+fs.sortField, "-_id").
+		Select(bson.M{"uploadDate": 1}).
+		Skip(keep).
+		Iter()
+	for i.Next(&r) {
+		if err := ctx.Err(); err != nil {
+			i.Close()
+			return removed, err
+		}
+		if !cutoff.IsZero() && !r.UploadDate.Before(cutoff) {
+			continue
+		}
+		if err := fs.remove(g, r.Id); err != nil {
+			i.Close()
+			return removed, err
+		}
+		removed++
+	}
+	return removed, i.Close()
+}
+
+// CompactKeep deletes all but keep newest files of a type, by the sort
+// field, files with the same value by id, as Compact. Nothing is removed if
+// there are keep or fewer files. Returns ErrInvalidLimit if keep < 1.
+func (fs *Fs) CompactKeep(typ string, keep int) error {
+	if keep < 1 {
+		return ErrInvalidLimit
+	}
+	_, err := fs.CompactWith(typ, KeepLast(keep))
+	return err
+}
+
+// CompactDedup removes files of a type with the same content as the
+// previous kept file, in uploadDate order. Runs of identical files are
+// collapsed to the first one, content is compared by stored md5 and length
+// so chunks are not read. Metadata of the removed files is not compared.
+// Returns number of removed files.
+func (fs *Fs) CompactDedup(typ string) (int, error) {
+	removed := 0
+	err := fs.db.UseFs(fs.name, fs.name+"_compact_dedup", func(g *mgo.GridFS) error {
+		type content struct {
+			Id     interface{} `bson:"_id"`
+			MD5    string      `bson:"md5"`
+			Length int64       `bson:"length"`
+		}
+		var prev content
+		i := g.Find(fs.live(bson.M{"filename": typ})).
+			Sort("uploadDate").
+			Select(bson.M{"md5": 1, "length": 1}).
+			Iter()
+		for {
+			var r content
+			if !i.Next(&r) {
+				break
+			}
+			if r.MD5 == "" || r.MD5 != prev.MD5 || r.Length != prev.Length {
+				prev = r
+				continue
+			}
+			if err := fs.remove(g, r.Id); err != nil {
+				i.Close()
+				return err
+			}
+			removed++
+		}
+		return i.Close()
+	})
+	return removed, err
+}
+
+// StartCompactor compacts files of types by policy every interval.
+// Tick is skipped if the previous compaction is still running.
+// Returned func stops compactor and waits for the running compaction.
+func (fs *Fs) StartCompactor(interval time.Duration, types []string, policy CompactPolicy) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var running int32
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+					log.S("fs", fs.name).Info("compaction still running, tick skipped")
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer atomic.StoreInt32(&running, 0)
+					fs.compactTypes(types, policy, done)
+				}()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		wg.Wait()
+	}
+}
+
+// compactTypes compacts each type, stops between types when done is closed
+func (fs *Fs) compactTypes(types []string, policy CompactPolicy, done <-chan struct{}) {
+	for _, typ := range types {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		n, err := fs.CompactWith(typ, policy)
+		if err != nil {
+			log.S("fs", fs.name).S("type", typ).Error(err)
+			continue
+		}
+		log.S("fs", fs.name).S("type", typ).I("removed", n).Info("compacted")
+	}
+}
@@ -0,0 +1,75 @@
+package mdb
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactDedup(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []func(fs *Fs)
+		soft bool
+	}{
+		{name: "remove"},
+		{name: "soft delete", opts: []func(fs *Fs){SoftDelete(false)}, soft: true},
+		{name: "soft delete dedup purge", opts: []func(fs *Fs){Dedup(), SoftDelete(true)}, soft: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fs, cleanup := testFs(t, c.opts...)
+			defer cleanup()
+			t0 := time.Now().Truncate(time.Millisecond)
+			var ids []bson.ObjectId
+			for i, body := range []string{"a", "a", "b", "a", "a"} {
+				ids = append(ids, insertFiles(t, fs, "t", body, t0.Add(time.Duration(i)*time.Second))...)
+			}
+
+			n, err := fs.CompactDedup("t")
+			assert.Nil(t, err)
+			assert.Equal(t, 2, n)
+			assert.Equal(t, []interface{}{ids[0], ids[2], ids[3]}, liveIds(t, fs, "t"))
+			if c.soft {
+				assert.ElementsMatch(t, []interface{}{ids[1], ids[4]}, deletedIds(t, fs, "t"))
+			} else {
+				assert.Len(t, deletedIds(t, fs, "t"), 0)
+			}
+
+			// kept files are readable
+			for i, id := range []bson.ObjectId{ids[0], ids[2], ids[3]} {
+				assert.Nil(t, fs.FindId(id, func(rc io.ReadCloser) error {
+					b, err := ioutil.ReadAll(rc)
+					assert.Equal(t, []string{"a", "b", "a"}[i], string(b))
+					return err
+				}))
+			}
+		})
+	}
+}
+
+func TestCompactKeep(t *testing.T) {
+	fs, cleanup := testFs(t)
+	defer cleanup()
+	t0 := time.Now().Truncate(time.Millisecond)
+	t1 := t0.Add(time.Second)
+	// last two have the same uploadDate, tie is broken by id
+	ids := insertFiles(t, fs, "a", "a", t0, t1, t1)
+
+	assert.Equal(t, ErrInvalidLimit, fs.CompactKeep("a", 0))
+	assert.Nil(t, fs.CompactKeep("a", 3))
+	assert.Len(t, liveIds(t, fs, "a"), 3)
+
+	assert.Nil(t, fs.CompactKeep("a", 2))
+	assert.ElementsMatch(t, []interface{}{ids[1], ids[2]}, liveIds(t, fs, "a"))
+
+	assert.Nil(t, fs.CompactKeep("a", 1))
+	assert.Equal(t, []interface{}{ids[2]}, liveIds(t, fs, "a"))
+	// the same file is kept as by Compact
+	assert.Nil(t, fs.Compact("a"))
+	assert.Equal(t, []interface{}{ids[2]}, liveIds(t, fs, "a"))
+}
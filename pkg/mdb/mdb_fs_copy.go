@@ -0,0 +1,27 @@
+package mdb
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// CopyFile streams file by id from src to dst, which could be in other Mdb.
+// Id, type, ts, content type and metadata are preserved.
+// Content is not loaded into memory (unless dst uses WriteAhead).
+// Existing id in dst is handled as in Insert: ErrDuplicate is returned.
+func CopyFile(src *Fs, id interface{}, dst *Fs) error {
+	return src.findId(context.Background(), id, func(f *mgo.GridFile, r seekResult) error {
+		defer f.Close()
+		var meta interface{}
+		var raw bson.Raw
+		if err := f.GetMeta(&raw); err != nil {
+			return err
+		}
+		if raw.Kind != 0 {
+			meta = raw
+		}
+		return dst.InsertMeta(r.Filename, r.Id, r.UploadDate, meta, f, SetContentType(f.ContentType()))
+	})
+}
@@ -0,0 +1,46 @@
+package mdb
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// SeekCursor is Seek which returns iterator instead of calling handler,
+// files of a type newer than fromTs in the same order.
+// Iter.Decode reads the file and decodes it into v with the codec chosen
+// by the file content type, as FindObject.
+func (fs *Fs) SeekCursor(typ string, fromTs time.Time) *Iter {
+	var g *mgo.GridFS
+	i := fs.db.newIter(func(s *mgo.Session) (cursor, error) {
+		g = s.DB(fs.db.name).GridFS(fs.name)
+		q := fs.live(bson.M{"filename": typ})
+		if !fromTs.IsZero() {
+			q["uploadDate"] = bson.M{"$gt": fromTs}
+		}
+		return g.Find(q).Sort(fs.sortField).Iter(), nil
+	})
+	i.decode = func(raw bson.Raw, v interface{}) error {
+		var r seekResult
+		if err := raw.Unmarshal(&r); err != nil {
+			return err
+		}
+		f, err := fs.open(g, r)
+		if err != nil {
+			return translateError(err)
+		}
+		defer f.Close()
+		c, err := fs.decoder(f.ContentType())
+		if err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return c.Unmarshal(buf, v)
+	}
+	return i
+}
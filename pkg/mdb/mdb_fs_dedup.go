@@ -0,0 +1,215 @@
+package mdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// maxRefDepth limits following of the references chain
+const maxRefDepth = 8
+
+// Dedup stores file with the same content as an existing one as a reference.
+// Reference is a .files document with ref field set to the id of the file
+// which owns the chunks, and without chunks of its own.
+// Reads resolve references transparently, Remove of the owner moves
+// its chunks to one of the referencing files.
+// Files inserted with metadata are not deduplicated, content type must match.
+func Dedup() func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.dedup = true
+	}
+}
+
+// openId opens file content by id, following the reference
+func (fs *Fs) openId(g *mgo.GridFS, id interface{}) (*mgo.GridFile, seekResult, error) {
+	if !fs.dedup && !fs.softDelete {
+		f, err := g.OpenId(id)
+		if err != nil {
+			return nil, seekResult{}, err
+		}
+		return f, seekResult{Id: f.Id(), Filename: f.Name(), UploadDate: f.UploadDate()}, nil
+	}
+	var r seekResult
+	if err := g.Files.FindId(id).One(&r); err != nil {
+		return nil, r, err
+	}
+	if !r.Deleted.IsZero() {
+		return nil, r, ErrDeleted
+	}
+	f, err := fs.open(g, r)
+	return f, r, err
+}
+
+// open opens content of the file found by query
+func (fs *Fs) open(g *mgo.GridFS, r seekResult) (*mgo.GridFile, error) {
+	id := r.Id
+	for i := 0; r.Ref != nil; i++ {
+		if i == maxRefDepth {
+			return nil, ErrNotFound
+		}
+		id = r.Ref
+		r = seekResult{}
+		if err := g.Files.FindId(id).One(&r); err != nil {
+			return nil, err
+		}
+	}
+	return g.OpenId(id)
+}
+
+// dedupFile replaces just written file with reference to the
+// existing one with the same content.
+// Of all candidates the first in _id order owns the chunks, so concurrent
+// inserts of the same content agree on the owner.
+// Owner is registered for the time of the dedup, and releaseChunks of the
+// owner waits for registered dedups, so the reference is either seen by it
+// or not written at all.
+func (fs *Fs) dedupFile(g *mgo.GridFS, id interface{}) error {
+	if !fs.dedup {
+		return nil
+	}
+	var d struct {
+		MD5         string    `bson:"md5"`
+		Length      int64     `bson:"length"`
+		ContentType string    `bson:"contentType"`
+		Metadata    *bson.Raw `bson:"metadata"`
+	}
+	if err := g.Files.FindId(id).One(&d); err != nil {
+		return err
+	}
+	if d.Metadata != nil || d.MD5 == "" {
+		return nil
+	}
+	q := bson.M{
+		"md5":       d.MD5,
+		"length":    d.Length,
+		"ref":       bson.M{"$exists": false},
+		"metadata":  bson.M{"$exists": false},
+		"deleted":   bson.M{"$exists": false},
+		"releasing": bson.M{"$exists": false},
+	}
+	if d.ContentType != "" {
+		q["contentType"] = d.ContentType
+	} else {
+		q["contentType"] = bson.M{"$exists": false}
+	}
+	var owner seekResult
+	if err := g.Files.Find(q).Sort("_id").Select(bson.M{"_id": 1}).One(&owner); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if owner.Id == id {
+		return nil
+	}
+	// register, fails if the owner is removed or being released
+	err := g.Files.Update(
+		bson.M{"_id": owner.Id, "releasing": bson.M{"$exists": false}},
+		bson.M{"$addToSet": bson.M{"dedups": id}})
+	if err == mgo.ErrNotFound {
+		return nil // keep own chunks
+	}
+	if err != nil {
+		return err
+	}
+	defer g.Files.UpdateId(owner.Id, bson.M{"$pull": bson.M{"dedups": id}})
+	if err := g.Files.UpdateId(id, bson.M{"$set": bson.M{"ref": owner.Id}}); err != nil {
+		return err
+	}
+	_, err = g.Chunks.RemoveAll(bson.M{"files_id": id})
+	return err
+}
+
+// dedupWait is how long releaseChunks waits for dedups registered on the
+// owner, after that they are considered dead (process stopped in dedup)
+var dedupWait = 10 * time.Second
+
+// waitDedups marks owner as releasing, so no new reference is made to it,
+// and waits for dedups in progress
+func (fs *Fs) waitDedups(g *mgo.GridFS, id interface{}) error {
+	if err := g.Files.UpdateId(id, bson.M{"$set": bson.M{"releasing": true}}); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(dedupWait)
+	for {
+		var r struct {
+			Dedups []interface{} `bson:"dedups"`
+		}
+		if err := g.Files.FindId(id).Select(bson.M{"dedups": 1}).One(&r); err != nil {
+			return err
+		}
+		if len(r.Dedups) == 0 || time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// removeId removes file. In dedup mode chunks of the file referenced by
+// others are moved to the first referencing file which becomes the owner.
+func (fs *Fs) removeId(g *mgo.GridFS, id interface{}) error {
+	if !fs.dedup {
+		return g.RemoveId(id)
+	}
+	if err := fs.releaseChunks(g, id); err != nil {
+		return err
+	}
+	return g.Files.RemoveId(id)
+}
+
+// releaseChunks removes chunks of the file in dedup mode,
+// files document is left to the caller.
+func (fs *Fs) releaseChunks(g *mgo.GridFS, id interface{}) error {
+	var r seekResult
+	if err := g.Files.FindId(id).One(&r); err != nil {
+		return err
+	}
+	if r.Ref != nil {
+		// reference has no chunks, point its referrers to its owner
+		_, err := g.Files.UpdateAll(bson.M{"ref": id}, bson.M{"$set": bson.M{"ref": r.Ref}})
+		return err
+	}
+	if err := fs.waitDedups(g, id); err != nil {
+		return err
+	}
+	var heir seekResult
+	err := g.Files.Find(bson.M{"ref": id}).Sort("_id").Select(bson.M{"_id": 1}).One(&heir)
+	if err == mgo.ErrNotFound {
+		_, err = g.Chunks.RemoveAll(bson.M{"files_id": id})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := g.Chunks.UpdateAll(bson.M{"files_id": id}, bson.M{"$set": bson.M{"files_id": heir.Id}}); err != nil {
+		return err
+	}
+	if err := g.Files.UpdateId(heir.Id, bson.M{"$unset": bson.M{"ref": 1}}); err != nil {
+		return err
+	}
+	_, err = g.Files.UpdateAll(bson.M{"ref": id}, bson.M{"$set": bson.M{"ref": heir.Id}})
+	return err
+}
+
+// removeType removes all files of a type
+func (fs *Fs) removeType(ctx context.Context, g *mgo.GridFS, typ string) error {
+	if !fs.dedup {
+		return g.Remove(typ)
+	}
+	var r seekResult
+	i := g.Find(bson.M{"filename": typ}).Select(bson.M{"_id": 1}).Iter()
+	for i.Next(&r) {
+		if err := ctx.Err(); err != nil {
+			i.Close()
+			return err
+		}
+		if err := fs.removeId(g, r.Id); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
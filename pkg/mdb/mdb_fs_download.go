@@ -0,0 +1,88 @@
+package mdb
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ArchiveFormat is format of the DownloadArchive output
+type ArchiveFormat int
+
+const (
+	// ArchiveTar is uncompressed tar
+	ArchiveTar ArchiveFormat = iota
+	// ArchiveZip is zip with deflate compression
+	ArchiveZip
+)
+
+var errArchiveFormat = errors.New("unknown archive format")
+
+// DownloadArchive writes all files of a type to w as single archive.
+// Entries are named by file id, modification time is uploadDate.
+// Files are streamed one by one in seek order.
+func (fs *Fs) DownloadArchive(typ string, w io.Writer, format ArchiveFormat) error {
+	switch format {
+	case ArchiveTar:
+		tw := tar.NewWriter(w)
+		err := fs.Seek(typ, time.Time{}, func(rc io.ReadCloser, ts time.Time, id interface{}) error {
+			hdr := &tar.Header{
+				Name:    entryName(id),
+				Mode:    0644,
+				Size:    rc.(*mgo.GridFile).Size(),
+				ModTime: ts,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, rc)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	case ArchiveZip:
+		zw := zip.NewWriter(w)
+		err := fs.Seek(typ, time.Time{}, func(rc io.ReadCloser, ts time.Time, id interface{}) error {
+			hdr := &zip.FileHeader{
+				Name:     entryName(id),
+				Method:   zip.Deflate,
+				Modified: ts,
+			}
+			ew, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(ew, rc)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	return errArchiveFormat
+}
+
+// entryName is archive entry name for file id.
+// Id is path escaped so that the entry can't leave the extract directory.
+func entryName(id interface{}) string {
+	if oid, ok := id.(bson.ObjectId); ok {
+		return oid.Hex()
+	}
+	name := url.PathEscape(fmt.Sprintf("%v", id))
+	switch name {
+	case "", ".", "..":
+		return strings.Replace(name, ".", "%2E", -1) + "_"
+	}
+	return name
+}
@@ -0,0 +1,31 @@
+package mdb
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryName(t *testing.T) {
+	assert.Equal(t, "5b1e4f2c9d1c3a0001a1b2c3", entryName(bson.ObjectIdHex("5b1e4f2c9d1c3a0001a1b2c3")))
+	assert.Equal(t, "abc", entryName("abc"))
+	assert.Equal(t, "42", entryName(42))
+}
+
+func TestEntryNameEscaped(t *testing.T) {
+	for id, name := range map[string]string{
+		"../../etc/passwd": "..%2F..%2Fetc%2Fpasswd",
+		"/etc/passwd":      "%2Fetc%2Fpasswd",
+		`..\..\boot.ini`:   "..%5C..%5Cboot.ini",
+		"..":               "%2E%2E_",
+		".":                "%2E_",
+		"":                 "_",
+	} {
+		got := entryName(id)
+		assert.Equal(t, name, got)
+		assert.NotContains(t, got, "/")
+		assert.NotContains(t, got, `\`)
+		assert.NotEqual(t, "..", got)
+	}
+}
@@ -0,0 +1,131 @@
+package mdb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrNotDurable is returned from Insert when file is written to the primary
+// but the server didn't confirm the write concern (e.g. majority not reached
+// in time). File is complete on the primary and visible to reads, but may be
+// lost on failover. Retry of the insert with the same id returns
+// ErrDuplicate; check it with FindId after the replica set recovers.
+var ErrNotDurable = errors.New("write not confirmed durable")
+
+// write concern error codes returned by the server
+const (
+	codeWriteConcernFailed        = 64
+	codeUnsatisfiableWriteConcern = 100
+)
+
+// WriteConcern sets write concern used by Insert of the Fs, instead of the
+// session one. File is written acknowledged by the primary, Insert then
+// waits until the server confirms the write concern, ErrNotDurable if it
+// is not confirmed. Ref: InsertSafe for the write concern of the single call.
+func WriteConcern(safe *mgo.Safe) func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.safe = safe
+	}
+}
+
+// DurableWrites makes Insert wait until file is journaled on the majority of
+// the replica set, at most timeout (zero is without limit).
+func DurableWrites(timeout time.Duration) func(fs *Fs) {
+	return WriteConcern(DurableSafe(timeout))
+}
+
+// DurableSafe is write concern of the file journaled on the majority of
+// the replica set, confirmed in at most timeout (zero is without limit).
+func DurableSafe(timeout time.Duration) *mgo.Safe {
+	return &mgo.Safe{
+		WMode:    "majority",
+		J:        true,
+		WTimeout: int(timeout / time.Millisecond),
+	}
+}
+
+// confirmSafe waits until the write of the file id in files collection
+// satisfies safe. Acknowledge by the primary is already confirmed by
+// the write. It is no-op update of the files document with the write
+// concern: server waits for the write concern of the latest writes
+// and leaves the written documents in place if it fails.
+func confirmSafe(files *mgo.Collection, id interface{}, safe *mgo.Safe) error {
+	if safe == nil || (safe.W <= 1 && safe.WMode == "" && !safe.J && !safe.FSync) {
+		return nil
+	}
+	var res writeResult
+	if err := files.Database.Run(confirmCmd(files.Name, id, safe), &res); err != nil {
+		return notDurable(err)
+	}
+	return res.err()
+}
+
+// confirmCmd is no-op update of the file id with write concern safe
+func confirmCmd(col string, id interface{}, safe *mgo.Safe) bson.D {
+	wc := bson.D{}
+	switch {
+	case safe.WMode != "":
+		wc = append(wc, bson.DocElem{Name: "w", Value: safe.WMode})
+	case safe.W > 1:
+		wc = append(wc, bson.DocElem{Name: "w", Value: safe.W})
+	}
+	if safe.J {
+		wc = append(wc, bson.DocElem{Name: "j", Value: true})
+	}
+	if safe.FSync {
+		wc = append(wc, bson.DocElem{Name: "fsync", Value: true})
+	}
+	if safe.WTimeout > 0 {
+		wc = append(wc, bson.DocElem{Name: "wtimeout", Value: safe.WTimeout})
+	}
+	return bson.D{
+		{Name: "update", Value: col},
+		{Name: "updates", Value: []bson.M{{
+			"q": bson.M{"_id": id},
+			// field is never set, document is not changed
+			"u": bson.M{"$unset": bson.M{"_confirm": ""}},
+		}}},
+		{Name: "writeConcern", Value: wc},
+	}
+}
+
+// writeResult is reply of the write command
+type writeResult struct {
+	WriteErrors []struct {
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+	WriteConcernError *struct {
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeConcernError"`
+}
+
+// err returns ErrNotDurable if write concern is not satisfied
+func (r writeResult) err() error {
+	if len(r.WriteErrors) > 0 {
+		return errors.New(r.WriteErrors[0].ErrMsg)
+	}
+	if r.WriteConcernError != nil {
+		return ErrNotDurable
+	}
+	return nil
+}
+
+// notDurable translates write concern error into ErrNotDurable
+func notDurable(err error) error {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		if e.WTimeout || e.Code == codeWriteConcernFailed || e.Code == codeUnsatisfiableWriteConcern {
+			return ErrNotDurable
+		}
+	case *mgo.QueryError:
+		if e.Code == codeWriteConcernFailed || e.Code == codeUnsatisfiableWriteConcern {
+			return ErrNotDurable
+		}
+	}
+	return err
+}
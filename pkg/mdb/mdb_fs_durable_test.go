@@ -0,0 +1,84 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotDurable(t *testing.T) {
+	other := errors.New("other")
+	fs := &Fs{}
+	DurableWrites(time.Second)(fs)
+	assert.Equal(t, "majority", fs.safe.WMode)
+	assert.True(t, fs.safe.J)
+	assert.Equal(t, 1000, fs.safe.WTimeout)
+
+	assert.Equal(t, ErrNotDurable, notDurable(&mgo.LastError{Code: codeWriteConcernFailed}))
+	assert.Equal(t, ErrNotDurable, notDurable(&mgo.LastError{WTimeout: true}))
+	assert.Equal(t, ErrNotDurable, notDurable(&mgo.QueryError{Code: codeUnsatisfiableWriteConcern}))
+	assert.Equal(t, other, notDurable(other))
+	assert.Nil(t, notDurable(nil))
+}
+
+func TestConfirmSafeAcknowledged(t *testing.T) {
+	// nothing to confirm, session is not used
+	assert.Nil(t, confirmSafe(nil, "id", nil))
+	assert.Nil(t, confirmSafe(nil, "id", &mgo.Safe{}))
+	assert.Nil(t, confirmSafe(nil, "id", &mgo.Safe{W: 1, WTimeout: 100}))
+}
+
+func TestConfirmCmd(t *testing.T) {
+	cmd := confirmCmd("fs.files", "id", DurableSafe(time.Second))
+	assert.Equal(t, "update", cmd[0].Name)
+	assert.Equal(t, "fs.files", cmd[0].Value)
+	assert.Equal(t, "writeConcern", cmd[2].Name)
+	assert.Equal(t, bson.D{
+		{Name: "w", Value: "majority"},
+		{Name: "j", Value: true},
+		{Name: "wtimeout", Value: 1000},
+	}, cmd[2].Value)
+	wc := confirmCmd("fs.files", "id", &mgo.Safe{W: 2, FSync: true})[2].Value
+	assert.Equal(t, bson.D{{Name: "w", Value: 2}, {Name: "fsync", Value: true}}, wc)
+
+	// reply of the server
+	reply := func(doc bson.M) error {
+		raw, err := bson.Marshal(doc)
+		assert.Nil(t, err)
+		var r writeResult
+		assert.Nil(t, bson.Unmarshal(raw, &r))
+		return r.err()
+	}
+	assert.Nil(t, reply(bson.M{"ok": 1, "n": 1}))
+	assert.Equal(t, ErrNotDurable, reply(bson.M{"ok": 1, "n": 1,
+		"writeConcernError": bson.M{"code": codeWriteConcernFailed, "errmsg": "waiting for replication timed out"}}))
+	assert.EqualError(t, reply(bson.M{"ok": 1, "writeErrors": []bson.M{{"code": 2, "errmsg": "bad"}}}), "bad")
+}
+
+func TestInsertSafe(t *testing.T) {
+	fs, cleanup := testFs(t)
+	defer cleanup()
+	ctx := context.Background()
+	ts := time.Now()
+
+	// test server may not have two members to confirm the write concern,
+	// file is written in any case
+	fs.InsertSafe(ctx, &mgo.Safe{W: 2, WTimeout: 100}, "a", "id", ts, nil, strings.NewReader("a"))
+	assert.Equal(t, []interface{}{"id"}, liveIds(t, fs, "a"))
+	assert.Nil(t, fs.FindId("id", func(rc io.ReadCloser) error {
+		b, err := ioutil.ReadAll(rc)
+		assert.Equal(t, "a", string(b))
+		return err
+	}))
+
+	assert.Nil(t, fs.InsertSafe(ctx, DurableSafe(time.Second), "a", "id2", ts, nil, strings.NewReader("a")))
+	assert.Equal(t, ErrDuplicate, fs.InsertSafe(ctx, DurableSafe(time.Second), "a", "id2", ts, nil, strings.NewReader("a")))
+}
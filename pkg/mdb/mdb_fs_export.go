@@ -0,0 +1,113 @@
+package mdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrInvalidExport is returned from Import for stream not written by Export
+var ErrInvalidExport = errors.New("invalid export")
+
+// maxExportEntry limits size of the single file in export stream
+const maxExportEntry = 1 << 30
+
+// Export writes files of the types (all if none) to w, in uploadDate order.
+// Each file is written with type, id, ts (uploadDate), metadata, content
+// type and content, so Import reconstructs it exactly: Seek, Find and
+// Compact behave the same on the imported Fs as on the source.
+// Soft deleted files are not exported.
+func (fs *Fs) Export(w io.Writer, typs ...string) error {
+	q := bson.M{}
+	if len(typs) > 0 {
+		q["filename"] = bson.M{"$in": typs}
+	}
+	return fs.db.UseFs(fs.name, fs.name+"_export", func(g *mgo.GridFS) error {
+		i := g.Find(fs.live(q)).Sort("uploadDate", "_id").Iter()
+		var r exportResult
+		for i.Next(&r) {
+			f, err := fs.open(g, r.seekResult)
+			if err != nil {
+				i.Close()
+				return translateError(err)
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				i.Close()
+				return err
+			}
+			e := &walEntry{Typ: r.Filename, Id: r.Id, Ts: r.UploadDate, Meta: r.Metadata, ContentType: r.ContentType, Data: data}
+			if err := writeEntry(w, e); err != nil {
+				i.Close()
+				return err
+			}
+			r = exportResult{}
+		}
+		return i.Close()
+	})
+}
+
+// Import inserts files written by Export, in the export order.
+// Existing id fails with ErrDuplicate, files before it stay inserted.
+func (fs *Fs) Import(r io.Reader) error {
+	for {
+		e, err := readEntry(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fs.InsertMeta(e.Typ, e.Id, e.Ts, e.meta(), bytes.NewReader(e.Data), SetContentType(e.ContentType)); err != nil {
+			return err
+		}
+	}
+}
+
+// exportResult is .files document with the fields needed for export
+type exportResult struct {
+	seekResult  `bson:",inline"`
+	Metadata    *bson.Raw `bson:"metadata,omitempty"`
+	ContentType string    `bson:"contentType,omitempty"`
+}
+
+// writeEntry writes entry as bson document, which starts with its length
+func writeEntry(w io.Writer, e *walEntry) error {
+	raw, err := bson.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// readEntry reads next entry, io.EOF at the end of the stream
+func readEntry(r io.Reader) (*walEntry, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidExport
+		}
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(l[:])
+	if n < 5 || n > maxExportEntry {
+		return nil, ErrInvalidExport
+	}
+	raw := make([]byte, n)
+	copy(raw, l[:])
+	if _, err := io.ReadFull(r, raw[4:]); err != nil {
+		return nil, ErrInvalidExport
+	}
+	e := &walEntry{}
+	if err := bson.Unmarshal(raw, e); err != nil {
+		return nil, ErrInvalidExport
+	}
+	return e, nil
+}
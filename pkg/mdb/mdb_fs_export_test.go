@@ -0,0 +1,88 @@
+package mdb
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportEntries(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	meta, _ := bson.Marshal(bson.M{"seq": 1})
+	in := []*walEntry{
+		{Typ: "a", Id: "1", Ts: ts, Data: []byte("one")},
+		{Typ: "b", Id: bson.NewObjectId(), Ts: ts.Add(time.Millisecond), Meta: &bson.Raw{Kind: 0x03, Data: meta}, ContentType: "application/json", Data: []byte("{}")},
+		{Typ: "a", Id: int64(3), Ts: ts.Add(time.Second), Data: []byte{}},
+	}
+	buf := &bytes.Buffer{}
+	for _, e := range in {
+		assert.Nil(t, writeEntry(buf, e))
+	}
+	data := buf.Bytes()
+
+	r := bytes.NewReader(data)
+	for _, e := range in {
+		out, err := readEntry(r)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Typ, out.Typ)
+		assert.Equal(t, e.Id, out.Id)
+		assert.True(t, e.Ts.Equal(out.Ts))
+		assert.Equal(t, e.ContentType, out.ContentType)
+		assert.Equal(t, string(e.Data), string(out.Data))
+		if e.Meta == nil {
+			assert.Nil(t, out.meta())
+		} else {
+			assert.Equal(t, e.Meta.Data, out.Meta.Data)
+		}
+	}
+	_, err := readEntry(r)
+	assert.Equal(t, io.EOF, err)
+
+	// truncated stream
+	r = bytes.NewReader(data[:len(data)-1])
+	for err == nil || err == io.EOF {
+		_, err = readEntry(r)
+		if err == io.EOF {
+			t.Fatal("truncated stream read to the end")
+		}
+	}
+	assert.Equal(t, ErrInvalidExport, err)
+}
+
+func TestExportImportSeek(t *testing.T) {
+	src, cleanup := testFs(t)
+	defer cleanup()
+	dst, cleanup2 := testFs(t)
+	defer cleanup2()
+	t0 := time.Now().Truncate(time.Millisecond)
+	insertFiles(t, src, "a", "a", t0, t0.Add(2*time.Second), t0.Add(time.Second))
+	insertFiles(t, src, "b", "b", t0)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, src.Export(buf, "a"))
+	assert.Nil(t, dst.Import(buf))
+
+	type file struct {
+		ts   time.Time
+		id   interface{}
+		body string
+	}
+	seek := func(fs *Fs, typ string) []file {
+		var files []file
+		assert.Nil(t, fs.Seek(typ, time.Time{}, func(rc io.ReadCloser, ts time.Time, id interface{}) error {
+			b, err := ioutil.ReadAll(rc)
+			files = append(files, file{ts: ts, id: id, body: string(b)})
+			return err
+		}))
+		return files
+	}
+	want := seek(src, "a")
+	assert.Len(t, want, 3)
+	assert.Equal(t, want, seek(dst, "a"))
+	assert.Len(t, seek(dst, "b"), 0, "not exported")
+}
@@ -0,0 +1,117 @@
+package mdb
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/globalsign/mgo"
+)
+
+// FindIds returns files by ids, one by one in ids order.
+// Ref: FindIdsParallel
+func (fs *Fs) FindIds(ids []interface{}, h func(i int, rc io.ReadCloser, err error) error) error {
+	return fs.FindIdsParallel(ids, 1, h)
+}
+
+// FindIdsParallel opens up to concurrency files at once, each in its own
+// session, but calls handler in ids order, one call at a time.
+// Handler gets index of the id in ids. Missing file is reported in its
+// position with rc nil and err ErrNotFound (or ErrDeleted, ErrInvalidId).
+// Other errors, and error returned from the handler, stop the remaining
+// ids and are returned.
+// Opened file waits for its turn, so at most concurrency sessions are used.
+func (fs *Fs) FindIdsParallel(ids []interface{}, concurrency int, h func(i int, rc io.ReadCloser, err error) error) error {
+	return inOrder(len(ids), concurrency, func(i int, found func(io.ReadCloser)) error {
+		return fs.findId(context.Background(), ids[i], func(f *mgo.GridFile, _ seekResult) error {
+			found(f)
+			return nil
+		})
+	}, h)
+}
+
+// inOrder runs fetch of n items in parallel and calls handler in item order.
+// fetch calls found with the item while its session is open, and
+// found returns after the handler is done with it.
+func inOrder(n, concurrency int, fetch func(i int, found func(io.ReadCloser)) error, h func(i int, rc io.ReadCloser, err error) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// turns[i] is closed when it is the turn of the item i
+	turns := make([]chan struct{}, n+1)
+	for i := range turns {
+		turns[i] = make(chan struct{})
+	}
+	close(turns[0])
+
+	done := make(chan struct{})
+	var ferr error
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			ferr = err
+			close(done)
+		})
+	}
+	// deliver waits for the turn of i, calls handler and passes the turn to i+1
+	deliver := func(i int, rc io.ReadCloser, err error) {
+		<-turns[i]
+		defer close(turns[i+1])
+		select {
+		case <-done:
+			if rc != nil {
+				rc.Close()
+			}
+			return
+		default:
+		}
+		if rc != nil {
+			err = h(i, rc, nil)
+		} else if positional(err) {
+			err = h(i, nil, err)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				called := false
+				err := fetch(i, func(rc io.ReadCloser) {
+					called = true
+					deliver(i, rc, nil)
+				})
+				if !called {
+					deliver(i, nil, err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case next <- i:
+			continue
+		case <-done:
+		}
+		// remaining items are skipped, pass their turns
+		for j := i; j < n; j++ {
+			go deliver(j, nil, nil)
+		}
+		break
+	}
+	close(next)
+	wg.Wait()
+	<-turns[n]
+	return ferr
+}
+
+// positional errors are reported to the handler in the position of the item
+func positional(err error) bool {
+	return err == ErrNotFound || err == ErrDeleted || err == ErrInvalidId
+}
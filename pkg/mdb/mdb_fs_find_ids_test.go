@@ -0,0 +1,77 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInOrder(t *testing.T) {
+	var open, maxOpen int32
+	fetch := func(i int, found func(io.ReadCloser)) error {
+		if i%3 == 2 {
+			return ErrNotFound
+		}
+		n := atomic.AddInt32(&open, 1)
+		defer atomic.AddInt32(&open, -1)
+		for {
+			m := atomic.LoadInt32(&maxOpen)
+			if n <= m || atomic.CompareAndSwapInt32(&maxOpen, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		found(ioutil.NopCloser(strings.NewReader(strconv.Itoa(i))))
+		return nil
+	}
+	var got []int
+	err := inOrder(20, 4, fetch, func(i int, rc io.ReadCloser, err error) error {
+		got = append(got, i)
+		if i%3 == 2 {
+			assert.Equal(t, ErrNotFound, err)
+			assert.Nil(t, rc)
+			return nil
+		}
+		assert.Nil(t, err)
+		buf, _ := ioutil.ReadAll(rc)
+		assert.Equal(t, strconv.Itoa(i), string(buf))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, got, 20)
+	for i, v := range got {
+		assert.Equal(t, i, v)
+	}
+	assert.True(t, maxOpen <= 4)
+
+	// handler error stops remaining
+	stop := errors.New("stop")
+	got = nil
+	err = inOrder(20, 4, fetch, func(i int, rc io.ReadCloser, err error) error {
+		got = append(got, i)
+		if i == 5 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, got)
+
+	// fetch error is not positional
+	fail := errors.New("no reachable servers")
+	err = inOrder(5, 2, func(i int, found func(io.ReadCloser)) error {
+		return fail
+	}, func(i int, rc io.ReadCloser, err error) error {
+		t.Fatal("handler called")
+		return nil
+	})
+	assert.Equal(t, fail, err)
+}
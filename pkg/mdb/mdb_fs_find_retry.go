@@ -0,0 +1,48 @@
+package mdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/minus5/svckit/metric"
+)
+
+// FindIdRetry makes FindId retry when the file is not found, for the
+// replication lag of reads from secondary (e.g. SecondaryPreferred mode)
+// of the file just inserted to primary. FindId is retried at most attempts
+// times, first after backoff, each next after double the previous wait.
+// After the last attempt ErrNotFound is returned, so missing file costs
+// up to backoff*(2^attempts-1) wait.
+// Only not found file is retried, handler errors are returned immediately.
+// Default is no retry.
+func FindIdRetry(attempts int, backoff time.Duration) func(fs *Fs) {
+	return func(fs *Fs) {
+		if attempts > 0 && backoff > 0 {
+			fs.findRetry = &findRetry{attempts: attempts, backoff: backoff, sleep: sleepCtx}
+		}
+	}
+}
+
+type findRetry struct {
+	attempts int
+	backoff  time.Duration
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// do calls find until it finds the file or attempts are exhausted.
+// find returns found false when file is not opened.
+// Retry stops with ctx.Err() when ctx is done, also during the wait.
+func (r *findRetry) do(ctx context.Context, find func() (found bool, err error)) error {
+	backoff := r.backoff
+	for i := 0; ; i++ {
+		found, err := find()
+		if found || err != ErrNotFound || i >= r.attempts {
+			return err
+		}
+		metric.Counter("db.fs.find_id.retry")
+		if err := r.sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,81 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindRetry(t *testing.T) {
+	var waits []time.Duration
+	r := &findRetry{attempts: 3, backoff: time.Millisecond, sleep: func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}}
+
+	ctx := context.Background()
+
+	// found after replication lag
+	calls := 0
+	err := r.do(ctx, func() (bool, error) {
+		calls++
+		if calls < 3 {
+			return false, ErrNotFound
+		}
+		return true, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond}, waits)
+
+	// missing file is not found after the last attempt
+	calls, waits = 0, nil
+	err = r.do(ctx, func() (bool, error) {
+		calls++
+		return false, ErrNotFound
+	})
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}, waits)
+
+	// other errors and handler errors are not retried
+	for _, found := range []bool{false, true} {
+		calls = 0
+		err = r.do(ctx, func() (bool, error) {
+			calls++
+			if found {
+				return true, ErrNotFound
+			}
+			return false, errors.New("failed")
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, calls)
+	}
+
+	// cancelled context stops retry after the wait
+	cctx, cancel := context.WithCancel(ctx)
+	calls, waits = 0, nil
+	err = r.do(cctx, func() (bool, error) {
+		calls++
+		cancel()
+		return false, ErrNotFound
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+
+	// wait is interrupted when ctx is done
+	r.sleep = sleepCtx
+	r.backoff = time.Hour
+	cctx, cancel = context.WithCancel(ctx)
+	calls = 0
+	err = r.do(cctx, func() (bool, error) {
+		calls++
+		go cancel()
+		return false, ErrNotFound
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,163 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrInvalidGroup is returned for group with fields not set by GroupBy,
+// and on insert for group without all of the fields.
+var ErrInvalidGroup = errors.New("invalid group")
+
+// Group is composite grouping key, field name to value, e.g.
+// Group{"tenant": "t1", "type": "odds"}.
+type Group map[string]string
+
+// GroupBy groups files by composite key of fields instead of a single type.
+// Fields are stored in the file metadata, index on fields followed by the
+// sort field is created. Queries may use partial key: all fields or any of
+// them, prefix of fields (in GroupBy order) uses the index.
+// Filename of the file is GroupName, so type methods (Remove, Compact...)
+// work for the full key.
+func GroupBy(fields ...string) func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.groupBy = fields
+	}
+}
+
+// GroupName returns filename of the files in the group.
+// Fields are escaped and sorted, different groups can't collide.
+func GroupName(g Group) string {
+	v := url.Values{}
+	for f, val := range g {
+		v.Set(f, val)
+	}
+	return v.Encode()
+}
+
+// InsertGroup inserts file into the group, all GroupBy fields must be set.
+// meta fields are stored next to the group fields, it must be a document.
+func (fs *Fs) InsertGroup(g Group, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	if len(fs.groupBy) == 0 || len(g) != len(fs.groupBy) {
+		return ErrInvalidGroup
+	}
+	m := bson.M{}
+	if meta != nil {
+		raw, err := bson.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := bson.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+	}
+	for _, f := range fs.groupBy {
+		v, ok := g[f]
+		if !ok {
+			return ErrInvalidGroup
+		}
+		m[f] = v
+	}
+	return fs.InsertMeta(GroupName(g), id, ts, m, rdr, opts...)
+}
+
+// SeekGroup returns files of the (partial) group newer than fromTs,
+// handler gets full group of each file.
+func (fs *Fs) SeekGroup(g Group, fromTs time.Time, h func(io.ReadCloser, Group, time.Time, interface{}) error) error {
+	q, err := fs.groupQuery(g)
+	if err != nil {
+		return err
+	}
+	if !fromTs.IsZero() {
+		q["uploadDate"] = bson.M{"$gt": fromTs}
+	}
+	return fs.db.UseFs(fs.name, fs.name+"_seek_group", func(gfs *mgo.GridFS) error {
+		i := gfs.Find(q).Sort(fs.sortField).Iter()
+		var r groupResult
+		for i.Next(&r) {
+			f, err := fs.open(gfs, r.seekResult)
+			if err != nil {
+				i.Close()
+				return err
+			}
+			if err := fs.handle(f, func(rc io.ReadCloser) error { return h(rc, fs.group(r.Metadata), r.UploadDate, r.Id) }); err != nil {
+				i.Close()
+				return err
+			}
+		}
+		return i.Close()
+	})
+}
+
+// FindGroup returns the last file of the (partial) group.
+// Returns ErrNotFound if there are no files in the group.
+func (fs *Fs) FindGroup(g Group, h func(io.ReadCloser, Group, time.Time, interface{}) error) error {
+	q, err := fs.groupQuery(g)
+	if err != nil {
+		return err
+	}
+	return fs.db.UseFs(fs.name, fs.name+"_find_group", func(gfs *mgo.GridFS) error {
+		var r groupResult
+		if err := gfs.Find(q).Sort("-" + fs.sortField).One(&r); err != nil {
+			return translateError(err)
+		}
+		f, err := fs.open(gfs, r.seekResult)
+		if err != nil {
+			return translateError(err)
+		}
+		return translateError(fs.handle(f, func(rc io.ReadCloser) error { return h(rc, fs.group(r.Metadata), r.UploadDate, r.Id) }))
+	})
+}
+
+// groupResult is seekResult with metadata holding group fields
+type groupResult struct {
+	seekResult `bson:",inline"`
+	Metadata   bson.M `bson:"metadata"`
+}
+
+// groupQuery builds query for the (partial) group
+func (fs *Fs) groupQuery(g Group) (bson.M, error) {
+	if len(fs.groupBy) == 0 || len(g) == 0 {
+		return nil, ErrInvalidGroup
+	}
+	q := bson.M{}
+	for f, v := range g {
+		if !fs.groupField(f) {
+			return nil, ErrInvalidGroup
+		}
+		q["metadata."+f] = v
+	}
+	return fs.live(q), nil
+}
+
+func (fs *Fs) groupField(f string) bool {
+	for _, gf := range fs.groupBy {
+		if gf == f {
+			return true
+		}
+	}
+	return false
+}
+
+// group extracts group fields from the file metadata
+func (fs *Fs) group(md bson.M) Group {
+	g := make(Group, len(fs.groupBy))
+	for _, f := range fs.groupBy {
+		g[f], _ = md[f].(string)
+	}
+	return g
+}
+
+// groupIndex is index on the group fields and sort field
+func (fs *Fs) groupIndex() mgo.Index {
+	var key []string
+	for _, f := range fs.groupBy {
+		key = append(key, "metadata."+f)
+	}
+	return mgo.Index{Key: append(key, fs.sortField)}
+}
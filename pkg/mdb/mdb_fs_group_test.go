@@ -0,0 +1,33 @@
+package mdb
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupName(t *testing.T) {
+	assert.Equal(t, "tenant=a&type=b", GroupName(Group{"type": "b", "tenant": "a"}))
+	// concatenation would collide
+	assert.NotEqual(t, GroupName(Group{"tenant": "a&type=b", "type": "c"}),
+		GroupName(Group{"tenant": "a", "type": "b&type=c"}))
+}
+
+func TestGroupQuery(t *testing.T) {
+	fs := &Fs{sortField: defaultSortField}
+	_, err := fs.groupQuery(Group{"tenant": "a"})
+	assert.Equal(t, ErrInvalidGroup, err)
+
+	fs.groupBy = []string{"tenant", "type"}
+	q, err := fs.groupQuery(Group{"tenant": "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"metadata.tenant": "a"}, q)
+	_, err = fs.groupQuery(Group{"other": "a"})
+	assert.Equal(t, ErrInvalidGroup, err)
+	_, err = fs.groupQuery(Group{})
+	assert.Equal(t, ErrInvalidGroup, err)
+
+	assert.Equal(t, Group{"tenant": "a", "type": ""}, fs.group(bson.M{"tenant": "a", "seq": 1}))
+	assert.Equal(t, []string{"metadata.tenant", "metadata.type", "uploadDate"}, fs.groupIndex().Key)
+}
@@ -0,0 +1,130 @@
+package mdb
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/minus5/svckit/log"
+)
+
+// FileListItem is element of the FsHandler listing
+type FileListItem struct {
+	Id          interface{} `json:"id"`
+	Ts          time.Time   `json:"ts"`
+	Length      int64       `json:"length"`
+	ContentType string      `json:"content_type,omitempty"`
+}
+
+// FsHandler serves files of a type:
+//
+//	GET /          newest file
+//	GET /{id}      file by id (ObjectId hex or string), supports range requests
+//	GET /?from=ts  JSON list of files newer than ts (RFC3339 or unix milliseconds)
+//
+// File responses have ETag and Last-Modified headers,
+// conditional requests for unchanged file get 304 Not Modified.
+func FsHandler(fs *Fs, typ string) http.Handler {
+	return &fsHandler{fs: fs, typ: typ}
+}
+
+type fsHandler struct {
+	fs  *Fs
+	typ string
+}
+
+func (h *fsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	id := strings.Trim(r.URL.Path, "/")
+	switch {
+	case id != "":
+		err = h.fs.findId(r.Context(), ParseId(id), func(f *mgo.GridFile, sr seekResult) error {
+			if sr.Filename != h.typ {
+				return ErrNotFound
+			}
+			serveFile(w, r, f, sr.UploadDate)
+			return nil
+		})
+	case r.URL.Query().Get("from") != "":
+		err = h.list(w, r.URL.Query().Get("from"))
+	default:
+		err = h.fs.Find(h.typ, func(rc io.ReadCloser, ts time.Time, _ interface{}) error {
+			serveFile(w, r, rc.(*mgo.GridFile), ts)
+			return nil
+		})
+	}
+	switch err {
+	case nil:
+	case ErrNotFound:
+		http.NotFound(w, r)
+	case ErrDeleted:
+		http.Error(w, err.Error(), http.StatusGone)
+	case errInvalidFrom:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.S("fs", h.fs.name).S("type", h.typ).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *fsHandler) list(w http.ResponseWriter, from string) error {
+	fromTs, err := parseTs(from)
+	if err != nil {
+		return err
+	}
+	items := []FileListItem{}
+	err = h.fs.Seek(h.typ, fromTs, func(rc io.ReadCloser, ts time.Time, id interface{}) error {
+		f := rc.(*mgo.GridFile)
+		items = append(items, FileListItem{
+			Id:          id,
+			Ts:          ts,
+			Length:      f.Size(),
+			ContentType: f.ContentType(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(items)
+}
+
+// serveFile writes file with Content-Type and Content-Length headers.
+// ETag is file md5, Last-Modified is ts (uploadDate).
+// Range and conditional requests (If-None-Match, If-Modified-Since)
+// are handled by http.ServeContent.
+func serveFile(w http.ResponseWriter, r *http.Request, f *mgo.GridFile, ts time.Time) {
+	if ct := f.ContentType(); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if md5 := f.MD5(); md5 != "" {
+		w.Header().Set("ETag", `"`+md5+`"`)
+	}
+	http.ServeContent(w, r, "", ts, f)
+}
+
+var errInvalidFrom = errors.New("invalid from, expecting RFC3339 or unix milliseconds")
+
+func parseTs(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errInvalidFrom
+	}
+	return ts, nil
+}
@@ -0,0 +1,101 @@
+package mdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrInvalidId is returned for file id of the unsupported type
+var ErrInvalidId = errors.New("invalid file id")
+
+// Id is file id of the type supported by Fs.
+// Ids are compared by type, string with ObjectId hex doesn't find
+// file stored with ObjectId. Supported types which round-trip through
+// mongo unchanged are bson.ObjectId and string. Integers are stored as
+// int64 and match any integer type in the query.
+type Id struct {
+	v interface{}
+}
+
+// NewId validates v and wraps it in Id.
+// Returns ErrInvalidId for invalid ObjectId, empty string and other types.
+func NewId(v interface{}) (Id, error) {
+	switch t := v.(type) {
+	case Id:
+		return t, nil
+	case bson.ObjectId:
+		if !t.Valid() {
+			return Id{}, ErrInvalidId
+		}
+		return Id{v: t}, nil
+	case string:
+		if t == "" {
+			return Id{}, ErrInvalidId
+		}
+		return Id{v: t}, nil
+	case int:
+		return Id{v: int64(t)}, nil
+	case int32:
+		return Id{v: int64(t)}, nil
+	case int64:
+		return Id{v: t}, nil
+	}
+	return Id{}, ErrInvalidId
+}
+
+// ParseId returns ObjectId for ObjectId hex string, string otherwise
+func ParseId(s string) Id {
+	if bson.IsObjectIdHex(s) {
+		return Id{v: bson.ObjectIdHex(s)}
+	}
+	return Id{v: s}
+}
+
+// Value is id as stored in mongo
+func (id Id) Value() interface{} {
+	return id.v
+}
+
+func (id Id) String() string {
+	if oid, ok := id.v.(bson.ObjectId); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprintf("%v", id.v)
+}
+
+// IsZero is true for Id which is not set
+func (id Id) IsZero() bool {
+	return id.v == nil
+}
+
+// idValue validates id passed to Fs methods and unwraps Id.
+// Nil is passed through, it means id is not set.
+func idValue(id interface{}) (interface{}, error) {
+	if id == nil {
+		return nil, nil
+	}
+	v, err := NewId(id)
+	if err != nil {
+		return nil, err
+	}
+	return v.v, nil
+}
+
+// FindById is FindId with typed id
+func (fs *Fs) FindById(id Id, h func(io.ReadCloser) error) error {
+	if id.IsZero() {
+		return ErrInvalidId
+	}
+	return fs.FindId(id.v, h)
+}
+
+// RemoveById is RemoveId with typed id
+func (fs *Fs) RemoveById(id Id) error {
+	if id.IsZero() {
+		return ErrInvalidId
+	}
+	return fs.RemoveId(id.v)
+}
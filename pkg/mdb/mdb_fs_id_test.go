@@ -0,0 +1,34 @@
+package mdb
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewId(t *testing.T) {
+	oid := bson.NewObjectId()
+	id, err := NewId(oid)
+	assert.Nil(t, err)
+	assert.Equal(t, oid, id.Value())
+	assert.Equal(t, oid.Hex(), id.String())
+
+	id, err = NewId(42)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), id.Value())
+
+	for _, v := range []interface{}{"", bson.ObjectId("short"), 1.5, []byte("a"), bson.M{"a": 1}} {
+		_, err := NewId(v)
+		assert.Equal(t, ErrInvalidId, err)
+	}
+	v, err := idValue(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+}
+
+func TestParseId(t *testing.T) {
+	oid := bson.NewObjectId()
+	assert.Equal(t, oid, ParseId(oid.Hex()).Value())
+	assert.Equal(t, "abc", ParseId("abc").Value())
+}
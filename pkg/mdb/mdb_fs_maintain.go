@@ -0,0 +1,136 @@
+package mdb
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// MaintainOptions controls what Maintain fixes
+type MaintainOptions struct {
+	RemoveOrphans bool // remove chunks which don't have .files entry
+	// Orphans with chunks written in the last OrphanGrace are not removed,
+	// they are probably of the file being inserted: .files entry is written
+	// after all chunks. Zero is DefaultOrphanGrace.
+	OrphanGrace time.Duration
+}
+
+// DefaultOrphanGrace is default MaintainOptions.OrphanGrace
+const DefaultOrphanGrace = time.Hour
+
+// MaintainReport is result of the Maintain
+type MaintainReport struct {
+	Indexes        []IndexInfo   // index status after ensuring required indexes
+	OrphanChunks   int           // chunks without .files entry
+	OrphansRemoved int           // orphan chunks removed, older than OrphanGrace
+	MissingChunks  []interface{} // ids of files with less chunks than their length requires
+}
+
+// Maintain ensures required indexes and checks consistency
+// of the .chunks and .files collections.
+// Intended to be run occasionally, it scans both collections.
+func (fs *Fs) Maintain(opts MaintainOptions) (MaintainReport, error) {
+	var rpt MaintainReport
+	if err := fs.EnsureIndexes(); err != nil {
+		return rpt, err
+	}
+	indexes, err := fs.IndexStatus()
+	if err != nil {
+		return rpt, err
+	}
+	rpt.Indexes = indexes
+
+	// expected number of chunks for each file
+	expected := make(map[interface{}]int)
+	err = fs.db.UseWithoutTimeout(fs.name+".files", func(c *mgo.Collection) error {
+		var f struct {
+			Id        interface{} `bson:"_id"`
+			Length    int64       `bson:"length"`
+			ChunkSize int         `bson:"chunkSize"`
+			Ref       interface{} `bson:"ref"`
+			Purged    bool        `bson:"purged"`
+		}
+		iter := c.Find(nil).Select(bson.M{"length": 1, "chunkSize": 1, "ref": 1, "purged": 1}).Iter()
+		for iter.Next(&f) {
+			if f.Purged {
+				expected[f.Id] = 0 // soft deleted, chunks removed
+				continue
+			}
+			if f.Ref != nil {
+				continue // dedup reference, chunks are owned by other file
+			}
+			n := 0
+			if f.ChunkSize > 0 {
+				n = int((f.Length + int64(f.ChunkSize) - 1) / int64(f.ChunkSize))
+			}
+			expected[f.Id] = n
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return rpt, err
+	}
+
+	grace := opts.OrphanGrace
+	if grace <= 0 {
+		grace = DefaultOrphanGrace
+	}
+	// chunk ids are ObjectIds created when the chunk is written
+	cutoff := time.Now().Add(-grace)
+	var orphans []interface{}
+	err = fs.db.UseWithoutTimeout(fs.name+".chunks", func(c *mgo.Collection) error {
+		var g struct {
+			FileId interface{} `bson:"_id"`
+			Count  int         `bson:"count"`
+			Last   interface{} `bson:"last"`
+		}
+		pipe := c.Pipe([]bson.M{
+			{"$group": bson.M{"_id": "$files_id", "count": bson.M{"$sum": 1}, "last": bson.M{"$max": "$_id"}}},
+		}).AllowDiskUse()
+		iter := pipe.Iter()
+		for iter.Next(&g) {
+			n, ok := expected[g.FileId]
+			if !ok {
+				rpt.OrphanChunks += g.Count
+				if last, ok := g.Last.(bson.ObjectId); ok && last.Time().Before(cutoff) {
+					orphans = append(orphans, g.FileId)
+				}
+				continue
+			}
+			if g.Count < n {
+				rpt.MissingChunks = append(rpt.MissingChunks, g.FileId)
+			}
+			delete(expected, g.FileId)
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return rpt, err
+	}
+	// files without any chunk
+	for id, n := range expected {
+		if n > 0 {
+			rpt.MissingChunks = append(rpt.MissingChunks, id)
+		}
+	}
+
+	if !opts.RemoveOrphans || len(orphans) == 0 {
+		return rpt, nil
+	}
+	err = fs.db.UseWithoutTimeout(fs.name+".chunks", func(c *mgo.Collection) error {
+		for start := 0; start < len(orphans); start += maxBulkOps {
+			end := start + maxBulkOps
+			if end > len(orphans) {
+				end = len(orphans)
+			}
+			info, err := c.RemoveAll(bson.M{"files_id": bson.M{"$in": orphans[start:end]}})
+			if err != nil {
+				return err
+			}
+			rpt.OrphansRemoved += info.Removed
+		}
+		return nil
+	})
+	return rpt, err
+}
@@ -0,0 +1,37 @@
+package mdb
+
+import (
+	"io"
+	"time"
+)
+
+// SeekOrNotFound is Seek which returns ErrNotFound when there are no
+// files of a type newer than fromTs, consistent with Find.
+func (fs *Fs) SeekOrNotFound(typ string, fromTs time.Time, h func(io.ReadCloser, time.Time, interface{}) error) error {
+	var c counted
+	return c.notFound(fs.Seek(typ, fromTs, c.wrap(h)))
+}
+
+// SeekRangeOrNotFound is SeekRange which returns ErrNotFound when there
+// are no files in the range, consistent with Find.
+func (fs *Fs) SeekRangeOrNotFound(typ string, fromTs, toTs time.Time, h func(io.ReadCloser, time.Time, interface{}) error) error {
+	var c counted
+	return c.notFound(fs.SeekRange(typ, fromTs, toTs, c.wrap(h)))
+}
+
+// counted counts handler calls
+type counted int
+
+func (c *counted) wrap(h func(io.ReadCloser, time.Time, interface{}) error) func(io.ReadCloser, time.Time, interface{}) error {
+	return func(rc io.ReadCloser, ts time.Time, id interface{}) error {
+		*c++
+		return h(rc, ts, id)
+	}
+}
+
+func (c *counted) notFound(err error) error {
+	if err == nil && *c == 0 {
+		return ErrNotFound
+	}
+	return err
+}
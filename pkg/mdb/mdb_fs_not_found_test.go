@@ -0,0 +1,20 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountedNotFound(t *testing.T) {
+	var c counted
+	assert.Equal(t, ErrNotFound, c.notFound(nil))
+	h := c.wrap(func(io.ReadCloser, time.Time, interface{}) error { return nil })
+	assert.Nil(t, h(nil, time.Time{}, nil))
+	assert.Nil(t, c.notFound(nil))
+	err := errors.New("seek failed")
+	assert.Equal(t, err, c.notFound(err))
+}
@@ -0,0 +1,176 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned from Insert when type is over its rate limit.
+// Ref: RateLimit
+var ErrRateLimited = errors.New("insert rate limited")
+
+// RateLimits configures per type insert rate limit, ref: RateLimit
+type RateLimits struct {
+	Default float64            `json:"default"` // inserts per second of the types not in Types, 0 is no limit
+	Types   map[string]float64 `json:"types"`   // inserts per second by type, 0 is no limit
+	Burst   int                `json:"burst"`   // inserts allowed at once, default is rate rounded up
+	Wait    bool               `json:"wait"`    // Insert waits for its turn instead of returning ErrRateLimited
+}
+
+func (l RateLimits) validate() error {
+	if l.Default < 0 || l.Burst < 0 {
+		return errors.New("negative rate limit")
+	}
+	for _, r := range l.Types {
+		if r < 0 {
+			return errors.New("negative rate limit")
+		}
+	}
+	return nil
+}
+
+// RateLimit limits inserts of each type with token bucket.
+// Insert over the limit returns ErrRateLimited, or waits if Wait is set
+// (InsertCtx stops waiting when its ctx is done).
+// Files already in WriteAhead log are not limited when flushed.
+func RateLimit(limits RateLimits) func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.limiter = newRateLimiter(limits)
+	}
+}
+
+// rateSweepEvery is how often buckets are checked for eviction
+const rateSweepEvery = time.Minute
+
+type rateLimiter struct {
+	limits  RateLimits
+	buckets map[string]*bucket // buckets of the limited types in use
+	sweptAt time.Time
+	now     func() time.Time
+	sleep   func(ctx context.Context, d time.Duration) error
+	sync.Mutex
+}
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+		sleep:   sleepCtx,
+	}
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allow takes token for the insert of the type.
+// Wait for the token is interrupted when ctx is done, token is returned then.
+func (l *rateLimiter) allow(ctx context.Context, typ string) error {
+	d, err := l.reserve(typ)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return nil
+	}
+	if err := l.sleep(ctx, d); err != nil {
+		l.cancel(typ)
+		return err
+	}
+	return nil
+}
+
+// cancel returns token taken in advance by reserve
+func (l *rateLimiter) cancel(typ string) {
+	l.Lock()
+	defer l.Unlock()
+	if b, ok := l.buckets[typ]; ok {
+		b.tokens++
+	}
+}
+
+// reserve takes token, returns how long to wait for it in Wait mode
+func (l *rateLimiter) reserve(typ string) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b := l.bucket(typ, now)
+	if b == nil {
+		return 0, nil
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+	if !l.limits.Wait {
+		return 0, ErrRateLimited
+	}
+	// token is taken in advance, following inserts wait behind it
+	b.tokens--
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), nil
+}
+
+// bucket returns bucket of the type, nil if type is not limited
+func (l *rateLimiter) bucket(typ string, now time.Time) *bucket {
+	if b, ok := l.buckets[typ]; ok {
+		return b
+	}
+	rate, ok := l.limits.Types[typ]
+	if !ok {
+		rate = l.limits.Default
+	}
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(l.limits.Burst)
+	if burst < 1 {
+		burst = math.Ceil(rate)
+	}
+	b := &bucket{rate: rate, burst: burst, tokens: burst, last: now}
+	l.buckets[typ] = b
+	return b
+}
+
+// sweep removes buckets which are full again, they are the same as
+// the new ones, so the map holds only types inserted recently
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < rateSweepEvery {
+		return
+	}
+	l.sweptAt = now
+	for typ, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, typ)
+		}
+	}
+}
+
+// refill adds tokens for the time passed since the last refill
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
@@ -0,0 +1,87 @@
+package mdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(RateLimits{Default: 2, Types: map[string]float64{"free": 0, "slow": 0.5}})
+	l.now = func() time.Time { return now }
+
+	// burst of the default rate, then limited
+	assert.Nil(t, l.allow(context.Background(), "a"))
+	assert.Nil(t, l.allow(context.Background(), "a"))
+	assert.Equal(t, ErrRateLimited, l.allow(context.Background(), "a"))
+	// types have own buckets
+	assert.Nil(t, l.allow(context.Background(), "b"))
+	assert.Nil(t, l.allow(context.Background(), "slow"))
+	assert.Equal(t, ErrRateLimited, l.allow(context.Background(), "slow"))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, l.allow(context.Background(), "free"))
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, l.allow(context.Background(), "a"))
+	assert.Equal(t, ErrRateLimited, l.allow(context.Background(), "a"))
+	assert.Equal(t, ErrRateLimited, l.allow(context.Background(), "slow"))
+	now = now.Add(1500 * time.Millisecond)
+	assert.Nil(t, l.allow(context.Background(), "slow"))
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	now := time.Unix(0, 0)
+	var waits []time.Duration
+	l := newRateLimiter(RateLimits{Default: 10, Burst: 1, Wait: true})
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, l.allow(context.Background(), "a"))
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, waits)
+
+	// canceled wait returns its token, the next one waits as long
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, l.allow(ctx, "a"))
+	assert.Nil(t, l.allow(context.Background(), "a"))
+	assert.Equal(t, 300*time.Millisecond, waits[len(waits)-1])
+}
+
+func TestSleepCtx(t *testing.T) {
+	assert.Nil(t, sleepCtx(context.Background(), time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, sleepCtx(ctx, time.Hour))
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(RateLimits{Default: 1, Types: map[string]float64{"free": 0}})
+	l.now = func() time.Time { return now }
+
+	assert.Nil(t, l.allow(context.Background(), "free"))
+	assert.Len(t, l.buckets, 0, "unlimited types are not kept")
+	assert.Nil(t, l.allow(context.Background(), "a"))
+	assert.Nil(t, l.allow(context.Background(), "b"))
+	assert.Len(t, l.buckets, 2)
+
+	// full buckets are evicted, b is taken again
+	now = now.Add(rateSweepEvery)
+	assert.Nil(t, l.allow(context.Background(), "b"))
+	now = now.Add(time.Millisecond)
+	assert.Equal(t, ErrRateLimited, l.allow(context.Background(), "b"))
+	now = now.Add(rateSweepEvery)
+	assert.Nil(t, l.allow(context.Background(), "c"))
+	_, ok := l.buckets["a"]
+	assert.False(t, ok, "idle bucket evicted")
+	assert.Len(t, l.buckets, 1, "only c")
+}
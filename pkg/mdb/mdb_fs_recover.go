@@ -0,0 +1,43 @@
+package mdb
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// PanicError is returned from seek and find methods when handler panics
+// and RecoverPanics is set.
+type PanicError struct {
+	Value interface{} // value passed to panic
+	Stack []byte      // stack of the panicking handler
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// RecoverPanics makes seek and find methods recover panic in the handler
+// and return it as *PanicError. File and iterator are closed, remaining
+// files are not passed to the handler.
+// Default is to let the panic through.
+func RecoverPanics() func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.recoverPanics = true
+	}
+}
+
+// handle calls handler with the opened file and closes the file after it.
+// Handler may close the file itself but is not required to,
+// file must not be used after the handler returns.
+func (fs *Fs) handle(f io.ReadCloser, h func(io.ReadCloser) error) (err error) {
+	defer f.Close()
+	if fs.recoverPanics {
+		defer func() {
+			if v := recover(); v != nil {
+				err = &PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return h(f)
+}
@@ -0,0 +1,35 @@
+package mdb
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRecoversPanic(t *testing.T) {
+	h := func(rc io.ReadCloser) error {
+		panic("bad file")
+	}
+
+	// fail fast by default
+	fs := &Fs{}
+	f := &countCloser{Reader: strings.NewReader("a")}
+	assert.Panics(t, func() { fs.handle(f, h) })
+	assert.Equal(t, 1, f.closed)
+
+	RecoverPanics()(fs)
+	f = &countCloser{Reader: strings.NewReader("a")}
+	err := fs.handle(f, h)
+	pe, ok := err.(*PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "bad file", pe.Value)
+	assert.NotEmpty(t, pe.Stack)
+	assert.Equal(t, "handler panic: bad file", err.Error())
+	assert.Equal(t, 1, f.closed)
+
+	// errors are not changed
+	f = &countCloser{Reader: strings.NewReader("a")}
+	assert.Equal(t, ErrNotFound, fs.handle(f, func(io.ReadCloser) error { return ErrNotFound }))
+}
@@ -0,0 +1,72 @@
+package mdb
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ReplaceLatest inserts new file of a type and then removes all files
+// of the type not newer than ts. New file is stored before any of the old
+// ones is removed, so concurrent Find returns either the old or the new file,
+// never ErrNotFound.
+// Files newer than ts are kept, Find returns them after the replace.
+// Old files are only marked as deleted in SoftDelete mode.
+// File is inserted directly into mongo, also when WriteAhead is set.
+func (fs *Fs) ReplaceLatest(typ string, ts time.Time, rdr io.Reader, opts ...FileOption) error {
+	if fs.limiter != nil {
+		if err := fs.limiter.allow(context.Background(), typ); err != nil {
+			return err
+		}
+	}
+	id := bson.NewObjectId()
+	// old files are removed only after the server acknowledges the new one
+	if err := fs.insertAcked(context.Background(), typ, id, ts, nil, rdr, opts...); err != nil {
+		return err
+	}
+	return fs.db.UseFs(fs.name, fs.name+"_replace", func(g *mgo.GridFS) error {
+		_, err := fs.removeUntil(g, typ, ts, id)
+		return err
+	})
+}
+
+// RemoveUntil removes files of a type not newer than ts.
+// Files are only marked as deleted in SoftDelete mode.
+// Returns number of removed files.
+func (fs *Fs) RemoveUntil(typ string, ts time.Time) (int, error) {
+	removed := 0
+	err := fs.db.UseFs(fs.name, fs.name+"_remove", func(g *mgo.GridFS) error {
+		var err error
+		removed, err = fs.removeUntil(g, typ, ts, nil)
+		return err
+	})
+	return removed, err
+}
+
+// removeUntil removes files of a type not newer than ts, except file
+// with id except (if not nil)
+func (fs *Fs) removeUntil(g *mgo.GridFS, typ string, ts time.Time, except interface{}) (int, error) {
+	var r struct {
+		Id interface{} `bson:"_id"`
+	}
+	q := fs.live(bson.M{
+		"filename":   typ,
+		"uploadDate": bson.M{"$lte": ts},
+	})
+	if except != nil {
+		q["_id"] = bson.M{"$ne": except}
+	}
+	removed := 0
+	i := g.Find(q).Select(bson.M{"_id": 1}).Iter()
+	for i.Next(&r) {
+		if err := fs.remove(g, r.Id); err != nil {
+			i.Close()
+			return removed, err
+		}
+		removed++
+	}
+	return removed, i.Close()
+}
@@ -0,0 +1,42 @@
+package mdb
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceLatest(t *testing.T) {
+	fs, cleanup := testFs(t)
+	defer cleanup()
+	t0 := time.Now().Truncate(time.Millisecond)
+	find := func(typ string) string {
+		var body string
+		assert.Nil(t, fs.Find(typ, func(rc io.ReadCloser, _ time.Time, _ interface{}) error {
+			b, err := ioutil.ReadAll(rc)
+			body = string(b)
+			return err
+		}))
+		return body
+	}
+
+	// without previous files
+	assert.Nil(t, fs.ReplaceLatest("a", t0, strings.NewReader("first")))
+	assert.Len(t, liveIds(t, fs, "a"), 1)
+	assert.Equal(t, "first", find("a"))
+
+	insertFiles(t, fs, "a", "old", t0.Add(time.Second))
+	newer := insertFiles(t, fs, "a", "newer", t0.Add(3*time.Second))
+	insertFiles(t, fs, "b", "other type", t0)
+	assert.Nil(t, fs.ReplaceLatest("a", t0.Add(2*time.Second), strings.NewReader("new")))
+
+	ids := liveIds(t, fs, "a")
+	assert.Len(t, ids, 2, "replaced and newer")
+	assert.Contains(t, ids, newer[0])
+	assert.Equal(t, "newer", find("a"))
+	assert.Len(t, liveIds(t, fs, "b"), 1)
+}
@@ -0,0 +1,83 @@
+package mdb
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// chunkSize is the same as mgo default
+const chunkSize = 255 * 1024
+
+// insertReserved writes GridFS file with the given id.
+// Files document without filename (invisible to seek and find) is inserted
+// first, it fails with ErrDuplicate on the unique _id index.
+// Then chunks are written and the document is completed.
+// On error only the reserved document and its chunks are removed.
+// Writes are acknowledged, unacknowledged reservation would not detect
+// the duplicate.
+func insertReserved(g *mgo.GridFS, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	g.Files.Database.Session.EnsureSafe(&mgo.Safe{})
+	attrs := newFileAttrs(opts)
+	name, size := typ, chunkSize
+	if attrs.name != "" {
+		name = attrs.name
+	}
+	if attrs.chunkSize > 0 {
+		size = attrs.chunkSize
+	}
+	if ts.IsZero() {
+		ts = bson.Now()
+	}
+
+	doc := bson.M{"_id": id, "chunkSize": size, "uploadDate": ts, "length": 0}
+	if err := g.Files.Insert(doc); err != nil {
+		return translateError(err)
+	}
+	cleanup := func(err error) error {
+		g.Chunks.RemoveAll(bson.M{"files_id": id})
+		g.Files.RemoveId(id)
+		return err
+	}
+
+	sum := md5.New()
+	buf := make([]byte, size)
+	var length int64
+	for n := 0; ; n++ {
+		k, rerr := io.ReadFull(rdr, buf)
+		if k > 0 {
+			sum.Write(buf[:k])
+			chunk := bson.M{"_id": bson.NewObjectId(), "files_id": id, "n": n, "data": buf[:k]}
+			if err := g.Chunks.Insert(chunk); err != nil {
+				return cleanup(err)
+			}
+			length += int64(k)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return cleanup(rerr)
+		}
+	}
+
+	set := bson.M{
+		"filename": name,
+		"length":   length,
+		"md5":      hex.EncodeToString(sum.Sum(nil)),
+	}
+	if attrs.contentType != "" {
+		set["contentType"] = attrs.contentType
+	}
+	if meta != nil {
+		set["metadata"] = meta
+	}
+	if err := g.Files.UpdateId(id, bson.M{"$set": set}); err != nil {
+		return cleanup(err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrShortWrite is returned from InsertSized when reader ends before length bytes.
+	ErrShortWrite = errors.New("short write")
+	// ErrLengthMismatch is returned from InsertSized when reader has more than length bytes.
+	ErrLengthMismatch = errors.New("length mismatch")
+)
+
+// InsertSized inserts file of known length.
+// Exactly length bytes must be read from rdr, otherwise file is not stored
+// and ErrShortWrite (reader ended early) or ErrLengthMismatch (reader has more)
+// is returned. Guards against silently truncated content.
+func (fs *Fs) InsertSized(typ string, id interface{}, ts time.Time, length int64, rdr io.Reader, opts ...FileOption) error {
+	return fs.Insert(typ, id, ts, &sizedReader{r: rdr, left: length}, opts...)
+}
+
+// sizedReader fails with ErrShortWrite or ErrLengthMismatch
+// if underlying reader doesn't have exactly left bytes.
+// Error is returned on each Read after it, so it is not lost by
+// callers which drop error of the read which filled their buffer.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.left <= 0 {
+		// expect EOF
+		var b [1]byte
+		for {
+			n, err := s.r.Read(b[:])
+			if n > 0 {
+				return 0, ErrLengthMismatch
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		return n, ErrShortWrite
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,31 @@
+package mdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizedReader(t *testing.T) {
+	data := []byte("0123456789")
+
+	buf, err := ioutil.ReadAll(&sizedReader{r: bytes.NewReader(data), left: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	buf, err = ioutil.ReadAll(&sizedReader{r: iotest.OneByteReader(bytes.NewReader(data)), left: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	_, err = ioutil.ReadAll(&sizedReader{r: bytes.NewReader(data), left: 11})
+	assert.Equal(t, ErrShortWrite, err)
+
+	_, err = ioutil.ReadAll(&sizedReader{r: bytes.NewReader(data), left: 9})
+	assert.Equal(t, ErrLengthMismatch, err)
+
+	_, err = ioutil.ReadAll(&sizedReader{r: bytes.NewReader(nil), left: 0})
+	assert.Nil(t, err)
+}
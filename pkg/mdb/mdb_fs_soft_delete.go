@@ -0,0 +1,108 @@
+package mdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// SoftDelete makes Remove and RemoveId mark files as deleted instead of
+// removing them. Deleted files are not returned by seek and find,
+// FindId returns ErrDeleted. Tombstones lists them, Purge removes them.
+// With purgeChunks content of the file is removed immediately,
+// only .files document is kept.
+func SoftDelete(purgeChunks bool) func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.softDelete = true
+		fs.purge = purgeChunks
+	}
+}
+
+// live adds condition which skips deleted files to the query
+func (fs *Fs) live(q bson.M) bson.M {
+	if fs.softDelete {
+		q["deleted"] = bson.M{"$exists": false}
+	}
+	return q
+}
+
+// remove deletes file, in SoftDelete mode marks it as deleted
+func (fs *Fs) remove(g *mgo.GridFS, id interface{}) error {
+	if fs.softDelete {
+		return fs.tombstone(g, id)
+	}
+	return fs.removeId(g, id)
+}
+
+// tombstone marks file as deleted, and removes its chunks if configured.
+// File is marked before chunks are removed so it is never read partially.
+func (fs *Fs) tombstone(g *mgo.GridFS, id interface{}) error {
+	var r seekResult
+	if err := g.Files.FindId(id).One(&r); err != nil {
+		return err
+	}
+	if !r.Deleted.IsZero() {
+		return nil
+	}
+	if err := g.Files.UpdateId(id, bson.M{"$set": bson.M{"deleted": time.Now()}}); err != nil {
+		return err
+	}
+	if !fs.purge {
+		return nil
+	}
+	if fs.dedup {
+		if err := fs.releaseChunks(g, id); err != nil {
+			return err
+		}
+	} else if _, err := g.Chunks.RemoveAll(bson.M{"files_id": id}); err != nil {
+		return err
+	}
+	return g.Files.UpdateId(id, bson.M{
+		"$set":   bson.M{"purged": true},
+		"$unset": bson.M{"ref": 1},
+	})
+}
+
+func (fs *Fs) tombstoneType(ctx context.Context, g *mgo.GridFS, typ string) error {
+	return fs.iterIds(ctx, g, typ, time.Time{}, "uploadDate", func(id interface{}, _ time.Time) error {
+		return fs.tombstone(g, id)
+	})
+}
+
+// Tombstones lists deleted files of a type in delete order
+func (fs *Fs) Tombstones(typ string, h func(id interface{}, ts time.Time, deleted time.Time) error) error {
+	return fs.db.UseFs(fs.name, fs.name+"_tombstones", func(g *mgo.GridFS) error {
+		var r seekResult
+		i := g.Find(bson.M{"filename": typ, "deleted": bson.M{"$exists": true}}).Sort("deleted").Iter()
+		for i.Next(&r) {
+			if err := h(r.Id, r.UploadDate, r.Deleted); err != nil {
+				i.Close()
+				return err
+			}
+		}
+		return i.Close()
+	})
+}
+
+// Purge removes files deleted more than retention ago.
+// Returns number of removed files.
+func (fs *Fs) Purge(retention time.Duration) (int, error) {
+	removed := 0
+	err := fs.db.UseFs(fs.name, fs.name+"_purge", func(g *mgo.GridFS) error {
+		var r seekResult
+		i := g.Find(bson.M{"deleted": bson.M{"$lt": time.Now().Add(-retention)}}).
+			Select(bson.M{"_id": 1}).
+			Iter()
+		for i.Next(&r) {
+			if err := fs.removeId(g, r.Id); err != nil {
+				i.Close()
+				return err
+			}
+			removed++
+		}
+		return i.Close()
+	})
+	return removed, err
+}
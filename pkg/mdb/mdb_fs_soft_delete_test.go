@@ -0,0 +1,37 @@
+package mdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftDeleteCompact(t *testing.T) {
+	fs, cleanup := testFs(t, SoftDelete(false))
+	defer cleanup()
+	t0 := time.Now().Truncate(time.Millisecond)
+
+	ids := insertFiles(t, fs, "a", "a", t0, t0.Add(time.Second), t0.Add(2*time.Second))
+	assert.Nil(t, fs.Compact("a"))
+	assert.Equal(t, []interface{}{ids[2]}, liveIds(t, fs, "a"))
+	assert.Len(t, deletedIds(t, fs, "a"), 2)
+
+	ids = insertFiles(t, fs, "b", "b", t0, t0.Add(time.Second), t0.Add(2*time.Second))
+	n, err := fs.CompactWith("b", KeepLast(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []interface{}{ids[0]}, deletedIds(t, fs, "b"))
+
+	insertFiles(t, fs, "c", "same", t0, t0.Add(time.Second))
+	n, err = fs.CompactDedup("c")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, deletedIds(t, fs, "c"), 1)
+
+	ids = insertFiles(t, fs, "d", "d", t0)
+	assert.Nil(t, fs.ReplaceLatest("d", t0.Add(time.Second), strings.NewReader("new")))
+	assert.Equal(t, []interface{}{ids[0]}, deletedIds(t, fs, "d"))
+	assert.Len(t, liveIds(t, fs, "d"), 1)
+}
@@ -0,0 +1,141 @@
+package mdb
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// FsTypeStats are aggregate statistics of the files of a type.
+// Bytes is sum of the file lengths, in Dedup mode references
+// are counted with the length of the referenced content.
+type FsTypeStats struct {
+	Type    string    `json:"type"`
+	Count   int       `json:"count"`
+	Bytes   int64     `json:"bytes"`
+	Oldest  time.Time `json:"oldest"`   // uploadDate of the oldest file
+	Newest  time.Time `json:"newest"`   // uploadDate of the newest file
+	AvgSize int64     `json:"avg_size"` // Bytes / Count
+}
+
+// statsResult is the aggregation result for a type
+type statsResult struct {
+	Type   string    `bson:"_id"`
+	Count  int       `bson:"count"`
+	Bytes  int64     `bson:"bytes"`
+	Oldest time.Time `bson:"oldest"`
+	Newest time.Time `bson:"newest"`
+}
+
+func (r statsResult) stats() FsTypeStats {
+	s := FsTypeStats{
+		Type:   r.Type,
+		Count:  r.Count,
+		Bytes:  r.Bytes,
+		Oldest: r.Oldest,
+		Newest: r.Newest,
+	}
+	if r.Count > 0 {
+		s.AvgSize = r.Bytes / int64(r.Count)
+	}
+	return s
+}
+
+// Stats returns statistics of the files of a type.
+// Only .files documents are aggregated, content is not read.
+// Returns ErrNotFound if there are no files of the type.
+func (fs *Fs) Stats(typ string) (*FsTypeStats, error) {
+	ss, err := fs.stats(bson.M{"filename": typ})
+	if err != nil {
+		return nil, err
+	}
+	if len(ss) == 0 {
+		return nil, ErrNotFound
+	}
+	return &ss[0], nil
+}
+
+// StatsByType returns statistics of each type in the bucket, sorted by type.
+func (fs *Fs) StatsByType() ([]FsTypeStats, error) {
+	return fs.stats(bson.M{})
+}
+
+func (fs *Fs) stats(q bson.M) ([]FsTypeStats, error) {
+	var ss []FsTypeStats
+	err := fs.db.UseFs(fs.name, fs.name+"_stats", func(g *mgo.GridFS) error {
+		i := g.Files.Pipe([]bson.M{
+			{"$match": fs.live(q)},
+			{"$group": bson.M{
+				"_id":    "$filename",
+				"count":  bson.M{"$sum": 1},
+				"bytes":  bson.M{"$sum": "$length"},
+				"oldest": bson.M{"$min": "$uploadDate"},
+				"newest": bson.M{"$max": "$uploadDate"},
+			}},
+			{"$sort": bson.M{"_id": 1}},
+		}).AllowDiskUse().Iter()
+		var r statsResult
+		for i.Next(&r) {
+			ss = append(ss, r.stats())
+			r = statsResult{}
+		}
+		return i.Close()
+	})
+	return ss, err
+}
+
+// FileInfo describes stored file, ref: Stat
+type FileInfo struct {
+	Id          interface{} `bson:"_id" json:"id"`
+	Length      int64       `bson:"length" json:"length"`
+	UploadDate  time.Time   `bson:"uploadDate" json:"upload_date"`
+	MD5         string      `bson:"md5" json:"md5"`
+	ContentType string      `bson:"contentType,omitempty" json:"content_type,omitempty"`
+}
+
+// statDoc is .files document read by Stat
+type statDoc struct {
+	FileInfo `bson:",inline"`
+	Deleted  time.Time `bson:"deleted,omitempty"` // ref: SoftDelete
+}
+
+var statFields = bson.M{"length": 1, "uploadDate": 1, "md5": 1, "contentType": 1, "deleted": 1}
+
+// Stat returns info of the last file of a type, the one Find returns.
+// Only .files document is read, content is not opened.
+// Returns ErrNotFound if there are no files of the type.
+func (fs *Fs) Stat(typ string) (FileInfo, error) {
+	var d statDoc
+	err := fs.db.UseFs(fs.name, fs.name+"_stat", func(g *mgo.GridFS) error {
+		return g.Find(fs.live(bson.M{"filename": typ})).
+			Sort("-" + fs.sortField).
+			Select(statFields).
+			One(&d)
+	})
+	if err != nil {
+		return FileInfo{}, translateError(err)
+	}
+	return d.FileInfo, nil
+}
+
+// StatId returns info of the file by id, as Stat.
+// Returns ErrNotFound if there is no such file,
+// ErrDeleted for file removed in SoftDelete mode.
+func (fs *Fs) StatId(id interface{}) (FileInfo, error) {
+	id, err := idValue(id)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	var d statDoc
+	err = fs.db.UseFs(fs.name, fs.name+"_stat_id", func(g *mgo.GridFS) error {
+		return g.Files.FindId(id).Select(statFields).One(&d)
+	})
+	if err != nil {
+		return FileInfo{}, translateError(err)
+	}
+	if !d.Deleted.IsZero() {
+		return FileInfo{}, ErrDeleted
+	}
+	return d.FileInfo, nil
+}
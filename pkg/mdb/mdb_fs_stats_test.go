@@ -0,0 +1,120 @@
+package mdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsResult(t *testing.T) {
+	now := time.Now()
+	s := statsResult{Type: "a", Count: 4, Bytes: 10, Oldest: now.Add(-time.Hour), Newest: now}.stats()
+	assert.Equal(t, FsTypeStats{Type: "a", Count: 4, Bytes: 10, Oldest: now.Add(-time.Hour), Newest: now, AvgSize: 2}, s)
+
+	// empty type
+	assert.Equal(t, int64(0), statsResult{Type: "b"}.stats().AvgSize)
+}
+
+func TestStatDoc(t *testing.T) {
+	ts := time.Unix(1600000000, 0).UTC()
+	buf, err := bson.Marshal(bson.M{
+		"_id":         "a",
+		"filename":    "typ",
+		"length":      int64(3),
+		"uploadDate":  ts,
+		"md5":         "900150983cd24fb0d6963f7d28e17f72",
+		"contentType": "text/plain",
+		"deleted":     ts,
+	})
+	assert.Nil(t, err)
+	var d statDoc
+	assert.Nil(t, bson.Unmarshal(buf, &d))
+	assert.Equal(t, FileInfo{Id: "a", Length: 3, UploadDate: ts, MD5: "900150983cd24fb0d6963f7d28e17f72", ContentType: "text/plain"}, d.FileInfo)
+	assert.Equal(t, ts, d.Deleted.UTC())
+}
+
+func TestStat(t *testing.T) {
+	fs, cleanup := testFs(t, SortField("metadata.seq"), SoftDelete(false))
+	defer cleanup()
+	_, err := fs.Stat("a")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = fs.StatId(bson.NewObjectId())
+	assert.Equal(t, ErrNotFound, err)
+
+	t0 := time.Now().Truncate(time.Millisecond)
+	// uploadDate order is reverse of the seq order
+	var ids []bson.ObjectId
+	for seq := 1; seq <= 3; seq++ {
+		id := bson.NewObjectId()
+		assert.Nil(t, fs.InsertMeta("a", id, t0.Add(-time.Duration(seq)*time.Second), bson.M{"seq": seq}, strings.NewReader(strings.Repeat("a", seq)),
+			SetContentType("text/plain")))
+		ids = append(ids, id)
+	}
+	// content is not read, stat works without chunks
+	assert.Nil(t, fs.db.UseFs(fs.name, fs.name+"_test", func(g *mgo.GridFS) error {
+		_, err := g.Chunks.RemoveAll(nil)
+		return err
+	}))
+
+	fi, err := fs.Stat("a")
+	assert.Nil(t, err)
+	assert.Equal(t, ids[2], fi.Id)
+	assert.Equal(t, int64(3), fi.Length)
+	assert.True(t, t0.Add(-3*time.Second).Equal(fi.UploadDate))
+	assert.Equal(t, "47bce5c74f589f4867dbd57e9ca9f808", fi.MD5)
+	assert.Equal(t, "text/plain", fi.ContentType)
+	fi2, err := fs.StatId(ids[2].Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, fi, fi2)
+
+	// removed newest is skipped by Stat and reported by StatId
+	assert.Nil(t, fs.RemoveId(ids[2]))
+	fi, err = fs.Stat("a")
+	assert.Nil(t, err)
+	assert.Equal(t, ids[1], fi.Id)
+	_, err = fs.StatId(ids[2])
+	assert.Equal(t, ErrDeleted, err)
+
+	assert.Nil(t, fs.Remove("a"))
+	_, err = fs.Stat("a")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestStats(t *testing.T) {
+	fs, cleanup := testFs(t, SoftDelete(false))
+	defer cleanup()
+	_, err := fs.Stats("a")
+	assert.Equal(t, ErrNotFound, err)
+	ss, err := fs.StatsByType()
+	assert.Nil(t, err)
+	assert.Len(t, ss, 0)
+
+	t0 := time.Now().Truncate(time.Millisecond)
+	insertFiles(t, fs, "b", "bb", t0)
+	insertFiles(t, fs, "a", "a", t0.Add(-time.Hour), t0)
+	insertFiles(t, fs, "a", "aaaa", t0.Add(-2*time.Hour))
+	removed := insertFiles(t, fs, "a", "aaaaaaaa", t0.Add(time.Hour))
+	assert.Nil(t, fs.RemoveId(removed[0]))
+
+	s, err := fs.Stats("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", s.Type)
+	assert.Equal(t, 3, s.Count)
+	assert.Equal(t, int64(6), s.Bytes)
+	assert.Equal(t, int64(2), s.AvgSize)
+	assert.True(t, t0.Add(-2*time.Hour).Equal(s.Oldest))
+	assert.True(t, t0.Equal(s.Newest), "removed file is not counted")
+
+	ss, err = fs.StatsByType()
+	assert.Nil(t, err)
+	if assert.Len(t, ss, 2) {
+		assert.Equal(t, *s, ss[0])
+		assert.Equal(t, "b", ss[1].Type)
+		assert.Equal(t, 1, ss[1].Count)
+		assert.Equal(t, int64(2), ss[1].Bytes)
+	}
+}
@@ -0,0 +1,193 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+type countCloser struct {
+	io.Reader
+	closed int
+}
+
+func (c *countCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestHandleClosesFile(t *testing.T) {
+	fs := &Fs{}
+	// handler doesn't close
+	f := &countCloser{Reader: strings.NewReader("a")}
+	err := fs.handle(f, func(rc io.ReadCloser) error {
+		assert.Equal(t, 0, f.closed)
+		_, err := ioutil.ReadAll(rc)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, f.closed)
+
+	// handler closes early and fails
+	f = &countCloser{Reader: strings.NewReader("a")}
+	herr := errors.New("handler")
+	err = fs.handle(f, func(rc io.ReadCloser) error {
+		rc.Close()
+		return herr
+	})
+	assert.Equal(t, herr, err)
+	assert.Equal(t, 2, f.closed)
+}
+
+func TestCtxReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := ctxReader{ctx: ctx, r: strings.NewReader("abc")}
+	buf := make([]byte, 1)
+	n, err := r.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	cancel()
+	_, err = r.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestFsCtx(t *testing.T) {
+	fs, cleanup := testFs(t, SortField("metadata.seq"))
+	defer cleanup()
+	t0 := time.Now().Truncate(time.Millisecond)
+	// uploadDate order is reverse of the seq order
+	for seq := 1; seq <= 3; seq++ {
+		assert.Nil(t, fs.InsertMeta("a", nil, t0.Add(-time.Duration(seq)*time.Second), bson.M{"seq": seq}, strings.NewReader("a")))
+	}
+	seqOf := func(id interface{}) int {
+		var seq int
+		assert.Nil(t, fs.FindId(id, func(rc io.ReadCloser) error {
+			var m bson.M
+			if err := rc.(*mgo.GridFile).GetMeta(&m); err != nil {
+				return err
+			}
+			seq = m["seq"].(int)
+			return nil
+		}))
+		return seq
+	}
+
+	// handlers get ctx, cancel stops before the next file
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "v"))
+	var seqs []int
+	err := fs.SeekCtx(ctx, "a", time.Time{}, func(hctx context.Context, _ io.ReadCloser, _ time.Time, id interface{}) error {
+		assert.Equal(t, "v", hctx.Value(key{}))
+		seqs = append(seqs, seqOf(id))
+		cancel()
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []int{1}, seqs)
+	assert.Nil(t, fs.FindCtx(context.Background(), "a", func(hctx context.Context, _ io.ReadCloser, _ time.Time, id interface{}) error {
+		assert.NotNil(t, hctx)
+		assert.Equal(t, 3, seqOf(id))
+		return nil
+	}))
+
+	// CompactCtx keeps the newest file by the sort field
+	assert.Nil(t, fs.CompactCtx(context.Background(), "a"))
+	ids := liveIds(t, fs, "a")
+	assert.Len(t, ids, 1)
+	assert.Equal(t, 3, seqOf(ids[0]))
+}
+
+func TestFsCtxVariants(t *testing.T) {
+	fs, cleanup := testFs(t, SoftDelete(false))
+	defer cleanup()
+	t0 := time.Now().Truncate(time.Millisecond)
+	ids := insertFiles(t, fs, "a", "a", t0, t0.Add(time.Second), t0.Add(2*time.Second))
+	insertFiles(t, fs, "b", "b", t0.Add(time.Second))
+	from, to := t0.Add(-time.Second), t0.Add(time.Minute)
+
+	// each handler cancels ctx, seek stops before the next file
+	type key struct{}
+	seek := func(name string, f func(ctx context.Context, cancel func()) error) int {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, name))
+		defer cancel()
+		calls := 0
+		err := f(ctx, func() {
+			calls++
+			cancel()
+		})
+		assert.Equal(t, context.Canceled, err, name)
+		return calls
+	}
+	h := func(cancel func()) func(context.Context, io.ReadCloser, time.Time, interface{}) error {
+		return func(ctx context.Context, _ io.ReadCloser, _ time.Time, _ interface{}) error {
+			assert.NotNil(t, ctx.Value(key{}))
+			cancel()
+			return nil
+		}
+	}
+	assert.Equal(t, 1, seek("SeekRangeCtx", func(ctx context.Context, cancel func()) error {
+		return fs.SeekRangeCtx(ctx, "a", from, to, h(cancel))
+	}))
+	assert.Equal(t, 1, seek("SeekRangeDescCtx", func(ctx context.Context, cancel func()) error {
+		return fs.SeekRangeDescCtx(ctx, "a", from, to, h(cancel))
+	}))
+	assert.Equal(t, 1, seek("SeekTypesCtx", func(ctx context.Context, cancel func()) error {
+		return fs.SeekTypesCtx(ctx, []string{"a", "b"}, time.Time{}, func(ctx context.Context, rc io.ReadCloser, _ string, ts time.Time, id interface{}) error {
+			return h(cancel)(ctx, rc, ts, id)
+		})
+	}))
+	assert.Equal(t, 1, seek("IterIdsCtx", func(ctx context.Context, cancel func()) error {
+		return fs.IterIdsCtx(ctx, "a", time.Time{}, func(ctx context.Context, _ interface{}, _ time.Time) error {
+			assert.NotNil(t, ctx.Value(key{}))
+			cancel()
+			return nil
+		})
+	}))
+	// file sent to the worker before cancel is still handled
+	assert.True(t, seek("SeekParallelCtx", func(ctx context.Context, cancel func()) error {
+		return fs.SeekParallelCtx(ctx, "a", time.Time{}, 1, h(cancel))
+	}) <= 2)
+
+	// cancelled remove leaves files in place
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, fs.RemoveIdCtx(ctx, ids[0]))
+	assert.Equal(t, context.Canceled, fs.RemoveCtx(ctx, "a"))
+	assert.Len(t, liveIds(t, fs, "a"), 3)
+	assert.Nil(t, fs.RemoveIdCtx(context.Background(), ids[0]))
+	assert.Nil(t, fs.RemoveCtx(context.Background(), "b"))
+	assert.Equal(t, []interface{}{ids[1], ids[2]}, liveIds(t, fs, "a"))
+	assert.Len(t, liveIds(t, fs, "b"), 0)
+}
+
+func TestFindLatest(t *testing.T) {
+	fs, cleanup := testFs(t)
+	defer cleanup()
+	t0 := time.Now().Truncate(time.Millisecond)
+	ids := insertFiles(t, fs, "a", "a", t0, t0.Add(2*time.Second), t0.Add(time.Second))
+
+	h := func(found *[]interface{}) func(io.ReadCloser, time.Time, interface{}) error {
+		return func(rc io.ReadCloser, _ time.Time, id interface{}) error {
+			*found = append(*found, id)
+			return nil
+		}
+	}
+	var found []interface{}
+	assert.Nil(t, fs.FindLatest("a", 2, h(&found)))
+	assert.Equal(t, []interface{}{ids[1], ids[2]}, found, "newest first")
+
+	found = nil
+	assert.Nil(t, fs.FindLatest("a", 5, h(&found)), "fewer than n")
+	assert.Equal(t, []interface{}{ids[1], ids[2], ids[0]}, found)
+
+	assert.Equal(t, ErrInvalidLimit, fs.FindLatest("a", 0, h(&found)))
+	assert.Equal(t, ErrNotFound, fs.FindLatest("b", 1, h(&found)))
+}
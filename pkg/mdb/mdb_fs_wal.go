@@ -0,0 +1,312 @@
+package mdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/minus5/svckit/log"
+)
+
+const (
+	walExt        = ".wal"
+	walMinBackoff = 100 * time.Millisecond
+	walMaxBackoff = 10 * time.Second
+)
+
+// WriteAhead fronts Insert with write-ahead log in dir on local disk.
+// Content is written (and synced) to the log first, then inserted into mongo.
+// If mongo insert fails Insert still returns nil, file stays in the log and
+// background flusher retries until mongo recovers. Log left by the previous
+// process is replayed on NewFs.
+//
+// Guarantees:
+//   - at least once: file is removed from the log only after successful insert;
+//     file without id gets generated ObjectId before it is logged, so
+//     replay of already stored file ends with ErrDuplicate and is skipped
+//   - ordering: while there are queued files new inserts are queued behind
+//     them and flushed in the Insert call order; concurrent Inserts are not ordered
+//   - Insert returns ErrDuplicate and ErrInvalidId immediately, those are
+//     not retried
+//
+// Files waiting in the log are not visible to seek and find.
+func WriteAhead(dir string) func(fs *Fs) {
+	return func(fs *Fs) {
+		fs.walDir = dir
+	}
+}
+
+// walEntry is file of the log, with the file attributes
+// as set by the Insert arguments and FileOptions
+type walEntry struct {
+	Typ         string      `bson:"typ"`
+	Id          interface{} `bson:"id"`
+	Ts          time.Time   `bson:"ts"`
+	Meta        *bson.Raw   `bson:"meta,omitempty"`
+	Name        string      `bson:"name,omitempty"`
+	ContentType string      `bson:"ct,omitempty"`
+	ChunkSize   int         `bson:"cs,omitempty"`
+	Data        []byte      `bson:"data"`
+}
+
+type wal struct {
+	fs      *Fs
+	dir     string
+	err     error    // error opening log dir
+	seq     uint64   // last used sequence
+	pending []string // log files in insert order
+	kick    chan struct{}
+	sync.Mutex
+}
+
+// openWal creates log dir, loads files left in it and starts flusher
+func openWal(fs *Fs, dir string) *wal {
+	w := &wal{fs: fs, dir: dir, kick: make(chan struct{}, 1)}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.S("fs", fs.name).S("dir", dir).Error(err)
+		w.err = err
+		return w
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), walExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), walExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > w.seq {
+			w.seq = seq
+		}
+		w.pending = append(w.pending, filepath.Join(dir, f.Name()))
+	}
+	// names are zero padded, sorted by name is sorted by sequence
+	sort.Strings(w.pending)
+	if len(w.pending) > 0 {
+		log.S("fs", fs.name).I("pending", len(w.pending)).Info("replaying write-ahead log")
+	}
+	fs.db.goLoop(w.loop)
+	w.signal()
+	return w
+}
+
+// insert logs file and tries to insert it into mongo.
+// ctx is honored until the file is logged, logged file is inserted
+// regardless of ctx, as the flusher would.
+func (w *wal) insert(ctx context.Context, typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) error {
+	if w.err != nil {
+		return w.err
+	}
+	e, err := newWalEntry(typ, id, ts, meta, ctxReader{ctx: ctx, r: rdr}, opts...)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.Lock()
+	fn, err := w.write(e)
+	if err != nil {
+		w.Unlock()
+		return err
+	}
+	if len(w.pending) > 0 {
+		// keep order, flusher will insert it
+		w.pending = append(w.pending, fn)
+		w.Unlock()
+		w.signal()
+		return nil
+	}
+	w.Unlock()
+
+	err = w.fs.insertAcked(context.Background(), e.Typ, e.Id, e.Ts, e.meta(), bytes.NewReader(e.Data), e.options()...)
+	if err == nil || !walRetriable(err) {
+		os.Remove(fn)
+		return err
+	}
+	log.S("fs", w.fs.name).S("id", fmt.Sprintf("%v", e.Id)).S("error", err.Error()).Info("insert queued in write-ahead log")
+	w.Lock()
+	w.pending = append(w.pending, fn)
+	w.Unlock()
+	w.signal()
+	return nil
+}
+
+// write stores entry to the next log file, must be called under lock
+func (w *wal) write(e *walEntry) (string, error) {
+	raw, err := bson.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	w.seq++
+	fn := filepath.Join(w.dir, fmt.Sprintf("%020d%s", w.seq, walExt))
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return fn, os.Rename(tmp, fn)
+}
+
+func (w *wal) signal() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// loop flushes pending files, backs off while mongo is unavailable.
+// Stops when Mdb is closed.
+func (w *wal) loop() {
+	done := w.fs.db.done
+	backoff := walMinBackoff
+	for {
+		select {
+		case <-w.kick:
+		case <-done:
+			return
+		}
+		for {
+			err := w.flush()
+			if err == nil {
+				backoff = walMinBackoff
+				break
+			}
+			if err == ErrClosed {
+				return
+			}
+			log.S("fs", w.fs.name).S("backoff", backoff.String()).Error(err)
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-done:
+				t.Stop()
+				return
+			}
+			if backoff *= 2; backoff > walMaxBackoff {
+				backoff = walMaxBackoff
+			}
+		}
+	}
+}
+
+// flush inserts pending files in order until the first retriable error
+func (w *wal) flush() error {
+	for {
+		w.Lock()
+		if len(w.pending) == 0 {
+			w.Unlock()
+			return nil
+		}
+		fn := w.pending[0]
+		w.Unlock()
+
+		if err := w.replay(fn); err != nil {
+			return err
+		}
+		os.Remove(fn)
+		w.Lock()
+		w.pending = w.pending[1:]
+		w.Unlock()
+	}
+}
+
+// replay inserts logged file, file stored by the previous attempt is success
+func (w *wal) replay(fn string) error {
+	raw, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	e := &walEntry{}
+	if err := bson.Unmarshal(raw, e); err != nil {
+		// partially written file can't be recovered, it was never acknowledged
+		log.S("fs", w.fs.name).S("file", fn).Error(err)
+		return nil
+	}
+	err = w.fs.insertAcked(context.Background(), e.Typ, e.Id, e.Ts, e.meta(), bytes.NewReader(e.Data), e.options()...)
+	if err == nil || err == ErrDuplicate {
+		return nil
+	}
+	if !walRetriable(err) {
+		log.S("fs", w.fs.name).S("id", fmt.Sprintf("%v", e.Id)).Error(err)
+		return nil
+	}
+	return err
+}
+
+func newWalEntry(typ string, id interface{}, ts time.Time, meta interface{}, rdr io.Reader, opts ...FileOption) (*walEntry, error) {
+	if id == nil {
+		id = bson.NewObjectId()
+	}
+	e := &walEntry{Typ: typ, Id: id, Ts: ts}
+	if meta != nil {
+		raw, err := bson.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		e.Meta = &bson.Raw{Kind: 0x03, Data: raw}
+	}
+	attrs := newFileAttrs(opts)
+	e.Name, e.ContentType, e.ChunkSize = attrs.name, attrs.contentType, attrs.chunkSize
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	e.Data = data
+	return e, nil
+}
+
+// options returns FileOptions which set logged file attributes
+func (e *walEntry) options() []FileOption {
+	var opts []FileOption
+	if e.Name != "" {
+		opts = append(opts, SetName(e.Name))
+	}
+	if e.ContentType != "" {
+		opts = append(opts, SetContentType(e.ContentType))
+	}
+	if e.ChunkSize > 0 {
+		opts = append(opts, SetChunkSize(e.ChunkSize))
+	}
+	return opts
+}
+
+func (e *walEntry) meta() interface{} {
+	if e.Meta == nil {
+		return nil
+	}
+	return e.Meta
+}
+
+// walRetriable is false for errors caused by the content, retry would fail the same way
+func walRetriable(err error) bool {
+	return err != ErrDuplicate && err != ErrInvalidId
+}
@@ -0,0 +1,77 @@
+package mdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ts := time.Unix(1500000000, 0).UTC()
+	e, err := newWalEntry("typ", nil, ts, bson.M{"seq": 1}, strings.NewReader("content"), SetContentType("text/plain"))
+	assert.Nil(t, err)
+	_, ok := e.Id.(bson.ObjectId)
+	assert.True(t, ok)
+	assert.Equal(t, "text/plain", e.ContentType)
+
+	w := &wal{dir: dir}
+	fn1, err := w.write(e)
+	assert.Nil(t, err)
+	fn2, err := w.write(e)
+	assert.Nil(t, err)
+	assert.True(t, fn1 < fn2)
+
+	raw, err := ioutil.ReadFile(fn1)
+	assert.Nil(t, err)
+	e2 := &walEntry{}
+	assert.Nil(t, bson.Unmarshal(raw, e2))
+	assert.Equal(t, e.Id, e2.Id)
+	assert.Equal(t, "typ", e2.Typ)
+	assert.True(t, ts.Equal(e2.Ts))
+	assert.Equal(t, []byte("content"), e2.Data)
+	var m bson.M
+	assert.Nil(t, e2.Meta.Unmarshal(&m))
+	assert.Equal(t, 1, m["seq"])
+}
+
+func TestWalEntryOptions(t *testing.T) {
+	ts := time.Unix(1500000000, 0).UTC()
+	e, err := newWalEntry("typ", "id", ts, bson.M{"seq": 1}, strings.NewReader("content"),
+		SetContentType("text/plain"), SetName("name"), SetChunkSize(1024))
+	assert.Nil(t, err)
+	assert.Equal(t, "typ", e.Typ)
+	assert.Equal(t, "id", e.Id)
+	assert.True(t, ts.Equal(e.Ts))
+	assert.Equal(t, "name", e.Name)
+	assert.Equal(t, "text/plain", e.ContentType)
+	assert.Equal(t, 1024, e.ChunkSize)
+	var m bson.M
+	assert.Nil(t, e.Meta.Unmarshal(&m))
+	assert.Equal(t, 1, m["seq"])
+	assert.Len(t, e.options(), 3)
+	assert.Equal(t, fileAttrs{"name", "text/plain", 1024}, newFileAttrs(e.options()))
+}
+
+func TestWalInsertCtx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := &wal{dir: dir}
+	assert.Equal(t, context.Canceled, w.insert(ctx, "typ", nil, time.Now(), nil, strings.NewReader("content")))
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0, "cancelled insert is not logged")
+}
@@ -6,10 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -112,3 +116,97 @@ func _id(o interface{}) interface{} {
 	}
 	return nil
 }
+
+func TestCloseTwice(t *testing.T) {
+	db := &Mdb{name: "dbName", done: make(chan struct{})}
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+	assert.False(t, db.Ping())
+	err := db.Use("col", "col", func(*mgo.Collection) error { return nil })
+	assert.Equal(t, ErrClosed, err)
+	err = db.UseFs("fs", "fs", func(*mgo.GridFS) error { return nil })
+	assert.Equal(t, ErrClosed, err)
+	err = db.UseSafe("col", "col", func(*mgo.Collection) error { return nil })
+	assert.Equal(t, ErrClosed, err)
+	err = db.UseWithoutTimeout("col", func(*mgo.Collection) error { return nil })
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, db.EnsureIndex("col", []string{"a"}, 0))
+	assert.Equal(t, ErrClosed, db.EnsureUniqueIndex("col", []string{"a"}))
+	assert.Equal(t, ErrClosed, db.CreateCapedCollection("col", 1))
+	assert.Equal(t, ErrClosed, db.FindIter("col", nil, nil, nil).Err())
+	db.LogServers()
+	db.ResetIndexCache()
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	url := os.Getenv(testMongoEnv)
+	if url == "" {
+		t.Skip(testMongoEnv + " not set")
+	}
+	name := fmt.Sprintf("svckit_test_%d", time.Now().UnixNano())
+	db, err := NewDb(url, Name(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if s, err := mgo.Dial(url); err == nil {
+			s.DB(name).DropDatabase()
+			s.Close()
+		}
+	}()
+	ops := []func() error{
+		func() error {
+			return db.Use("col", "col", func(c *mgo.Collection) error { _, err := c.Count(); return err })
+		},
+		func() error { return db.UseSafe("col", "col", func(*mgo.Collection) error { return nil }) },
+		func() error { return db.UseFs("fs", "fs", func(*mgo.GridFS) error { return nil }) },
+		func() error { return db.EnsureIndex("col", []string{"a"}, 0) },
+		func() error { return db.FindIter("col", nil, nil, nil).Close() },
+		func() error { db.LogServers(); db.ResetIndexCache(); return nil },
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for _, op := range ops {
+		wg.Add(1)
+		go func(op func() error) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					errs <- fmt.Errorf("panic: %v", r)
+				}
+			}()
+			for {
+				err := op()
+				if err == ErrClosed {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if db.isClosed() {
+					return
+				}
+			}
+		}(op)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Close())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCloseWaitsLoops(t *testing.T) {
+	db := &Mdb{name: "dbName", done: make(chan struct{})}
+	stopped := false
+	db.goLoop(func() {
+		<-db.done
+		time.Sleep(10 * time.Millisecond)
+		stopped = true
+	})
+	assert.Nil(t, db.Close())
+	assert.True(t, stopped)
+}
@@ -0,0 +1,66 @@
+package mdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMongoEnv is the environment variable with connection string of the
+// mongo used by tests which need it, they are skipped when it is not set.
+const testMongoEnv = "SVCKIT_MDB_TEST_URL"
+
+// testFs returns Fs in a new database, dropped by returned cleanup
+func testFs(t *testing.T, opts ...func(fs *Fs)) (*Fs, func()) {
+	url := os.Getenv(testMongoEnv)
+	if url == "" {
+		t.Skip(testMongoEnv + " not set")
+	}
+	name := fmt.Sprintf("svckit_test_%d", time.Now().UnixNano())
+	db, err := NewDb(url, Name(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.NewFs("fs", opts...), func() {
+		s := db.session.Copy()
+		s.DB(name).DropDatabase()
+		s.Close()
+		db.Close()
+	}
+}
+
+// insertFiles inserts file with content body for each ts, returns ids
+func insertFiles(t *testing.T, fs *Fs, typ string, body string, ts ...time.Time) []bson.ObjectId {
+	var ids []bson.ObjectId
+	for _, ts := range ts {
+		id := bson.NewObjectId()
+		assert.Nil(t, fs.Insert(typ, id, ts, strings.NewReader(body)))
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// liveIds returns ids of not deleted files of the type
+func liveIds(t *testing.T, fs *Fs, typ string) []interface{} {
+	var ids []interface{}
+	assert.Nil(t, fs.IterIds(typ, time.Time{}, func(id interface{}, _ time.Time) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	return ids
+}
+
+// deletedIds returns ids of soft deleted files of the type
+func deletedIds(t *testing.T, fs *Fs, typ string) []interface{} {
+	var ids []interface{}
+	assert.Nil(t, fs.Tombstones(typ, func(id interface{}, _ time.Time, _ time.Time) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	return ids
+}
@@ -0,0 +1,55 @@
+package mdb
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// PositionStore keeps acked client positions in a collection,
+// one document per client and topic. Implements broker.PositionStore.
+type PositionStore struct {
+	db  *Mdb
+	col string
+}
+
+type position struct {
+	Id       string `bson:"_id"`
+	ClientID string `bson:"c"`
+	Topic    string `bson:"t"`
+	Ts       int64  `bson:"ts"`
+}
+
+// NewPositionStore creates store in col and ensures index on client id
+func NewPositionStore(db *Mdb, col string) (*PositionStore, error) {
+	if err := db.EnsureIndex(col, []string{"c"}, 0); err != nil {
+		return nil, err
+	}
+	return &PositionStore{db: db, col: col}, nil
+}
+
+// Save stores ts unless greater one is already stored
+func (p *PositionStore) Save(clientID, topic string, ts int64) error {
+	return p.db.Use(p.col, "save_position", func(c *mgo.Collection) error {
+		_, err := c.UpsertId(clientID+"|"+topic, bson.M{
+			"$set": bson.M{"c": clientID, "t": topic},
+			"$max": bson.M{"ts": ts},
+		})
+		return err
+	})
+}
+
+// Load returns positions of the client by topic
+func (p *PositionStore) Load(clientID string) (map[string]int64, error) {
+	var ps []position
+	err := p.db.Use(p.col, "load_positions", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"c": clientID}).All(&ps)
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]int64, len(ps))
+	for _, p := range ps {
+		m[p.Topic] = p.Ts
+	}
+	return m, nil
+}
@@ -0,0 +1,140 @@
+package mdb
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+// ReconnectBackoff is schedule of the session refresh while mongo is
+// unavailable, ref: Reconnect.
+// First failure refreshes immediately, each next refresh waits
+// Base * Multiplier^n, at most Max. Jitter (0-1) is the random part
+// of each wait, so processes sharing the mongo don't refresh in lockstep.
+type ReconnectBackoff struct {
+	Base       Duration `json:"base"`
+	Max        Duration `json:"max"`
+	Multiplier float64  `json:"multiplier"` // default 2
+	Jitter     float64  `json:"jitter"`
+}
+
+func (b ReconnectBackoff) validate() error {
+	if b.Base < 0 || b.Max < 0 {
+		return errors.New("negative reconnect interval")
+	}
+	if b.Max > 0 && b.Max < b.Base {
+		return errors.New("reconnect max is less than base")
+	}
+	if b.Multiplier != 0 && b.Multiplier < 1 {
+		return errors.New("reconnect multiplier is less than 1")
+	}
+	if b.Jitter < 0 || b.Jitter > 1 {
+		return errors.New("reconnect jitter out of range 0-1")
+	}
+	return nil
+}
+
+// Reconnect refreshes session by the backoff schedule when operations
+// (or background ping) fail because mongo is unavailable.
+// Schedule is shared by all callers, of the concurrent failures only the
+// one due by the schedule refreshes the session. First successful operation
+// resets the schedule, so the next outage again starts with immediate refresh.
+// Without it the ping started by PingInterval refreshes on each failure.
+func Reconnect(b ReconnectBackoff) func(db *Mdb) {
+	return func(db *Mdb) {
+		if b.Base > 0 {
+			db.reconnect = newReconnector(b)
+		}
+	}
+}
+
+type reconnector struct {
+	base       time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	rnd        func() float64
+
+	failing int32     // set on failure, checked without lock on success
+	attempt int       // refreshes in the current outage
+	next    time.Time // earliest time of the next refresh
+	sync.Mutex
+}
+
+func newReconnector(b ReconnectBackoff) *reconnector {
+	r := &reconnector{
+		base:       time.Duration(b.Base),
+		max:        time.Duration(b.Max),
+		multiplier: b.Multiplier,
+		jitter:     b.Jitter,
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())).Float64,
+	}
+	if r.multiplier == 0 {
+		r.multiplier = 2
+	}
+	return r
+}
+
+// due returns true if the caller should refresh now,
+// schedules the next refresh
+func (r *reconnector) due(now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	atomic.StoreInt32(&r.failing, 1)
+	if now.Before(r.next) {
+		return false
+	}
+	r.next = now.Add(r.delay(r.attempt))
+	r.attempt++
+	return true
+}
+
+// delay returns wait after the n-th refresh, called with lock
+func (r *reconnector) delay(n int) time.Duration {
+	d := float64(r.base) * math.Pow(r.multiplier, float64(n))
+	if r.max > 0 && d > float64(r.max) {
+		d = float64(r.max)
+	}
+	if r.jitter > 0 {
+		d -= d * r.jitter * r.rnd()
+	}
+	return time.Duration(d)
+}
+
+// reset starts the schedule over after mongo is available again
+func (r *reconnector) reset() {
+	if atomic.LoadInt32(&r.failing) == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	atomic.StoreInt32(&r.failing, 0)
+	if r.attempt > 0 {
+		log.I("refreshes", r.attempt).Info("mongo reconnected")
+	}
+	r.attempt = 0
+	r.next = time.Time{}
+}
+
+// reconnectAfter refreshes session by the Reconnect schedule
+// if err shows that mongo is unavailable
+func (db *Mdb) reconnectAfter(err error) {
+	r := db.reconnect
+	if r == nil {
+		return
+	}
+	if !unavailable(err) {
+		r.reset()
+		return
+	}
+	if r.due(time.Now()) {
+		metric.Counter("db.reconnect")
+		db.session.Refresh()
+	}
+}
@@ -0,0 +1,76 @@
+package mdb
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectorSchedule(t *testing.T) {
+	r := newReconnector(ReconnectBackoff{Base: Duration(time.Second), Max: Duration(5 * time.Second)})
+	now := time.Now()
+
+	// first failure refreshes immediately, next ones wait by schedule
+	assert.True(t, r.due(now))
+	assert.False(t, r.due(now.Add(999*time.Millisecond)))
+	assert.True(t, r.due(now.Add(time.Second)))
+	now = now.Add(time.Second)
+	assert.False(t, r.due(now.Add(time.Second)))
+	assert.True(t, r.due(now.Add(2*time.Second)))
+	now = now.Add(2 * time.Second)
+	assert.True(t, r.due(now.Add(4*time.Second)))
+	now = now.Add(4 * time.Second)
+	// capped at max
+	assert.False(t, r.due(now.Add(4*time.Second)))
+	assert.True(t, r.due(now.Add(5*time.Second)))
+
+	// recovered, next outage starts over
+	r.reset()
+	assert.True(t, r.due(now))
+	assert.False(t, r.due(now))
+}
+
+func TestReconnectorJitter(t *testing.T) {
+	r := newReconnector(ReconnectBackoff{Base: Duration(time.Second), Multiplier: 3, Jitter: 0.5})
+	r.rnd = func() float64 { return 1 }
+	assert.Equal(t, 500*time.Millisecond, r.delay(0))
+	assert.Equal(t, 1500*time.Millisecond, r.delay(1))
+	r.rnd = func() float64 { return 0 }
+	assert.Equal(t, 9*time.Second, r.delay(2))
+}
+
+func TestReconnectorConcurrent(t *testing.T) {
+	r := newReconnector(ReconnectBackoff{Base: Duration(time.Minute)})
+	now := time.Now()
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	refreshes := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r.due(now) {
+				lock.Lock()
+				refreshes++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, refreshes)
+}
+
+func TestReconnectAfter(t *testing.T) {
+	db := &Mdb{}
+	// not configured
+	db.reconnectAfter(io.EOF)
+
+	db.reconnect = newReconnector(ReconnectBackoff{Base: Duration(time.Minute)})
+	// server errors don't start the schedule
+	db.reconnectAfter(errors.New("duplicate"))
+	assert.Equal(t, 0, db.reconnect.attempt)
+}
@@ -0,0 +1,85 @@
+package mdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/minus5/svckit/log"
+	"github.com/minus5/svckit/metric"
+)
+
+type traceKey struct{}
+
+// WithTrace returns ctx which carries trace id of the caller request.
+// Operations run with UseContext and UseFsContext log it.
+func WithTrace(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceKey{}, id)
+}
+
+// Trace returns trace id carried by ctx, empty if none.
+// Handler can pass it to the query as comment (mgo.Query.Comment),
+// so the operation is labeled in the mongo profiler and slow query log.
+func Trace(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// LogSlow logs operations which last longer than d, with the operation
+// metric key and trace id. Zero (default) disables logging.
+func LogSlow(d time.Duration) func(db *Mdb) {
+	return func(db *Mdb) {
+		db.logSlow = d
+	}
+}
+
+// UseContext is Use which labels the operation with the ctx trace id
+func (db *Mdb) UseContext(ctx context.Context, col string, metricKey string, handler func(*mgo.Collection) error) error {
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := db.breaker.allow(); err != nil {
+		return err
+	}
+	c := s.DB(db.name).C(col)
+	return db.timing(ctx, metricKey, func() error {
+		return handler(c)
+	})
+}
+
+// UseFsContext is UseFs which labels the operation with the ctx trace id
+func (db *Mdb) UseFsContext(ctx context.Context, col string, metricKey string, handler func(*mgo.GridFS) error) error {
+	s, err := db.copySession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := db.breaker.allow(); err != nil {
+		return err
+	}
+	g := s.DB(db.name).GridFS(col)
+	return db.timing(ctx, metricKey, func() error {
+		return handler(g)
+	})
+}
+
+// timing measures the operation. Metric name doesn't include trace id,
+// it would create metric for each request.
+func (db *Mdb) timing(ctx context.Context, metricKey string, op func() error) error {
+	var err error
+	start := time.Now()
+	metric.Timing("db."+metricKey, func() {
+		err = op()
+	})
+	db.breaker.done(err)
+	db.reconnectAfter(err)
+	if d := time.Since(start); db.logSlow > 0 && d >= db.logSlow {
+		log.S("op", metricKey).
+			S("trace", Trace(ctx)).
+			I("duration", int(d/time.Millisecond)).
+			Info("slow mongo operation")
+	}
+	return err
+}
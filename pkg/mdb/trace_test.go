@@ -0,0 +1,14 @@
+package mdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", Trace(ctx))
+	assert.Equal(t, "abc", Trace(WithTrace(ctx, "abc")))
+}